@@ -2,18 +2,25 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+	// Embed the time zone database so tz-aware reports work in minimal images
+	_ "time/tzdata"
 
 	"github.com/gin-gonic/gin"
 	"github.com/tushar-kalsi/product-views/internal/config"
+	"github.com/tushar-kalsi/product-views/internal/eventbus"
 	"github.com/tushar-kalsi/product-views/internal/handlers"
+	"github.com/tushar-kalsi/product-views/internal/jobs"
 	"github.com/tushar-kalsi/product-views/internal/kafka"
+	"github.com/tushar-kalsi/product-views/internal/leaderboard"
 	"github.com/tushar-kalsi/product-views/internal/repository"
+	"github.com/tushar-kalsi/product-views/internal/schemaregistry"
 	// Swagger support is optional for now, commenting out
 	// _ "github.com/tushar-kalsi/product-views/docs"
 )
@@ -39,35 +46,197 @@ func main() {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
 
-	// Initialize Kafka producer
-	kafkaProducer, err := kafka.NewProducer(cfg.KafkaBroker, "product-views")
+	// Select the event bus carrying view events
+	bus, err := kafka.OpenBus(cfg.EventBus, cfg.KafkaBroker, db.GetConn(), kafka.WithPartitioner(cfg.KafkaPartitioner))
 	if err != nil {
-		log.Fatalf("Failed to create Kafka producer: %v", err)
+		log.Fatalf("Failed to open event bus: %v", err)
 	}
+
+	// Initialize view event producer
+	publisher, err := bus.NewPublisher()
+	if err != nil {
+		log.Fatalf("Failed to create publisher: %v", err)
+	}
+	// Keep accepting views during broker outages by spooling them to disk
+	if cfg.SpoolDir != "" {
+		spool, err := eventbus.OpenSpool(cfg.SpoolDir, eventbus.SpoolOptions{
+			MaxBytes:      cfg.SpoolMaxBytes,
+			SegmentBytes:  cfg.SpoolSegmentBytes,
+			Fsync:         cfg.SpoolFsync,
+			FsyncInterval: cfg.SpoolFsyncInterval,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open spool: %v", err)
+		}
+		publisher = eventbus.NewSpooledPublisher(publisher, spool)
+	}
+
+	// Register the view event schema when producing a registry-managed encoding
+	var registry schemaregistry.Client
+	if cfg.SchemaRegistryURL != "" {
+		if registry, err = schemaregistry.Open(cfg.SchemaRegistryURL); err != nil {
+			log.Fatalf("Failed to open schema registry: %v", err)
+		}
+	}
+	registerCtx, cancelRegister := context.WithTimeout(context.Background(), 10*time.Second)
+	encoder, err := kafka.NewEncoder(registerCtx, cfg.ViewEventEncoding, registry, cfg.ViewsTopic)
+	cancelRegister()
+	if err != nil {
+		log.Fatalf("Failed to set up view event encoding: %v", err)
+	}
+
+	kafkaProducer := kafka.NewProducer(publisher, cfg.ViewsTopic, kafka.WithEncoder(encoder))
 	defer kafkaProducer.Close()
 
-	// Initialize repositories and handlers
+	// Initialize repositories
 	productRepo := repository.NewProductRepository(db.GetConn())
-	productHandler := handlers.NewProductHandler(productRepo, kafkaProducer)
-
-	// Start Kafka consumer in the background
-	kafkaConsumer, err := kafka.NewConsumer(
-		cfg.KafkaBroker,
-		"product-views-consumer",
-		"product-views",
-		productRepo,
-	)
+
+	// Trending scores are expressed in the recorded half-life; switching to
+	// another one takes a rebuild with product-views-trending
+	if cfg.TrendHalfLife > 0 {
+		trendStore, ok := productRepo.(repository.TrendStore)
+		if !ok {
+			log.Fatal("Product repository cannot keep trending scores")
+		}
+		trendCtx, cancelTrend := context.WithTimeout(context.Background(), 10*time.Second)
+		recorded, err := trendStore.RecordTrendHalfLife(trendCtx, cfg.TrendHalfLife)
+		cancelTrend()
+		if err != nil {
+			log.Fatalf("Failed to record the trending half-life: %v", err)
+		}
+		if recorded != cfg.TrendHalfLife {
+			log.Printf("Trending scores are kept with a half-life of %s, not the configured %s; rebuild them to switch\n", recorded, cfg.TrendHalfLife)
+		}
+	}
+
+	handlerOpts := []handlers.ProductHandlerOption{
+		handlers.WithTrendHalfLife(cfg.TrendHalfLife),
+		handlers.WithSyncDeliveryTimeout(cfg.SyncDeliveryTimeout),
+		handlers.WithSearchPopularityWeight(cfg.SearchPopularityWeight),
+	}
+	consumerOpts := []kafka.ConsumerOption{
+		kafka.WithDedupWindow(cfg.ViewDedupWindow),
+		kafka.WithTrendHalfLife(cfg.TrendHalfLife),
+		kafka.WithBatching(cfg.ConsumerBatchSize, cfg.ConsumerBatchInterval),
+	}
+
+	// Serve top N from memory; until warmed, requests fall back to the database
+	if cfg.LeaderboardReconcileInterval > 0 {
+		lb := leaderboard.New(productRepo)
+		warmCtx, cancelWarm := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := lb.Warm(warmCtx); err != nil {
+			log.Printf("Leaderboard is cold, will retry on reconcile: %v", err)
+		}
+		cancelWarm()
+		lb.Start(cfg.LeaderboardReconcileInterval)
+		defer lb.Stop()
+
+		handlerOpts = append(handlerOpts, handlers.WithLeaderboard(lb))
+		consumerOpts = append(consumerOpts, kafka.WithLeaderboard(lb))
+	}
+
+	if cfg.ConsumerExactlyOnce {
+		store, ok := productRepo.(repository.OffsetStore)
+		if !ok {
+			log.Fatal("Product repository cannot store consumer offsets")
+		}
+		consumerOpts = append(consumerOpts, kafka.WithExactlyOnce(store))
+	}
+
+	// Spread view count increments over shards so popular products do not
+	// serialise on their products row
+	counterStore, ok := productRepo.(repository.CounterStore)
+	if !ok {
+		log.Fatal("Product repository cannot shard view counters")
+	}
+	if cfg.CounterShards > 0 {
+		consumerOpts = append(consumerOpts, kafka.WithShardedCounters(cfg.CounterShards))
+	}
+
+	rankStore, ok := productRepo.(repository.RankStore)
+	if !ok {
+		log.Fatal("Product repository cannot rank products")
+	}
+
+	archivedPolicy := kafka.ArchivedViewPolicy(cfg.ArchivedViewPolicy)
+	if !archivedPolicy.Valid() {
+		log.Fatalf("Unknown ARCHIVED_VIEW_POLICY %q", cfg.ArchivedViewPolicy)
+	}
+	consumerOpts = append(consumerOpts, kafka.WithArchivedViewPolicy(archivedPolicy))
+
+	reconcileStore, ok := productRepo.(repository.ReconcileStore)
+	if !ok {
+		log.Fatal("Product repository cannot reconcile view counts")
+	}
+
+	// Route messages that can never be processed to the dead-letter topic
+	if cfg.DeadLetterTopic != "" {
+		deadLetterPublisher, err := bus.NewPublisher()
+		if err != nil {
+			log.Fatalf("Failed to create dead-letter publisher: %v", err)
+		}
+		deadLetters := kafka.NewDeadLetterProducer(deadLetterPublisher, cfg.DeadLetterTopic)
+		defer deadLetters.Close()
+
+		consumerOpts = append(consumerOpts, kafka.WithDeadLetters(deadLetters))
+	}
+
+	productHandler := handlers.NewProductHandler(productRepo, kafkaProducer, handlerOpts...)
+
+	// Start view event consumer in the background
+	subscriber, err := bus.NewSubscriber(kafka.ConsumerGroup)
 	if err != nil {
-		log.Fatalf("Failed to create Kafka consumer: %v", err)
+		log.Fatalf("Failed to create subscriber: %v", err)
 	}
+	kafkaConsumer := kafka.NewConsumer(subscriber, kafka.ConsumerGroup, cfg.ViewsTopic, productRepo, consumerOpts...)
 	defer kafkaConsumer.Stop()
 
 	if err := kafkaConsumer.Start(); err != nil {
 		log.Fatalf("Failed to start Kafka consumer: %v", err)
 	}
 
+	// Run the periodic maintenance jobs; instances claim each run in the
+	// database, so every interval of a job runs once
+	if cfg.RunJobs {
+		jobStore, ok := productRepo.(repository.JobStore)
+		if !ok {
+			log.Fatal("Product repository cannot schedule jobs")
+		}
+		partitionStore, ok := productRepo.(repository.ViewEventStore)
+		if !ok {
+			log.Fatal("Product repository cannot manage view event partitions")
+		}
+		rollupStore, ok := productRepo.(repository.RollupStore)
+		if !ok {
+			log.Fatal("Product repository cannot materialize view rollups")
+		}
+
+		scheduler := jobs.NewScheduler(jobStore,
+			// Keep partitions of the raw view event table ready and expire old days
+			jobs.PartitionMaintenance(partitionStore, cfg.ViewEventPartitionsAhead, cfg.ViewEventRetention),
+			jobs.ViewDedupPurge(productRepo, cfg.ViewDedupWindow),
+			jobs.Rollups(rollupStore, cfg.ViewRollupInterval, cfg.ViewRollupLateness),
+			// Check the view counts for drift; repairs go through the admin endpoints
+			jobs.Reconciliation(reconcileStore, cfg.ReconcileInterval, cfg.ReconcileSource),
+			jobs.CounterCompaction(counterStore, cfg.CounterCompactionInterval),
+			// Snapshot the top products for the paginated leaderboard, whose
+			// cursors page through one snapshot while the counts move
+			jobs.RankSnapshots(rankStore, cfg.RankSnapshotInterval, cfg.RankSnapshotDepth, cfg.RankSnapshotRetention),
+		)
+		scheduler.Start()
+		defer scheduler.Stop()
+	}
+
+	taxonomyStore, ok := productRepo.(repository.TaxonomyStore)
+	if !ok {
+		log.Fatal("Product repository cannot manage categories and tags")
+	}
+
 	// Set up HTTP server
-	router := setupRouter(productHandler)
+	adminHandler := handlers.NewAdminHandler(reconcileStore, cfg.ReconcileSource)
+	taxonomyHandler := handlers.NewTaxonomyHandler(taxonomyStore)
+	rankHandler := handlers.NewRankHandler(rankStore)
+	router := setupRouter(productHandler, taxonomyHandler, rankHandler, adminHandler, cfg.AdminToken)
 
 	// Start server in a goroutine
 	srv := &http.Server{
@@ -99,7 +268,7 @@ func main() {
 	log.Println("Server exiting")
 }
 
-func setupRouter(handler *handlers.ProductHandler) *gin.Engine {
+func setupRouter(handler *handlers.ProductHandler, taxonomy *handlers.TaxonomyHandler, ranks *handlers.RankHandler, admin *handlers.AdminHandler, adminToken string) *gin.Engine {
 	router := gin.Default()
 
 	// Health check endpoint
@@ -107,6 +276,9 @@ func setupRouter(handler *handlers.ProductHandler) *gin.Engine {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
+	// Runtime and consumer metrics
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+
 	// Swagger documentation - commented out for now
 	// router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
@@ -115,10 +287,51 @@ func setupRouter(handler *handlers.ProductHandler) *gin.Engine {
 	{
 		products := v1.Group("/products")
 		{
+			products.GET("", handler.ListProducts)
 			products.POST("", handler.CreateProduct)
 			products.GET(":id", handler.GetProduct)
+			products.PUT(":id", handler.UpdateProduct)
+			products.PATCH(":id", handler.PatchProduct)
+			products.DELETE(":id", handler.DeleteProduct)
+			products.GET(":id/views", handler.GetProductViews)
+			products.GET(":id/categories", taxonomy.GetProductCategories)
+			products.PUT(":id/categories", taxonomy.SetProductCategories)
+			products.GET(":id/tags", taxonomy.GetProductTags)
+			products.PUT(":id/tags", taxonomy.SetProductTags)
+			products.GET(":id/rank", ranks.GetProductRank)
 			products.GET("top", handler.GetTopProducts)
+			products.GET("trending", handler.GetTrendingProducts)
+			products.GET("search", handler.SearchProducts)
+			products.GET("leaderboard", ranks.GetLeaderboard)
 			products.POST("view", handler.ViewProduct)
+			products.POST("views:batch", handler.BatchViewProducts)
+		}
+
+		categories := v1.Group("/categories")
+		{
+			categories.POST("", taxonomy.CreateCategory)
+			categories.GET("", taxonomy.ListCategories)
+			categories.GET(":id", taxonomy.GetCategory)
+			categories.PUT(":id", taxonomy.UpdateCategory)
+			categories.DELETE(":id", taxonomy.DeleteCategory)
+		}
+
+		tags := v1.Group("/tags")
+		{
+			tags.POST("", taxonomy.CreateTag)
+			tags.GET("", taxonomy.ListTags)
+			tags.PUT(":id", taxonomy.UpdateTag)
+			tags.DELETE(":id", taxonomy.DeleteTag)
+		}
+
+		// Admin routes are only served with a token configured
+		if adminToken != "" {
+			adminRoutes := v1.Group("/admin", handlers.AdminAuth(adminToken))
+			{
+				adminRoutes.POST("reconciliations", admin.Reconcile)
+				adminRoutes.GET("reconciliations", admin.ListReconciliations)
+				adminRoutes.GET("reconciliations/:id", admin.GetReconciliation)
+			}
 		}
 	}
 
@@ -0,0 +1,96 @@
+// Command dlq inspects and re-drives messages in the product views dead-letter topic.
+//
+// Usage:
+//
+//	dlq inspect [-limit N] [-payload]
+//	dlq redrive [-limit N]
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tushar-kalsi/product-views/internal/config"
+	"github.com/tushar-kalsi/product-views/internal/kafka"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	cfg := config.Load()
+	if cfg.DeadLetterTopic == "" {
+		log.Fatal("DEAD_LETTER_TOPIC is empty, dead-lettering is disabled")
+	}
+	if cfg.EventBus == kafka.BusMemory {
+		log.Fatal("The memory event bus is local to the API process and cannot be inspected")
+	}
+
+	var conn *sql.DB
+	if cfg.EventBus == kafka.BusPostgres {
+		db, err := repository.NewDB(cfg)
+		if err != nil {
+			log.Fatalf("Failed to connect to database: %v", err)
+		}
+		defer db.Close()
+		conn = db.GetConn()
+	}
+
+	bus, err := kafka.OpenBus(cfg.EventBus, cfg.KafkaBroker, conn, kafka.WithPartitioner(cfg.KafkaPartitioner))
+	if err != nil {
+		log.Fatalf("Failed to open event bus: %v", err)
+	}
+	admin := kafka.NewDeadLetterAdmin(bus, cfg.DeadLetterTopic)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	switch os.Args[1] {
+	case "inspect":
+		fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+		limit := fs.Int("limit", 100, "maximum number of messages to show, 0 for all")
+		payload := fs.Bool("payload", false, "print message payloads")
+		_ = fs.Parse(os.Args[2:])
+
+		err := admin.Inspect(ctx, *limit, func(dl kafka.DeadLetter) error {
+			fmt.Printf("%d@%d\t%s\t%s[%d]@%d\t%s\t%s\n",
+				dl.Partition, dl.Offset, dl.FailedAt.Format(time.RFC3339),
+				dl.SourceTopic, dl.SourcePartition, dl.SourceOffset, dl.Reason, dl.Error)
+			if *payload {
+				fmt.Printf("\t%s\n", dl.Payload)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Failed to inspect dead letters: %v", err)
+		}
+
+	case "redrive":
+		fs := flag.NewFlagSet("redrive", flag.ExitOnError)
+		limit := fs.Int("limit", 0, "maximum number of messages to re-drive, 0 for all")
+		_ = fs.Parse(os.Args[2:])
+
+		n, err := admin.Redrive(ctx, cfg.ViewsTopic, *limit)
+		log.Printf("Re-drove %d messages to %s", n, cfg.ViewsTopic)
+		if err != nil {
+			log.Fatalf("Failed to re-drive dead letters: %v", err)
+		}
+
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dlq inspect [-limit N] [-payload] | dlq redrive [-limit N]")
+	os.Exit(2)
+}
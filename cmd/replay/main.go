@@ -0,0 +1,186 @@
+// Command replay rebuilds the view counts since a cut-off time from the views
+// topic, next to the live counts, and swaps them in once the replay has caught
+// up with the live consumer. The live consumer keeps running throughout.
+//
+// Usage:
+//
+//	replay start -since T [-lookback D] [-offsets P:O,...]
+//	replay status [-limit N]
+//	replay run [-max-lag N] [-swap] [-max-change F]
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tushar-kalsi/product-views/internal/config"
+	"github.com/tushar-kalsi/product-views/internal/kafka"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	cfg := config.Load()
+	if cfg.EventBus != kafka.BusKafka {
+		log.Fatal("Replays read the views topic from given offsets, which only the kafka event bus supports")
+	}
+
+	db, err := repository.NewDB(cfg)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	store, ok := repository.NewProductRepository(db.GetConn()).(repository.ReplayStore)
+	if !ok {
+		log.Fatal("Product repository cannot replay views")
+	}
+
+	bus, err := kafka.OpenBus(cfg.EventBus, cfg.KafkaBroker, nil, kafka.WithPartitioner(cfg.KafkaPartitioner))
+	if err != nil {
+		log.Fatalf("Failed to open event bus: %v", err)
+	}
+	subscriber, err := bus.NewSubscriber(kafka.ReplayGroup(kafka.ConsumerGroup))
+	if err != nil {
+		log.Fatalf("Failed to create subscriber: %v", err)
+	}
+	defer subscriber.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	switch os.Args[1] {
+	case "start":
+		fs := flag.NewFlagSet("start", flag.ExitOnError)
+		since := fs.String("since", "", "cut-off time to rebuild views from (RFC3339)")
+		lookback := fs.Duration("lookback", time.Hour, "how long before the cut-off to start reading, for views published late")
+		offsets := fs.String("offsets", "", "partition:offset pairs to start from instead of looking them up by time")
+		_ = fs.Parse(os.Args[2:])
+
+		sinceTime, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			log.Fatalf("Invalid -since: %v", err)
+		}
+
+		var starts map[int32]int64
+		if *offsets != "" {
+			starts, err = parseOffsets(*offsets)
+			if err != nil {
+				log.Fatalf("Invalid -offsets: %v", err)
+			}
+		} else {
+			starts, err = kafka.ReplayStartOffsets(subscriber, cfg.ViewsTopic, sinceTime.Add(-*lookback))
+			if err != nil {
+				log.Fatalf("Failed to look up start offsets: %v", err)
+			}
+		}
+
+		if err := store.StartReplay(ctx, kafka.ConsumerGroup, cfg.ViewsTopic, sinceTime, starts); err != nil {
+			log.Fatalf("Failed to start replay: %v", err)
+		}
+		log.Printf("Started replaying views since %s from offsets %v", sinceTime.Format(time.RFC3339), starts)
+
+	case "status":
+		fs := flag.NewFlagSet("status", flag.ExitOnError)
+		limit := fs.Int("limit", 10, "number of products with the largest changes to show")
+		_ = fs.Parse(os.Args[2:])
+
+		state, err := store.LoadReplay(ctx)
+		if err != nil {
+			log.Fatalf("Failed to load replay: %v", err)
+		}
+		live, err := store.LoadConsumerOffsets(ctx, state.GroupID, state.Topic)
+		if err != nil {
+			log.Fatalf("Failed to load live offsets: %v", err)
+		}
+		fmt.Printf("replaying %s since %s, started %s\n",
+			state.Topic, state.Since.Format(time.RFC3339), state.StartedAt.Format(time.RFC3339))
+		for p, next := range state.Positions {
+			fmt.Printf("partition %d\tstart %d\tnext %d\tlive %d\n", p, state.Starts[p], next, live[p])
+		}
+
+		report, err := store.ReplayReport(ctx, *limit)
+		if err != nil {
+			log.Fatalf("Failed to compare replayed views: %v", err)
+		}
+		printReport(report)
+
+	case "run":
+		fs := flag.NewFlagSet("run", flag.ExitOnError)
+		maxLag := fs.Int64("max-lag", 1000, "offsets behind the live consumer at which the replay stops or swaps")
+		swap := fs.Bool("swap", false, "swap the replayed counts in once caught up")
+		maxChange := fs.Float64("max-change", 0.05, "largest change in total views since the cut-off a swap may make, 0 for any")
+		_ = fs.Parse(os.Args[2:])
+
+		replayer := kafka.NewReplayer(subscriber, store, cfg.ViewDedupWindow)
+		if err := replayer.Run(ctx, *maxLag); err != nil {
+			log.Fatalf("Failed to replay views: %v", err)
+		}
+		if !*swap {
+			log.Printf("Replay is within %d offsets of the live consumer", *maxLag)
+			return
+		}
+
+		report, err := replayer.Swap(ctx, *maxChange)
+		printReport(report)
+		if errors.Is(err, kafka.ErrReplayDiverged) {
+			log.Fatalf("Refusing to swap: %v", err)
+		}
+		if err != nil {
+			log.Fatalf("Failed to swap replayed views: %v", err)
+		}
+		log.Printf("Swapped in the views replayed since %s", report.Since.Format(time.RFC3339))
+
+	default:
+		usage()
+	}
+}
+
+// parseOffsets parses a list of partition:offset pairs
+func parseOffsets(s string) (map[int32]int64, error) {
+	offsets := make(map[int32]int64)
+	for _, pair := range strings.Split(s, ",") {
+		p, o, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not partition:offset", pair)
+		}
+		partition, err := strconv.ParseInt(p, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := strconv.ParseInt(o, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		offsets[int32(partition)] = offset
+	}
+	return offsets, nil
+}
+
+func printReport(report repository.ReplayReport) {
+	fmt.Printf("views since %s: live %d, replayed %d (%.2f%% change)\n",
+		report.Since.Format(time.RFC3339), report.LiveViews, report.ReplayViews, report.Change()*100)
+	fmt.Printf("unique views: live %d, replayed %d\n", report.LiveUniqueViews, report.ReplayUniqueViews)
+	fmt.Printf("%d products change\n", report.ChangedProducts)
+	for _, d := range report.Largest {
+		fmt.Printf("%s\tviews %d -> %d\tunique %d -> %d\n",
+			d.ProductID, d.LiveViews, d.ReplayViews, d.LiveUniqueViews, d.ReplayUniqueViews)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: replay start -since T [-lookback D] [-offsets P:O,...] | replay status [-limit N] | replay run [-max-lag N] [-swap] [-max-change F]")
+	os.Exit(2)
+}
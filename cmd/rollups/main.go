@@ -0,0 +1,83 @@
+// Command rollups maintains the hourly and daily product view rollups.
+//
+// Usage:
+//
+//	rollups materialize [-lateness D]
+//	rollups rebuild -from T -to T
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tushar-kalsi/product-views/internal/config"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	cfg := config.Load()
+	db, err := repository.NewDB(cfg)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	store, ok := repository.NewProductRepository(db.GetConn()).(repository.RollupStore)
+	if !ok {
+		log.Fatal("Product repository cannot maintain view rollups")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	switch os.Args[1] {
+	case "materialize":
+		fs := flag.NewFlagSet("materialize", flag.ExitOnError)
+		lateness := fs.Duration("lateness", cfg.ViewRollupLateness, "how long closed hours are aggregated again")
+		_ = fs.Parse(os.Args[2:])
+
+		watermark, err := store.MaterializeViewRollups(ctx, time.Now(), *lateness)
+		if err != nil {
+			log.Fatalf("Failed to materialize view rollups: %v", err)
+		}
+		log.Printf("View rollups are complete until %s", watermark.Format(time.RFC3339))
+
+	case "rebuild":
+		fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+		from := fs.String("from", "", "start of the range to rebuild (RFC3339, inclusive)")
+		to := fs.String("to", "", "end of the range to rebuild (RFC3339, exclusive)")
+		_ = fs.Parse(os.Args[2:])
+
+		fromTime, err := time.Parse(time.RFC3339, *from)
+		if err != nil {
+			log.Fatalf("Invalid -from: %v", err)
+		}
+		toTime, err := time.Parse(time.RFC3339, *to)
+		if err != nil {
+			log.Fatalf("Invalid -to: %v", err)
+		}
+
+		if err := store.RebuildViewRollups(ctx, fromTime, toTime); err != nil {
+			log.Fatalf("Failed to rebuild view rollups: %v", err)
+		}
+		log.Printf("Rebuilt view rollups from %s to %s", fromTime.Format(time.RFC3339), toTime.Format(time.RFC3339))
+
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: rollups materialize [-lateness D] | rollups rebuild -from T -to T")
+	os.Exit(2)
+}
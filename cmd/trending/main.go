@@ -0,0 +1,63 @@
+// Command trending maintains the time-decayed trending scores.
+//
+// Usage:
+//
+//	trending rebuild [-half-life D]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tushar-kalsi/product-views/internal/config"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	cfg := config.Load()
+	db, err := repository.NewDB(cfg)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	store, ok := repository.NewProductRepository(db.GetConn()).(repository.TrendStore)
+	if !ok {
+		log.Fatal("Product repository cannot keep trending scores")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	switch os.Args[1] {
+	case "rebuild":
+		fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+		halfLife := fs.Duration("half-life", cfg.TrendHalfLife, "half-life to rebuild the scores with")
+		_ = fs.Parse(os.Args[2:])
+
+		if *halfLife <= 0 {
+			log.Fatal("Invalid -half-life: must be positive")
+		}
+		if err := store.RebuildTrendScores(ctx, *halfLife); err != nil {
+			log.Fatalf("Failed to rebuild trending scores: %v", err)
+		}
+		log.Printf("Rebuilt trending scores with a half-life of %s", *halfLife)
+
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: trending rebuild [-half-life D]")
+	os.Exit(2)
+}
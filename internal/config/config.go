@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"time"
 )
 
 // Config holds the application configuration
@@ -11,6 +12,105 @@ type Config struct {
 	KafkaBroker string
 	ServerPort  string
 	Environment string
+
+	// EventBus selects the backend carrying view events: kafka, memory or postgres
+	EventBus string
+	// ViewsTopic carries product view events
+	ViewsTopic string
+	// KafkaPartitioner is the librdkafka partitioner mapping product ID keys
+	// to partitions
+	KafkaPartitioner string
+	// DeadLetterTopic receives view events the consumer can never process;
+	// empty drops them after logging
+	DeadLetterTopic string
+
+	// ViewEventEncoding is the payload encoding of produced view events: json
+	// or protobuf. Consumers read both.
+	ViewEventEncoding string
+	// SchemaRegistryURL locates the schema registry: an http(s) URL or a
+	// file URL of a local registry file
+	SchemaRegistryURL string
+
+	// SyncDeliveryTimeout bounds how long a view recorded with delivery=sync
+	// waits for the bus to acknowledge it
+	SyncDeliveryTimeout time.Duration
+
+	// ViewDedupWindow counts repeated views by the same user or session once
+	// per window in the unique view count; zero disables deduplication
+	ViewDedupWindow time.Duration
+	// TrendHalfLife is the half-life of the time-decayed trending score
+	TrendHalfLife time.Duration
+	// LeaderboardReconcileInterval is how often the in-memory leaderboard is
+	// reloaded from the database; zero disables the leaderboard
+	LeaderboardReconcileInterval time.Duration
+	// ConsumerBatchSize and ConsumerBatchInterval bound how many view events
+	// the consumer accumulates, and for how long, before writing them together
+	ConsumerBatchSize     int
+	ConsumerBatchInterval time.Duration
+	// ConsumerExactlyOnce stores consumer offsets in PostgreSQL together
+	// with the view counts instead of relying on Kafka commits. It is off by
+	// default: on the postgres bus every batch would serialize on the single
+	// consumer_offsets row of its one partition, and the stored offsets are
+	// ignored there. Replays need it on the live consumers, as they catch up
+	// with these offsets.
+	ConsumerExactlyOnce bool
+	// RunJobs schedules the periodic maintenance jobs on this instance. Each
+	// interval of a job runs once across all instances that schedule it.
+	RunJobs bool
+	// ViewEventRetention is how long raw view events are kept before their
+	// daily partition is dropped; zero keeps them forever
+	ViewEventRetention time.Duration
+	// ViewEventPartitionsAhead is how many days of view event partitions are
+	// created in advance
+	ViewEventPartitionsAhead int
+	// ViewRollupInterval is how often the hourly and daily view rollups are
+	// materialized; zero disables them
+	ViewRollupInterval time.Duration
+	// ViewRollupLateness is how long after an hour closes its rollup is
+	// recomputed to include views consumed late
+	ViewRollupLateness time.Duration
+	// ReconcileInterval is how often the view counts are checked for drift;
+	// zero disables the check
+	ReconcileInterval time.Duration
+	// ReconcileSource is what the view counts are checked against: buckets
+	// or events
+	ReconcileSource string
+	// CounterShards is how many rows each product's view count increments are
+	// spread over; zero updates the products row directly
+	CounterShards int
+	// CounterCompactionInterval is how often the counter shards are compacted
+	// into the products table
+	CounterCompactionInterval time.Duration
+	// ArchivedViewPolicy is what the consumer does with views of archived
+	// products: count, drop or dead_letter
+	ArchivedViewPolicy string
+	// SearchPopularityWeight is added to a search result's score per natural
+	// log of its lifetime views; zero ranks by text relevance alone
+	SearchPopularityWeight float64
+	// RankSnapshotInterval is how often the top products are snapshotted for
+	// the paginated leaderboard and rank lookups; zero disables the snapshots
+	RankSnapshotInterval time.Duration
+	// RankSnapshotDepth is how many top products of each ranking a snapshot
+	// keeps, which is how deep the leaderboard can be paged and how deep
+	// product ranks are exact
+	RankSnapshotDepth int
+	// RankSnapshotRetention is how long rank snapshots are kept after a newer
+	// one is taken, which bounds how long a leaderboard cursor stays valid
+	RankSnapshotRetention time.Duration
+
+	// AdminToken is the bearer token of the admin endpoints; empty disables them
+	AdminToken string
+
+	// SpoolDir holds view events that could not be published until the bus
+	// recovers; empty disables spooling
+	SpoolDir string
+	// SpoolMaxBytes limits the disk space of the spool; zero means no limit
+	SpoolMaxBytes int64
+	// SpoolSegmentBytes is the size of each spool segment file
+	SpoolSegmentBytes int64
+	// SpoolFsync is the spool's fsync policy: always, interval or never
+	SpoolFsync         string
+	SpoolFsyncInterval time.Duration
 }
 
 // Load loads configuration from environment variables
@@ -20,6 +120,51 @@ func Load() *Config {
 		KafkaBroker: getEnv("KAFKA_BROKER", "localhost:9092"),
 		ServerPort:  getEnv("PORT", "8080"),
 		Environment: getEnv("ENVIRONMENT", "development"),
+
+		EventBus:         getEnv("EVENT_BUS", "kafka"),
+		ViewsTopic:       getEnv("KAFKA_TOPIC", "product-views"),
+		KafkaPartitioner: getEnv("KAFKA_PARTITIONER", "murmur2_random"),
+		DeadLetterTopic:  getEnv("DEAD_LETTER_TOPIC", "product-views-dlq"),
+
+		ViewEventEncoding: getEnv("VIEW_EVENT_ENCODING", "json"),
+		SchemaRegistryURL: getEnv("SCHEMA_REGISTRY_URL", ""),
+
+		SyncDeliveryTimeout: GetDurationEnv("SYNC_DELIVERY_TIMEOUT", 5*time.Second),
+
+		ViewDedupWindow: GetDurationEnv("VIEW_DEDUP_WINDOW", 30*time.Minute),
+		TrendHalfLife:   GetDurationEnv("TREND_HALF_LIFE", 6*time.Hour),
+
+		LeaderboardReconcileInterval: GetDurationEnv("LEADERBOARD_RECONCILE_INTERVAL", 30*time.Second),
+
+		ConsumerBatchSize:     GetIntEnv("CONSUMER_BATCH_SIZE", 500),
+		ConsumerBatchInterval: GetDurationEnv("CONSUMER_BATCH_INTERVAL", 200*time.Millisecond),
+		ConsumerExactlyOnce:   GetBoolEnv("CONSUMER_EXACTLY_ONCE", false),
+
+		RunJobs:                  GetBoolEnv("RUN_JOBS", true),
+		ViewEventRetention:       GetDurationEnv("VIEW_EVENT_RETENTION", 90*24*time.Hour),
+		ViewEventPartitionsAhead: GetIntEnv("VIEW_EVENT_PARTITIONS_AHEAD", 7),
+		ViewRollupInterval:       GetDurationEnv("VIEW_ROLLUP_INTERVAL", 5*time.Minute),
+		ViewRollupLateness:       GetDurationEnv("VIEW_ROLLUP_LATENESS", 6*time.Hour),
+		ReconcileInterval:        GetDurationEnv("RECONCILE_INTERVAL", 24*time.Hour),
+		ReconcileSource:          getEnv("RECONCILE_SOURCE", "buckets"),
+
+		CounterShards:             GetIntEnv("COUNTER_SHARDS", 16),
+		CounterCompactionInterval: GetDurationEnv("COUNTER_COMPACTION_INTERVAL", time.Minute),
+		ArchivedViewPolicy:        getEnv("ARCHIVED_VIEW_POLICY", "count"),
+
+		SearchPopularityWeight: GetFloatEnv("SEARCH_POPULARITY_WEIGHT", 0.1),
+
+		RankSnapshotInterval:  GetDurationEnv("RANK_SNAPSHOT_INTERVAL", time.Minute),
+		RankSnapshotDepth:     GetIntEnv("RANK_SNAPSHOT_DEPTH", 10000),
+		RankSnapshotRetention: GetDurationEnv("RANK_SNAPSHOT_RETENTION", 15*time.Minute),
+
+		AdminToken: getEnv("ADMIN_TOKEN", ""),
+
+		SpoolDir:           getEnv("SPOOL_DIR", ""),
+		SpoolMaxBytes:      int64(GetIntEnv("SPOOL_MAX_BYTES", 1<<30)),
+		SpoolSegmentBytes:  int64(GetIntEnv("SPOOL_SEGMENT_BYTES", 64<<20)),
+		SpoolFsync:         getEnv("SPOOL_FSYNC", "interval"),
+		SpoolFsyncInterval: GetDurationEnv("SPOOL_FSYNC_INTERVAL", time.Second),
 	}
 }
 
@@ -40,3 +185,33 @@ func GetIntEnv(key string, fallback int) int {
 	}
 	return fallback
 }
+
+// GetFloatEnv gets a floating point environment variable with a fallback
+func GetFloatEnv(key string, fallback float64) float64 {
+	if value, ok := os.LookupEnv(key); ok {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return fallback
+}
+
+// GetBoolEnv gets a boolean environment variable (e.g. "true", "0") with a fallback
+func GetBoolEnv(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return fallback
+}
+
+// GetDurationEnv gets a duration environment variable (e.g. "30m") with a fallback
+func GetDurationEnv(key string, fallback time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
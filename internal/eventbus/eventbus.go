@@ -0,0 +1,93 @@
+// Package eventbus abstracts publishing and consuming messages so that the view
+// pipeline can run on Kafka, on PostgreSQL or entirely in memory.
+package eventbus
+
+import (
+	"context"
+	"time"
+)
+
+// OffsetCommitted starts a partition from the position its consumer group last
+// committed, or from the beginning if it never committed one
+const OffsetCommitted int64 = -1000
+
+// Header is a key/value pair carried alongside a message
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Message is a single message on a topic. Partition and Offset are set by the
+// bus on delivery and, for synchronous publishes, once the message is stored.
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+	Timestamp time.Time
+}
+
+// Position is the next offset to read from a topic partition
+type Position struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// Publisher sends messages to topics
+type Publisher interface {
+	// Publish hands messages to the bus. Backends may deliver them
+	// asynchronously, in which case delivery failures are only logged.
+	Publish(ctx context.Context, msgs ...*Message) error
+	// PublishSync returns once every message is durably stored, and fills in
+	// the partition and offset each one was stored at
+	PublishSync(ctx context.Context, msgs ...*Message) error
+	Close() error
+}
+
+// DeliveryFailureNotifier is implemented by publishers that deliver Publish
+// asynchronously. The handler is called with each message whose delivery failed
+// after Publish returned, including messages still queued when the publisher is
+// closed, instead of the failure only being logged.
+type DeliveryFailureNotifier interface {
+	NotifyDeliveryFailures(handler func(*Message))
+}
+
+// Rebalance is notified when partitions are assigned to or revoked from a
+// subscriber. Either function may be nil.
+type Rebalance struct {
+	// Assigned returns the positions to start the assigned partitions from.
+	// Partitions it leaves at OffsetCommitted resume from the group's commit.
+	Assigned func(partitions []Position) ([]Position, error)
+	// Revoked is called before partitions are taken away, while commits for
+	// them are still accepted
+	Revoked func(partitions []Position)
+}
+
+// Subscriber consumes a topic as a member of a consumer group. It is not safe
+// for concurrent use; rebalance callbacks run on the goroutine calling Poll.
+type Subscriber interface {
+	Subscribe(topic string, rebalance Rebalance) error
+	// Poll waits up to timeout for the next message and returns nil if none arrived
+	Poll(timeout time.Duration) (*Message, error)
+	// Commit marks every message before each position as processed by the group
+	Commit(positions []Position) error
+	Close() error
+}
+
+// OffsetLookup is implemented by subscribers that can find where a topic's
+// messages published at a given time start
+type OffsetLookup interface {
+	// OffsetsForTime returns, for every partition of topic, the offset of the
+	// first message timestamped at or after t, or the end of the partition if
+	// there is none
+	OffsetsForTime(topic string, t time.Time) ([]Position, error)
+}
+
+// Bus creates publishers and subscribers on one backend
+type Bus interface {
+	NewPublisher() (Publisher, error)
+	NewSubscriber(groupID string) (Subscriber, error)
+}
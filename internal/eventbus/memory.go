@@ -0,0 +1,230 @@
+package eventbus
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// MemoryBus is a process-local bus for tests and local development. Topics are
+// split into a fixed number of partitions and keep every message until the
+// process exits. Each subscriber is assigned all partitions of its topic, so a
+// consumer group should have a single member.
+type MemoryBus struct {
+	partitions int
+
+	mu        sync.Mutex
+	topics    map[string][][]*Message
+	committed map[memoryGroupPartition]int64
+	next      int
+	// published is closed and replaced whenever a message is published
+	published chan struct{}
+}
+
+type memoryGroupPartition struct {
+	group     string
+	topic     string
+	partition int32
+}
+
+// NewMemoryBus creates an in-memory bus with the given number of partitions per topic
+func NewMemoryBus(partitions int) *MemoryBus {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &MemoryBus{
+		partitions: partitions,
+		topics:     make(map[string][][]*Message),
+		committed:  make(map[memoryGroupPartition]int64),
+		published:  make(chan struct{}),
+	}
+}
+
+// NewPublisher returns a publisher on the bus
+func (b *MemoryBus) NewPublisher() (Publisher, error) {
+	return &memoryPublisher{bus: b}, nil
+}
+
+// NewSubscriber returns a subscriber in the given consumer group
+func (b *MemoryBus) NewSubscriber(groupID string) (Subscriber, error) {
+	return &memorySubscriber{bus: b, group: groupID}, nil
+}
+
+// partitionsLocked returns the partition logs of a topic, creating them if needed
+func (b *MemoryBus) partitionsLocked(topic string) [][]*Message {
+	logs, ok := b.topics[topic]
+	if !ok {
+		logs = make([][]*Message, b.partitions)
+		b.topics[topic] = logs
+	}
+	return logs
+}
+
+// append stores messages, choosing partitions by key hash or round robin
+func (b *MemoryBus) append(msgs []*Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, msg := range msgs {
+		logs := b.partitionsLocked(msg.Topic)
+
+		var partition int
+		if len(msg.Key) > 0 {
+			h := fnv.New32a()
+			h.Write(msg.Key)
+			partition = int(h.Sum32() % uint32(b.partitions))
+		} else {
+			partition = b.next % b.partitions
+			b.next++
+		}
+
+		stored := *msg
+		stored.Partition = int32(partition)
+		stored.Offset = int64(len(logs[partition]))
+		if stored.Timestamp.IsZero() {
+			stored.Timestamp = time.Now()
+		}
+		logs[partition] = append(logs[partition], &stored)
+
+		msg.Partition, msg.Offset, msg.Timestamp = stored.Partition, stored.Offset, stored.Timestamp
+	}
+
+	close(b.published)
+	b.published = make(chan struct{})
+}
+
+type memoryPublisher struct {
+	bus *MemoryBus
+}
+
+func (p *memoryPublisher) Publish(ctx context.Context, msgs ...*Message) error {
+	p.bus.append(msgs)
+	return nil
+}
+
+func (p *memoryPublisher) PublishSync(ctx context.Context, msgs ...*Message) error {
+	p.bus.append(msgs)
+	return nil
+}
+
+func (p *memoryPublisher) Close() error {
+	return nil
+}
+
+type memorySubscriber struct {
+	bus   *MemoryBus
+	group string
+	topic string
+	// positions holds the next offset to read from each partition
+	positions []int64
+	// cursor rotates the partition polled first so that none is starved
+	cursor int
+}
+
+func (s *memorySubscriber) Subscribe(topic string, rebalance Rebalance) error {
+	if s.positions != nil {
+		return errors.New("already subscribed")
+	}
+
+	assigned := make([]Position, s.bus.partitions)
+	for i := range assigned {
+		assigned[i] = Position{Topic: topic, Partition: int32(i), Offset: OffsetCommitted}
+	}
+	if rebalance.Assigned != nil {
+		var err error
+		if assigned, err = rebalance.Assigned(assigned); err != nil {
+			return err
+		}
+	}
+
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	s.topic = topic
+	s.positions = make([]int64, s.bus.partitions)
+	for _, pos := range assigned {
+		offset := pos.Offset
+		if offset == OffsetCommitted {
+			offset = s.bus.committed[memoryGroupPartition{s.group, topic, pos.Partition}]
+		}
+		s.positions[pos.Partition] = offset
+	}
+	return nil
+}
+
+func (s *memorySubscriber) Poll(timeout time.Duration) (*Message, error) {
+	if s.positions == nil {
+		return nil, errors.New("not subscribed")
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		msg, published := s.next()
+		if msg != nil {
+			return msg, nil
+		}
+
+		select {
+		case <-published:
+		case <-timer.C:
+			return nil, nil
+		}
+	}
+}
+
+// next returns the next unread message, or the channel signalling new messages if there is none
+func (s *memorySubscriber) next() (*Message, <-chan struct{}) {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	logs := s.bus.partitionsLocked(s.topic)
+	for i := range logs {
+		p := (s.cursor + i) % len(logs)
+		if s.positions[p] < int64(len(logs[p])) {
+			msg := *logs[p][s.positions[p]]
+			s.positions[p]++
+			s.cursor = p + 1
+			return &msg, nil
+		}
+	}
+	return nil, s.bus.published
+}
+
+func (s *memorySubscriber) Commit(positions []Position) error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	for _, pos := range positions {
+		key := memoryGroupPartition{s.group, pos.Topic, pos.Partition}
+		s.bus.committed[key] = max(s.bus.committed[key], pos.Offset)
+	}
+	return nil
+}
+
+// OffsetsForTime scans each partition for the first message at or after t
+func (s *memorySubscriber) OffsetsForTime(topic string, t time.Time) ([]Position, error) {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	logs := s.bus.partitionsLocked(topic)
+	positions := make([]Position, len(logs))
+	for p, log := range logs {
+		offset := int64(len(log))
+		for i, msg := range log {
+			if !msg.Timestamp.Before(t) {
+				offset = int64(i)
+				break
+			}
+		}
+		positions[p] = Position{Topic: topic, Partition: int32(p), Offset: offset}
+	}
+	return positions, nil
+}
+
+func (s *memorySubscriber) Close() error {
+	return nil
+}
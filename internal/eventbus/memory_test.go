@@ -0,0 +1,117 @@
+package eventbus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func publish(t *testing.T, pub Publisher, topic string, values ...string) {
+	t.Helper()
+	for _, v := range values {
+		assert.NoError(t, pub.Publish(context.Background(), &Message{Topic: topic, Value: []byte(v)}))
+	}
+}
+
+func poll(t *testing.T, sub Subscriber) *Message {
+	t.Helper()
+	msg, err := sub.Poll(time.Second)
+	assert.NoError(t, err)
+	return msg
+}
+
+func TestMemoryBus(t *testing.T) {
+	t.Run("Delivers in order and resumes from the commit", func(t *testing.T) {
+		bus := NewMemoryBus(1)
+		pub, _ := bus.NewPublisher()
+		publish(t, pub, "views", "a", "b", "c")
+
+		sub, _ := bus.NewSubscriber("group")
+		assert.NoError(t, sub.Subscribe("views", Rebalance{}))
+		assert.Equal(t, "a", string(poll(t, sub).Value))
+		b := poll(t, sub)
+		assert.Equal(t, "b", string(b.Value))
+		assert.NoError(t, sub.Commit([]Position{{Topic: "views", Partition: b.Partition, Offset: b.Offset + 1}}))
+
+		// A new member of the group starts after the commit
+		next, _ := bus.NewSubscriber("group")
+		assert.NoError(t, next.Subscribe("views", Rebalance{}))
+		assert.Equal(t, "c", string(poll(t, next).Value))
+
+		// Other groups start from the beginning
+		other, _ := bus.NewSubscriber("other")
+		assert.NoError(t, other.Subscribe("views", Rebalance{}))
+		assert.Equal(t, "a", string(poll(t, other).Value))
+	})
+
+	t.Run("Waits for new messages", func(t *testing.T) {
+		bus := NewMemoryBus(1)
+		pub, _ := bus.NewPublisher()
+		sub, _ := bus.NewSubscriber("group")
+		assert.NoError(t, sub.Subscribe("views", Rebalance{}))
+
+		msg, err := sub.Poll(10 * time.Millisecond)
+		assert.NoError(t, err)
+		assert.Nil(t, msg)
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			publish(t, pub, "views", "late")
+		}()
+		assert.Equal(t, "late", string(poll(t, sub).Value))
+	})
+
+	t.Run("Assigned positions override the commit", func(t *testing.T) {
+		bus := NewMemoryBus(1)
+		pub, _ := bus.NewPublisher()
+		publish(t, pub, "views", "a", "b", "c")
+
+		sub, _ := bus.NewSubscriber("group")
+		err := sub.Subscribe("views", Rebalance{
+			Assigned: func(partitions []Position) ([]Position, error) {
+				assert.Equal(t, OffsetCommitted, partitions[0].Offset)
+				partitions[0].Offset = 2
+				return partitions, nil
+			},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "c", string(poll(t, sub).Value))
+	})
+
+	t.Run("Keys choose stable partitions", func(t *testing.T) {
+		bus := NewMemoryBus(4)
+		pub, _ := bus.NewPublisher()
+
+		first := &Message{Topic: "views", Key: []byte("product-1"), Value: []byte("1")}
+		second := &Message{Topic: "views", Key: []byte("product-1"), Value: []byte("2")}
+		assert.NoError(t, pub.PublishSync(context.Background(), first, second))
+		assert.Equal(t, first.Partition, second.Partition)
+		assert.Equal(t, first.Offset+1, second.Offset)
+	})
+
+	t.Run("Finds offsets by time", func(t *testing.T) {
+		bus := NewMemoryBus(2)
+		pub, _ := bus.NewPublisher()
+		start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 4; i++ {
+			msg := &Message{Topic: "views", Value: []byte("v"), Timestamp: start.Add(time.Duration(i) * time.Minute)}
+			assert.NoError(t, pub.PublishSync(context.Background(), msg))
+		}
+
+		sub, _ := bus.NewSubscriber("group")
+		positions, err := sub.(OffsetLookup).OffsetsForTime("views", start.Add(time.Minute))
+		assert.NoError(t, err)
+		// Round robin puts minutes 0 and 2 in partition 0, 1 and 3 in partition 1
+		assert.Equal(t, []Position{
+			{Topic: "views", Partition: 0, Offset: 1},
+			{Topic: "views", Partition: 1, Offset: 0},
+		}, positions)
+
+		positions, err = sub.(OffsetLookup).OffsetsForTime("views", start.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), positions[0].Offset)
+		assert.Equal(t, int64(2), positions[1].Offset)
+	})
+}
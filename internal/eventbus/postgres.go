@@ -0,0 +1,213 @@
+package eventbus
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// postgresLease is how long a polled message stays reserved for its
+	// subscriber before other subscribers may take it over
+	postgresLease = time.Minute
+	// postgresFetchSize is the number of messages reserved per query
+	postgresFetchSize = 100
+	// postgresPollInterval is how often an empty queue is polled again
+	postgresPollInterval = 200 * time.Millisecond
+)
+
+// PostgresBus is a queue backed by the event_bus_messages table. Subscribers
+// reserve messages with SELECT ... FOR UPDATE SKIP LOCKED, so any number of them
+// can share a topic, and committed messages are deleted. A topic therefore has
+// a single partition, 0, serves a single consumer group, and offsets cannot be
+// rewound: assigned positions other than OffsetCommitted are ignored.
+type PostgresBus struct {
+	db *sql.DB
+}
+
+// NewPostgresBus creates a bus on the given database
+func NewPostgresBus(db *sql.DB) *PostgresBus {
+	return &PostgresBus{db: db}
+}
+
+// NewPublisher returns a publisher on the bus
+func (b *PostgresBus) NewPublisher() (Publisher, error) {
+	return &postgresPublisher{db: b.db}, nil
+}
+
+// NewSubscriber returns a subscriber. The group ID is not used, as each topic
+// serves a single consumer group.
+func (b *PostgresBus) NewSubscriber(groupID string) (Subscriber, error) {
+	return &postgresSubscriber{db: b.db, id: uuid.NewString()}, nil
+}
+
+type postgresPublisher struct {
+	db *sql.DB
+}
+
+// Publish stores messages synchronously, as the insert is the delivery
+func (p *postgresPublisher) Publish(ctx context.Context, msgs ...*Message) error {
+	return p.PublishSync(ctx, msgs...)
+}
+
+func (p *postgresPublisher) PublishSync(ctx context.Context, msgs ...*Message) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, msg := range msgs {
+		headers, err := json.Marshal(msg.Headers)
+		if err != nil {
+			return fmt.Errorf("failed to marshal headers: %w", err)
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO event_bus_messages (topic, msg_key, value, headers)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, published_at`,
+			msg.Topic, msg.Key, msg.Value, string(headers),
+		).Scan(&msg.Offset, &msg.Timestamp)
+		if err != nil {
+			return err
+		}
+		msg.Partition = 0
+	}
+
+	return tx.Commit()
+}
+
+func (p *postgresPublisher) Close() error {
+	return nil
+}
+
+type postgresSubscriber struct {
+	db    *sql.DB
+	id    string
+	topic string
+	// buffered holds reserved messages not yet returned by Poll, in offset order
+	buffered []*Message
+}
+
+func (s *postgresSubscriber) Subscribe(topic string, rebalance Rebalance) error {
+	if s.topic != "" {
+		return errors.New("already subscribed")
+	}
+	s.topic = topic
+
+	if rebalance.Assigned != nil {
+		_, err := rebalance.Assigned([]Position{{Topic: topic, Partition: 0, Offset: OffsetCommitted}})
+		return err
+	}
+	return nil
+}
+
+func (s *postgresSubscriber) Poll(timeout time.Duration) (*Message, error) {
+	if s.topic == "" {
+		return nil, errors.New("not subscribed")
+	}
+
+	deadline := time.Now().Add(timeout)
+	for len(s.buffered) == 0 {
+		if err := s.reserve(); err != nil {
+			return nil, err
+		}
+		if len(s.buffered) > 0 {
+			break
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, nil
+		}
+		time.Sleep(min(remaining, postgresPollInterval))
+	}
+
+	msg := s.buffered[0]
+	s.buffered = s.buffered[1:]
+	return msg, nil
+}
+
+// reserve leases the next batch of unreserved messages, or messages whose lease expired
+func (s *postgresSubscriber) reserve() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE event_bus_messages m
+		SET leased_by = $2, leased_until = CURRENT_TIMESTAMP + make_interval(secs => $3)
+		WHERE m.id IN (
+			SELECT id FROM event_bus_messages
+			WHERE topic = $1 AND (leased_until IS NULL OR leased_until < CURRENT_TIMESTAMP)
+			ORDER BY id
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING m.id, m.msg_key, m.value, m.headers, m.published_at`,
+		s.topic, s.id, postgresLease.Seconds(), postgresFetchSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg := &Message{Topic: s.topic}
+		var headers []byte
+		if err := rows.Scan(&msg.Offset, &msg.Key, &msg.Value, &headers, &msg.Timestamp); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(headers, &msg.Headers); err != nil {
+			return fmt.Errorf("failed to unmarshal headers: %w", err)
+		}
+		s.buffered = append(s.buffered, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(s.buffered, func(i, j int) bool { return s.buffered[i].Offset < s.buffered[j].Offset })
+	return nil
+}
+
+// Commit deletes the messages this subscriber reserved before each position
+func (s *postgresSubscriber) Commit(positions []Position) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, pos := range positions {
+		_, err := s.db.ExecContext(ctx, `
+			DELETE FROM event_bus_messages
+			WHERE topic = $1 AND leased_by = $2 AND id < $3`,
+			pos.Topic, s.id, pos.Offset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases the leases of messages polled but not committed, so that other
+// subscribers can take them at once
+func (s *postgresSubscriber) Close() error {
+	if s.topic == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE event_bus_messages
+		SET leased_by = NULL, leased_until = NULL
+		WHERE topic = $1 AND leased_by = $2`,
+		s.topic, s.id)
+	s.buffered = nil
+	return err
+}
@@ -0,0 +1,528 @@
+package eventbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSpoolFull is returned when appending would take the spool over its size limit
+var ErrSpoolFull = errors.New("spool is full")
+
+// Fsync policies of a spool
+const (
+	// FsyncAlways syncs the segment after every append
+	FsyncAlways = "always"
+	// FsyncInterval syncs the segment periodically, so a machine crash can
+	// lose the messages appended within the last interval
+	FsyncInterval = "interval"
+	// FsyncNever leaves syncing to the operating system
+	FsyncNever = "never"
+)
+
+const (
+	spoolSegmentExt = ".spool"
+	// spoolHeaderSize is the length and CRC32 preceding each record
+	spoolHeaderSize = 8
+	// spoolMaxRecord bounds the record length read back, so that a corrupt
+	// length is reported instead of allocated
+	spoolMaxRecord = 16 << 20
+)
+
+// spoolMetrics exposes the spool's backlog and traffic under /debug/vars
+var spoolMetrics = expvar.NewMap("event_spool")
+
+// SpoolOptions configures a Spool
+type SpoolOptions struct {
+	// MaxBytes limits the disk space used by the spool; zero means no limit
+	MaxBytes int64
+	// SegmentBytes is the size at which a new segment file is started
+	SegmentBytes int64
+	// Fsync is one of FsyncAlways, FsyncInterval or FsyncNever
+	Fsync string
+	// FsyncInterval is how often segments are synced with FsyncInterval
+	FsyncInterval time.Duration
+}
+
+// Spool is a durable FIFO of messages in a directory of append-only segment
+// files. Each record is framed by its length and CRC32, so a record torn by a
+// crash is detected and truncated when the spool is reopened. Segments are
+// deleted once every record in them has been consumed.
+type Spool struct {
+	dir  string
+	opts SpoolOptions
+
+	mu sync.Mutex
+	// segments lists the sequence numbers of the segment files, oldest first.
+	// The last one is open for appending.
+	segments []uint64
+	writer   *os.File
+	// writerSize is the size of the segment open for appending
+	writerSize int64
+	// readOffset is the position of the next record in the oldest segment
+	readOffset int64
+	bytes      int64
+	pending    int
+	dirty      bool
+	closed     bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// spoolRecord is the serialized form of a spooled message
+type spoolRecord struct {
+	Topic     string    `json:"topic"`
+	Key       []byte    `json:"key,omitempty"`
+	Value     []byte    `json:"value"`
+	Headers   []Header  `json:"headers,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// OpenSpool opens the spool in dir, creating the directory if needed, and
+// recovers the messages left in it by a previous run
+func OpenSpool(dir string, opts SpoolOptions) (*Spool, error) {
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = 64 << 20
+	}
+	if opts.Fsync == "" {
+		opts.Fsync = FsyncInterval
+	}
+	if opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = time.Second
+	}
+	switch opts.Fsync {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %q", opts.Fsync)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &Spool{dir: dir, opts: opts, done: make(chan struct{})}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	if len(s.segments) == 0 {
+		s.segments = []uint64{1}
+	}
+	if err := s.openWriter(); err != nil {
+		return nil, err
+	}
+	s.updateGauges()
+
+	if opts.Fsync == FsyncInterval {
+		s.wg.Add(1)
+		go s.syncPeriodically()
+	}
+
+	return s, nil
+}
+
+// recover lists the segments left in the directory and counts their records,
+// truncating each segment at its first damaged record
+func (s *Spool) recover() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	for _, seq := range s.segments {
+		records, size, err := s.scanSegment(seq)
+		if err != nil {
+			return err
+		}
+		s.pending += records
+		s.bytes += size
+	}
+
+	return nil
+}
+
+// scanSegment counts the intact records of a segment and truncates whatever follows them
+func (s *Spool) scanSegment(seq uint64) (int, int64, error) {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	records := 0
+	var size int64
+	for {
+		n, _, err := readSpoolRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Truncating spool segment %s at offset %d: %v\n", s.segmentPath(seq), size, err)
+			if err := f.Truncate(size); err != nil {
+				return 0, 0, fmt.Errorf("failed to truncate spool segment: %w", err)
+			}
+			break
+		}
+		records++
+		size += n
+	}
+
+	return records, size, nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+// openWriter opens the newest segment for appending
+func (s *Spool) openWriter() error {
+	path := s.segmentPath(s.segments[len(s.segments)-1])
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.writer = f
+	s.writerSize = info.Size()
+	return nil
+}
+
+// Append stores messages at the tail of the spool. Either all of them are
+// stored or, if they do not fit within MaxBytes, none are and ErrSpoolFull is
+// returned.
+func (s *Spool) Append(msgs ...*Message) error {
+	records := make([][]byte, len(msgs))
+	var size int64
+	for i, msg := range msgs {
+		rec, err := encodeSpoolRecord(msg)
+		if err != nil {
+			return err
+		}
+		records[i] = rec
+		size += int64(len(rec))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("spool is closed")
+	}
+	if s.opts.MaxBytes > 0 && s.bytes+size > s.opts.MaxBytes {
+		spoolMetrics.Add("messages_rejected", int64(len(msgs)))
+		return ErrSpoolFull
+	}
+
+	for _, rec := range records {
+		if s.writerSize > 0 && s.writerSize+int64(len(rec)) > s.opts.SegmentBytes {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		if _, err := s.writer.Write(rec); err != nil {
+			return fmt.Errorf("failed to write to spool: %w", err)
+		}
+		s.writerSize += int64(len(rec))
+		s.bytes += int64(len(rec))
+		s.pending++
+	}
+	s.dirty = true
+
+	if s.opts.Fsync == FsyncAlways {
+		if err := s.syncLocked(); err != nil {
+			return err
+		}
+	}
+
+	spoolMetrics.Add("messages_spooled", int64(len(msgs)))
+	s.updateGauges()
+	return nil
+}
+
+// rotate syncs and closes the current segment and starts a new one
+func (s *Spool) rotate() error {
+	if s.opts.Fsync != FsyncNever {
+		if err := s.syncLocked(); err != nil {
+			return err
+		}
+	}
+	if err := s.writer.Close(); err != nil {
+		return err
+	}
+	s.segments = append(s.segments, s.segments[len(s.segments)-1]+1)
+	return s.openWriter()
+}
+
+// Len returns the number of messages waiting in the spool
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// Drain reads up to n messages from the head of the spool and passes them to
+// fn. They are removed from the spool only if fn succeeds. Drain must not be
+// called concurrently with itself; it returns the number of messages removed.
+func (s *Spool) Drain(n int, fn func([]*Message) error) (int, error) {
+	msgs, end, err := s.peek(n)
+	if err != nil || len(msgs) == 0 {
+		return 0, err
+	}
+
+	// Appends may continue while fn runs, as they never touch the head
+	if err := fn(msgs); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readOffset = end
+	s.pending -= len(msgs)
+	if err := s.releaseHead(); err != nil {
+		return len(msgs), err
+	}
+	spoolMetrics.Add("messages_replayed", int64(len(msgs)))
+	s.updateGauges()
+	return len(msgs), nil
+}
+
+// peek reads up to n messages from the oldest segment holding any, returning
+// the offset just past the last one
+func (s *Spool) peek(n int) ([]*Message, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.pending > 0 {
+		msgs, end, err := s.readHead(n)
+		if err != nil || len(msgs) > 0 || len(s.segments) == 1 {
+			return msgs, end, err
+		}
+
+		// The head segment is exhausted but newer ones remain: move on to the next
+		s.readOffset = end
+		if err := s.releaseHead(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return nil, 0, nil
+}
+
+// readHead reads up to n records of the oldest segment from readOffset. The
+// caller must hold s.mu; records are written whole under it, so none is torn.
+func (s *Spool) readHead(n int) ([]*Message, int64, error) {
+	f, err := os.Open(s.segmentPath(s.segments[0]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(s.readOffset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	r := bufio.NewReader(f)
+	offset := s.readOffset
+	var msgs []*Message
+	for len(msgs) < n {
+		size, msg, err := readSpoolRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read spool segment: %w", err)
+		}
+		msgs = append(msgs, msg)
+		offset += size
+	}
+
+	return msgs, offset, nil
+}
+
+// releaseHead deletes the oldest segment once all of its records are consumed.
+// The segment open for appending is truncated instead once the spool is empty.
+func (s *Spool) releaseHead() error {
+	head := s.segments[0]
+	if len(s.segments) == 1 {
+		if s.pending > 0 || s.readOffset < s.writerSize {
+			return nil
+		}
+		if err := s.writer.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate spool segment: %w", err)
+		}
+		s.bytes, s.writerSize, s.readOffset = 0, 0, 0
+		return nil
+	}
+
+	info, err := os.Stat(s.segmentPath(head))
+	if err != nil {
+		return err
+	}
+	if s.readOffset < info.Size() {
+		return nil
+	}
+	if err := os.Remove(s.segmentPath(head)); err != nil {
+		return fmt.Errorf("failed to remove spool segment: %w", err)
+	}
+	s.segments = s.segments[1:]
+	s.bytes -= info.Size()
+	s.readOffset = 0
+	return nil
+}
+
+// syncPeriodically syncs appended records every FsyncInterval
+func (s *Spool) syncPeriodically() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.FsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if err := s.syncLocked(); err != nil {
+				log.Printf("Error syncing spool: %v\n", err)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Spool) syncLocked() error {
+	if !s.dirty || s.closed {
+		return nil
+	}
+	if err := s.writer.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// updateGauges publishes the backlog size. The caller must hold s.mu.
+func (s *Spool) updateGauges() {
+	setSpoolGauge("messages_pending", int64(s.pending))
+	setSpoolGauge("bytes", s.bytes)
+	setSpoolGauge("segments", int64(len(s.segments)))
+}
+
+func setSpoolGauge(key string, value int64) {
+	v, ok := spoolMetrics.Get(key).(*expvar.Int)
+	if !ok {
+		v = new(expvar.Int)
+		spoolMetrics.Set(key, v)
+	}
+	v.Set(value)
+}
+
+// Close syncs and closes the spool. Messages still in it are replayed when the
+// spool is next opened.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	err := s.syncLocked()
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+
+	if cerr := s.writer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// encodeSpoolRecord frames a message as length, CRC32 and JSON payload
+func encodeSpoolRecord(msg *Message) ([]byte, error) {
+	payload, err := json.Marshal(spoolRecord{
+		Topic:     msg.Topic,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Headers:   msg.Headers,
+		Timestamp: msg.Timestamp,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode spool record: %w", err)
+	}
+
+	rec := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(payload))
+	copy(rec[spoolHeaderSize:], payload)
+	return rec, nil
+}
+
+// readSpoolRecord reads the next record, returning its size on disk. It returns
+// io.EOF at a clean end of segment and an error for torn or corrupt records.
+func readSpoolRecord(r *bufio.Reader) (int64, *Message, error) {
+	var header [spoolHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, fmt.Errorf("torn record header: %w", err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > spoolMaxRecord {
+		return 0, nil, fmt.Errorf("record length %d exceeds limit", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, fmt.Errorf("torn record: %w", err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, nil, errors.New("record checksum mismatch")
+	}
+
+	var rec spoolRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return 0, nil, fmt.Errorf("invalid record: %w", err)
+	}
+
+	msg := &Message{
+		Topic:     rec.Topic,
+		Key:       rec.Key,
+		Value:     rec.Value,
+		Headers:   rec.Headers,
+		Timestamp: rec.Timestamp,
+	}
+	return int64(spoolHeaderSize + len(payload)), msg, nil
+}
@@ -0,0 +1,187 @@
+package eventbus
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func values(msgs []*Message) []string {
+	out := make([]string, len(msgs))
+	for i, msg := range msgs {
+		out[i] = string(msg.Value)
+	}
+	return out
+}
+
+// drainAll removes every message from the spool, n at a time
+func drainAll(t *testing.T, s *Spool, n int) []string {
+	t.Helper()
+	var out []string
+	for {
+		removed, err := s.Drain(n, func(msgs []*Message) error {
+			out = append(out, values(msgs)...)
+			return nil
+		})
+		assert.NoError(t, err)
+		if removed == 0 {
+			return out
+		}
+	}
+}
+
+func appendValues(t *testing.T, s *Spool, values ...string) {
+	t.Helper()
+	for _, v := range values {
+		assert.NoError(t, s.Append(&Message{Topic: "views", Value: []byte(v)}))
+	}
+}
+
+func TestSpool(t *testing.T) {
+	t.Run("Drains in order across segments", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := OpenSpool(dir, SpoolOptions{SegmentBytes: 100, Fsync: FsyncAlways})
+		assert.NoError(t, err)
+		defer s.Close()
+
+		appendValues(t, s, "a", "b", "c", "d", "e")
+		entries, _ := os.ReadDir(dir)
+		assert.Greater(t, len(entries), 1)
+
+		// A failed drain keeps the messages
+		_, err = s.Drain(2, func([]*Message) error { return errors.New("broker down") })
+		assert.Error(t, err)
+		assert.Equal(t, 5, s.Len())
+
+		assert.Equal(t, []string{"a", "b", "c", "d", "e"}, drainAll(t, s, 2))
+		assert.Equal(t, 0, s.Len())
+
+		// Consumed segments are removed and the last one is emptied
+		entries, _ = os.ReadDir(dir)
+		assert.Len(t, entries, 1)
+		info, _ := entries[0].Info()
+		assert.Zero(t, info.Size())
+	})
+
+	t.Run("Recovers messages and truncates a torn record", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := OpenSpool(dir, SpoolOptions{Fsync: FsyncNever})
+		assert.NoError(t, err)
+		appendValues(t, s, "a", "b")
+		assert.NoError(t, s.Close())
+
+		// Simulate a crash in the middle of writing a record
+		rec, _ := encodeSpoolRecord(&Message{Topic: "views", Value: []byte("c")})
+		f, _ := os.OpenFile(s.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0)
+		f.Write(rec[:len(rec)-3])
+		f.Close()
+
+		s, err = OpenSpool(dir, SpoolOptions{})
+		assert.NoError(t, err)
+		defer s.Close()
+		assert.Equal(t, 2, s.Len())
+
+		appendValues(t, s, "d")
+		assert.Equal(t, []string{"a", "b", "d"}, drainAll(t, s, 10))
+	})
+
+	t.Run("Rejects appends over the size limit", func(t *testing.T) {
+		s, err := OpenSpool(t.TempDir(), SpoolOptions{MaxBytes: 150})
+		assert.NoError(t, err)
+		defer s.Close()
+
+		appendValues(t, s, "a")
+		err = s.Append(&Message{Topic: "views", Value: []byte("b")}, &Message{Topic: "views", Value: []byte("c")})
+		assert.ErrorIs(t, err, ErrSpoolFull)
+		assert.Equal(t, 1, s.Len())
+
+		// Draining frees the space again
+		drainAll(t, s, 10)
+		appendValues(t, s, "b")
+	})
+
+	t.Run("Rejects unknown fsync policies", func(t *testing.T) {
+		_, err := OpenSpool(t.TempDir(), SpoolOptions{Fsync: "sometimes"})
+		assert.Error(t, err)
+	})
+}
+
+// flakyPublisher fails while down and reports asynchronous delivery failures
+type flakyPublisher struct {
+	mu        sync.Mutex
+	down      bool
+	published []string
+	onFailure func(*Message)
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, msgs ...*Message) error {
+	return p.PublishSync(ctx, msgs...)
+}
+
+func (p *flakyPublisher) PublishSync(ctx context.Context, msgs ...*Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down {
+		return errors.New("broker down")
+	}
+	p.published = append(p.published, values(msgs)...)
+	return nil
+}
+
+func (p *flakyPublisher) NotifyDeliveryFailures(handler func(*Message)) {
+	p.onFailure = handler
+}
+
+func (p *flakyPublisher) Close() error {
+	return nil
+}
+
+func (p *flakyPublisher) setDown(down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down = down
+}
+
+func (p *flakyPublisher) sent() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.published...)
+}
+
+func TestSpooledPublisher(t *testing.T) {
+	dir := t.TempDir()
+	inner := &flakyPublisher{}
+	spool, err := OpenSpool(dir, SpoolOptions{})
+	assert.NoError(t, err)
+	pub := NewSpooledPublisher(inner, spool)
+
+	publish(t, pub, "views", "a")
+	inner.setDown(true)
+	publish(t, pub, "views", "b", "c")
+	// An asynchronous delivery failure is spooled as well
+	inner.onFailure(&Message{Topic: "views", Value: []byte("d")})
+	assert.Equal(t, 3, spool.Len())
+
+	// Messages spooled before the broker recovers are replayed in order
+	inner.setDown(false)
+	assert.Eventually(t, func() bool { return len(inner.sent()) == 4 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, inner.sent())
+
+	// Messages left in the spool on close are replayed by the next publisher
+	inner.setDown(true)
+	publish(t, pub, "views", "e")
+	assert.NoError(t, pub.Close())
+
+	inner.setDown(false)
+	spool, err = OpenSpool(dir, SpoolOptions{})
+	assert.NoError(t, err)
+	pub = NewSpooledPublisher(inner, spool)
+	defer pub.Close()
+	assert.Eventually(t, func() bool { return len(inner.sent()) == 5 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "e", inner.sent()[4])
+}
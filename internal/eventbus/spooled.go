@@ -0,0 +1,173 @@
+package eventbus
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// spoolReplayBatch is the number of spooled messages republished at a time
+	spoolReplayBatch = 100
+	// spoolReplayTimeout bounds a single attempt to republish a batch
+	spoolReplayTimeout = 30 * time.Second
+	// maxSpoolBackoff caps the delay between attempts while the bus is unavailable
+	maxSpoolBackoff = 30 * time.Second
+)
+
+// SpooledPublisher publishes through another publisher and falls back to a
+// Spool when it fails. Messages that cannot be handed to the bus, and messages
+// whose asynchronous delivery fails if the publisher is a
+// DeliveryFailureNotifier, are appended to the spool, and a background
+// goroutine republishes them in order once the bus recovers. While the spool
+// holds messages new ones are spooled behind them rather than overtaking them.
+//
+// A message is only removed from the spool once the bus acknowledges it, and
+// a restart replays the oldest segment from its beginning, so spooled messages
+// are delivered at least once.
+type SpooledPublisher struct {
+	publisher Publisher
+	spool     *Spool
+
+	// wake signals the replay goroutine that messages were spooled
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewSpooledPublisher wraps publisher with spool and starts replaying any
+// messages left in the spool
+func NewSpooledPublisher(publisher Publisher, spool *Spool) *SpooledPublisher {
+	p := &SpooledPublisher{
+		publisher: publisher,
+		spool:     spool,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	if notifier, ok := publisher.(DeliveryFailureNotifier); ok {
+		notifier.NotifyDeliveryFailures(p.spoolFailed)
+	}
+
+	p.wg.Add(1)
+	go p.replay()
+	// Replay whatever a previous run left behind
+	p.signal()
+
+	return p
+}
+
+// Publish hands messages to the underlying publisher, or appends them to the
+// spool if it fails or the spool is still being replayed. It only fails when
+// the spool cannot take the messages either.
+func (p *SpooledPublisher) Publish(ctx context.Context, msgs ...*Message) error {
+	if p.spool.Len() == 0 {
+		err := p.publisher.Publish(ctx, msgs...)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Publish failed, spooling %d messages: %v\n", len(msgs), err)
+	}
+
+	if err := p.spool.Append(msgs...); err != nil {
+		return err
+	}
+	p.signal()
+	return nil
+}
+
+// PublishSync waits for the underlying publisher's acknowledgement and returns
+// its error without spooling, as callers rely on the partition and offset of
+// acknowledged messages
+func (p *SpooledPublisher) PublishSync(ctx context.Context, msgs ...*Message) error {
+	return p.publisher.PublishSync(ctx, msgs...)
+}
+
+// spoolFailed appends a message whose asynchronous delivery failed
+func (p *SpooledPublisher) spoolFailed(msg *Message) {
+	if err := p.spool.Append(msg); err != nil {
+		log.Printf("Failed to spool undelivered message, dropping it: %v\n", err)
+		spoolMetrics.Add("messages_dropped", 1)
+		return
+	}
+	p.signal()
+}
+
+func (p *SpooledPublisher) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// replay republishes spooled messages until the spool is empty, backing off
+// exponentially while the underlying publisher keeps failing
+func (p *SpooledPublisher) replay() {
+	defer p.wg.Done()
+
+	var backoff time.Duration
+	for {
+		if backoff == 0 {
+			select {
+			case <-p.done:
+				return
+			case <-p.wake:
+			}
+		} else {
+			// Messages spooled meanwhile wait out the backoff too
+			timer := time.NewTimer(backoff)
+			select {
+			case <-p.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		if err := p.drain(); err != nil {
+			spoolMetrics.Add("replay_errors", 1)
+			backoff = min(max(2*backoff, time.Second), maxSpoolBackoff)
+			log.Printf("Failed to replay spooled messages, retrying in %s: %v\n", backoff, err)
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// drain republishes batches until the spool is empty or publishing fails
+func (p *SpooledPublisher) drain() error {
+	for {
+		select {
+		case <-p.done:
+			return nil
+		default:
+		}
+
+		n, err := p.spool.Drain(spoolReplayBatch, func(msgs []*Message) error {
+			ctx, cancel := context.WithTimeout(context.Background(), spoolReplayTimeout)
+			defer cancel()
+			return p.publisher.PublishSync(ctx, msgs...)
+		})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
+
+// Close stops replaying, closes the underlying publisher, spooling whatever
+// it could not deliver, and closes the spool. Messages left in the spool are
+// replayed on the next start.
+func (p *SpooledPublisher) Close() error {
+	close(p.done)
+	p.wg.Wait()
+
+	err := p.publisher.Close()
+	if serr := p.spool.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// reconcileTimeout bounds a reconciliation started over HTTP
+const reconcileTimeout = 5 * time.Minute
+
+// AdminHandler handles operational HTTP requests
+type AdminHandler struct {
+	reconciler repository.ReconcileStore
+	// source is what dry runs compare with when the request names none
+	source string
+}
+
+// NewAdminHandler creates a new AdminHandler. Dry runs that name no source
+// compare with source.
+func NewAdminHandler(reconciler repository.ReconcileStore, source string) *AdminHandler {
+	return &AdminHandler{reconciler: reconciler, source: source}
+}
+
+// AdminAuth rejects requests without the bearer token
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Reconcile compares the stored view counts with the expected ones, or repairs
+// the discrepancies of a dry run
+// @Summary Reconcile view counts
+// @Description Without apply_run_id, records a dry run listing every product whose view counts differ from the sum of its view buckets (source=buckets) or its raw view events (source=events). With apply_run_id, repairs the discrepancies of that dry run that have not changed since.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body ReconcileRequest true "Reconciliation request"
+// @Param limit query int false "Maximum number of discrepancies to return (1-1000)" default(20)
+// @Success 201 {object} ReconciliationResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/admin/reconciliations [post]
+func (h *AdminHandler) Reconcile(c *gin.Context) {
+	var req ReconcileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+	var page ReconciliationsRequest
+	if err := c.ShouldBindQuery(&page); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid query parameters"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reconcileTimeout)
+	defer cancel()
+
+	triggeredBy := "admin " + c.ClientIP()
+	var run *repository.Reconciliation
+	var err error
+	if req.ApplyRunID != nil {
+		run, err = h.reconciler.ApplyReconciliation(ctx, *req.ApplyRunID, triggeredBy)
+	} else {
+		source := req.Source
+		if source == "" {
+			source = h.source
+		}
+		run, err = h.reconciler.ReconcileViewCounts(ctx, source, triggeredBy)
+	}
+	switch {
+	case errors.Is(err, repository.ErrReconciliationNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Reconciliation not found"})
+		return
+	case errors.Is(err, repository.ErrNotDryRun):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Only dry runs can be applied"})
+		return
+	case err != nil:
+		log.Printf("Failed to reconcile view counts: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to reconcile view counts"})
+		return
+	}
+	log.Printf("%s", run)
+
+	// Reload the run with its largest discrepancies
+	run, err = h.reconciler.GetReconciliation(ctx, run.ID, page.Limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch reconciliation"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, toReconciliationResponse(run))
+}
+
+// GetReconciliation returns a reconciliation run with its largest discrepancies
+// @Summary Get a reconciliation run
+// @Description Returns the audit record of a reconciliation run and its largest discrepancies. The discrepancies of an applied run are the products it repaired.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "Reconciliation ID"
+// @Param limit query int false "Maximum number of discrepancies to return (1-1000)" default(20)
+// @Success 200 {object} ReconciliationResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/admin/reconciliations/{id} [get]
+func (h *AdminHandler) GetReconciliation(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid reconciliation ID"})
+		return
+	}
+	var req ReconciliationsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid query parameters"})
+		return
+	}
+
+	run, err := h.reconciler.GetReconciliation(c.Request.Context(), id, req.Limit)
+	if errors.Is(err, repository.ErrReconciliationNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Reconciliation not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch reconciliation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, toReconciliationResponse(run))
+}
+
+// ListReconciliations returns the latest reconciliation runs
+// @Summary List reconciliation runs
+// @Description Returns the audit records of the latest reconciliation runs, most recent first
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param limit query int false "Maximum number of runs to return (1-1000)" default(20)
+// @Success 200 {array} ReconciliationResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/admin/reconciliations [get]
+func (h *AdminHandler) ListReconciliations(c *gin.Context) {
+	var req ReconciliationsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid query parameters"})
+		return
+	}
+
+	runs, err := h.reconciler.ListReconciliations(c.Request.Context(), req.Limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch reconciliations"})
+		return
+	}
+
+	response := make([]ReconciliationResponse, 0, len(runs))
+	for i := range runs {
+		response = append(response, toReconciliationResponse(&runs[i]))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// toReconciliationResponse converts a reconciliation run to its API representation
+func toReconciliationResponse(run *repository.Reconciliation) ReconciliationResponse {
+	response := ReconciliationResponse{
+		ID:              run.ID,
+		Source:          run.Source,
+		DryRun:          run.DryRun,
+		AppliedRunID:    run.AppliedRunID,
+		TriggeredBy:     run.TriggeredBy,
+		ProductsChecked: run.ProductsChecked,
+		Discrepancies:   run.Discrepancies,
+		ViewDrift:       run.ViewDrift,
+		UniqueViewDrift: run.UniqueViewDrift,
+		Repaired:        run.Repaired,
+		StartedAt:       run.StartedAt.Format(time.RFC3339),
+		FinishedAt:      run.FinishedAt.Format(time.RFC3339),
+	}
+	for _, d := range run.Products {
+		response.Products = append(response.Products, CountDiscrepancyResponse{
+			ProductID:               d.ProductID,
+			ViewCount:               d.ViewCount,
+			ExpectedViewCount:       d.ExpectedViewCount,
+			UniqueViewCount:         d.UniqueViewCount,
+			ExpectedUniqueViewCount: d.ExpectedUniqueViewCount,
+		})
+	}
+	return response
+}
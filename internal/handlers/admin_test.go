@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// MockReconcileStore is a mock implementation of ReconcileStore
+type MockReconcileStore struct {
+	mock.Mock
+}
+
+func (m *MockReconcileStore) ReconcileViewCounts(ctx context.Context, source, triggeredBy string) (*repository.Reconciliation, error) {
+	args := m.Called(ctx, source, triggeredBy)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*repository.Reconciliation), args.Error(1)
+}
+
+func (m *MockReconcileStore) ApplyReconciliation(ctx context.Context, runID uuid.UUID, triggeredBy string) (*repository.Reconciliation, error) {
+	args := m.Called(ctx, runID, triggeredBy)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*repository.Reconciliation), args.Error(1)
+}
+
+func (m *MockReconcileStore) GetReconciliation(ctx context.Context, id uuid.UUID, limit int) (*repository.Reconciliation, error) {
+	args := m.Called(ctx, id, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*repository.Reconciliation), args.Error(1)
+}
+
+func (m *MockReconcileStore) ListReconciliations(ctx context.Context, limit int) ([]repository.Reconciliation, error) {
+	args := m.Called(ctx, limit)
+	return args.Get(0).([]repository.Reconciliation), args.Error(1)
+}
+
+func TestReconcile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newRouter := func(store *MockReconcileStore) *gin.Engine {
+		handler := NewAdminHandler(store, repository.ReconcileBuckets)
+		router := gin.New()
+		admin := router.Group("/admin", AdminAuth("secret"))
+		admin.POST("reconciliations", handler.Reconcile)
+		admin.GET("reconciliations/:id", handler.GetReconciliation)
+		return router
+	}
+	post := func(router *gin.Engine, body any, token string) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", "/admin/reconciliations?limit=5", bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Requires the admin token", func(t *testing.T) {
+		store := new(MockReconcileStore)
+		router := newRouter(store)
+
+		assert.Equal(t, http.StatusUnauthorized, post(router, ReconcileRequest{}, "").Code)
+		assert.Equal(t, http.StatusUnauthorized, post(router, ReconcileRequest{}, "wrong").Code)
+		store.AssertNotCalled(t, "ReconcileViewCounts", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Dry run with the default source", func(t *testing.T) {
+		store := new(MockReconcileStore)
+		router := newRouter(store)
+
+		run := &repository.Reconciliation{ID: uuid.New(), Source: repository.ReconcileBuckets, DryRun: true, StartedAt: time.Now()}
+		detailed := *run
+		detailed.Discrepancies = 1
+		detailed.ViewDrift = 3
+		detailed.Products = []repository.CountDiscrepancy{{ProductID: uuid.New(), ViewCount: 8, ExpectedViewCount: 5}}
+		store.On("ReconcileViewCounts", mock.Anything, repository.ReconcileBuckets, mock.Anything).Return(run, nil)
+		store.On("GetReconciliation", mock.Anything, run.ID, 5).Return(&detailed, nil)
+
+		w := post(router, ReconcileRequest{}, "secret")
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response ReconciliationResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.True(t, response.DryRun)
+		assert.Equal(t, int64(3), response.ViewDrift)
+		assert.Len(t, response.Products, 1)
+		assert.Equal(t, int64(5), response.Products[0].ExpectedViewCount)
+		store.AssertExpectations(t)
+	})
+
+	t.Run("Applies a dry run", func(t *testing.T) {
+		store := new(MockReconcileStore)
+		router := newRouter(store)
+
+		dryRunID := uuid.New()
+		run := &repository.Reconciliation{ID: uuid.New(), AppliedRunID: &dryRunID, Repaired: 2}
+		store.On("ApplyReconciliation", mock.Anything, dryRunID, mock.Anything).Return(run, nil)
+		store.On("GetReconciliation", mock.Anything, run.ID, 5).Return(run, nil)
+
+		w := post(router, ReconcileRequest{ApplyRunID: &dryRunID}, "secret")
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response ReconciliationResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, &dryRunID, response.AppliedRunID)
+		assert.Equal(t, int64(2), response.Repaired)
+		store.AssertExpectations(t)
+	})
+
+	t.Run("Only dry runs can be applied", func(t *testing.T) {
+		store := new(MockReconcileStore)
+		router := newRouter(store)
+
+		runID := uuid.New()
+		store.On("ApplyReconciliation", mock.Anything, runID, mock.Anything).Return(nil, repository.ErrNotDryRun)
+
+		w := post(router, ReconcileRequest{ApplyRunID: &runID}, "secret")
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Rejects unknown sources", func(t *testing.T) {
+		store := new(MockReconcileStore)
+		router := newRouter(store)
+
+		w := post(router, map[string]string{"source": "guesswork"}, "secret")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Unknown run", func(t *testing.T) {
+		store := new(MockReconcileStore)
+		router := newRouter(store)
+
+		id := uuid.New()
+		store.On("GetReconciliation", mock.Anything, id, 20).Return(nil, repository.ErrReconciliationNotFound)
+
+		req := httptest.NewRequest("GET", "/admin/reconciliations/"+id.String(), nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
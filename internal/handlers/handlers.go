@@ -1,39 +1,143 @@
 package handlers
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/google/uuid"
 	"github.com/tushar-kalsi/product-views/internal/kafka"
+	"github.com/tushar-kalsi/product-views/internal/leaderboard"
 	"github.com/tushar-kalsi/product-views/internal/repository"
 )
 
+const (
+	// batchStatusAccepted marks a batch item that was handed to Kafka
+	batchStatusAccepted = "accepted"
+	// batchStatusRejected marks a batch item that failed validation or delivery
+	batchStatusRejected = "rejected"
+
+	// maxClockSkew is how far in the future a client timestamp may be
+	maxClockSkew = 5 * time.Minute
+	// maxEventAge is how old a buffered client event may be
+	maxEventAge = 7 * 24 * time.Hour
+)
+
+const (
+	// defaultSeriesRange is how far back a view series goes when from is omitted
+	defaultSeriesRange = 7 * 24 * time.Hour
+	// maxSeriesPoints caps the number of intervals in a view series
+	maxSeriesPoints = 1000
+)
+
+// topWindows maps the supported relative windows of the top N endpoint to durations
+var topWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// defaultTrendHalfLife is used when no trending half-life is configured
+const defaultTrendHalfLife = 6 * time.Hour
+
+// defaultSearchPopularityWeight is used when no search popularity weight is configured
+const defaultSearchPopularityWeight = 0.1
+
+// defaultSyncDeliveryTimeout bounds the wait for a synchronous view's acknowledgement
+const defaultSyncDeliveryTimeout = 5 * time.Second
+
+// Delivery modes of a view
+const (
+	deliveryAsync = "async"
+	deliverySync  = "sync"
+)
+
 // ProductHandler handles product-related HTTP requests
 type ProductHandler struct {
-	repo     repository.ProductRepository
-	producer kafka.ProducerInterface
+	repo          repository.ProductRepository
+	producer      kafka.ProducerInterface
+	trendHalfLife time.Duration
+	leaderboard   *leaderboard.Leaderboard
+	syncTimeout   time.Duration
+	// searchPopularityWeight is added to a search result's score per natural
+	// log of its lifetime views
+	searchPopularityWeight float64
+}
+
+// ProductHandlerOption configures optional ProductHandler behaviour
+type ProductHandlerOption func(*ProductHandler)
+
+// WithTrendHalfLife sets the half-life trending scores are decayed with.
+// It must match the half-life the consumer maintains the scores with.
+func WithTrendHalfLife(halfLife time.Duration) ProductHandlerOption {
+	return func(h *ProductHandler) {
+		h.trendHalfLife = halfLife
+	}
+}
+
+// WithLeaderboard serves lifetime top N requests from the in-memory leaderboard
+// whenever it is warm
+func WithLeaderboard(lb *leaderboard.Leaderboard) ProductHandlerOption {
+	return func(h *ProductHandler) {
+		h.leaderboard = lb
+	}
+}
+
+// WithSyncDeliveryTimeout sets how long a view recorded with delivery=sync
+// waits for the bus to acknowledge it
+func WithSyncDeliveryTimeout(timeout time.Duration) ProductHandlerOption {
+	return func(h *ProductHandler) {
+		h.syncTimeout = timeout
+	}
+}
+
+// WithSearchPopularityWeight sets how much a product's views weigh in its
+// search ranking against text relevance; zero ranks by relevance alone
+func WithSearchPopularityWeight(weight float64) ProductHandlerOption {
+	return func(h *ProductHandler) {
+		h.searchPopularityWeight = weight
+	}
 }
 
 // NewProductHandler creates a new ProductHandler
-func NewProductHandler(repo repository.ProductRepository, producer kafka.ProducerInterface) *ProductHandler {
-	return &ProductHandler{
-		repo:     repo,
-		producer: producer,
+func NewProductHandler(repo repository.ProductRepository, producer kafka.ProducerInterface, opts ...ProductHandlerOption) *ProductHandler {
+	h := &ProductHandler{
+		repo:          repo,
+		producer:      producer,
+		trendHalfLife: defaultTrendHalfLife,
+		syncTimeout:   defaultSyncDeliveryTimeout,
+
+		searchPopularityWeight: defaultSearchPopularityWeight,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 // ViewProduct handles the request to view a product
 // @Summary Record a product view
-// @Description Records a view for a specific product by ID
+// @Description Records a view for a specific product by ID. By default the view is accepted once it is queued for delivery; with delivery=sync the response waits until the event bus acknowledges it and reports where it was stored.
 // @Tags products
 // @Accept json
 // @Produce json
 // @Param request body ViewProductRequest true "Product view request"
+// @Param delivery query string false "Delivery mode: async (default) or sync"
+// @Success 200 {object} ViewDeliveryResponse
 // @Success 202 {object} map[string]interface{}
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Router /api/v1/products/view [post]
 func (h *ProductHandler) ViewProduct(c *gin.Context) {
 	var req ViewProductRequest
@@ -42,26 +146,226 @@ func (h *ProductHandler) ViewProduct(c *gin.Context) {
 		return
 	}
 
+	delivery := c.DefaultQuery("delivery", deliveryAsync)
+	if delivery != deliveryAsync && delivery != deliverySync {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid delivery mode, must be async or sync"})
+		return
+	}
+
+	event := kafka.NewViewEvent(req.ProductID)
+	event.ViewContext = toViewContext(req.ViewContextRequest)
+	if event.Referrer == "" {
+		event.Referrer = c.Request.Referer()
+	}
+
+	if delivery == deliverySync {
+		h.viewProductSync(c, event)
+		return
+	}
+
 	// Send view event to Kafka
-	if err := h.producer.SendViewEvent(c.Request.Context(), req.ProductID); err != nil {
+	if err := h.producer.SendViewEvent(eventContext(c), event); err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to record view"})
 		return
 	}
 
 	c.JSON(http.StatusAccepted, gin.H{
-		"status":  "accepted",
-		"message": "View recorded successfully",
+		"status":   "accepted",
+		"message":  "View recorded successfully",
+		"event_id": event.EventID,
+	})
+}
+
+// viewProductSync sends a view event and responds once the bus acknowledges it
+func (h *ProductHandler) viewProductSync(c *gin.Context, event kafka.ViewEvent) {
+	timeout := h.syncTimeout
+	if timeout <= 0 {
+		timeout = defaultSyncDeliveryTimeout
+	}
+	ctx, cancel := context.WithTimeout(eventContext(c), timeout)
+	defer cancel()
+
+	delivery, err := h.producer.SendViewEventSync(ctx, event)
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, ErrorResponse{Error: "Timed out waiting for the view to be delivered"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to deliver view event %s: %v", event.EventID, err)
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Failed to deliver view"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ViewDeliveryResponse{
+		Status:    "delivered",
+		Message:   "View delivered",
+		EventID:   event.EventID,
+		Topic:     delivery.Topic,
+		Partition: delivery.Partition,
+		Offset:    delivery.Offset,
 	})
 }
 
+// eventContext returns the request context carrying the caller's trace
+// context, so that produced events join the caller's trace
+func eventContext(c *gin.Context) context.Context {
+	return kafka.ContextWithTraceParent(c.Request.Context(), c.GetHeader("traceparent"))
+}
+
+// toViewContext maps the optional request context onto the Kafka event context
+func toViewContext(r ViewContextRequest) kafka.ViewContext {
+	vc := kafka.ViewContext{
+		UserID:     r.UserID,
+		SessionID:  r.SessionID,
+		Source:     r.Source,
+		DeviceType: r.DeviceType,
+		Referrer:   r.Referrer,
+	}
+	if r.UTM != nil {
+		vc.UTM = &kafka.UTMParams{
+			Source:   r.UTM.Source,
+			Medium:   r.UTM.Medium,
+			Campaign: r.UTM.Campaign,
+			Term:     r.UTM.Term,
+			Content:  r.UTM.Content,
+		}
+	}
+	return vc
+}
+
+// BatchViewProducts handles the request to record several product views at once
+// @Summary Record a batch of product views
+// @Description Records up to 500 views in one call, validating each entry independently
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param request body BatchViewRequest true "Batch view request"
+// @Success 202 {object} BatchViewResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} BatchViewResponse
+// @Failure 500 {object} BatchViewResponse
+// @Router /api/v1/products/views:batch [post]
+func (h *ProductHandler) BatchViewProducts(c *gin.Context) {
+	// Gin cannot escape ':' in routes, so the ":batch" suffix arrives as a path parameter
+	if action, ok := c.Params.Get("batch"); ok && action != ":batch" {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Not found"})
+		return
+	}
+
+	var req BatchViewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	now := time.Now()
+	results := make([]BatchViewResult, len(req.Events))
+	events := make([]kafka.ViewEvent, 0, len(req.Events))
+	indexes := make([]int, 0, len(req.Events))
+
+	for i, raw := range req.Events {
+		results[i] = BatchViewResult{Index: i, Status: batchStatusRejected}
+
+		var item BatchViewItem
+		if err := json.Unmarshal(raw, &item); err != nil {
+			results[i].Error = "invalid event"
+			continue
+		}
+		results[i].ProductID = item.ProductID
+
+		if msg := validateBatchViewItem(item, now); msg != "" {
+			results[i].Error = msg
+			continue
+		}
+		if err := binding.Validator.ValidateStruct(&item); err != nil {
+			results[i].Error = "invalid view context"
+			continue
+		}
+
+		event := kafka.NewViewEvent(item.ProductID)
+		event.SetTime(time.Unix(item.Timestamp, 0))
+		event.ViewContext = toViewContext(item.ViewContextRequest)
+
+		events = append(events, event)
+		indexes = append(indexes, i)
+	}
+
+	failed := 0
+	if len(events) > 0 {
+		errs := h.producer.SendViewEvents(eventContext(c), events)
+		for j, i := range indexes {
+			if errs[j] != nil {
+				results[i].Error = "failed to record view"
+				failed++
+				continue
+			}
+			results[i].Status = batchStatusAccepted
+			results[i].EventID = events[j].EventID.String()
+		}
+	}
+
+	response := BatchViewResponse{Results: results}
+	for _, r := range results {
+		if r.Status == batchStatusAccepted {
+			response.Accepted++
+		} else {
+			response.Rejected++
+		}
+	}
+
+	// Only report failure when nothing in the batch made it through
+	status := http.StatusAccepted
+	if response.Accepted == 0 {
+		status = http.StatusUnprocessableEntity
+		if failed > 0 {
+			status = http.StatusInternalServerError
+		}
+	}
+
+	c.JSON(status, response)
+}
+
+// validateBatchViewItem returns a human readable reason when the item is invalid
+func validateBatchViewItem(item BatchViewItem, now time.Time) string {
+	if item.ProductID == uuid.Nil {
+		return "product_id is required"
+	}
+	if item.Timestamp <= 0 {
+		return "timestamp is required"
+	}
+
+	ts := time.Unix(item.Timestamp, 0)
+	if ts.After(now.Add(maxClockSkew)) {
+		return "timestamp is in the future"
+	}
+	if ts.Before(now.Add(-maxEventAge)) {
+		return "timestamp is too old"
+	}
+
+	return ""
+}
+
 // GetTopProducts returns the top N most viewed products
 // @Summary Get top N most viewed products
-// @Description Returns the most viewed products, limited by the 'limit' parameter (max 100)
+// @Description Returns the most viewed products, limited by the 'limit' parameter (max 100).
+// @Description Products are ranked by lifetime views unless a 'window' or a 'from'/'to' range is given.
+// @Description Archived products are left out unless 'include_archived' is set.
+// @Description 'category' and 'tag' rank within a category, including its subcategories, and within the products with a tag.
 // @Tags products
 // @Produce json
 // @Param limit query int false "Maximum number of products to return (1-100)" default(10)
+// @Param count query string false "Rank by raw or deduplicated views (raw, unique)" default(raw)
+// @Param window query string false "Relative time window (1h, 24h, 7d, 30d)"
+// @Param from query string false "Range start (RFC3339, inclusive)"
+// @Param to query string false "Range end (RFC3339, exclusive), defaults to now"
+// @Param include_archived query bool false "Rank archived products too (lifetime views only)" default(false)
+// @Param category query string false "Rank within a category and its subcategories, by slug (lifetime views only)"
+// @Param tag query string false "Rank within the products with a tag (lifetime views only)"
 // @Success 200 {array} ProductResponse
+// @Header 200 {string} X-Data-Source "leaderboard or database"
+// @Header 200 {string} X-As-Of "Time the ranking was last updated (RFC3339)"
 // @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
 // @Router /api/v1/products/top [get]
 func (h *ProductHandler) GetTopProducts(c *gin.Context) {
 	var req TopProductsRequest
@@ -75,22 +379,159 @@ func (h *ProductHandler) GetTopProducts(c *gin.Context) {
 		req.Limit = 10
 	}
 
-	products, err := h.repo.GetTopViewedProducts(c.Request.Context(), req.Limit)
+	from, to, windowed, err := resolveTopRange(&req, time.Now())
 	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	unique := req.Count == "unique"
+	slice := repository.ProductSlice{Category: req.Category, Tag: req.Tag}
+	if windowed {
+		if req.IncludeArchived {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "include_archived is only supported for lifetime views"})
+			return
+		}
+		if slice != (repository.ProductSlice{}) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "category and tag are only supported for lifetime views"})
+			return
+		}
+		h.getTopProductsInRange(c, from, to, req.Limit, unique)
+		return
+	}
+
+	var products []repository.Product
+	source, asOf := "database", time.Now()
+	switch {
+	case slice != (repository.ProductSlice{}):
+		products, err = h.repo.GetTopProductsInSlice(c.Request.Context(), slice, req.Limit, unique, req.IncludeArchived)
+	case req.IncludeArchived:
+		products, err = h.repo.GetTopProductsIncludingArchived(c.Request.Context(), req.Limit, unique)
+	case unique:
+		products, err = h.repo.GetTopUniqueViewedProducts(c.Request.Context(), req.Limit)
+	case h.leaderboard != nil && h.leaderboard.IsWarm():
+		products, asOf, err = h.leaderboard.Top(req.Limit)
+		source = "leaderboard"
+		// Archivals since its last warm-up can leave the leaderboard short of a page
+		if errors.Is(err, leaderboard.ErrIncomplete) {
+			products, err = h.repo.GetTopViewedProducts(c.Request.Context(), req.Limit)
+			source, asOf = "database", time.Now()
+		}
+	default:
+		products, err = h.repo.GetTopViewedProducts(c.Request.Context(), req.Limit)
+	}
+	switch {
+	case errors.Is(err, repository.ErrCategoryNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Category not found"})
+		return
+	case errors.Is(err, repository.ErrTagNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Tag not found"})
+		return
+	case err != nil:
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch top products"})
 		return
 	}
 
+	// Tell clients how fresh the ranking is
+	c.Header("X-Data-Source", source)
+	c.Header("X-As-Of", asOf.UTC().Format(time.RFC3339Nano))
+
 	// Convert repository models to API response models
 	response := make([]ProductResponse, 0, len(products))
-	for _, p := range products {
-		response = append(response, ProductResponse{
-			ID:          p.ID,
-			Name:        p.Name,
-			Description: p.Description,
-			ViewCount:   p.ViewCount,
-			CreatedAt:   p.CreatedAt.Format(time.RFC3339),
-			UpdatedAt:   p.UpdatedAt.Format(time.RFC3339),
+	for i := range products {
+		response = append(response, toProductResponse(&products[i]))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// getTopProductsInRange responds with the top products by views within [from, to)
+func (h *ProductHandler) getTopProductsInRange(c *gin.Context, from, to time.Time, limit int, unique bool) {
+	products, err := h.repo.GetTopViewedProductsInRange(c.Request.Context(), from, to, limit, unique)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch top products"})
+		return
+	}
+
+	c.Header("X-Data-Source", "database")
+	c.Header("X-As-Of", time.Now().UTC().Format(time.RFC3339Nano))
+
+	response := make([]ProductResponse, 0, len(products))
+	for i := range products {
+		p := toProductResponse(&products[i].Product)
+		p.PeriodViewCount = &products[i].Views
+		p.PeriodUniqueViewCount = &products[i].UniqueViews
+		response = append(response, p)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// resolveTopRange turns the window or from/to parameters into a time range.
+// windowed is false when the request asks for lifetime rankings.
+func resolveTopRange(req *TopProductsRequest, now time.Time) (from, to time.Time, windowed bool, err error) {
+	hasRange := !req.From.IsZero() || !req.To.IsZero()
+
+	switch {
+	case req.Window != "" && hasRange:
+		return from, to, false, errors.New("window cannot be combined with from/to")
+	case req.Window != "":
+		return now.Add(-topWindows[req.Window]), now, true, nil
+	case !hasRange:
+		return from, to, false, nil
+	case req.From.IsZero():
+		return from, to, false, errors.New("from is required when to is set")
+	}
+
+	to = req.To
+	if to.IsZero() {
+		to = now
+	}
+	if !req.From.Before(to) {
+		return from, to, false, errors.New("from must be before to")
+	}
+
+	return req.From, to, true, nil
+}
+
+// GetTrendingProducts returns the products whose views are rising fastest
+// @Summary Get trending products
+// @Description Returns products ranked by an exponentially time-decayed view score, limited by the 'limit' parameter (max 100)
+// @Tags products
+// @Produce json
+// @Param limit query int false "Maximum number of products to return (1-100)" default(10)
+// @Success 200 {array} TrendingProductResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/trending [get]
+func (h *ProductHandler) GetTrendingProducts(c *gin.Context) {
+	var req TrendingProductsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid query parameters"})
+		return
+	}
+
+	// Default to 10 if limit is not provided
+	if req.Limit == 0 {
+		req.Limit = 10
+	}
+
+	halfLife := h.trendHalfLife
+	if halfLife <= 0 {
+		halfLife = defaultTrendHalfLife
+	}
+
+	products, err := h.repo.GetTrendingProducts(c.Request.Context(), req.Limit, halfLife)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch trending products"})
+		return
+	}
+
+	response := make([]TrendingProductResponse, 0, len(products))
+	for i := range products {
+		response = append(response, TrendingProductResponse{
+			ProductResponse: toProductResponse(&products[i].Product),
+			TrendScore:      products[i].Score,
 		})
 	}
 
@@ -99,11 +540,12 @@ func (h *ProductHandler) GetTopProducts(c *gin.Context) {
 
 // GetProduct handles the request to get a product by ID
 // @Summary Get a product by ID
-// @Description Returns the product with the specified ID
+// @Description Returns the product with the specified ID, including archived products
 // @Tags products
 // @Produce json
 // @Param id path string true "Product ID"
 // @Success 200 {object} ProductResponse
+// @Header 200 {string} ETag "Product version, for If-Match"
 // @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /api/v1/products/{id} [get]
@@ -124,14 +566,275 @@ func (h *ProductHandler) GetProduct(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, ProductResponse{
-		ID:          product.ID,
-		Name:        product.Name,
-		Description: product.Description,
-		ViewCount:   product.ViewCount,
-		CreatedAt:   product.CreatedAt.Format(time.RFC3339),
-		UpdatedAt:   product.UpdatedAt.Format(time.RFC3339),
-	})
+	c.Header("ETag", productETag(product.Version))
+	c.JSON(http.StatusOK, toProductResponse(product))
+}
+
+// GetProductViews returns a product's view counts over time
+// @Summary Get a product's view time series
+// @Description Returns zero-filled view counts per hour, day or week, bucketed in the requested time zone
+// @Tags products
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param from query string false "Series start (RFC3339), defaults to 7 days before to"
+// @Param to query string false "Series end (RFC3339, exclusive), defaults to now"
+// @Param interval query string false "Bucket width (hour, day, week)" default(day)
+// @Param tz query string false "IANA time zone used for bucketing, e.g. Asia/Kolkata" default(UTC)
+// @Success 200 {object} ViewSeriesResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/{id}/views [get]
+func (h *ProductHandler) GetProductViews(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid product ID"})
+		return
+	}
+
+	var req ViewSeriesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid query parameters"})
+		return
+	}
+
+	// "Local" would resolve to the server's zone, which Postgres does not know
+	loc, err := time.LoadLocation(req.TZ)
+	if err != nil || req.TZ == "Local" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid time zone"})
+		return
+	}
+
+	interval := repository.SeriesInterval(req.Interval)
+	if req.To.IsZero() {
+		req.To = time.Now()
+	}
+	if req.From.IsZero() {
+		req.From = req.To.Add(-defaultSeriesRange)
+	}
+	if !req.From.Before(req.To) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "from must be before to"})
+		return
+	}
+
+	starts := seriesStarts(req.From, req.To, interval, loc)
+	if len(starts) > maxSeriesPoints {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Too many points, use a shorter range or a wider interval"})
+		return
+	}
+	from := starts[0]
+	to := repository.NextInterval(starts[len(starts)-1], interval, loc)
+
+	if _, err := h.repo.GetProduct(c.Request.Context(), id); err != nil {
+		if err.Error() == "product not found" {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch product"})
+		return
+	}
+
+	points, err := h.repo.GetProductViewSeries(c.Request.Context(), id, from, to, interval, loc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch product views"})
+		return
+	}
+
+	// Zero-fill the intervals without views
+	byStart := make(map[int64]repository.ViewSeriesPoint, len(points))
+	for _, p := range points {
+		byStart[p.Start.Unix()] = p
+	}
+
+	response := ViewSeriesResponse{
+		ProductID: id,
+		Interval:  req.Interval,
+		TZ:        loc.String(),
+		From:      from.Format(time.RFC3339),
+		To:        to.Format(time.RFC3339),
+		Points:    make([]ViewSeriesPoint, 0, len(starts)),
+	}
+	for _, start := range starts {
+		p := byStart[start.Unix()]
+		response.Points = append(response.Points, ViewSeriesPoint{
+			Start:       start.Format(time.RFC3339),
+			Views:       p.Views,
+			UniqueViews: p.UniqueViews,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// seriesStarts returns the local start of every interval overlapping [from, to).
+// It stops early once more than maxSeriesPoints intervals have been generated.
+func seriesStarts(from, to time.Time, interval repository.SeriesInterval, loc *time.Location) []time.Time {
+	var starts []time.Time
+	for t := repository.TruncateToInterval(from, interval, loc); t.Before(to); t = repository.NextInterval(t, interval, loc) {
+		starts = append(starts, t)
+		if len(starts) > maxSeriesPoints {
+			break
+		}
+	}
+	return starts
+}
+
+// ListProducts returns a page of the product catalog
+// @Summary List products
+// @Description Returns products sorted by name, creation time or view count, ties broken by ID, optionally filtered by creation time and view count.
+// @Description Pass next_cursor as 'cursor' with the same parameters to get the following page; pages never repeat or skip products that keep their sort key.
+// @Description Sorting or filtering by view count uses the compacted view counts, which can trail the lifetime counts by the most recent views. Such pages return the compacted counts and set approximate_view_counts.
+// @Tags products
+// @Produce json
+// @Param limit query int false "Maximum number of products to return (1-100)" default(20)
+// @Param sort query string false "Sort order (name, created_at, view_count)" default(created_at)
+// @Param order query string false "asc or desc; defaults to asc for name and desc otherwise"
+// @Param created_from query string false "Created at or after (RFC3339)"
+// @Param created_to query string false "Created before (RFC3339)"
+// @Param min_views query int false "Minimum compacted view count"
+// @Param max_views query int false "Maximum compacted view count"
+// @Param include_archived query bool false "List archived products too" default(false)
+// @Param cursor query string false "next_cursor of the previous page"
+// @Success 200 {object} ProductListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products [get]
+func (h *ProductHandler) ListProducts(c *gin.Context) {
+	var req ListProductsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid query parameters"})
+		return
+	}
+
+	if !req.CreatedFrom.IsZero() && !req.CreatedTo.IsZero() && !req.CreatedFrom.Before(req.CreatedTo) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "created_from must be before created_to"})
+		return
+	}
+	if req.MinViews != nil && req.MaxViews != nil && *req.MinViews > *req.MaxViews {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "min_views must not exceed max_views"})
+		return
+	}
+
+	query := repository.ProductListQuery{
+		Sort:            repository.ProductSort(req.Sort),
+		Descending:      req.Order == "desc" || (req.Order == "" && req.Sort != string(repository.SortByName)),
+		CreatedFrom:     req.CreatedFrom,
+		CreatedTo:       req.CreatedTo,
+		MinViews:        req.MinViews,
+		MaxViews:        req.MaxViews,
+		IncludeArchived: req.IncludeArchived,
+		Limit:           req.Limit,
+	}
+	if req.Cursor != "" {
+		var cursor repository.ProductCursor
+		if err := decodeCursor(req.Cursor, &cursor); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid cursor"})
+			return
+		}
+		query.After = &cursor
+	}
+
+	page, err := h.repo.ListProducts(c.Request.Context(), query)
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid cursor"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list products"})
+		return
+	}
+
+	response := ProductListResponse{
+		Products:              make([]ProductResponse, 0, len(page.Products)),
+		ApproximateViewCounts: page.ApproximateViews,
+	}
+	for i := range page.Products {
+		response.Products = append(response.Products, toProductResponse(&page.Products[i]))
+	}
+	if page.Next != nil {
+		response.NextCursor = encodeCursor(page.Next)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// encodeCursor makes a listing or search position into an opaque, URL-safe token
+func encodeCursor(cursor any) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor reverses encodeCursor
+func decodeCursor(token string, cursor any) error {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, cursor)
+}
+
+// SearchProducts handles full-text product search
+// @Summary Search products
+// @Description Searches product names and descriptions, tolerating typos in names. Results are ranked by text relevance plus a configurable weight on the log of their lifetime views, and carry the name and description fragments HTML escaped, with the matched words in <mark> tags.
+// @Description Pass next_cursor as 'cursor' with the same q to get the following page.
+// @Tags products
+// @Produce json
+// @Param q query string true "Search text: words, quoted phrases, or, -excluded words"
+// @Param limit query int false "Maximum number of results to return (1-100)" default(20)
+// @Param include_archived query bool false "Search archived products too" default(false)
+// @Param cursor query string false "next_cursor of the previous page"
+// @Success 200 {object} ProductSearchResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/search [get]
+func (h *ProductHandler) SearchProducts(c *gin.Context) {
+	var req SearchProductsRequest
+	if err := c.ShouldBindQuery(&req); err != nil || strings.TrimSpace(req.Q) == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid query parameters"})
+		return
+	}
+
+	query := repository.ProductSearchQuery{
+		Text:             req.Q,
+		PopularityWeight: h.searchPopularityWeight,
+		IncludeArchived:  req.IncludeArchived,
+		Limit:            req.Limit,
+	}
+	if req.Cursor != "" {
+		var cursor repository.ProductSearchCursor
+		if err := decodeCursor(req.Cursor, &cursor); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid cursor"})
+			return
+		}
+		query.After = &cursor
+	}
+
+	page, err := h.repo.SearchProducts(c.Request.Context(), query)
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid cursor"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to search products"})
+		return
+	}
+
+	response := ProductSearchResponse{Results: make([]ProductSearchResult, 0, len(page.Results))}
+	for i := range page.Results {
+		res := &page.Results[i]
+		response.Results = append(response.Results, ProductSearchResult{
+			ProductResponse: toProductResponse(&res.Product),
+			Relevance:       res.Relevance,
+			Score:           res.Score,
+			NameHighlight:   res.NameHighlight,
+			Snippet:         res.Snippet,
+		})
+	}
+	if page.Next != nil {
+		response.NextCursor = encodeCursor(page.Next)
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 // CreateProduct handles the request to create a new product
@@ -163,12 +866,191 @@ func (h *ProductHandler) CreateProduct(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, ProductResponse{
-		ID:          product.ID,
-		Name:        product.Name,
-		Description: product.Description,
-		ViewCount:   product.ViewCount,
-		CreatedAt:   product.CreatedAt.Format(time.RFC3339),
-		UpdatedAt:   product.UpdatedAt.Format(time.RFC3339),
-	})
+	c.JSON(http.StatusCreated, toProductResponse(product))
+}
+
+// UpdateProduct handles the request to replace a product's catalog fields
+// @Summary Update a product
+// @Description Replaces the name and description of a product. If-Match must carry the product's current ETag, or * to update whatever its version. An update that changes nothing keeps the version.
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param If-Match header string true "ETag of the product version the update is based on"
+// @Param request body UpdateProductRequest true "Product details"
+// @Success 200 {object} ProductResponse
+// @Header 200 {string} ETag "New product version"
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 412 {object} ErrorResponse
+// @Failure 428 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/{id} [put]
+func (h *ProductHandler) UpdateProduct(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid product ID"})
+		return
+	}
+	var req UpdateProductRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	h.changeProduct(c, id, repository.ProductUpdate{Name: &req.Name, Description: &req.Description})
+}
+
+// PatchProduct handles the request to change some of a product's catalog fields
+// @Summary Partially update a product
+// @Description Changes the fields present in the request and keeps the others. If-Match must carry the product's current ETag, or * to update whatever its version. A patch that changes nothing keeps the version.
+// @Tags products
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param If-Match header string true "ETag of the product version the update is based on"
+// @Param request body PatchProductRequest true "Fields to change"
+// @Success 200 {object} ProductResponse
+// @Header 200 {string} ETag "New product version"
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 412 {object} ErrorResponse
+// @Failure 428 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/{id} [patch]
+func (h *ProductHandler) PatchProduct(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid product ID"})
+		return
+	}
+	var req PatchProductRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	h.changeProduct(c, id, repository.ProductUpdate{Name: req.Name, Description: req.Description})
+}
+
+// changeProduct applies a catalog update under the version required by If-Match
+func (h *ProductHandler) changeProduct(c *gin.Context, id uuid.UUID, update repository.ProductUpdate) {
+	version, ok := requiredVersion(c)
+	if !ok {
+		return
+	}
+
+	product, err := h.repo.UpdateProduct(c.Request.Context(), id, update, version)
+	if err != nil {
+		respondProductChangeError(c, err)
+		return
+	}
+	if h.leaderboard != nil {
+		h.leaderboard.Refresh(*product)
+	}
+
+	c.Header("ETag", productETag(product.Version))
+	c.JSON(http.StatusOK, toProductResponse(product))
+}
+
+// DeleteProduct handles the request to archive a product
+// @Summary Archive a product
+// @Description Archives a product: it keeps its views and can still be fetched by ID, but is left out of the rankings and can no longer be updated. How its later views are handled depends on the consumer's archived view policy. Archiving an archived product does nothing.
+// @Tags products
+// @Param id path string true "Product ID"
+// @Param If-Match header string true "ETag of the product version the deletion is based on"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 412 {object} ErrorResponse
+// @Failure 428 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/{id} [delete]
+func (h *ProductHandler) DeleteProduct(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid product ID"})
+		return
+	}
+	version, ok := requiredVersion(c)
+	if !ok {
+		return
+	}
+
+	_, err = h.repo.ArchiveProduct(c.Request.Context(), id, version)
+	if err != nil && !errors.Is(err, repository.ErrProductArchived) {
+		respondProductChangeError(c, err)
+		return
+	}
+	if h.leaderboard != nil {
+		h.leaderboard.Remove(id)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// productETag returns the entity tag of a product version
+func productETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// requiredVersion returns the product version the request's If-Match header
+// requires, repository.AnyVersion for *, or responds and returns false when
+// the header is missing or names no product version
+func requiredVersion(c *gin.Context) (int64, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		c.JSON(http.StatusPreconditionRequired, ErrorResponse{Error: "If-Match header required"})
+		return 0, false
+	}
+	if header == "*" {
+		return repository.AnyVersion, true
+	}
+
+	// Only a single strong entity tag can match, as If-Match compares strongly
+	tag, ok := strings.CutPrefix(header, `"`)
+	if ok {
+		tag, ok = strings.CutSuffix(tag, `"`)
+	}
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if !ok || err != nil || version <= 0 {
+		c.JSON(http.StatusPreconditionFailed, ErrorResponse{Error: "Product was modified"})
+		return 0, false
+	}
+	return version, true
+}
+
+// respondProductChangeError responds to a failed update or archival of a product
+func respondProductChangeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, repository.ErrProductNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Product not found"})
+	case errors.Is(err, repository.ErrVersionMismatch):
+		c.JSON(http.StatusPreconditionFailed, ErrorResponse{Error: "Product was modified"})
+	case errors.Is(err, repository.ErrProductArchived):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Product is archived"})
+	default:
+		log.Printf("Failed to change product: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update product"})
+	}
+}
+
+// toProductResponse converts a repository product to its API representation
+func toProductResponse(p *repository.Product) ProductResponse {
+	response := ProductResponse{
+		ID:              p.ID,
+		Name:            p.Name,
+		Description:     p.Description,
+		ViewCount:       p.ViewCount,
+		UniqueViewCount: p.UniqueViewCount,
+		Version:         p.Version,
+		CreatedAt:       p.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:       p.UpdatedAt.Format(time.RFC3339),
+	}
+	if p.ArchivedAt != nil {
+		response.ArchivedAt = p.ArchivedAt.Format(time.RFC3339)
+	}
+	return response
 }
@@ -1,28 +1,330 @@
 package handlers
 
-import "github.com/google/uuid"
+import (
+    "encoding/json"
+    "time"
+
+    "github.com/google/uuid"
+)
 
 // ErrorResponse represents an error response
 type ErrorResponse struct {
     Error string `json:"error"`
 }
 
+// UTMRequest holds the campaign parameters of a view
+type UTMRequest struct {
+    Source   string `json:"source,omitempty" binding:"max=255"`
+    Medium   string `json:"medium,omitempty" binding:"max=255"`
+    Campaign string `json:"campaign,omitempty" binding:"max=255"`
+    Term     string `json:"term,omitempty" binding:"max=255"`
+    Content  string `json:"content,omitempty" binding:"max=255"`
+}
+
+// ViewContextRequest holds the optional context describing a view
+type ViewContextRequest struct {
+    UserID     string      `json:"user_id,omitempty" binding:"max=255"`
+    SessionID  string      `json:"session_id,omitempty" binding:"max=255"`
+    Source     string      `json:"source,omitempty" binding:"omitempty,oneof=search home pdp recommendation"`
+    DeviceType string      `json:"device_type,omitempty" binding:"omitempty,oneof=mobile tablet desktop other"`
+    Referrer   string      `json:"referrer,omitempty" binding:"max=2048"`
+    UTM        *UTMRequest `json:"utm,omitempty"`
+}
+
 // ViewProductRequest represents a request to view a product
 type ViewProductRequest struct {
     ProductID uuid.UUID `json:"product_id" binding:"required"`
+    ViewContextRequest
+}
+
+// ViewDeliveryResponse reports where a synchronously delivered view was stored
+type ViewDeliveryResponse struct {
+    Status    string    `json:"status"`
+    Message   string    `json:"message"`
+    EventID   uuid.UUID `json:"event_id"`
+    Topic     string    `json:"topic"`
+    Partition int32     `json:"partition"`
+    Offset    int64     `json:"offset"`
 }
 
 // ProductResponse represents a product in the API response
 type ProductResponse struct {
-    ID          uuid.UUID `json:"id"`
-    Name        string    `json:"name"`
-    Description string    `json:"description,omitempty"`
-    ViewCount   int64     `json:"view_count"`
-    CreatedAt   string    `json:"created_at,omitempty"`
-    UpdatedAt   string    `json:"updated_at,omitempty"`
+    ID              uuid.UUID `json:"id"`
+    Name            string    `json:"name"`
+    Description     string    `json:"description,omitempty"`
+    ViewCount       int64     `json:"view_count"`
+    UniqueViewCount int64     `json:"unique_view_count"`
+    Version         int64     `json:"version,omitempty"` // also sent as the ETag header
+    ArchivedAt      string    `json:"archived_at,omitempty"`
+    CreatedAt       string    `json:"created_at,omitempty"`
+    UpdatedAt       string    `json:"updated_at,omitempty"`
+
+    // Views within the requested time range, only set for windowed top N queries
+    PeriodViewCount       *int64 `json:"period_view_count,omitempty"`
+    PeriodUniqueViewCount *int64 `json:"period_unique_view_count,omitempty"`
 }
 
 // TopProductsRequest represents a request to get top N products
 type TopProductsRequest struct {
+    Limit int    `form:"limit,default=10" binding:"min=1,max=100"`
+    Count string `form:"count" binding:"omitempty,oneof=raw unique"` // rank by raw or deduplicated views
+
+    // Rank archived products too; only supported for lifetime views
+    IncludeArchived bool `form:"include_archived"`
+
+    // Rank within a category (by slug, including its subcategories) and/or a tag; only supported for lifetime views
+    Category string `form:"category"`
+    Tag      string `form:"tag"`
+
+    // Either a relative window or an explicit RFC3339 range; both empty ranks by lifetime views
+    Window string    `form:"window" binding:"omitempty,oneof=1h 24h 7d 30d"`
+    From   time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+    To     time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+// ListProductsRequest represents a request for a page of the product catalog
+type ListProductsRequest struct {
+    Limit int    `form:"limit,default=20" binding:"min=1,max=100"`
+    Sort  string `form:"sort,default=created_at" binding:"oneof=name created_at view_count"`
+    Order string `form:"order" binding:"omitempty,oneof=asc desc"` // defaults to asc for name, desc otherwise
+
+    // Filters: creation time in [created_from, created_to) and lifetime views in [min_views, max_views]
+    CreatedFrom     time.Time `form:"created_from" time_format:"2006-01-02T15:04:05Z07:00"`
+    CreatedTo       time.Time `form:"created_to" time_format:"2006-01-02T15:04:05Z07:00"`
+    MinViews        *int64    `form:"min_views" binding:"omitempty,min=0"`
+    MaxViews        *int64    `form:"max_views" binding:"omitempty,min=0"`
+    IncludeArchived bool      `form:"include_archived"`
+
+    // Opaque cursor from the previous page's next_cursor; the other parameters must not change
+    Cursor string `form:"cursor"`
+}
+
+// ProductListResponse is a page of the product catalog
+type ProductListResponse struct {
+    Products   []ProductResponse `json:"products"`
+    NextCursor string            `json:"next_cursor,omitempty"` // absent on the last page
+    // Set when sorted or filtered by view count: the view counts are then the
+    // compacted counts the page was ordered and filtered by, without the most
+    // recent views
+    ApproximateViewCounts bool `json:"approximate_view_counts"`
+}
+
+// SearchProductsRequest represents a full-text product search
+type SearchProductsRequest struct {
+    Q               string `form:"q" binding:"required,max=200"`
+    Limit           int    `form:"limit,default=20" binding:"min=1,max=100"`
+    IncludeArchived bool   `form:"include_archived"`
+    Cursor          string `form:"cursor"` // next_cursor of the previous page, for the same q
+}
+
+// ProductSearchResult represents a product matching a search
+type ProductSearchResult struct {
+    ProductResponse
+    Relevance float64 `json:"relevance"` // text relevance alone
+    Score     float64 `json:"score"`     // relevance plus popularity, results are ordered by it
+
+    // HTML escaped text with the matched words wrapped in <mark> tags
+    NameHighlight string `json:"name_highlight"`
+    Snippet       string `json:"snippet,omitempty"`
+}
+
+// ProductSearchResponse is a page of search results
+type ProductSearchResponse struct {
+    Results    []ProductSearchResult `json:"results"`
+    NextCursor string                `json:"next_cursor,omitempty"` // absent on the last page
+}
+
+// UpdateProductRequest replaces the catalog fields of a product
+type UpdateProductRequest struct {
+    Name        string `json:"name" binding:"required,max=255"`
+    Description string `json:"description"`
+}
+
+// PatchProductRequest changes some catalog fields of a product; omitted fields are kept
+type PatchProductRequest struct {
+    Name        *string `json:"name,omitempty" binding:"omitempty,min=1,max=255"`
+    Description *string `json:"description,omitempty"`
+}
+
+// TrendingProductsRequest represents a request to get the top N trending products
+type TrendingProductsRequest struct {
     Limit int `form:"limit,default=10" binding:"min=1,max=100"`
 }
+
+// TrendingProductResponse represents a trending product in the API response
+type TrendingProductResponse struct {
+    ProductResponse
+    TrendScore float64 `json:"trend_score"` // time-decayed view score
+}
+
+// ViewSeriesRequest represents a request for a product's view time series
+type ViewSeriesRequest struct {
+    From     time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+    To       time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+    Interval string    `form:"interval,default=day" binding:"oneof=hour day week"`
+    TZ       string    `form:"tz,default=UTC"`
+}
+
+// ViewSeriesPoint represents the views of one interval in a time series
+type ViewSeriesPoint struct {
+    Start       string `json:"start"`
+    Views       int64  `json:"views"`
+    UniqueViews int64  `json:"unique_views"`
+}
+
+// ViewSeriesResponse represents a product's view time series
+type ViewSeriesResponse struct {
+    ProductID uuid.UUID         `json:"product_id"`
+    Interval  string            `json:"interval"`
+    TZ        string            `json:"tz"`
+    From      string            `json:"from"`
+    To        string            `json:"to"`
+    Points    []ViewSeriesPoint `json:"points"`
+}
+
+// BatchViewRequest represents a request to record several product views at once.
+// Events are kept raw so that each one can be validated independently.
+type BatchViewRequest struct {
+    Events []json.RawMessage `json:"events" binding:"required,min=1,max=500"`
+}
+
+// BatchViewItem represents a single view event inside a batch request
+type BatchViewItem struct {
+    ProductID uuid.UUID `json:"product_id"`
+    Timestamp int64     `json:"timestamp"` // client-side Unix timestamp in seconds
+    ViewContextRequest
+}
+
+// BatchViewResult represents the outcome of a single batch item
+type BatchViewResult struct {
+    Index     int       `json:"index"`
+    ProductID uuid.UUID `json:"product_id"`
+    EventID   string    `json:"event_id,omitempty"`
+    Status    string    `json:"status"`
+    Error     string    `json:"error,omitempty"`
+}
+
+// BatchViewResponse represents the response to a batch view request
+type BatchViewResponse struct {
+    Accepted int               `json:"accepted"`
+    Rejected int               `json:"rejected"`
+    Results  []BatchViewResult `json:"results"`
+}
+
+// ReconcileRequest starts a reconciliation of the view counts. Without
+// apply_run_id it is a dry run; with one it repairs that dry run's discrepancies.
+type ReconcileRequest struct {
+    Source     string     `json:"source" binding:"omitempty,oneof=buckets events"`
+    ApplyRunID *uuid.UUID `json:"apply_run_id,omitempty"`
+}
+
+// ReconciliationsRequest pages through reconciliation runs or a run's discrepancies
+type ReconciliationsRequest struct {
+    Limit int `form:"limit,default=20" binding:"min=1,max=1000"`
+}
+
+// CountDiscrepancyResponse is a product whose stored counts differ from its expected ones
+type CountDiscrepancyResponse struct {
+    ProductID               uuid.UUID `json:"product_id"`
+    ViewCount               int64     `json:"view_count"`
+    ExpectedViewCount       int64     `json:"expected_view_count"`
+    UniqueViewCount         int64     `json:"unique_view_count"`
+    ExpectedUniqueViewCount int64     `json:"expected_unique_view_count"`
+}
+
+// ReconciliationResponse is the audit record of a reconciliation run
+type ReconciliationResponse struct {
+    ID              uuid.UUID                  `json:"id"`
+    Source          string                     `json:"source"`
+    DryRun          bool                       `json:"dry_run"`
+    AppliedRunID    *uuid.UUID                 `json:"applied_run_id,omitempty"`
+    TriggeredBy     string                     `json:"triggered_by"`
+    ProductsChecked int64                      `json:"products_checked"`
+    Discrepancies   int64                      `json:"discrepancies"`
+    ViewDrift       int64                      `json:"view_drift"`
+    UniqueViewDrift int64                      `json:"unique_view_drift"`
+    Repaired        int64                      `json:"repaired"`
+    StartedAt       string                     `json:"started_at"`
+    FinishedAt      string                     `json:"finished_at"`
+    Products        []CountDiscrepancyResponse `json:"products,omitempty"`
+}
+
+// CategoryRequest creates or replaces a category
+type CategoryRequest struct {
+    Slug     string     `json:"slug" binding:"required,max=100"`
+    Name     string     `json:"name" binding:"required,max=255"`
+    ParentID *uuid.UUID `json:"parent_id,omitempty"` // omitted for top-level categories
+}
+
+// CategoryResponse represents a category in the API response
+type CategoryResponse struct {
+    ID        uuid.UUID  `json:"id"`
+    Slug      string     `json:"slug"`
+    Name      string     `json:"name"`
+    ParentID  *uuid.UUID `json:"parent_id,omitempty"`
+    CreatedAt string     `json:"created_at"`
+    UpdatedAt string     `json:"updated_at"`
+}
+
+// TagRequest creates or renames a tag
+type TagRequest struct {
+    Name string `json:"name" binding:"required,max=100"`
+}
+
+// TagResponse represents a tag in the API response
+type TagResponse struct {
+    ID        uuid.UUID `json:"id"`
+    Name      string    `json:"name"`
+    CreatedAt string    `json:"created_at"`
+}
+
+// ProductCategoriesRequest replaces the categories of a product
+type ProductCategoriesRequest struct {
+    CategoryIDs []uuid.UUID `json:"category_ids" binding:"max=50"`
+}
+
+// ProductTagsRequest replaces the tags of a product; unknown tags are created
+type ProductTagsRequest struct {
+    Tags []string `json:"tags" binding:"max=50,dive,max=100"`
+}
+
+// ProductRankRequest represents a request for a product's rank
+type ProductRankRequest struct {
+    Count     string `form:"count" binding:"omitempty,oneof=raw unique"` // rank by raw or deduplicated views
+    Neighbors int    `form:"neighbors,default=1" binding:"min=0,max=10"` // products to return on each side
+}
+
+// RankedProductResponse represents a product and its rank
+type RankedProductResponse struct {
+    Rank int64 `json:"rank"`
+    ProductResponse
+}
+
+// ProductRankResponse represents a product's position in the ranking
+type ProductRankResponse struct {
+    RankedProductResponse
+    Approximate    bool    `json:"approximate"`     // rank estimated, for products beyond the snapshot's depth
+    Percentile     float64 `json:"percentile"`      // share of ranked products at or below this one, 100 for the first
+    RankedProducts int64   `json:"ranked_products"` // number of products in the ranking, as of the latest snapshot
+
+    // The products ranked just before and after it, both in rank order
+    Above []RankedProductResponse `json:"above"`
+    Below []RankedProductResponse `json:"below"`
+}
+
+// LeaderboardRequest represents a request for a page of the top of the ranking
+type LeaderboardRequest struct {
+    Limit  int    `form:"limit,default=20" binding:"min=1,max=100"`
+    Count  string `form:"count" binding:"omitempty,oneof=raw unique"` // rank by raw or deduplicated views
+    Offset int64  `form:"offset" binding:"min=0"`                     // products to skip; not combined with cursor
+    Cursor string `form:"cursor"`                                     // next_cursor of the previous page, for the same count
+}
+
+// LeaderboardResponse is a page of the top of the ranking
+type LeaderboardResponse struct {
+    Products       []RankedProductResponse `json:"products"`
+    RankedProducts int64                   `json:"ranked_products"` // number of products in the ranking
+    Depth          int64                   `json:"depth"`           // number of top products that can be paged through
+    AsOf           string                  `json:"as_of"`
+    NextCursor     string                  `json:"next_cursor,omitempty"` // absent on the last page
+}
@@ -9,11 +9,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/tushar-kalsi/product-views/internal/kafka"
+	"github.com/tushar-kalsi/product-views/internal/leaderboard"
 	"github.com/tushar-kalsi/product-views/internal/repository"
 )
 
@@ -27,11 +30,66 @@ func (m *MockProductRepository) IncrementViewCount(ctx context.Context, productI
 	return args.Error(0)
 }
 
+func (m *MockProductRepository) RecordView(ctx context.Context, v *repository.ViewEvent, opts repository.RecordOptions) (repository.RecordResult, error) {
+	args := m.Called(ctx, v, opts)
+	return args.Get(0).(repository.RecordResult), args.Error(1)
+}
+
+func (m *MockProductRepository) RecordViews(ctx context.Context, events []*repository.ViewEvent, opts repository.RecordOptions) (repository.BatchResult, error) {
+	args := m.Called(ctx, events, opts)
+	return args.Get(0).(repository.BatchResult), args.Error(1)
+}
+
+func (m *MockProductRepository) PurgeViewDedup(ctx context.Context, before time.Time) (int64, error) {
+	args := m.Called(ctx, before)
+	return args.Get(0).(int64), args.Error(1)
+}
+
 func (m *MockProductRepository) GetTopViewedProducts(ctx context.Context, limit int) ([]repository.Product, error) {
 	args := m.Called(ctx, limit)
 	return args.Get(0).([]repository.Product), args.Error(1)
 }
 
+func (m *MockProductRepository) GetTopUniqueViewedProducts(ctx context.Context, limit int) ([]repository.Product, error) {
+	args := m.Called(ctx, limit)
+	return args.Get(0).([]repository.Product), args.Error(1)
+}
+
+func (m *MockProductRepository) GetTopProductsIncludingArchived(ctx context.Context, limit int, unique bool) ([]repository.Product, error) {
+	args := m.Called(ctx, limit, unique)
+	return args.Get(0).([]repository.Product), args.Error(1)
+}
+
+func (m *MockProductRepository) ListProducts(ctx context.Context, q repository.ProductListQuery) (repository.ProductPage, error) {
+	args := m.Called(ctx, q)
+	return args.Get(0).(repository.ProductPage), args.Error(1)
+}
+
+func (m *MockProductRepository) SearchProducts(ctx context.Context, q repository.ProductSearchQuery) (repository.ProductSearchPage, error) {
+	args := m.Called(ctx, q)
+	return args.Get(0).(repository.ProductSearchPage), args.Error(1)
+}
+
+func (m *MockProductRepository) GetTopProductsInSlice(ctx context.Context, slice repository.ProductSlice, limit int, unique, includeArchived bool) ([]repository.Product, error) {
+	args := m.Called(ctx, slice, limit, unique, includeArchived)
+	return args.Get(0).([]repository.Product), args.Error(1)
+}
+
+func (m *MockProductRepository) GetTopViewedProductsInRange(ctx context.Context, from, to time.Time, limit int, unique bool) ([]repository.ProductPeriodViews, error) {
+	args := m.Called(ctx, from, to, limit, unique)
+	return args.Get(0).([]repository.ProductPeriodViews), args.Error(1)
+}
+
+func (m *MockProductRepository) GetTrendingProducts(ctx context.Context, limit int, halfLife time.Duration) ([]repository.TrendingProduct, error) {
+	args := m.Called(ctx, limit, halfLife)
+	return args.Get(0).([]repository.TrendingProduct), args.Error(1)
+}
+
+func (m *MockProductRepository) GetProductViewSeries(ctx context.Context, productID uuid.UUID, from, to time.Time, interval repository.SeriesInterval, loc *time.Location) ([]repository.ViewSeriesPoint, error) {
+	args := m.Called(ctx, productID, from, to, interval, loc)
+	return args.Get(0).([]repository.ViewSeriesPoint), args.Error(1)
+}
+
 func (m *MockProductRepository) GetProduct(ctx context.Context, id uuid.UUID) (*repository.Product, error) {
 	args := m.Called(ctx, id)
 	if args.Get(0) == nil {
@@ -45,16 +103,49 @@ func (m *MockProductRepository) CreateProduct(ctx context.Context, p *repository
 	return args.Error(0)
 }
 
+func (m *MockProductRepository) UpdateProduct(ctx context.Context, id uuid.UUID, update repository.ProductUpdate, version int64) (*repository.Product, error) {
+	args := m.Called(ctx, id, update, version)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*repository.Product), args.Error(1)
+}
+
+func (m *MockProductRepository) ArchiveProduct(ctx context.Context, id uuid.UUID, version int64) (*repository.Product, error) {
+	args := m.Called(ctx, id, version)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*repository.Product), args.Error(1)
+}
+
 // MockKafkaProducer is a mock implementation of Kafka Producer
 type MockKafkaProducer struct {
 	mock.Mock
 }
 
-func (m *MockKafkaProducer) SendViewEvent(ctx context.Context, productID uuid.UUID) error {
-	args := m.Called(ctx, productID)
+func (m *MockKafkaProducer) SendViewEvent(ctx context.Context, event kafka.ViewEvent) error {
+	args := m.Called(ctx, event)
 	return args.Error(0)
 }
 
+// viewEventFor matches a view event for the given product
+func viewEventFor(productID uuid.UUID) interface{} {
+	return mock.MatchedBy(func(e kafka.ViewEvent) bool {
+		return e.ProductID == productID && e.EventID != uuid.Nil && e.TimestampMs > 0
+	})
+}
+
+func (m *MockKafkaProducer) SendViewEventSync(ctx context.Context, event kafka.ViewEvent) (kafka.Delivery, error) {
+	args := m.Called(ctx, event)
+	return args.Get(0).(kafka.Delivery), args.Error(1)
+}
+
+func (m *MockKafkaProducer) SendViewEvents(ctx context.Context, events []kafka.ViewEvent) []error {
+	args := m.Called(ctx, events)
+	return args.Get(0).([]error)
+}
+
 func (m *MockKafkaProducer) Close() {
 	m.Called()
 }
@@ -71,7 +162,7 @@ func TestViewProduct(t *testing.T) {
 		}
 
 		productID := uuid.New()
-		mockProducer.On("SendViewEvent", mock.Anything, productID).Return(nil)
+		mockProducer.On("SendViewEvent", mock.Anything, viewEventFor(productID)).Return(nil)
 
 		router := gin.New()
 		router.POST("/view", handler.ViewProduct)
@@ -95,6 +186,67 @@ func TestViewProduct(t *testing.T) {
 		mockProducer.AssertExpectations(t)
 	})
 
+	t.Run("With view context", func(t *testing.T) {
+		mockProducer := new(MockKafkaProducer)
+		handler := &ProductHandler{producer: mockProducer}
+
+		productID := uuid.New()
+		mockProducer.On("SendViewEvent", mock.Anything, mock.MatchedBy(func(e kafka.ViewEvent) bool {
+			return e.ProductID == productID &&
+				e.UserID == "user-42" &&
+				e.SessionID == "session-1" &&
+				e.Source == kafka.SourceRecommendation &&
+				e.DeviceType == kafka.DeviceMobile &&
+				e.Referrer == "https://example.com/home" &&
+				e.UTM != nil && e.UTM.Campaign == "diwali"
+		})).Return(nil)
+
+		router := gin.New()
+		router.POST("/view", handler.ViewProduct)
+
+		body := []byte(fmt.Sprintf(`{
+			"product_id": %q,
+			"user_id": "user-42",
+			"session_id": "session-1",
+			"source": "recommendation",
+			"device_type": "mobile",
+			"utm": {"source": "newsletter", "campaign": "diwali"}
+		}`, productID))
+
+		req := httptest.NewRequest("POST", "/view", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Referer", "https://example.com/home")
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		var response map[string]string
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, response["event_id"])
+
+		mockProducer.AssertExpectations(t)
+	})
+
+	t.Run("Invalid source", func(t *testing.T) {
+		handler := &ProductHandler{}
+
+		router := gin.New()
+		router.POST("/view", handler.ViewProduct)
+
+		body := []byte(fmt.Sprintf(`{"product_id": %q, "source": "billboard"}`, uuid.New()))
+
+		req := httptest.NewRequest("POST", "/view", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
 	t.Run("Invalid Product ID", func(t *testing.T) {
 		handler := &ProductHandler{}
 
@@ -122,7 +274,7 @@ func TestViewProduct(t *testing.T) {
 		}
 
 		productID := uuid.New()
-		mockProducer.On("SendViewEvent", mock.Anything, productID).Return(errors.New("kafka error"))
+		mockProducer.On("SendViewEvent", mock.Anything, viewEventFor(productID)).Return(errors.New("kafka error"))
 
 		router := gin.New()
 		router.POST("/view", handler.ViewProduct)
@@ -141,9 +293,250 @@ func TestViewProduct(t *testing.T) {
 	})
 }
 
+func TestViewProductSync(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	send := func(handler *ProductHandler, productID uuid.UUID, delivery string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.POST("/view", handler.ViewProduct)
+
+		body, _ := json.Marshal(ViewProductRequest{ProductID: productID})
+		req := httptest.NewRequest("POST", "/view?delivery="+delivery, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Reports the delivery", func(t *testing.T) {
+		mockProducer := new(MockKafkaProducer)
+		handler := NewProductHandler(nil, mockProducer)
+
+		productID := uuid.New()
+		mockProducer.On("SendViewEventSync", mock.MatchedBy(func(ctx context.Context) bool {
+			_, ok := ctx.Deadline()
+			return ok
+		}), viewEventFor(productID)).Return(kafka.Delivery{Topic: "product-views", Partition: 2, Offset: 41}, nil)
+
+		w := send(handler, productID, "sync")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response ViewDeliveryResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "delivered", response.Status)
+		assert.NotEqual(t, uuid.Nil, response.EventID)
+		assert.Equal(t, int32(2), response.Partition)
+		assert.Equal(t, int64(41), response.Offset)
+		mockProducer.AssertExpectations(t)
+	})
+
+	t.Run("Delivery failure", func(t *testing.T) {
+		mockProducer := new(MockKafkaProducer)
+		handler := NewProductHandler(nil, mockProducer)
+
+		productID := uuid.New()
+		mockProducer.On("SendViewEventSync", mock.Anything, viewEventFor(productID)).Return(kafka.Delivery{}, errors.New("broker down"))
+
+		w := send(handler, productID, "sync")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		mockProducer := new(MockKafkaProducer)
+		handler := NewProductHandler(nil, mockProducer, WithSyncDeliveryTimeout(time.Millisecond))
+
+		productID := uuid.New()
+		mockProducer.On("SendViewEventSync", mock.Anything, viewEventFor(productID)).
+			Return(kafka.Delivery{}, fmt.Errorf("failed to deliver message: %w", context.DeadlineExceeded))
+
+		w := send(handler, productID, "sync")
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	})
+
+	t.Run("Invalid delivery mode", func(t *testing.T) {
+		w := send(NewProductHandler(nil, new(MockKafkaProducer)), uuid.New(), "eventually")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestBatchViewProducts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newBatchRequest := func(events ...interface{}) *http.Request {
+		body, _ := json.Marshal(map[string]interface{}{"events": events})
+		req := httptest.NewRequest("POST", "/products/views:batch", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	t.Run("Mixed valid and invalid items", func(t *testing.T) {
+		mockProducer := new(MockKafkaProducer)
+		handler := &ProductHandler{producer: mockProducer}
+
+		now := time.Now().Unix()
+		id1 := uuid.New()
+		id2 := uuid.New()
+		expected := mock.MatchedBy(func(events []kafka.ViewEvent) bool {
+			return len(events) == 2 &&
+				events[0].ProductID == id1 && events[0].Timestamp == now &&
+				events[1].ProductID == id2 && events[1].Timestamp == now-60 &&
+				events[1].Source == kafka.SourceSearch
+		})
+		mockProducer.On("SendViewEvents", mock.Anything, expected).Return([]error{nil, nil})
+
+		router := gin.New()
+		router.POST("/products/views:batch", handler.BatchViewProducts)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newBatchRequest(
+			BatchViewItem{ProductID: id1, Timestamp: now},
+			map[string]string{"product_id": "invalid-uuid"},
+			BatchViewItem{ProductID: id2, Timestamp: now - 60, ViewContextRequest: ViewContextRequest{Source: "search"}},
+			BatchViewItem{ProductID: uuid.New(), Timestamp: now + 3600},
+			BatchViewItem{ProductID: uuid.New(), Timestamp: now, ViewContextRequest: ViewContextRequest{Source: "email"}},
+		))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		var response BatchViewResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, response.Accepted)
+		assert.Equal(t, 3, response.Rejected)
+		assert.Len(t, response.Results, 5)
+		assert.Equal(t, "accepted", response.Results[0].Status)
+		assert.Equal(t, "rejected", response.Results[1].Status)
+		assert.Equal(t, "accepted", response.Results[2].Status)
+		assert.Equal(t, "rejected", response.Results[3].Status)
+		assert.Equal(t, "timestamp is in the future", response.Results[3].Error)
+		assert.Equal(t, "invalid view context", response.Results[4].Error)
+		assert.NotEmpty(t, response.Results[0].EventID)
+
+		mockProducer.AssertExpectations(t)
+	})
+
+	t.Run("Partial producer failure", func(t *testing.T) {
+		mockProducer := new(MockKafkaProducer)
+		handler := &ProductHandler{producer: mockProducer}
+
+		now := time.Now().Unix()
+		id1 := uuid.New()
+		id2 := uuid.New()
+		mockProducer.On("SendViewEvents", mock.Anything, mock.Anything).
+			Return([]error{nil, errors.New("queue full")})
+
+		router := gin.New()
+		router.POST("/products/views:batch", handler.BatchViewProducts)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newBatchRequest(
+			BatchViewItem{ProductID: id1, Timestamp: now},
+			BatchViewItem{ProductID: id2, Timestamp: now},
+		))
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		var response BatchViewResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, response.Accepted)
+		assert.Equal(t, "rejected", response.Results[1].Status)
+		assert.Equal(t, id2, response.Results[1].ProductID)
+
+		mockProducer.AssertExpectations(t)
+	})
+
+	t.Run("All items invalid", func(t *testing.T) {
+		handler := &ProductHandler{}
+
+		router := gin.New()
+		router.POST("/products/views:batch", handler.BatchViewProducts)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newBatchRequest(
+			BatchViewItem{ProductID: uuid.New()},
+			BatchViewItem{ProductID: uuid.New(), Timestamp: time.Now().Add(-30 * 24 * time.Hour).Unix()},
+		))
+
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	})
+
+	t.Run("Empty batch", func(t *testing.T) {
+		handler := &ProductHandler{}
+
+		router := gin.New()
+		router.POST("/products/views:batch", handler.BatchViewProducts)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newBatchRequest())
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
 func TestGetTopProducts(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
+	t.Run("Includes archived products on request", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := &ProductHandler{repo: mockRepo}
+
+		archivedAt := time.Now()
+		products := []repository.Product{{ID: uuid.New(), Name: "Retired", ViewCount: 500, ArchivedAt: &archivedAt}}
+		mockRepo.On("GetTopProductsIncludingArchived", mock.Anything, 10, true).Return(products, nil)
+
+		router := gin.New()
+		router.GET("/top", handler.GetTopProducts)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/top?include_archived=true&count=unique", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response []ProductResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response, 1)
+		assert.NotEmpty(t, response[0].ArchivedAt)
+
+		// Windowed rankings always leave archived products out
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/top?include_archived=true&window=24h", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Ranks within a category and tag", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := &ProductHandler{repo: mockRepo}
+
+		slice := repository.ProductSlice{Category: "electronics", Tag: "wireless"}
+		products := []repository.Product{{ID: uuid.New(), Name: "Headphones", ViewCount: 900}}
+		mockRepo.On("GetTopProductsInSlice", mock.Anything, slice, 10, false, false).Return(products, nil)
+		mockRepo.On("GetTopProductsInSlice", mock.Anything, repository.ProductSlice{Category: "toys"}, 10, false, false).
+			Return([]repository.Product(nil), repository.ErrCategoryNotFound)
+
+		router := gin.New()
+		router.GET("/top", handler.GetTopProducts)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/top?category=electronics&tag=wireless", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response []ProductResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response, 1)
+		assert.Equal(t, "Headphones", response[0].Name)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/top?category=toys", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		// Windowed rankings cannot be sliced
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/top?category=electronics&window=7d", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		mockRepo.AssertExpectations(t)
+	})
+
 	t.Run("Success with default limit", func(t *testing.T) {
 		mockRepo := new(MockProductRepository)
 		handler := &ProductHandler{repo: mockRepo}
@@ -216,27 +609,78 @@ func TestGetTopProducts(t *testing.T) {
 		mockRepo.AssertExpectations(t)
 	})
 
-	t.Run("Limit exceeds maximum", func(t *testing.T) {
+	t.Run("Served from warm leaderboard", func(t *testing.T) {
 		mockRepo := new(MockProductRepository)
-		mockProducer := new(MockKafkaProducer)
-		handler := &ProductHandler{repo: mockRepo, producer: mockProducer}
 
+		products := []repository.Product{
+			{ID: uuid.New(), Name: "Product 1", ViewCount: 1000},
+			{ID: uuid.New(), Name: "Product 2", ViewCount: 800},
+		}
+		// Only the warm-up hits the repository
+		mockRepo.On("GetTopViewedProducts", mock.Anything, leaderboard.Capacity).Return(products, nil).Once()
+
+		lb := leaderboard.New(mockRepo)
+		assert.NoError(t, lb.Warm(context.Background()))
+		lb.Update(context.Background(), products[1].ID, 1200)
+
+		handler := NewProductHandler(mockRepo, nil, WithLeaderboard(lb))
+
+		router := gin.New()
+		router.GET("/top", handler.GetTopProducts)
+
+		req := httptest.NewRequest("GET", "/top", nil)
 		w := httptest.NewRecorder()
-		c, _ := gin.CreateTestContext(w)
-		c.Request = httptest.NewRequest("GET", "/api/v1/products/top?limit=150", nil)
 
-		// No mock expectation needed as it should return 400 before calling repo
+		router.ServeHTTP(w, req)
 
-		handler.GetTopProducts(c)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "leaderboard", w.Header().Get("X-Data-Source"))
+		assert.NotEmpty(t, w.Header().Get("X-As-Of"))
 
-		assert.Equal(t, http.StatusBadRequest, w.Code)
+		var response []ProductResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Len(t, response, 2)
+		assert.Equal(t, "Product 2", response[0].Name)
+		assert.Equal(t, int64(1200), response[0].ViewCount)
+
+		mockRepo.AssertExpectations(t)
 	})
 
-	t.Run("Database error", func(t *testing.T) {
+	t.Run("Leaderboard short after archivals falls back to database", func(t *testing.T) {
 		mockRepo := new(MockProductRepository)
-		handler := &ProductHandler{repo: mockRepo}
 
-		mockRepo.On("GetTopViewedProducts", mock.Anything, 10).Return([]repository.Product{}, errors.New("db error"))
+		products := []repository.Product{
+			{ID: uuid.New(), Name: "Product 1", ViewCount: 1000},
+			{ID: uuid.New(), Name: "Product 2", ViewCount: 800},
+		}
+		mockRepo.On("GetTopViewedProducts", mock.Anything, leaderboard.Capacity).Return(products, nil).Once()
+
+		lb := leaderboard.New(mockRepo)
+		assert.NoError(t, lb.Warm(context.Background()))
+		lb.Remove(products[0].ID)
+
+		handler := NewProductHandler(mockRepo, nil, WithLeaderboard(lb))
+		mockRepo.On("GetTopViewedProducts", mock.Anything, 2).Return(products[1:], nil).Once()
+
+		router := gin.New()
+		router.GET("/top", handler.GetTopProducts)
+
+		req := httptest.NewRequest("GET", "/top?limit=2", nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "database", w.Header().Get("X-Data-Source"))
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Cold leaderboard falls back to database", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil, WithLeaderboard(leaderboard.New(mockRepo)))
+
+		mockRepo.On("GetTopViewedProducts", mock.Anything, 10).Return([]repository.Product{}, nil)
 
 		router := gin.New()
 		router.GET("/top", handler.GetTopProducts)
@@ -246,7 +690,654 @@ func TestGetTopProducts(t *testing.T) {
 
 		router.ServeHTTP(w, req)
 
-		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "database", w.Header().Get("X-Data-Source"))
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Ranked by unique views", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := &ProductHandler{repo: mockRepo}
+
+		products := []repository.Product{
+			{ID: uuid.New(), Name: "Product 1", ViewCount: 1000, UniqueViewCount: 400},
+		}
+
+		mockRepo.On("GetTopUniqueViewedProducts", mock.Anything, 5).Return(products, nil)
+
+		router := gin.New()
+		router.GET("/top", handler.GetTopProducts)
+
+		req := httptest.NewRequest("GET", "/top?limit=5&count=unique", nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response []ProductResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Len(t, response, 1)
+		assert.Equal(t, int64(400), response[0].UniqueViewCount)
+
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Relative window", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := &ProductHandler{repo: mockRepo}
+
+		products := []repository.ProductPeriodViews{
+			{Product: repository.Product{ID: uuid.New(), Name: "Hot Product", ViewCount: 10}, Views: 7, UniqueViews: 5},
+		}
+
+		mockRepo.On("GetTopViewedProductsInRange", mock.Anything,
+			mock.MatchedBy(func(from time.Time) bool { return time.Since(from) > 23*time.Hour && time.Since(from) < 25*time.Hour }),
+			mock.AnythingOfType("time.Time"), 10, false).Return(products, nil)
+
+		router := gin.New()
+		router.GET("/top", handler.GetTopProducts)
+
+		req := httptest.NewRequest("GET", "/top?window=24h", nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response []ProductResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Len(t, response, 1)
+		assert.Equal(t, int64(7), *response[0].PeriodViewCount)
+		assert.Equal(t, int64(5), *response[0].PeriodUniqueViewCount)
+
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Explicit range", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := &ProductHandler{repo: mockRepo}
+
+		from := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+		to := time.Date(2024, 6, 8, 0, 0, 0, 0, time.UTC)
+		mockRepo.On("GetTopViewedProductsInRange", mock.Anything,
+			mock.MatchedBy(from.Equal), mock.MatchedBy(to.Equal), 3, true).
+			Return([]repository.ProductPeriodViews{}, nil)
+
+		router := gin.New()
+		router.GET("/top", handler.GetTopProducts)
+
+		req := httptest.NewRequest("GET", "/top?limit=3&count=unique&from=2024-06-01T00:00:00Z&to=2024-06-08T00:00:00Z", nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Invalid ranges", func(t *testing.T) {
+		handler := &ProductHandler{}
+
+		router := gin.New()
+		router.GET("/top", handler.GetTopProducts)
+
+		for _, query := range []string{
+			"window=2h",
+			"window=24h&from=2024-06-01T00:00:00Z",
+			"to=2024-06-01T00:00:00Z",
+			"from=2024-06-08T00:00:00Z&to=2024-06-01T00:00:00Z",
+			"from=yesterday",
+		} {
+			req := httptest.NewRequest("GET", "/top?"+query, nil)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		}
+	})
+
+	t.Run("Invalid count mode", func(t *testing.T) {
+		handler := &ProductHandler{}
+
+		router := gin.New()
+		router.GET("/top", handler.GetTopProducts)
+
+		req := httptest.NewRequest("GET", "/top?count=weighted", nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Limit exceeds maximum", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		mockProducer := new(MockKafkaProducer)
+		handler := &ProductHandler{repo: mockRepo, producer: mockProducer}
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/api/v1/products/top?limit=150", nil)
+
+		// No mock expectation needed as it should return 400 before calling repo
+
+		handler.GetTopProducts(c)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Database error", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := &ProductHandler{repo: mockRepo}
+
+		mockRepo.On("GetTopViewedProducts", mock.Anything, 10).Return([]repository.Product{}, errors.New("db error"))
+
+		router := gin.New()
+		router.GET("/top", handler.GetTopProducts)
+
+		req := httptest.NewRequest("GET", "/top", nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		mockRepo.AssertExpectations(t)
+	})
+}
+
+func TestGetTrendingProducts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Run("Success", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil, WithTrendHalfLife(time.Hour))
+
+		products := []repository.TrendingProduct{
+			{Product: repository.Product{ID: uuid.New(), Name: "Rising", ViewCount: 20}, Score: 12.5},
+			{Product: repository.Product{ID: uuid.New(), Name: "Steady", ViewCount: 900}, Score: 3.25},
+		}
+		mockRepo.On("GetTrendingProducts", mock.Anything, 5, time.Hour).Return(products, nil)
+
+		router := gin.New()
+		router.GET("/trending", handler.GetTrendingProducts)
+
+		req := httptest.NewRequest("GET", "/trending?limit=5", nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response []TrendingProductResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Len(t, response, 2)
+		assert.Equal(t, "Rising", response[0].Name)
+		assert.Equal(t, 12.5, response[0].TrendScore)
+
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Limit exceeds maximum", func(t *testing.T) {
+		handler := NewProductHandler(nil, nil)
+
+		router := gin.New()
+		router.GET("/trending", handler.GetTrendingProducts)
+
+		req := httptest.NewRequest("GET", "/trending?limit=101", nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Database error", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil)
+
+		mockRepo.On("GetTrendingProducts", mock.Anything, 10, 6*time.Hour).
+			Return([]repository.TrendingProduct{}, errors.New("db error"))
+
+		router := gin.New()
+		router.GET("/trending", handler.GetTrendingProducts)
+
+		req := httptest.NewRequest("GET", "/trending", nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		mockRepo.AssertExpectations(t)
+	})
+}
+
+func TestListProducts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	list := func(handler *ProductHandler, query string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/products", handler.ListProducts)
+
+		req := httptest.NewRequest("GET", "/products"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Pages through the catalog with the cursor", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil)
+
+		minViews := int64(10)
+		next := &repository.ProductCursor{Sort: repository.SortByName, Key: "Lamp", ID: uuid.New()}
+		first := repository.ProductListQuery{Sort: repository.SortByName, MinViews: &minViews, Limit: 2}
+		mockRepo.On("ListProducts", mock.Anything, first).Return(repository.ProductPage{
+			Products:         []repository.Product{{ID: uuid.New(), Name: "Desk", ViewCount: 12}, {ID: next.ID, Name: "Lamp", ViewCount: 40}},
+			Next:             next,
+			ApproximateViews: true,
+		}, nil)
+		second := first
+		second.After = next
+		mockRepo.On("ListProducts", mock.Anything, second).Return(repository.ProductPage{
+			Products: []repository.Product{{ID: uuid.New(), Name: "Sofa", ViewCount: 15}},
+		}, nil)
+
+		w := list(handler, "?sort=name&min_views=10&limit=2")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response ProductListResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response.Products, 2)
+		assert.NotEmpty(t, response.NextCursor)
+		assert.True(t, response.ApproximateViewCounts)
+
+		w = list(handler, "?sort=name&min_views=10&limit=2&cursor="+response.NextCursor)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		response = ProductListResponse{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response.Products, 1)
+		assert.Equal(t, "Sofa", response.Products[0].Name)
+		assert.Empty(t, response.NextCursor)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Defaults to the newest products first", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil)
+
+		query := repository.ProductListQuery{Sort: repository.SortByCreatedAt, Descending: true, Limit: 20}
+		mockRepo.On("ListProducts", mock.Anything, query).Return(repository.ProductPage{}, nil)
+
+		w := list(handler, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"products":[],"approximate_view_counts":false}`, w.Body.String())
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Rejects invalid cursors", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil)
+
+		assert.Equal(t, http.StatusBadRequest, list(handler, "?cursor=not-a-cursor!").Code)
+		mockRepo.AssertNotCalled(t, "ListProducts", mock.Anything, mock.Anything)
+
+		// A cursor of another sort order is rejected by the repository
+		cursor := encodeCursor(&repository.ProductCursor{Sort: repository.SortByName, Key: "Lamp", ID: uuid.New()})
+		mockRepo.On("ListProducts", mock.Anything, mock.Anything).Return(repository.ProductPage{}, repository.ErrInvalidCursor)
+		assert.Equal(t, http.StatusBadRequest, list(handler, "?sort=view_count&cursor="+cursor).Code)
+	})
+
+	t.Run("Rejects inverted filters", func(t *testing.T) {
+		handler := NewProductHandler(nil, nil)
+
+		assert.Equal(t, http.StatusBadRequest, list(handler, "?created_from=2026-02-01T00:00:00Z&created_to=2026-01-01T00:00:00Z").Code)
+		assert.Equal(t, http.StatusBadRequest, list(handler, "?min_views=10&max_views=5").Code)
+		assert.Equal(t, http.StatusBadRequest, list(handler, "?sort=popularity").Code)
+	})
+}
+
+func TestSearchProducts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	search := func(handler *ProductHandler, query string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/products/search", handler.SearchProducts)
+
+		req := httptest.NewRequest("GET", "/products/search"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Ranks with the configured popularity weight", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil, WithSearchPopularityWeight(0.5))
+
+		next := &repository.ProductSearchCursor{Query: "desk", Score: 1.25, ID: uuid.New()}
+		query := repository.ProductSearchQuery{Text: "desk", PopularityWeight: 0.5, Limit: 1}
+		mockRepo.On("SearchProducts", mock.Anything, query).Return(repository.ProductSearchPage{
+			Results: []repository.ProductSearchResult{{
+				Product:       repository.Product{ID: next.ID, Name: "Standing Desk", ViewCount: 40},
+				Relevance:     0.6,
+				Score:         1.25,
+				NameHighlight: "Standing <mark>Desk</mark>",
+			}},
+			Next: next,
+		}, nil)
+		query.After = next
+		mockRepo.On("SearchProducts", mock.Anything, query).Return(repository.ProductSearchPage{}, nil)
+
+		w := search(handler, "?q=desk&limit=1")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response ProductSearchResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response.Results, 1)
+		assert.Equal(t, "Standing <mark>Desk</mark>", response.Results[0].NameHighlight)
+		assert.Equal(t, 1.25, response.Results[0].Score)
+		assert.NotEmpty(t, response.NextCursor)
+
+		w = search(handler, "?q=desk&limit=1&cursor="+response.NextCursor)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"results":[]}`, w.Body.String())
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Requires a query", func(t *testing.T) {
+		handler := NewProductHandler(nil, nil)
+
+		assert.Equal(t, http.StatusBadRequest, search(handler, "").Code)
+		assert.Equal(t, http.StatusBadRequest, search(handler, "?q=%20%20").Code)
+	})
+
+	t.Run("Rejects cursors of another search", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil)
+
+		mockRepo.On("SearchProducts", mock.Anything, mock.Anything).Return(repository.ProductSearchPage{}, repository.ErrInvalidCursor)
+
+		cursor := encodeCursor(&repository.ProductSearchCursor{Query: "lamp", ID: uuid.New()})
+		assert.Equal(t, http.StatusBadRequest, search(handler, "?q=desk&cursor="+cursor).Code)
+		assert.Equal(t, http.StatusBadRequest, search(handler, "?q=desk&cursor=%25%25").Code)
+	})
+}
+
+func TestGetProductViews(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	ist, err := time.LoadLocation("Asia/Kolkata")
+	assert.NoError(t, err)
+
+	t.Run("Zero-filled daily series in IST", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := &ProductHandler{repo: mockRepo}
+
+		productID := uuid.New()
+		dayStart := time.Date(2024, 6, 1, 0, 0, 0, 0, ist)
+		mockRepo.On("GetProduct", mock.Anything, productID).Return(&repository.Product{ID: productID}, nil)
+		mockRepo.On("GetProductViewSeries", mock.Anything, productID,
+			mock.MatchedBy(dayStart.Equal),
+			mock.MatchedBy(dayStart.AddDate(0, 0, 3).Equal),
+			repository.IntervalDay, ist).
+			Return([]repository.ViewSeriesPoint{
+				{Start: dayStart.AddDate(0, 0, 1), Views: 42, UniqueViews: 30},
+			}, nil)
+
+		router := gin.New()
+		router.GET("/products/:id/views", handler.GetProductViews)
+
+		// 2024-06-01T00:00+05:30 is 2024-05-31T18:30Z
+		url := fmt.Sprintf("/products/%s/views?from=2024-05-31T18:30:00Z&to=2024-06-03T18:30:00Z&interval=day&tz=Asia/Kolkata", productID)
+		req := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response ViewSeriesResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, "Asia/Kolkata", response.TZ)
+		assert.Len(t, response.Points, 3)
+		assert.Equal(t, "2024-06-01T00:00:00+05:30", response.Points[0].Start)
+		assert.Equal(t, int64(0), response.Points[0].Views)
+		assert.Equal(t, "2024-06-02T00:00:00+05:30", response.Points[1].Start)
+		assert.Equal(t, int64(42), response.Points[1].Views)
+		assert.Equal(t, int64(30), response.Points[1].UniqueViews)
+		assert.Equal(t, int64(0), response.Points[2].Views)
+
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Weekly series starts on Monday", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := &ProductHandler{repo: mockRepo}
+
+		productID := uuid.New()
+		monday := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+		mockRepo.On("GetProduct", mock.Anything, productID).Return(&repository.Product{ID: productID}, nil)
+		mockRepo.On("GetProductViewSeries", mock.Anything, productID,
+			mock.MatchedBy(monday.Equal), mock.MatchedBy(monday.AddDate(0, 0, 14).Equal),
+			repository.IntervalWeek, time.UTC).
+			Return([]repository.ViewSeriesPoint{}, nil)
+
+		router := gin.New()
+		router.GET("/products/:id/views", handler.GetProductViews)
+
+		url := fmt.Sprintf("/products/%s/views?from=2024-06-05T10:00:00Z&to=2024-06-12T10:00:00Z&interval=week", productID)
+		req := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response ViewSeriesResponse
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Len(t, response.Points, 2)
+		assert.Equal(t, "2024-06-03T00:00:00Z", response.Points[0].Start)
+
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Hourly series keeps the repeated DST hour", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := &ProductHandler{repo: mockRepo}
+
+		newYork, err := time.LoadLocation("America/New_York")
+		assert.NoError(t, err)
+
+		// 2024-11-03 01:00 happens twice in New York, at 05:00Z and 06:00Z
+		productID := uuid.New()
+		first := time.Date(2024, 11, 3, 5, 0, 0, 0, time.UTC)
+		mockRepo.On("GetProduct", mock.Anything, productID).Return(&repository.Product{ID: productID}, nil)
+		mockRepo.On("GetProductViewSeries", mock.Anything, productID,
+			mock.MatchedBy(first.Add(-time.Hour).Equal), mock.MatchedBy(first.Add(3*time.Hour).Equal),
+			repository.IntervalHour, newYork).
+			Return([]repository.ViewSeriesPoint{
+				{Start: first.In(newYork), Views: 3},
+				{Start: first.Add(time.Hour).In(newYork), Views: 5},
+			}, nil)
+
+		router := gin.New()
+		router.GET("/products/:id/views", handler.GetProductViews)
+
+		url := fmt.Sprintf("/products/%s/views?from=2024-11-03T04:00:00Z&to=2024-11-03T08:00:00Z&interval=hour&tz=America/New_York", productID)
+		req := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response ViewSeriesResponse
+		err = json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Len(t, response.Points, 4)
+		assert.Equal(t, "2024-11-03T01:00:00-04:00", response.Points[1].Start)
+		assert.Equal(t, int64(3), response.Points[1].Views)
+		assert.Equal(t, "2024-11-03T01:00:00-05:00", response.Points[2].Start)
+		assert.Equal(t, int64(5), response.Points[2].Views)
+
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Invalid parameters", func(t *testing.T) {
+		handler := &ProductHandler{}
+
+		router := gin.New()
+		router.GET("/products/:id/views", handler.GetProductViews)
+
+		id := uuid.New()
+		for _, url := range []string{
+			"/products/not-a-uuid/views",
+			fmt.Sprintf("/products/%s/views?interval=minute", id),
+			fmt.Sprintf("/products/%s/views?tz=Mars/Olympus", id),
+			fmt.Sprintf("/products/%s/views?from=2024-06-05T00:00:00Z&to=2024-06-01T00:00:00Z", id),
+			fmt.Sprintf("/products/%s/views?from=2020-01-01T00:00:00Z&to=2024-01-01T00:00:00Z&interval=hour", id),
+		} {
+			req := httptest.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code, url)
+		}
+	})
+
+	t.Run("Product not found", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := &ProductHandler{repo: mockRepo}
+
+		productID := uuid.New()
+		mockRepo.On("GetProduct", mock.Anything, productID).Return(nil, errors.New("product not found"))
+
+		router := gin.New()
+		router.GET("/products/:id/views", handler.GetProductViews)
+
+		req := httptest.NewRequest("GET", fmt.Sprintf("/products/%s/views", productID), nil)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		mockRepo.AssertExpectations(t)
+	})
+}
+
+func TestUpdateProduct(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	send := func(handler *ProductHandler, method, path, ifMatch string, body any) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.PUT("/products/:id", handler.UpdateProduct)
+		router.PATCH("/products/:id", handler.PatchProduct)
+		router.DELETE("/products/:id", handler.DeleteProduct)
+
+		var buf bytes.Buffer
+		if body != nil {
+			_ = json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Replaces the catalog fields", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil)
+
+		id := uuid.New()
+		name, description := "Renamed", ""
+		updated := &repository.Product{ID: id, Name: name, ViewCount: 42, Version: 4}
+		mockRepo.On("UpdateProduct", mock.Anything, id,
+			repository.ProductUpdate{Name: &name, Description: &description}, int64(3)).Return(updated, nil)
+
+		w := send(handler, "PUT", "/products/"+id.String(), `"3"`, UpdateProductRequest{Name: name})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"4"`, w.Header().Get("ETag"))
+
+		var response ProductResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "Renamed", response.Name)
+		assert.Equal(t, int64(42), response.ViewCount)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Patches only the given fields", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil)
+
+		id := uuid.New()
+		description := "New description"
+		mockRepo.On("UpdateProduct", mock.Anything, id,
+			repository.ProductUpdate{Description: &description}, repository.AnyVersion).
+			Return(&repository.Product{ID: id, Description: description, Version: 2}, nil)
+
+		w := send(handler, "PATCH", "/products/"+id.String(), "*", map[string]string{"description": description})
+		assert.Equal(t, http.StatusOK, w.Code)
+		mockRepo.AssertExpectations(t)
+	})
+
+	t.Run("Requires If-Match", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil)
+
+		w := send(handler, "PUT", "/products/"+uuid.New().String(), "", UpdateProductRequest{Name: "Renamed"})
+		assert.Equal(t, http.StatusPreconditionRequired, w.Code)
+
+		w = send(handler, "PUT", "/products/"+uuid.New().String(), `W/"3"`, UpdateProductRequest{Name: "Renamed"})
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+		mockRepo.AssertNotCalled(t, "UpdateProduct", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Rejects stale versions and archived products", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil)
+
+		stale, archived := uuid.New(), uuid.New()
+		mockRepo.On("UpdateProduct", mock.Anything, stale, mock.Anything, int64(1)).Return(nil, repository.ErrVersionMismatch)
+		mockRepo.On("UpdateProduct", mock.Anything, archived, mock.Anything, int64(1)).Return(nil, repository.ErrProductArchived)
+
+		w := send(handler, "PUT", "/products/"+stale.String(), `"1"`, UpdateProductRequest{Name: "Renamed"})
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+		w = send(handler, "PUT", "/products/"+archived.String(), `"1"`, UpdateProductRequest{Name: "Renamed"})
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Rejects empty names", func(t *testing.T) {
+		handler := NewProductHandler(new(MockProductRepository), nil)
+
+		w := send(handler, "PATCH", "/products/"+uuid.New().String(), "*", map[string]string{"name": ""})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Archives on delete", func(t *testing.T) {
+		mockRepo := new(MockProductRepository)
+		handler := NewProductHandler(mockRepo, nil)
+
+		id, archived, missing := uuid.New(), uuid.New(), uuid.New()
+		mockRepo.On("ArchiveProduct", mock.Anything, id, int64(2)).Return(&repository.Product{ID: id, Version: 3}, nil)
+		mockRepo.On("ArchiveProduct", mock.Anything, archived, int64(2)).Return(nil, repository.ErrProductArchived)
+		mockRepo.On("ArchiveProduct", mock.Anything, missing, int64(2)).Return(nil, repository.ErrProductNotFound)
+
+		assert.Equal(t, http.StatusNoContent, send(handler, "DELETE", "/products/"+id.String(), `"2"`, nil).Code)
+		assert.Equal(t, http.StatusNoContent, send(handler, "DELETE", "/products/"+archived.String(), `"2"`, nil).Code)
+		assert.Equal(t, http.StatusNotFound, send(handler, "DELETE", "/products/"+missing.String(), `"2"`, nil).Code)
 		mockRepo.AssertExpectations(t)
 	})
 }
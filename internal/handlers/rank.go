@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// RankHandler handles product rank and leaderboard HTTP requests. Both are
+// served from the latest snapshot of the top products, which a scheduled job
+// takes periodically; ranks beyond its depth are estimated.
+type RankHandler struct {
+	store repository.RankStore
+}
+
+// NewRankHandler creates a new RankHandler
+func NewRankHandler(store repository.RankStore) *RankHandler {
+	return &RankHandler{store: store}
+}
+
+// GetProductRank returns a product's rank and its neighbours
+// @Summary Get a product's rank
+// @Description Returns the product's rank among the products that are not archived, its percentile, and the products ranked just above and below it. Ties are broken by product ID, highest first. Ranks within the depth of the latest rank snapshot are as of the snapshot; deeper ones are estimated from the current view count and flagged approximate. Percentiles are relative to the number of products in the latest rank snapshot.
+// @Tags products
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param count query string false "Rank by raw or deduplicated views (raw, unique)" default(raw)
+// @Param neighbors query int false "Number of products to return above and below it (0-10)" default(1)
+// @Success 200 {object} ProductRankResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/{id}/rank [get]
+func (h *RankHandler) GetProductRank(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid product ID"})
+		return
+	}
+
+	var req ProductRankRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid query parameters"})
+		return
+	}
+
+	rank, err := h.store.GetProductRank(c.Request.Context(), id, req.Count == "unique", req.Neighbors)
+	switch {
+	case errors.Is(err, repository.ErrProductNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Product not found"})
+		return
+	case errors.Is(err, repository.ErrProductNotRanked):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Product not ranked"})
+		return
+	case errors.Is(err, repository.ErrNoRankSnapshot):
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Ranking not available yet"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch product rank"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ProductRankResponse{
+		RankedProductResponse: toRankedProductResponse(&rank.RankedProduct),
+		Approximate:           rank.Approximate,
+		Percentile:            rank.Percentile,
+		RankedProducts:        rank.Products,
+		Above:                 toRankedProductResponses(rank.Above),
+		Below:                 toRankedProductResponses(rank.Below),
+	})
+}
+
+// GetLeaderboard returns a page of the top of the ranking
+// @Summary Page through the top of the ranking
+// @Description Returns the top products that are not archived in rank order, each with its rank, down to the snapshot's depth. Ties are broken by product ID, highest first. Ranks and view counts are as of the snapshot, given in as_of.
+// @Description Pass next_cursor as 'cursor' with the same count to get the following page of the same snapshot, so that no product is skipped or repeated while the counts move; cursors expire with their snapshot. offset starts from the latest snapshot instead.
+// @Tags products
+// @Produce json
+// @Param limit query int false "Maximum number of products to return (1-100)" default(20)
+// @Param count query string false "Rank by raw or deduplicated views (raw, unique)" default(raw)
+// @Param offset query int false "Number of products to skip"
+// @Param cursor query string false "next_cursor of the previous page"
+// @Success 200 {object} LeaderboardResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 410 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/leaderboard [get]
+func (h *RankHandler) GetLeaderboard(c *gin.Context) {
+	var req LeaderboardRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid query parameters"})
+		return
+	}
+
+	query := repository.RankPageQuery{
+		Unique: req.Count == "unique",
+		Offset: req.Offset,
+		Limit:  req.Limit,
+	}
+	if req.Cursor != "" {
+		if req.Offset > 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "offset and cursor cannot be combined"})
+			return
+		}
+		var cursor repository.RankCursor
+		if err := decodeCursor(req.Cursor, &cursor); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid cursor"})
+			return
+		}
+		query.After = &cursor
+	}
+
+	page, err := h.store.GetRankedProducts(c.Request.Context(), query)
+	switch {
+	case errors.Is(err, repository.ErrInvalidCursor):
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid cursor"})
+		return
+	case errors.Is(err, repository.ErrRankSnapshotExpired):
+		c.JSON(http.StatusGone, ErrorResponse{Error: "Cursor expired, start again from the first page"})
+		return
+	case errors.Is(err, repository.ErrNoRankSnapshot):
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Ranking not available yet"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch leaderboard"})
+		return
+	}
+
+	response := LeaderboardResponse{
+		Products:       toRankedProductResponses(page.Products),
+		RankedProducts: page.Snapshot.Products,
+		Depth:          page.Snapshot.Depth,
+		AsOf:           page.Snapshot.RankedAt.UTC().Format(time.RFC3339Nano),
+	}
+	if page.Next != nil {
+		response.NextCursor = encodeCursor(page.Next)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// toRankedProductResponse converts a ranked product to its API response
+func toRankedProductResponse(p *repository.RankedProduct) RankedProductResponse {
+	return RankedProductResponse{Rank: p.Rank, ProductResponse: toProductResponse(&p.Product)}
+}
+
+// toRankedProductResponses converts ranked products to API responses, never returning nil
+func toRankedProductResponses(products []repository.RankedProduct) []RankedProductResponse {
+	response := make([]RankedProductResponse, 0, len(products))
+	for i := range products {
+		response = append(response, toRankedProductResponse(&products[i]))
+	}
+	return response
+}
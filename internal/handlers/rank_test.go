@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// MockRankStore is a mock implementation of RankStore
+type MockRankStore struct {
+	mock.Mock
+}
+
+func (m *MockRankStore) SnapshotRanks(ctx context.Context, depth int, retention time.Duration) (*repository.RankSnapshot, error) {
+	args := m.Called(ctx, depth, retention)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*repository.RankSnapshot), args.Error(1)
+}
+
+func (m *MockRankStore) GetProductRank(ctx context.Context, productID uuid.UUID, unique bool, neighbors int) (*repository.ProductRank, error) {
+	args := m.Called(ctx, productID, unique, neighbors)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*repository.ProductRank), args.Error(1)
+}
+
+func (m *MockRankStore) GetRankedProducts(ctx context.Context, q repository.RankPageQuery) (repository.RankPage, error) {
+	args := m.Called(ctx, q)
+	return args.Get(0).(repository.RankPage), args.Error(1)
+}
+
+func TestGetProductRank(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newRouter := func(store *MockRankStore) *gin.Engine {
+		handler := NewRankHandler(store)
+		router := gin.New()
+		router.GET("/products/:id/rank", handler.GetProductRank)
+		return router
+	}
+	get := func(router *gin.Engine, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	ranked := func(name string, rank, views int64) repository.RankedProduct {
+		return repository.RankedProduct{Product: repository.Product{ID: uuid.New(), Name: name, ViewCount: views}, Rank: rank}
+	}
+
+	t.Run("Returns the rank and neighbours", func(t *testing.T) {
+		store := new(MockRankStore)
+		router := newRouter(store)
+
+		product := ranked("B", 2, 200)
+		store.On("GetProductRank", mock.Anything, product.ID, true, 2).Return(&repository.ProductRank{
+			RankedProduct: product,
+			Products:      4,
+			Percentile:    75,
+			Above:         []repository.RankedProduct{ranked("A", 1, 300)},
+			Below:         []repository.RankedProduct{ranked("C", 3, 200), ranked("D", 4, 100)},
+		}, nil)
+
+		w := get(router, "/products/"+product.ID.String()+"/rank?count=unique&neighbors=2")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response ProductRankResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, int64(2), response.Rank)
+		assert.Equal(t, product.ID, response.ID)
+		assert.Equal(t, 75.0, response.Percentile)
+		assert.Equal(t, int64(4), response.RankedProducts)
+		assert.Len(t, response.Above, 1)
+		assert.Equal(t, int64(1), response.Above[0].Rank)
+		assert.Len(t, response.Below, 2)
+		assert.Equal(t, "D", response.Below[1].Name)
+		store.AssertExpectations(t)
+	})
+
+	t.Run("Flags estimated ranks", func(t *testing.T) {
+		store := new(MockRankStore)
+		router := newRouter(store)
+
+		product := ranked("Z", 20001, 5)
+		store.On("GetProductRank", mock.Anything, product.ID, false, 1).Return(&repository.ProductRank{
+			RankedProduct: product,
+			Approximate:   true,
+			Products:      40000,
+			Percentile:    50,
+		}, nil)
+
+		w := get(router, "/products/"+product.ID.String()+"/rank")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response ProductRankResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.True(t, response.Approximate)
+		assert.Equal(t, int64(20001), response.Rank)
+	})
+
+	t.Run("First product has no neighbours above", func(t *testing.T) {
+		store := new(MockRankStore)
+		router := newRouter(store)
+
+		product := ranked("A", 1, 300)
+		store.On("GetProductRank", mock.Anything, product.ID, false, 1).Return(&repository.ProductRank{
+			RankedProduct: product,
+			Products:      1,
+			Percentile:    100,
+		}, nil)
+
+		w := get(router, "/products/"+product.ID.String()+"/rank")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"above":[]`)
+		assert.Contains(t, w.Body.String(), `"below":[]`)
+	})
+
+	t.Run("Product not ranked", func(t *testing.T) {
+		store := new(MockRankStore)
+		router := newRouter(store)
+
+		archived, missing := uuid.New(), uuid.New()
+		store.On("GetProductRank", mock.Anything, archived, false, 1).Return(nil, repository.ErrProductNotRanked)
+		store.On("GetProductRank", mock.Anything, missing, false, 1).Return(nil, repository.ErrProductNotFound)
+
+		assert.Equal(t, http.StatusNotFound, get(router, "/products/"+archived.String()+"/rank").Code)
+		assert.Equal(t, http.StatusNotFound, get(router, "/products/"+missing.String()+"/rank").Code)
+	})
+
+	t.Run("No snapshot yet", func(t *testing.T) {
+		store := new(MockRankStore)
+		router := newRouter(store)
+
+		id := uuid.New()
+		store.On("GetProductRank", mock.Anything, id, false, 1).Return(nil, repository.ErrNoRankSnapshot)
+
+		assert.Equal(t, http.StatusServiceUnavailable, get(router, "/products/"+id.String()+"/rank").Code)
+	})
+
+	t.Run("Invalid parameters", func(t *testing.T) {
+		store := new(MockRankStore)
+		router := newRouter(store)
+
+		assert.Equal(t, http.StatusBadRequest, get(router, "/products/not-a-uuid/rank").Code)
+		assert.Equal(t, http.StatusBadRequest, get(router, "/products/"+uuid.NewString()+"/rank?neighbors=11").Code)
+		assert.Equal(t, http.StatusBadRequest, get(router, "/products/"+uuid.NewString()+"/rank?count=total").Code)
+		store.AssertNotCalled(t, "GetProductRank", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestGetLeaderboard(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newRouter := func(store *MockRankStore) *gin.Engine {
+		handler := NewRankHandler(store)
+		router := gin.New()
+		router.GET("/products/leaderboard", handler.GetLeaderboard)
+		return router
+	}
+	get := func(router *gin.Engine, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	snapshot := repository.RankSnapshot{ID: 7, RankedAt: time.Now(), Products: 5000, Depth: 250}
+
+	t.Run("Pages by offset beyond the top 100", func(t *testing.T) {
+		store := new(MockRankStore)
+		router := newRouter(store)
+
+		next := &repository.RankCursor{SnapshotID: 7, Rank: 202}
+		store.On("GetRankedProducts", mock.Anything, repository.RankPageQuery{Offset: 200, Limit: 2}).Return(repository.RankPage{
+			Snapshot: snapshot,
+			Products: []repository.RankedProduct{
+				{Product: repository.Product{ID: uuid.New(), Name: "A"}, Rank: 201},
+				{Product: repository.Product{ID: uuid.New(), Name: "B"}, Rank: 202},
+			},
+			Next: next,
+		}, nil)
+
+		w := get(router, "/products/leaderboard?offset=200&limit=2")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response LeaderboardResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response.Products, 2)
+		assert.Equal(t, int64(201), response.Products[0].Rank)
+		assert.Equal(t, int64(5000), response.RankedProducts)
+		assert.Equal(t, int64(250), response.Depth)
+		assert.Equal(t, encodeCursor(next), response.NextCursor)
+		store.AssertExpectations(t)
+	})
+
+	t.Run("Continues from a cursor", func(t *testing.T) {
+		store := new(MockRankStore)
+		router := newRouter(store)
+
+		cursor := repository.RankCursor{SnapshotID: 7, Unique: true, Rank: 240}
+		store.On("GetRankedProducts", mock.Anything, repository.RankPageQuery{Unique: true, After: &cursor, Limit: 20}).Return(repository.RankPage{
+			Snapshot: snapshot,
+			Products: []repository.RankedProduct{{Product: repository.Product{ID: uuid.New(), Name: "Z"}, Rank: 241}},
+		}, nil)
+
+		w := get(router, "/products/leaderboard?count=unique&cursor="+encodeCursor(cursor))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response LeaderboardResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Empty(t, response.NextCursor)
+		store.AssertExpectations(t)
+	})
+
+	t.Run("Expired cursor", func(t *testing.T) {
+		store := new(MockRankStore)
+		router := newRouter(store)
+
+		store.On("GetRankedProducts", mock.Anything, mock.Anything).Return(repository.RankPage{}, repository.ErrRankSnapshotExpired)
+
+		w := get(router, "/products/leaderboard?cursor="+encodeCursor(repository.RankCursor{SnapshotID: 3, Rank: 20}))
+		assert.Equal(t, http.StatusGone, w.Code)
+	})
+
+	t.Run("Invalid parameters", func(t *testing.T) {
+		store := new(MockRankStore)
+		router := newRouter(store)
+
+		assert.Equal(t, http.StatusBadRequest, get(router, "/products/leaderboard?cursor=%21%21").Code)
+		assert.Equal(t, http.StatusBadRequest, get(router, "/products/leaderboard?offset=-1").Code)
+		assert.Equal(t, http.StatusBadRequest, get(router, "/products/leaderboard?limit=101").Code)
+		cursor := encodeCursor(repository.RankCursor{SnapshotID: 7, Rank: 20})
+		assert.Equal(t, http.StatusBadRequest, get(router, "/products/leaderboard?offset=20&cursor="+cursor).Code)
+		store.AssertNotCalled(t, "GetRankedProducts", mock.Anything, mock.Anything)
+	})
+}
@@ -0,0 +1,469 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// slugPattern matches category slugs: lower case words joined by hyphens
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// TaxonomyHandler handles category and tag HTTP requests
+type TaxonomyHandler struct {
+	store repository.TaxonomyStore
+}
+
+// NewTaxonomyHandler creates a new TaxonomyHandler
+func NewTaxonomyHandler(store repository.TaxonomyStore) *TaxonomyHandler {
+	return &TaxonomyHandler{store: store}
+}
+
+// CreateCategory creates a category
+// @Summary Create a category
+// @Description Creates a category, under parent_id if given. Slugs are lower case words joined by hyphens and name the category in rankings.
+// @Tags categories
+// @Accept json
+// @Produce json
+// @Param request body CategoryRequest true "Category details"
+// @Success 201 {object} CategoryResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/categories [post]
+func (h *TaxonomyHandler) CreateCategory(c *gin.Context) {
+	var req CategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !slugPattern.MatchString(req.Slug) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	category := &repository.Category{Slug: req.Slug, Name: req.Name, ParentID: req.ParentID}
+	if err := h.store.CreateCategory(c.Request.Context(), category); err != nil {
+		respondCategoryError(c, err, "Failed to create category")
+		return
+	}
+
+	c.JSON(http.StatusCreated, toCategoryResponse(category))
+}
+
+// ListCategories returns every category
+// @Summary List categories
+// @Description Returns every category ordered by slug; the tree is given by their parent_id
+// @Tags categories
+// @Produce json
+// @Success 200 {array} CategoryResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/categories [get]
+func (h *TaxonomyHandler) ListCategories(c *gin.Context) {
+	categories, err := h.store.ListCategories(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch categories"})
+		return
+	}
+
+	c.JSON(http.StatusOK, toCategoryResponses(categories))
+}
+
+// GetCategory returns a category
+// @Summary Get a category by ID
+// @Tags categories
+// @Produce json
+// @Param id path string true "Category ID"
+// @Success 200 {object} CategoryResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/categories/{id} [get]
+func (h *TaxonomyHandler) GetCategory(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid category ID"})
+		return
+	}
+
+	category, err := h.store.GetCategory(c.Request.Context(), id)
+	if err != nil {
+		respondCategoryError(c, err, "Failed to fetch category")
+		return
+	}
+
+	c.JSON(http.StatusOK, toCategoryResponse(category))
+}
+
+// UpdateCategory replaces a category's slug, name and parent
+// @Summary Update a category
+// @Description Replaces the slug, name and parent of a category. Omitting parent_id makes it a top-level category; it cannot be moved under itself or its subcategories.
+// @Tags categories
+// @Accept json
+// @Produce json
+// @Param id path string true "Category ID"
+// @Param request body CategoryRequest true "Category details"
+// @Success 200 {object} CategoryResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/categories/{id} [put]
+func (h *TaxonomyHandler) UpdateCategory(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid category ID"})
+		return
+	}
+	var req CategoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !slugPattern.MatchString(req.Slug) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	category := &repository.Category{ID: id, Slug: req.Slug, Name: req.Name, ParentID: req.ParentID}
+	if err := h.store.UpdateCategory(c.Request.Context(), category); err != nil {
+		respondCategoryError(c, err, "Failed to update category")
+		return
+	}
+
+	c.JSON(http.StatusOK, toCategoryResponse(category))
+}
+
+// DeleteCategory deletes a category
+// @Summary Delete a category
+// @Description Deletes a category without subcategories and unassigns its products from it
+// @Tags categories
+// @Param id path string true "Category ID"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/categories/{id} [delete]
+func (h *TaxonomyHandler) DeleteCategory(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid category ID"})
+		return
+	}
+
+	if err := h.store.DeleteCategory(c.Request.Context(), id); err != nil {
+		respondCategoryError(c, err, "Failed to delete category")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// respondCategoryError responds with the status of a failed category
+// operation, with the failure message for unexpected errors
+func respondCategoryError(c *gin.Context, err error, failure string) {
+	switch {
+	case errors.Is(err, repository.ErrCategoryNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Category not found"})
+	case errors.Is(err, repository.ErrParentCategoryNotFound):
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Parent category not found"})
+	case errors.Is(err, repository.ErrCategoryExists):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Category slug already exists"})
+	case errors.Is(err, repository.ErrCategoryCycle):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Category cannot be moved under itself or its subcategories"})
+	case errors.Is(err, repository.ErrCategoryHasChildren):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Category has subcategories"})
+	default:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: failure})
+	}
+}
+
+// CreateTag creates a tag
+// @Summary Create a tag
+// @Description Creates a tag. Names are stored lower case with white space collapsed.
+// @Tags tags
+// @Accept json
+// @Produce json
+// @Param request body TagRequest true "Tag details"
+// @Success 201 {object} TagResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/tags [post]
+func (h *TaxonomyHandler) CreateTag(c *gin.Context) {
+	var req TagRequest
+	if err := c.ShouldBindJSON(&req); err != nil || repository.NormalizeTag(req.Name) == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	tag := &repository.Tag{Name: req.Name}
+	if err := h.store.CreateTag(c.Request.Context(), tag); err != nil {
+		respondTagError(c, err, "Failed to create tag")
+		return
+	}
+
+	c.JSON(http.StatusCreated, toTagResponse(tag))
+}
+
+// ListTags returns every tag
+// @Summary List tags
+// @Description Returns every tag ordered by name
+// @Tags tags
+// @Produce json
+// @Success 200 {array} TagResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/tags [get]
+func (h *TaxonomyHandler) ListTags(c *gin.Context) {
+	tags, err := h.store.ListTags(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to fetch tags"})
+		return
+	}
+
+	c.JSON(http.StatusOK, toTagResponses(tags))
+}
+
+// UpdateTag renames a tag
+// @Summary Rename a tag
+// @Tags tags
+// @Accept json
+// @Produce json
+// @Param id path string true "Tag ID"
+// @Param request body TagRequest true "Tag details"
+// @Success 200 {object} TagResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/tags/{id} [put]
+func (h *TaxonomyHandler) UpdateTag(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid tag ID"})
+		return
+	}
+	var req TagRequest
+	if err := c.ShouldBindJSON(&req); err != nil || repository.NormalizeTag(req.Name) == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	tag := &repository.Tag{ID: id, Name: req.Name}
+	if err := h.store.UpdateTag(c.Request.Context(), tag); err != nil {
+		respondTagError(c, err, "Failed to update tag")
+		return
+	}
+
+	c.JSON(http.StatusOK, toTagResponse(tag))
+}
+
+// DeleteTag deletes a tag
+// @Summary Delete a tag
+// @Description Deletes a tag and removes it from all products
+// @Tags tags
+// @Param id path string true "Tag ID"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/tags/{id} [delete]
+func (h *TaxonomyHandler) DeleteTag(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid tag ID"})
+		return
+	}
+
+	if err := h.store.DeleteTag(c.Request.Context(), id); err != nil {
+		respondTagError(c, err, "Failed to delete tag")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// respondTagError responds with the status of a failed tag operation, with
+// the failure message for unexpected errors
+func respondTagError(c *gin.Context, err error, failure string) {
+	switch {
+	case errors.Is(err, repository.ErrTagNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Tag not found"})
+	case errors.Is(err, repository.ErrTagExists):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Tag already exists"})
+	default:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: failure})
+	}
+}
+
+// GetProductCategories returns the categories of a product
+// @Summary Get a product's categories
+// @Description Returns the categories a product is assigned to, not including their ancestors
+// @Tags categories
+// @Produce json
+// @Param id path string true "Product ID"
+// @Success 200 {array} CategoryResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/{id}/categories [get]
+func (h *TaxonomyHandler) GetProductCategories(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid product ID"})
+		return
+	}
+
+	categories, err := h.store.GetProductCategories(c.Request.Context(), id)
+	if err != nil {
+		respondAssignmentError(c, err, "Failed to fetch product categories")
+		return
+	}
+
+	c.JSON(http.StatusOK, toCategoryResponses(categories))
+}
+
+// SetProductCategories replaces the categories of a product
+// @Summary Set a product's categories
+// @Description Replaces the categories a product is assigned to. It also ranks in the ancestors of these categories.
+// @Tags categories
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param request body ProductCategoriesRequest true "Category IDs"
+// @Success 200 {array} CategoryResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/{id}/categories [put]
+func (h *TaxonomyHandler) SetProductCategories(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid product ID"})
+		return
+	}
+	var req ProductCategoriesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	categories, err := h.store.SetProductCategories(c.Request.Context(), id, req.CategoryIDs)
+	if errors.Is(err, repository.ErrCategoryNotFound) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Category not found"})
+		return
+	}
+	if err != nil {
+		respondAssignmentError(c, err, "Failed to update product categories")
+		return
+	}
+
+	c.JSON(http.StatusOK, toCategoryResponses(categories))
+}
+
+// GetProductTags returns the tags of a product
+// @Summary Get a product's tags
+// @Tags tags
+// @Produce json
+// @Param id path string true "Product ID"
+// @Success 200 {array} TagResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/{id}/tags [get]
+func (h *TaxonomyHandler) GetProductTags(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid product ID"})
+		return
+	}
+
+	tags, err := h.store.GetProductTags(c.Request.Context(), id)
+	if err != nil {
+		respondAssignmentError(c, err, "Failed to fetch product tags")
+		return
+	}
+
+	c.JSON(http.StatusOK, toTagResponses(tags))
+}
+
+// SetProductTags replaces the tags of a product
+// @Summary Set a product's tags
+// @Description Replaces the tags of a product, creating the tags that do not exist yet
+// @Tags tags
+// @Accept json
+// @Produce json
+// @Param id path string true "Product ID"
+// @Param request body ProductTagsRequest true "Tag names"
+// @Success 200 {array} TagResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /api/v1/products/{id}/tags [put]
+func (h *TaxonomyHandler) SetProductTags(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid product ID"})
+		return
+	}
+	var req ProductTagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	tags, err := h.store.SetProductTags(c.Request.Context(), id, req.Tags)
+	if err != nil {
+		respondAssignmentError(c, err, "Failed to update product tags")
+		return
+	}
+
+	c.JSON(http.StatusOK, toTagResponses(tags))
+}
+
+// respondAssignmentError responds with the status of a failed read or change
+// of a product's categories or tags, with the failure message for unexpected errors
+func respondAssignmentError(c *gin.Context, err error, failure string) {
+	if errors.Is(err, repository.ErrProductNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Product not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, ErrorResponse{Error: failure})
+}
+
+// toCategoryResponse converts a category to its API representation
+func toCategoryResponse(category *repository.Category) CategoryResponse {
+	return CategoryResponse{
+		ID:        category.ID,
+		Slug:      category.Slug,
+		Name:      category.Name,
+		ParentID:  category.ParentID,
+		CreatedAt: category.CreatedAt.Format(time.RFC3339),
+		UpdatedAt: category.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+// toCategoryResponses converts categories to their API representation
+func toCategoryResponses(categories []repository.Category) []CategoryResponse {
+	response := make([]CategoryResponse, 0, len(categories))
+	for i := range categories {
+		response = append(response, toCategoryResponse(&categories[i]))
+	}
+	return response
+}
+
+// toTagResponse converts a tag to its API representation
+func toTagResponse(tag *repository.Tag) TagResponse {
+	return TagResponse{
+		ID:        tag.ID,
+		Name:      tag.Name,
+		CreatedAt: tag.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// toTagResponses converts tags to their API representation
+func toTagResponses(tags []repository.Tag) []TagResponse {
+	response := make([]TagResponse, 0, len(tags))
+	for i := range tags {
+		response = append(response, toTagResponse(&tags[i]))
+	}
+	return response
+}
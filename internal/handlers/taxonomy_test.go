@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// MockTaxonomyStore is a mock implementation of TaxonomyStore
+type MockTaxonomyStore struct {
+	mock.Mock
+}
+
+func (m *MockTaxonomyStore) CreateCategory(ctx context.Context, c *repository.Category) error {
+	args := m.Called(ctx, c)
+	return args.Error(0)
+}
+
+func (m *MockTaxonomyStore) GetCategory(ctx context.Context, id uuid.UUID) (*repository.Category, error) {
+	args := m.Called(ctx, id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*repository.Category), args.Error(1)
+}
+
+func (m *MockTaxonomyStore) ListCategories(ctx context.Context) ([]repository.Category, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]repository.Category), args.Error(1)
+}
+
+func (m *MockTaxonomyStore) UpdateCategory(ctx context.Context, c *repository.Category) error {
+	args := m.Called(ctx, c)
+	return args.Error(0)
+}
+
+func (m *MockTaxonomyStore) DeleteCategory(ctx context.Context, id uuid.UUID) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *MockTaxonomyStore) CreateTag(ctx context.Context, t *repository.Tag) error {
+	args := m.Called(ctx, t)
+	return args.Error(0)
+}
+
+func (m *MockTaxonomyStore) ListTags(ctx context.Context) ([]repository.Tag, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]repository.Tag), args.Error(1)
+}
+
+func (m *MockTaxonomyStore) UpdateTag(ctx context.Context, t *repository.Tag) error {
+	args := m.Called(ctx, t)
+	return args.Error(0)
+}
+
+func (m *MockTaxonomyStore) DeleteTag(ctx context.Context, id uuid.UUID) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *MockTaxonomyStore) SetProductCategories(ctx context.Context, productID uuid.UUID, categoryIDs []uuid.UUID) ([]repository.Category, error) {
+	args := m.Called(ctx, productID, categoryIDs)
+	return args.Get(0).([]repository.Category), args.Error(1)
+}
+
+func (m *MockTaxonomyStore) GetProductCategories(ctx context.Context, productID uuid.UUID) ([]repository.Category, error) {
+	args := m.Called(ctx, productID)
+	return args.Get(0).([]repository.Category), args.Error(1)
+}
+
+func (m *MockTaxonomyStore) SetProductTags(ctx context.Context, productID uuid.UUID, names []string) ([]repository.Tag, error) {
+	args := m.Called(ctx, productID, names)
+	return args.Get(0).([]repository.Tag), args.Error(1)
+}
+
+func (m *MockTaxonomyStore) GetProductTags(ctx context.Context, productID uuid.UUID) ([]repository.Tag, error) {
+	args := m.Called(ctx, productID)
+	return args.Get(0).([]repository.Tag), args.Error(1)
+}
+
+func TestCategories(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newRouter := func(store *MockTaxonomyStore) *gin.Engine {
+		handler := NewTaxonomyHandler(store)
+		router := gin.New()
+		router.POST("/categories", handler.CreateCategory)
+		router.PUT("/categories/:id", handler.UpdateCategory)
+		router.DELETE("/categories/:id", handler.DeleteCategory)
+		return router
+	}
+	send := func(router *gin.Engine, method, path string, body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Creates a subcategory", func(t *testing.T) {
+		store := new(MockTaxonomyStore)
+		router := newRouter(store)
+
+		parentID := uuid.New()
+		store.On("CreateCategory", mock.Anything, mock.MatchedBy(func(c *repository.Category) bool {
+			return c.Slug == "laptops" && c.ParentID != nil && *c.ParentID == parentID
+		})).Run(func(args mock.Arguments) {
+			args.Get(1).(*repository.Category).ID = uuid.New()
+		}).Return(nil)
+
+		w := send(router, "POST", "/categories", CategoryRequest{Slug: "laptops", Name: "Laptops", ParentID: &parentID})
+		assert.Equal(t, http.StatusCreated, w.Code)
+
+		var response CategoryResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "laptops", response.Slug)
+		assert.Equal(t, &parentID, response.ParentID)
+		store.AssertExpectations(t)
+	})
+
+	t.Run("Rejects invalid slugs", func(t *testing.T) {
+		store := new(MockTaxonomyStore)
+		router := newRouter(store)
+
+		for _, slug := range []string{"Laptops", "home office", "-audio", "tv--audio"} {
+			w := send(router, "POST", "/categories", CategoryRequest{Slug: slug, Name: "Category"})
+			assert.Equal(t, http.StatusBadRequest, w.Code, slug)
+		}
+		store.AssertNotCalled(t, "CreateCategory", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Maps conflicts", func(t *testing.T) {
+		store := new(MockTaxonomyStore)
+		router := newRouter(store)
+
+		id := uuid.New()
+		store.On("CreateCategory", mock.Anything, mock.Anything).Return(repository.ErrCategoryExists)
+		store.On("UpdateCategory", mock.Anything, mock.Anything).Return(repository.ErrCategoryCycle)
+		store.On("DeleteCategory", mock.Anything, id).Return(repository.ErrCategoryHasChildren)
+
+		assert.Equal(t, http.StatusConflict, send(router, "POST", "/categories", CategoryRequest{Slug: "audio", Name: "Audio"}).Code)
+		assert.Equal(t, http.StatusConflict, send(router, "PUT", "/categories/"+id.String(), CategoryRequest{Slug: "audio", Name: "Audio", ParentID: &id}).Code)
+		assert.Equal(t, http.StatusConflict, send(router, "DELETE", "/categories/"+id.String(), nil).Code)
+	})
+
+	t.Run("Unknown parent", func(t *testing.T) {
+		store := new(MockTaxonomyStore)
+		router := newRouter(store)
+
+		parentID := uuid.New()
+		store.On("CreateCategory", mock.Anything, mock.Anything).Return(repository.ErrParentCategoryNotFound)
+
+		w := send(router, "POST", "/categories", CategoryRequest{Slug: "audio", Name: "Audio", ParentID: &parentID})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestProductAssignments(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newRouter := func(store *MockTaxonomyStore) *gin.Engine {
+		handler := NewTaxonomyHandler(store)
+		router := gin.New()
+		router.PUT("/products/:id/categories", handler.SetProductCategories)
+		router.PUT("/products/:id/tags", handler.SetProductTags)
+		router.GET("/products/:id/tags", handler.GetProductTags)
+		return router
+	}
+	put := func(router *gin.Engine, path string, body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest("PUT", path, bytes.NewBuffer(b))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Replaces the tags", func(t *testing.T) {
+		store := new(MockTaxonomyStore)
+		router := newRouter(store)
+
+		productID := uuid.New()
+		names := []string{"Wireless", "noise cancelling"}
+		store.On("SetProductTags", mock.Anything, productID, names).Return([]repository.Tag{
+			{ID: uuid.New(), Name: "noise cancelling"},
+			{ID: uuid.New(), Name: "wireless"},
+		}, nil)
+
+		w := put(router, "/products/"+productID.String()+"/tags", ProductTagsRequest{Tags: names})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response []TagResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response, 2)
+		assert.Equal(t, "wireless", response[1].Name)
+		store.AssertExpectations(t)
+	})
+
+	t.Run("Unknown category", func(t *testing.T) {
+		store := new(MockTaxonomyStore)
+		router := newRouter(store)
+
+		productID := uuid.New()
+		store.On("SetProductCategories", mock.Anything, productID, mock.Anything).
+			Return([]repository.Category(nil), repository.ErrCategoryNotFound)
+
+		w := put(router, "/products/"+productID.String()+"/categories", ProductCategoriesRequest{CategoryIDs: []uuid.UUID{uuid.New()}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Unknown product", func(t *testing.T) {
+		store := new(MockTaxonomyStore)
+		router := newRouter(store)
+
+		productID := uuid.New()
+		store.On("GetProductTags", mock.Anything, productID).Return([]repository.Tag(nil), repository.ErrProductNotFound)
+
+		req := httptest.NewRequest("GET", "/products/"+productID.String()+"/tags", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,139 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// partitionMaintenanceInterval is how often the view event partitions are checked
+const partitionMaintenanceInterval = time.Hour
+
+// PartitionMaintenance keeps the daily partitions of the raw view event table
+// ahead days ahead of the current day and drops those older than retention,
+// hourly. A zero retention keeps every partition. Views of days without a
+// partition are rejected as invalid data.
+func PartitionMaintenance(store repository.ViewEventStore, ahead int, retention time.Duration) Job {
+	return Job{
+		Name:     "view_event_partitions",
+		Interval: partitionMaintenanceInterval,
+		Timeout:  30 * time.Second,
+		Run: func(ctx context.Context) error {
+			changes, err := store.MaintainViewEventPartitions(ctx, time.Now(), ahead, retention)
+			for _, name := range changes.Created {
+				log.Printf("Created view event partition %s\n", name)
+			}
+			for _, name := range changes.Dropped {
+				log.Printf("Dropped expired view event partition %s\n", name)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to maintain view event partitions: %w", err)
+			}
+			return nil
+		},
+	}
+}
+
+// ViewDedupPurge removes the view dedup entries older than window every
+// window, as they no longer affect which views count as unique
+func ViewDedupPurge(store repository.DedupStore, window time.Duration) Job {
+	return Job{
+		Name:     "view_dedup_purge",
+		Interval: window,
+		Timeout:  30 * time.Second,
+		Run: func(ctx context.Context) error {
+			purged, err := store.PurgeViewDedup(ctx, time.Now().Add(-window))
+			if err != nil {
+				return fmt.Errorf("failed to purge view dedup entries: %w", err)
+			}
+			if purged > 0 {
+				log.Printf("Purged %d expired view dedup entries\n", purged)
+			}
+			return nil
+		},
+	}
+}
+
+// Rollups materializes the hourly and daily view rollups every interval,
+// aggregating hours again until they are older than lateness so that late
+// views are included
+func Rollups(store repository.RollupStore, interval, lateness time.Duration) Job {
+	return Job{
+		Name:     "view_rollups",
+		Interval: interval,
+		Timeout:  time.Minute,
+		Run: func(ctx context.Context) error {
+			watermark, err := store.MaterializeViewRollups(ctx, time.Now(), lateness)
+			if err != nil {
+				return fmt.Errorf("failed to materialize view rollups: %w", err)
+			}
+			setMetric("rollup_watermark_seconds", float64(watermark.Unix()))
+			return nil
+		},
+	}
+}
+
+// Reconciliation compares the stored view counts with source every interval
+// as a dry run, recording and logging the drift. Repairs are applied
+// separately.
+func Reconciliation(store repository.ReconcileStore, interval time.Duration, source string) Job {
+	return Job{
+		Name:     "count_reconciliation",
+		Interval: interval,
+		Timeout:  5 * time.Minute,
+		Run: func(ctx context.Context) error {
+			run, err := store.ReconcileViewCounts(ctx, source, "scheduler")
+			if err != nil {
+				return fmt.Errorf("failed to reconcile view counts: %w", err)
+			}
+			log.Printf("%s\n", run)
+			setMetric("count_drift_products", float64(run.Discrepancies))
+			setMetric("count_drift_views", float64(run.ViewDrift))
+			return nil
+		},
+	}
+}
+
+// CounterCompaction moves the counter shards into the products table, and the
+// products' counts into their category and tag memberships, every interval
+func CounterCompaction(store repository.CounterStore, interval time.Duration) Job {
+	return Job{
+		Name:     "counter_compaction",
+		Interval: interval,
+		Timeout:  time.Minute,
+		Run: func(ctx context.Context) error {
+			compacted, err := store.CompactViewCounts(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to compact view counters: %w", err)
+			}
+			jobMetrics.Add("counter_shards_compacted", compacted)
+			return nil
+		},
+	}
+}
+
+// RankSnapshots snapshots the top depth products by lifetime counts and a
+// histogram of all the counts every interval, for the paginated leaderboard and
+// rank lookups, keeping older snapshots for retention so that readers paging
+// through one can finish
+func RankSnapshots(store repository.RankStore, interval time.Duration, depth int, retention time.Duration) Job {
+	return Job{
+		Name:     "rank_snapshots",
+		Interval: interval,
+		Timeout:  5 * time.Minute,
+		Run: func(ctx context.Context) error {
+			snapshot, err := store.SnapshotRanks(ctx, depth, retention)
+			if err != nil {
+				return fmt.Errorf("failed to snapshot product ranks: %w", err)
+			}
+			if snapshot != nil {
+				setMetric("rank_snapshot_products", float64(snapshot.Products))
+				setMetric("rank_snapshot_seconds", float64(snapshot.RankedAt.Unix()))
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,119 @@
+// Package jobs runs the periodic maintenance jobs of the service, such as view
+// event partition maintenance, rollups and count reconciliation. Every
+// instance may run a Scheduler: each run of a job is claimed in the database
+// under the job's advisory lock, so a job runs once per interval however many
+// instances schedule it, and independently of the event bus and its consumers.
+package jobs
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// jobMetrics exposes the outcome of the latest job runs under /debug/vars
+var jobMetrics = expvar.NewMap("jobs")
+
+// Job is a periodic job
+type Job struct {
+	// Name identifies the job across instances
+	Name string
+	// Interval is the time between runs. Runs are aligned to multiples of
+	// it, so all instances agree on them.
+	Interval time.Duration
+	// Timeout bounds a single run
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+}
+
+// Scheduler runs jobs on their intervals. A job whose current interval has
+// not run yet, such as after the first deploy, runs right away on start.
+type Scheduler struct {
+	store repository.JobStore
+	jobs  []Job
+	wg    sync.WaitGroup
+	done  chan struct{}
+}
+
+// NewScheduler creates a scheduler of jobs coordinated through store. Jobs
+// with a zero interval are disabled.
+func NewScheduler(store repository.JobStore, jobs ...Job) *Scheduler {
+	s := &Scheduler{store: store, done: make(chan struct{})}
+	for _, job := range jobs {
+		if job.Interval > 0 {
+			s.jobs = append(s.jobs, job)
+		}
+	}
+	return s
+}
+
+// Start begins scheduling the jobs
+func (s *Scheduler) Start() {
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go s.schedule(job)
+	}
+}
+
+// Stop stops scheduling and waits for running jobs to finish
+func (s *Scheduler) Stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// schedule runs a job at the start of each of its intervals
+func (s *Scheduler) schedule(job Job) {
+	defer s.wg.Done()
+
+	for {
+		slot := time.Now().Truncate(job.Interval)
+		s.run(job, slot)
+
+		timer := time.NewTimer(time.Until(slot.Add(job.Interval)))
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// run runs the job for the interval starting at slot, unless another instance
+// has claimed it
+func (s *Scheduler) run(job Job, slot time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), job.Timeout)
+	defer cancel()
+
+	finish, err := s.store.ClaimJobRun(ctx, job.Name, slot)
+	if err != nil {
+		log.Printf("Error claiming job %s: %v\n", job.Name, err)
+		return
+	}
+	if finish == nil {
+		return
+	}
+
+	err = job.Run(ctx)
+	finish(err)
+	if err != nil {
+		log.Printf("Error running job %s: %v\n", job.Name, err)
+		jobMetrics.Add(job.Name+"_failures", 1)
+		return
+	}
+	jobMetrics.Add(job.Name+"_runs", 1)
+}
+
+// setMetric sets a gauge in jobMetrics
+func setMetric(key string, value float64) {
+	v, ok := jobMetrics.Get(key).(*expvar.Float)
+	if !ok {
+		v = new(expvar.Float)
+		jobMetrics.Set(key, v)
+	}
+	v.Set(value)
+}
@@ -0,0 +1,162 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// fakeJobStore claims job runs in memory like the job_runs table does
+type fakeJobStore struct {
+	mu      sync.Mutex
+	slots   map[string]time.Time
+	running map[string]bool
+	errs    []error
+}
+
+func newFakeJobStore() *fakeJobStore {
+	return &fakeJobStore{slots: make(map[string]time.Time), running: make(map[string]bool)}
+}
+
+func (f *fakeJobStore) ClaimJobRun(ctx context.Context, name string, slot time.Time) (func(error), error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.running[name] {
+		return nil, nil
+	}
+	if last, ok := f.slots[name]; ok && !last.Before(slot) {
+		return nil, nil
+	}
+	f.slots[name] = slot
+	f.running[name] = true
+
+	return func(runErr error) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.running[name] = false
+		f.errs = append(f.errs, runErr)
+	}, nil
+}
+
+type fakePartitionStore struct {
+	mu    sync.Mutex
+	calls []time.Duration
+}
+
+func (f *fakePartitionStore) MaintainViewEventPartitions(ctx context.Context, now time.Time, ahead int, retention time.Duration) (repository.PartitionChanges, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, retention)
+	return repository.PartitionChanges{Created: []string{"view_events_p20240101"}}, nil
+}
+
+func TestPartitionMaintenance(t *testing.T) {
+	store := &fakePartitionStore{}
+	scheduler := NewScheduler(newFakeJobStore(), PartitionMaintenance(store, 7, 48*time.Hour))
+	scheduler.Start()
+
+	// Partitions are created on start rather than after the first interval
+	assert.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.calls) == 1
+	}, time.Second, 10*time.Millisecond)
+	scheduler.Stop()
+
+	assert.Equal(t, []time.Duration{48 * time.Hour}, store.calls)
+}
+
+type fakeDedupStore struct {
+	mu     sync.Mutex
+	before []time.Time
+}
+
+func (f *fakeDedupStore) PurgeViewDedup(ctx context.Context, before time.Time) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.before = append(f.before, before)
+	return 3, nil
+}
+
+func TestViewDedupPurge(t *testing.T) {
+	store := &fakeDedupStore{}
+	scheduler := NewScheduler(newFakeJobStore(), ViewDedupPurge(store, 30*time.Minute))
+	scheduler.Start()
+
+	assert.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.before) == 1
+	}, time.Second, 10*time.Millisecond)
+	scheduler.Stop()
+
+	// Entries older than the window are purged
+	assert.WithinDuration(t, time.Now().Add(-30*time.Minute), store.before[0], time.Second)
+}
+
+func TestSchedulerRunsEachIntervalOnce(t *testing.T) {
+	store := newFakeJobStore()
+
+	var mu sync.Mutex
+	runs := make(map[time.Time]int)
+	job := Job{
+		Name:     "test",
+		Interval: 50 * time.Millisecond,
+		Timeout:  time.Second,
+		Run: func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			runs[time.Now().Truncate(50*time.Millisecond)]++
+			return nil
+		},
+	}
+
+	// Three instances schedule the same job
+	var schedulers []*Scheduler
+	for i := 0; i < 3; i++ {
+		s := NewScheduler(store, job)
+		s.Start()
+		schedulers = append(schedulers, s)
+	}
+	time.Sleep(300 * time.Millisecond)
+	for _, s := range schedulers {
+		s.Stop()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.GreaterOrEqual(t, len(runs), 4)
+	for slot, n := range runs {
+		assert.Equal(t, 1, n, "interval %s ran %d times", slot, n)
+	}
+}
+
+func TestSchedulerRecordsFailures(t *testing.T) {
+	store := newFakeJobStore()
+	failure := errors.New("boom")
+	disabled := Job{Name: "disabled", Run: func(ctx context.Context) error {
+		t.Error("disabled job ran")
+		return nil
+	}}
+	failing := Job{Name: "failing", Interval: time.Hour, Timeout: time.Second, Run: func(ctx context.Context) error {
+		return failure
+	}}
+
+	scheduler := NewScheduler(store, disabled, failing)
+	scheduler.Start()
+	assert.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.errs) == 1
+	}, time.Second, 10*time.Millisecond)
+	scheduler.Stop()
+
+	assert.ErrorIs(t, store.errs[0], failure)
+	assert.False(t, store.running["failing"])
+}
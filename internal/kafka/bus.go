@@ -0,0 +1,377 @@
+package kafka
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/tushar-kalsi/product-views/internal/eventbus"
+)
+
+// Event bus backends selectable with OpenBus
+const (
+	BusKafka    = "kafka"
+	BusMemory   = "memory"
+	BusPostgres = "postgres"
+)
+
+// OpenBus returns the event bus backend with the given name. The memory bus
+// only connects publishers and subscribers within this process; the postgres
+// bus stores messages in db. Options apply to the Kafka bus only.
+func OpenBus(backend, brokers string, db *sql.DB, opts ...BusOption) (eventbus.Bus, error) {
+	switch backend {
+	case BusKafka:
+		return NewBus(brokers, opts...), nil
+	case BusMemory:
+		return eventbus.NewMemoryBus(1), nil
+	case BusPostgres:
+		return eventbus.NewPostgresBus(db), nil
+	default:
+		return nil, fmt.Errorf("unknown event bus backend %q", backend)
+	}
+}
+
+// Bus is the Kafka event bus backend
+type Bus struct {
+	brokers     string
+	partitioner string
+}
+
+// BusOption configures optional Bus behaviour
+type BusOption func(*Bus)
+
+// WithPartitioner sets the librdkafka partitioner mapping message keys to
+// partitions, e.g. murmur2_random to match the Java client. Unkeyed messages
+// are spread randomly by the *_random partitioners.
+func WithPartitioner(partitioner string) BusOption {
+	return func(b *Bus) {
+		b.partitioner = partitioner
+	}
+}
+
+// NewBus creates a Kafka bus on the given brokers
+func NewBus(brokers string, opts ...BusOption) *Bus {
+	bus := &Bus{brokers: brokers}
+	for _, opt := range opts {
+		opt(bus)
+	}
+	return bus
+}
+
+// Publisher publishes messages to Kafka
+type Publisher struct {
+	producer *kafka.Producer
+	// events is closed once every delivery report has been handled
+	events chan struct{}
+
+	mu        sync.Mutex
+	onFailure func(*eventbus.Message)
+}
+
+// NewPublisher creates a Kafka producer
+func (b *Bus) NewPublisher() (eventbus.Publisher, error) {
+	config := &kafka.ConfigMap{
+		"bootstrap.servers": b.brokers,
+		"message.max.bytes": 1000000, // 1MB
+		"retries":           3,
+		"acks":              "all",
+	}
+	if b.partitioner != "" {
+		if err := config.SetKey("partitioner", b.partitioner); err != nil {
+			return nil, err
+		}
+	}
+
+	p, err := kafka.NewProducer(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create producer: %w", err)
+	}
+
+	publisher := &Publisher{producer: p, events: make(chan struct{})}
+	go publisher.handleEvents()
+
+	return publisher, nil
+}
+
+// handleEvents handles delivery reports of asynchronous publishes until the producer is closed
+func (p *Publisher) handleEvents() {
+	defer close(p.events)
+
+	for e := range p.producer.Events() {
+		switch ev := e.(type) {
+		case *kafka.Message:
+			if ev.TopicPartition.Error == nil {
+				continue
+			}
+			p.mu.Lock()
+			onFailure := p.onFailure
+			p.mu.Unlock()
+
+			if onFailure == nil {
+				log.Printf("Delivery failed: %v\n", ev.TopicPartition.Error)
+				continue
+			}
+			onFailure(fromKafkaMessage(ev))
+		}
+	}
+}
+
+// NotifyDeliveryFailures passes messages whose asynchronous delivery failed to
+// handler instead of logging them. Messages still queued when the publisher is
+// closed are passed to it too.
+func (p *Publisher) NotifyDeliveryFailures(handler func(*eventbus.Message)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onFailure = handler
+}
+
+// Publish enqueues messages in librdkafka's queue and returns without waiting for delivery
+func (p *Publisher) Publish(ctx context.Context, msgs ...*eventbus.Message) error {
+	for _, msg := range msgs {
+		if err := p.producer.Produce(toKafkaMessage(msg), nil); err != nil {
+			return fmt.Errorf("failed to produce message: %w", err)
+		}
+	}
+	return nil
+}
+
+// PublishSync produces messages and waits for the brokers to acknowledge all of them
+func (p *Publisher) PublishSync(ctx context.Context, msgs ...*eventbus.Message) error {
+	delivery := make(chan kafka.Event, len(msgs))
+	for _, msg := range msgs {
+		km := toKafkaMessage(msg)
+		// Delivery reports carry the opaque value back to match them up
+		km.Opaque = msg
+		if err := p.producer.Produce(km, delivery); err != nil {
+			return fmt.Errorf("failed to produce message: %w", err)
+		}
+	}
+
+	var errs []string
+	for range msgs {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e := <-delivery:
+			km, ok := e.(*kafka.Message)
+			if !ok {
+				continue
+			}
+			if km.TopicPartition.Error != nil {
+				errs = append(errs, km.TopicPartition.Error.Error())
+				continue
+			}
+			if msg, ok := km.Opaque.(*eventbus.Message); ok {
+				msg.Partition = km.TopicPartition.Partition
+				msg.Offset = int64(km.TopicPartition.Offset)
+				msg.Timestamp = km.Timestamp
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("delivery failed: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Close waits up to 15 seconds for queued messages and closes the producer.
+// With a delivery failure handler, messages still queued after that are purged
+// and passed to it rather than lost.
+func (p *Publisher) Close() error {
+	remaining := p.producer.Flush(15 * 1000)
+
+	p.mu.Lock()
+	onFailure := p.onFailure
+	p.mu.Unlock()
+	if remaining > 0 && onFailure != nil {
+		if err := p.producer.Purge(kafka.PurgeQueue | kafka.PurgeInFlight); err != nil {
+			log.Printf("Failed to purge producer queue: %v\n", err)
+		}
+		// Serve the delivery reports of the purged messages
+		p.producer.Flush(5 * 1000)
+	}
+
+	p.producer.Close()
+	<-p.events
+	return nil
+}
+
+// Subscriber consumes a Kafka topic as a member of a consumer group
+type Subscriber struct {
+	consumer  *kafka.Consumer
+	rebalance eventbus.Rebalance
+}
+
+// NewSubscriber creates a Kafka consumer in the given group. Offsets are only
+// committed explicitly.
+func (b *Bus) NewSubscriber(groupID string) (eventbus.Subscriber, error) {
+	config := &kafka.ConfigMap{
+		"bootstrap.servers":    b.brokers,
+		"group.id":             groupID,
+		"auto.offset.reset":    "earliest",
+		"enable.auto.commit":   false,  // We'll commit manually after processing
+		"max.poll.interval.ms": 300000, // 5 minutes
+		"session.timeout.ms":   10000,  // 10 seconds
+	}
+
+	c, err := kafka.NewConsumer(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
+	}
+
+	return &Subscriber{consumer: c}, nil
+}
+
+// Subscribe joins the group's subscription to topic
+func (s *Subscriber) Subscribe(topic string, rebalance eventbus.Rebalance) error {
+	s.rebalance = rebalance
+	return s.consumer.Subscribe(topic, s.onRebalance)
+}
+
+// onRebalance forwards rebalance events. librdkafka assigns and revokes the
+// partitions itself unless the callback does.
+func (s *Subscriber) onRebalance(c *kafka.Consumer, ev kafka.Event) error {
+	switch e := ev.(type) {
+	case kafka.AssignedPartitions:
+		if s.rebalance.Assigned == nil {
+			return nil
+		}
+		positions, err := s.rebalance.Assigned(toPositions(e.Partitions))
+		if err != nil {
+			return err
+		}
+		return c.Assign(toTopicPartitions(positions))
+
+	case kafka.RevokedPartitions:
+		if s.rebalance.Revoked != nil {
+			s.rebalance.Revoked(toPositions(e.Partitions))
+		}
+	}
+	return nil
+}
+
+// Poll reads the next message, returning nil if none arrived within timeout
+func (s *Subscriber) Poll(timeout time.Duration) (*eventbus.Message, error) {
+	msg, err := s.consumer.ReadMessage(timeout)
+	if err != nil {
+		var kerr kafka.Error
+		if errors.As(err, &kerr) && kerr.Code() == kafka.ErrTimedOut {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return fromKafkaMessage(msg), nil
+}
+
+// Commit commits the group's offsets
+func (s *Subscriber) Commit(positions []eventbus.Position) error {
+	_, err := s.consumer.CommitOffsets(toTopicPartitions(positions))
+	return err
+}
+
+// lookupTimeoutMs bounds the metadata and offset queries of OffsetsForTime
+const lookupTimeoutMs = 10000
+
+// OffsetsForTime looks up the offsets of every partition of topic by
+// timestamp. Partitions without a message at or after t return their high
+// watermark.
+func (s *Subscriber) OffsetsForTime(topic string, t time.Time) ([]eventbus.Position, error) {
+	md, err := s.consumer.GetMetadata(&topic, false, lookupTimeoutMs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata: %w", err)
+	}
+	tm, ok := md.Topics[topic]
+	if !ok || tm.Error.Code() != kafka.ErrNoError {
+		return nil, fmt.Errorf("failed to get metadata of topic %s: %v", topic, tm.Error)
+	}
+
+	tps := make([]kafka.TopicPartition, len(tm.Partitions))
+	for i, p := range tm.Partitions {
+		tps[i] = kafka.TopicPartition{Topic: &topic, Partition: p.ID, Offset: kafka.Offset(t.UnixMilli())}
+	}
+	tps, err = s.consumer.OffsetsForTimes(tps, lookupTimeoutMs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up offsets: %w", err)
+	}
+
+	positions := make([]eventbus.Position, len(tps))
+	for i, tp := range tps {
+		offset := int64(tp.Offset)
+		if offset < 0 {
+			if _, offset, err = s.consumer.QueryWatermarkOffsets(topic, tp.Partition, lookupTimeoutMs); err != nil {
+				return nil, fmt.Errorf("failed to query watermarks of partition %d: %w", tp.Partition, err)
+			}
+		}
+		positions[i] = eventbus.Position{Topic: topic, Partition: tp.Partition, Offset: offset}
+	}
+	return positions, nil
+}
+
+// Close leaves the group and closes the consumer
+func (s *Subscriber) Close() error {
+	return s.consumer.Close()
+}
+
+func toKafkaMessage(msg *eventbus.Message) *kafka.Message {
+	topic := msg.Topic
+	km := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Timestamp:      msg.Timestamp,
+	}
+	for _, h := range msg.Headers {
+		km.Headers = append(km.Headers, kafka.Header{Key: h.Key, Value: h.Value})
+	}
+	return km
+}
+
+func fromKafkaMessage(km *kafka.Message) *eventbus.Message {
+	msg := &eventbus.Message{
+		Partition: km.TopicPartition.Partition,
+		Offset:    int64(km.TopicPartition.Offset),
+		Key:       km.Key,
+		Value:     km.Value,
+		Timestamp: km.Timestamp,
+	}
+	if km.TopicPartition.Topic != nil {
+		msg.Topic = *km.TopicPartition.Topic
+	}
+	for _, h := range km.Headers {
+		msg.Headers = append(msg.Headers, eventbus.Header{Key: h.Key, Value: h.Value})
+	}
+	return msg
+}
+
+func toPositions(tps []kafka.TopicPartition) []eventbus.Position {
+	positions := make([]eventbus.Position, len(tps))
+	for i, tp := range tps {
+		positions[i] = eventbus.Position{Partition: tp.Partition, Offset: int64(tp.Offset)}
+		if tp.Topic != nil {
+			positions[i].Topic = *tp.Topic
+		}
+		if tp.Offset < 0 {
+			positions[i].Offset = eventbus.OffsetCommitted
+		}
+	}
+	return positions
+}
+
+func toTopicPartitions(positions []eventbus.Position) []kafka.TopicPartition {
+	tps := make([]kafka.TopicPartition, len(positions))
+	for i, pos := range positions {
+		topic := pos.Topic
+		tps[i] = kafka.TopicPartition{Topic: &topic, Partition: pos.Partition, Offset: kafka.Offset(pos.Offset)}
+		if pos.Offset == eventbus.OffsetCommitted {
+			tps[i].Offset = kafka.OffsetStored
+		}
+	}
+	return tps
+}
@@ -2,52 +2,176 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"slices"
 	"sync"
 	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/google/uuid"
+	"github.com/tushar-kalsi/product-views/internal/eventbus"
+	"github.com/tushar-kalsi/product-views/internal/leaderboard"
 	"github.com/tushar-kalsi/product-views/internal/repository"
 )
 
-// Consumer handles consuming and processing messages from Kafka
+const (
+	// maxFlushBackoff caps the delay between attempts to flush a failed batch
+	maxFlushBackoff = 5 * time.Second
+	// flushTimeout bounds a single attempt to write a batch to the database
+	flushTimeout = 30 * time.Second
+)
+
+// ArchivedViewPolicy decides what the consumer does with views of archived products
+type ArchivedViewPolicy string
+
+const (
+	// ArchivedViewsCount records them like any other view
+	ArchivedViewsCount ArchivedViewPolicy = "count"
+	// ArchivedViewsDrop acknowledges them without recording them
+	ArchivedViewsDrop ArchivedViewPolicy = "drop"
+	// ArchivedViewsDeadLetter publishes them to the dead-letter topic, from
+	// where they can be re-driven if the product is restored
+	ArchivedViewsDeadLetter ArchivedViewPolicy = "dead_letter"
+)
+
+// Valid reports whether p is one of the known policies
+func (p ArchivedViewPolicy) Valid() bool {
+	switch p {
+	case ArchivedViewsCount, ArchivedViewsDrop, ArchivedViewsDeadLetter:
+		return true
+	}
+	return false
+}
+
+// consumerMetrics exposes consumer throughput and flush latency under /debug/vars
+var consumerMetrics = expvar.NewMap("kafka_consumer")
+
+// Consumer handles consuming and processing view events from the event bus
 type Consumer struct {
-	consumer *kafka.Consumer
-	topic    string
-	repo     repository.ProductRepository
-	wg       sync.WaitGroup
-	done     chan struct{}
+	subscriber     eventbus.Subscriber
+	groupID        string
+	topic          string
+	repo           repository.ProductRepository
+	dedupWindow    time.Duration
+	trendHalfLife  time.Duration
+	leaderboard    *leaderboard.Leaderboard
+	deadLetters    DeadLetterSender
+	offsetStore    repository.OffsetStore
+	archivedPolicy ArchivedViewPolicy
+	counterShards  int
+	batchSize      int
+	batchInterval  time.Duration
+	// pending holds messages read but not yet flushed. It is only touched by
+	// the processing goroutine, which also runs the rebalance callback.
+	pending      []*eventbus.Message
+	pendingSince time.Time
+	wg           sync.WaitGroup
+	done         chan struct{}
+}
+
+// ConsumerOption configures optional Consumer behaviour
+type ConsumerOption func(*Consumer)
+
+// WithDedupWindow counts repeated views of a product by the same user or session
+// once per window in the unique view count. A zero window disables deduplication.
+func WithDedupWindow(window time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		c.dedupWindow = window
+	}
 }
 
-// NewConsumer creates a new Kafka consumer
-func NewConsumer(brokers, groupID, topic string, repo repository.ProductRepository) (*Consumer, error) {
-	config := &kafka.ConfigMap{
-		"bootstrap.servers":    brokers,
-		"group.id":             groupID,
-		"auto.offset.reset":    "earliest",
-		"enable.auto.commit":   false,  // We'll commit manually after processing
-		"max.poll.interval.ms": 300000, // 5 minutes
-		"session.timeout.ms":   10000,  // 10 seconds
+// WithTrendHalfLife maintains each product's trending score with the given
+// half-life. A zero half-life disables trending scores.
+func WithTrendHalfLife(halfLife time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		c.trendHalfLife = halfLife
 	}
+}
 
-	c, err := kafka.NewConsumer(config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create consumer: %w", err)
+// WithLeaderboard feeds the updated view count of every recorded view into the leaderboard
+func WithLeaderboard(lb *leaderboard.Leaderboard) ConsumerOption {
+	return func(c *Consumer) {
+		c.leaderboard = lb
+	}
+}
+
+// WithDeadLetters publishes messages that fail permanently, such as undecodable
+// payloads or views of unknown products, to a dead-letter topic. Without it such
+// messages are logged and dropped.
+func WithDeadLetters(sender DeadLetterSender) ConsumerOption {
+	return func(c *Consumer) {
+		c.deadLetters = sender
+	}
+}
+
+// WithExactlyOnce stores the consumer's offsets in the database in the same
+// transaction as the views they cover, and resumes from the stored offsets when
+// partitions are assigned. A crash between recording a batch and committing its
+// offsets to Kafka then neither loses nor double-counts views. Offsets are still
+// committed to Kafka afterwards so that lag monitoring keeps working.
+func WithExactlyOnce(store repository.OffsetStore) ConsumerOption {
+	return func(c *Consumer) {
+		c.offsetStore = store
+	}
+}
+
+// WithArchivedViewPolicy sets what happens to views of archived products.
+// They are counted by default.
+func WithArchivedViewPolicy(policy ArchivedViewPolicy) ConsumerOption {
+	return func(c *Consumer) {
+		c.archivedPolicy = policy
+	}
+}
+
+// WithShardedCounters spreads the view count increments of each product over
+// shards rows picked at random, so that views of a popular product do not
+// contend for its products row. The shards are compacted into the products
+// table by a scheduled job.
+func WithShardedCounters(shards int) ConsumerOption {
+	return func(c *Consumer) {
+		c.counterShards = shards
+	}
+}
+
+// WithBatching accumulates up to size messages, or as many as arrive within
+// interval of the first one, and records them with a single database
+// transaction. Offsets are committed only once the batch has been recorded.
+func WithBatching(size int, interval time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		if size > 0 {
+			c.batchSize = size
+		}
+		c.batchInterval = interval
+	}
+}
+
+// NewConsumer creates a consumer that reads view events from topic through
+// subscriber, which must belong to groupID
+func NewConsumer(subscriber eventbus.Subscriber, groupID, topic string, repo repository.ProductRepository, opts ...ConsumerOption) *Consumer {
+	consumer := &Consumer{
+		subscriber: subscriber,
+		groupID:    groupID,
+		topic:      topic,
+		repo:       repo,
+		batchSize:  1,
+		done:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(consumer)
 	}
 
-	return &Consumer{
-		consumer: c,
-		topic:    topic,
-		repo:     repo,
-		done:     make(chan struct{}),
-	}, nil
+	return consumer
 }
 
 // Start begins consuming messages
 func (c *Consumer) Start() error {
-	if err := c.consumer.Subscribe(c.topic, nil); err != nil {
+	rebalance := eventbus.Rebalance{
+		Assigned: c.assigned,
+		Revoked:  c.revoked,
+	}
+	if err := c.subscriber.Subscribe(c.topic, rebalance); err != nil {
 		return fmt.Errorf("failed to subscribe to topic: %w", err)
 	}
 
@@ -61,7 +185,9 @@ func (c *Consumer) Start() error {
 func (c *Consumer) Stop() {
 	close(c.done)
 	c.wg.Wait()
-	_ = c.consumer.Close()
+	if err := c.subscriber.Close(); err != nil {
+		log.Printf("Error closing subscriber: %v\n", err)
+	}
 }
 
 func (c *Consumer) processMessages() {
@@ -70,44 +196,446 @@ func (c *Consumer) processMessages() {
 	for {
 		select {
 		case <-c.done:
+			// Give the pending batch one attempt; anything not committed is redelivered
+			c.flush()
 			return
 		default:
-			msg, err := c.consumer.ReadMessage(100 * time.Millisecond)
-			if err != nil {
-				if err.(kafka.Error).Code() == kafka.ErrTimedOut {
+			timeout := 100 * time.Millisecond
+			if len(c.pending) > 0 {
+				remaining := c.batchInterval - time.Since(c.pendingSince)
+				if remaining <= 0 {
+					c.flush()
 					continue
 				}
+				timeout = min(timeout, remaining)
+			}
+
+			msg, err := c.subscriber.Poll(timeout)
+			if err != nil {
 				log.Printf("Consumer error: %v\n", err)
 				continue
 			}
-
-			// Process the message
-			if err := c.handleMessage(msg); err != nil {
-				log.Printf("Error handling message: %v\n", err)
+			if msg == nil {
 				continue
 			}
 
-			// Commit the offset after successful processing
-			if _, err := c.consumer.CommitMessage(msg); err != nil {
-				log.Printf("Error committing offset: %v\n", err)
+			if len(c.pending) == 0 {
+				c.pendingSince = time.Now()
+			}
+			c.pending = append(c.pending, msg)
+			if len(c.pending) >= c.batchSize {
+				c.flush()
 			}
 		}
 	}
 }
 
-func (c *Consumer) handleMessage(msg *kafka.Message) error {
-	var event ViewEvent
-	if err := json.Unmarshal(msg.Value, &event); err != nil {
-		return fmt.Errorf("failed to unmarshal message: %w", err)
+// assigned starts newly assigned partitions from the offsets stored in the
+// database in exactly-once mode, and from the group's commit otherwise
+func (c *Consumer) assigned(partitions []eventbus.Position) ([]eventbus.Position, error) {
+	if c.offsetStore == nil {
+		return partitions, nil
+	}
+
+	var resumed []eventbus.Position
+	if !c.retry("loading consumer offsets", func() error {
+		var err error
+		resumed, err = c.resumeOffsets(partitions)
+		return err
+	}) {
+		return nil, errors.New("consumer stopped")
+	}
+	return resumed, nil
+}
+
+// revoked flushes the pending batch before partitions are revoked so that its
+// offsets are committed while this consumer still owns them
+func (c *Consumer) revoked(partitions []eventbus.Position) {
+	c.flush()
+}
+
+// resumeOffsets sets each partition's starting offset to the one stored in the
+// database. Partitions without a stored offset resume from the group's commit.
+func (c *Consumer) resumeOffsets(partitions []eventbus.Position) ([]eventbus.Position, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	stored, err := c.offsetStore.LoadConsumerOffsets(ctx, c.groupID, c.topic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load consumer offsets: %w", err)
+	}
+
+	resumed := make([]eventbus.Position, len(partitions))
+	for i, pos := range partitions {
+		if offset, ok := stored[pos.Partition]; ok {
+			pos.Offset = offset
+		} else {
+			pos.Offset = eventbus.OffsetCommitted
+		}
+		resumed[i] = pos
+	}
+	return resumed, nil
+}
+
+// flush records the pending batch and dead-letters its permanent failures, then
+// commits the highest offset of each partition. Transient errors are retried with
+// backoff until they succeed or the consumer stops, in which case nothing is
+// committed and the batch is redelivered.
+func (c *Consumer) flush() {
+	if len(c.pending) == 0 {
+		return
+	}
+	msgs := c.pending
+	c.pending = nil
+
+	failures, ok := c.recordWithRetry(msgs, nil)
+	if !ok {
+		return
+	}
+
+	if len(failures) > 0 && !c.retry("dead-lettering failed messages", func() error {
+		return c.sendDeadLetters(failures)
+	}) {
+		return
+	}
+
+	// Batches store their offsets only up to their first failure in each
+	// partition; now that the failures are dead-lettered, move past them
+	if c.offsetStore != nil && !c.retry("saving consumer offsets", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+		defer cancel()
+		return c.offsetStore.SaveConsumerOffsets(ctx, *c.batchOffsets(msgs))
+	}) {
+		return
+	}
+
+	if err := c.subscriber.Commit(commitOffsets(msgs)); err != nil {
+		log.Printf("Error committing offsets: %v\n", err)
+	}
+}
+
+// recordWithRetry records msgs and returns the messages that failed permanently.
+// When the database rejects a batch because of the data in it, the batch is
+// split in half until the offending messages are isolated. Failures found
+// earlier in the flush are passed in held so that no stored offset passes them.
+// It returns false if the consumer stopped before the batch could be recorded.
+func (c *Consumer) recordWithRetry(msgs []*eventbus.Message, held []Failure) ([]Failure, bool) {
+	var failures []Failure
+	var batchErr error
+
+	ok := c.retry(fmt.Sprintf("processing batch of %d messages", len(msgs)), func() error {
+		var err error
+		failures, err = c.processBatch(msgs, held)
+		if repository.IsInvalidData(err) {
+			batchErr = err
+			return nil
+		}
+		return err
+	})
+	if !ok || batchErr == nil {
+		return failures, ok
+	}
+
+	if len(msgs) == 1 {
+		return []Failure{{Message: msgs[0], Reason: ReasonInvalidData, Err: batchErr}}, true
+	}
+
+	mid := len(msgs) / 2
+	left, ok := c.recordWithRetry(msgs[:mid], held)
+	if !ok {
+		return nil, false
+	}
+	right, ok := c.recordWithRetry(msgs[mid:], slices.Concat(held, left))
+	if !ok {
+		return nil, false
+	}
+	return append(left, right...), true
+}
+
+// retry runs fn until it succeeds, backing off exponentially between attempts.
+// It returns false if the consumer stopped first.
+func (c *Consumer) retry(what string, fn func() error) bool {
+	backoff := 100 * time.Millisecond
+	for {
+		err := fn()
+		if err == nil {
+			return true
+		}
+		log.Printf("Error %s, retrying in %v: %v\n", what, backoff, err)
+
+		select {
+		case <-c.done:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxFlushBackoff)
+	}
+}
+
+// sendDeadLetters publishes permanent failures, or logs them if no dead-letter
+// topic is configured
+func (c *Consumer) sendDeadLetters(failures []Failure) error {
+	if c.deadLetters == nil {
+		for _, f := range failures {
+			log.Printf("Dropping message at %s (%s): %v\n", messagePosition(f.Message), f.Reason, f.Err)
+		}
+		consumerMetrics.Add("messages_dropped", int64(len(failures)))
+		return nil
 	}
 
-	// Update the view count in the database
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
 	defer cancel()
 
-	if err := c.repo.IncrementViewCount(ctx, event.ProductID); err != nil {
-		return fmt.Errorf("failed to increment view count: %w", err)
+	if err := c.deadLetters.Send(ctx, failures); err != nil {
+		return fmt.Errorf("failed to send dead letters: %w", err)
 	}
 
+	for _, f := range failures {
+		log.Printf("Dead-lettered message at %s (%s): %v\n", messagePosition(f.Message), f.Reason, f.Err)
+	}
+	consumerMetrics.Add("messages_dead_lettered", int64(len(failures)))
 	return nil
 }
+
+// processBatch records the views in a batch of messages in one transaction and
+// returns the messages that can never be recorded: undecodable payloads, views
+// of unknown products and, under ArchivedViewsDeadLetter, views of archived
+// products. An error means nothing was recorded. The stored offsets stop at the
+// first failure of each partition, including the held failures of messages
+// before the batch, until flush has dead-lettered them.
+func (c *Consumer) processBatch(msgs []*eventbus.Message, held []Failure) ([]Failure, error) {
+	start := time.Now()
+
+	var failures []Failure
+	events := make([]*repository.ViewEvent, 0, len(msgs))
+	sources := make(map[uuid.UUID][]*eventbus.Message, len(msgs))
+	for _, msg := range msgs {
+		event, err := decodeMessage(msg)
+		switch {
+		case errors.Is(err, errUnknownEventType):
+			// Other event types may share the topic; they are not ours to handle
+			consumerMetrics.Add("messages_skipped", 1)
+			continue
+		case errors.Is(err, errUnsupportedVersion):
+			// Kept for a re-drive once the consumer understands the version
+			failures = append(failures, Failure{Message: msg, Reason: ReasonUnsupportedVersion, Err: err})
+			continue
+		case err != nil:
+			failures = append(failures, Failure{Message: msg, Reason: ReasonDecodeError, Err: err})
+			continue
+		}
+		events = append(events, toRepositoryEvent(event))
+		sources[event.EventID] = append(sources[event.EventID], msg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	opts := repository.RecordOptions{
+		DedupWindow:   c.dedupWindow,
+		TrendHalfLife: c.trendHalfLife,
+		CounterShards: c.counterShards,
+		SkipArchived:  c.archivedPolicy == ArchivedViewsDrop || c.archivedPolicy == ArchivedViewsDeadLetter,
+	}
+	if c.offsetStore != nil {
+		opts.Offsets = c.batchOffsets(msgs).StopAt(failedOffsets(slices.Concat(held, failures)))
+		opts.Offsets.Positions = make(map[uuid.UUID][]repository.PartitionOffset, len(sources))
+		for id, sourced := range sources {
+			opts.Offsets.Positions[id] = messageOffsets(sourced)
+		}
+	}
+	result, err := c.repo.RecordViews(ctx, events, opts)
+	if err != nil {
+		consumerMetrics.Add("flush_errors", 1)
+		return nil, fmt.Errorf("failed to record views: %w", err)
+	}
+
+	for _, id := range result.NotFound {
+		msg := sources[id][0]
+		sources[id] = sources[id][1:]
+		failures = append(failures, Failure{
+			Message: msg,
+			Reason:  ReasonProductNotFound,
+			Err:     fmt.Errorf("view event %s: product not found", id),
+		})
+	}
+
+	for _, id := range result.Archived {
+		msg := sources[id][0]
+		sources[id] = sources[id][1:]
+		if c.archivedPolicy == ArchivedViewsDrop {
+			consumerMetrics.Add("archived_views_dropped", 1)
+			continue
+		}
+		failures = append(failures, Failure{
+			Message: msg,
+			Reason:  ReasonProductArchived,
+			Err:     fmt.Errorf("view event %s: product is archived", id),
+		})
+	}
+
+	if c.leaderboard != nil {
+		for id, counts := range result.Counts {
+			c.leaderboard.Update(ctx, id, counts.ViewCount)
+		}
+	}
+
+	elapsed := float64(time.Since(start).Microseconds()) / 1000
+	consumerMetrics.Add("messages", int64(len(msgs)))
+	consumerMetrics.Add("views_recorded", int64(result.Recorded))
+	consumerMetrics.Add("duplicates", int64(result.Duplicates))
+	consumerMetrics.Add("messages_failed", int64(len(failures)))
+	consumerMetrics.Add("flushes", 1)
+	consumerMetrics.AddFloat("flush_ms_total", elapsed)
+	setMetric("flush_ms_last", elapsed)
+	setMetric("batch_size_last", float64(len(msgs)))
+
+	return failures, nil
+}
+
+// viewDecoders maps each supported schema of view events to its decoder
+var viewDecoders = map[eventSchema]func(*eventbus.Message) (*ViewEvent, error){
+	{EventTypeProductViewed, 1}: decodeViewEventV1,
+}
+
+// decodeMessage decodes the view event carried by a message with the decoder
+// for its event type and schema version
+func decodeMessage(msg *eventbus.Message) (*ViewEvent, error) {
+	schema, err := messageSchema(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	decode, ok := viewDecoders[schema]
+	if !ok {
+		if schema.eventType != EventTypeProductViewed {
+			return nil, fmt.Errorf("%w %q", errUnknownEventType, schema.eventType)
+		}
+		return nil, fmt.Errorf("%w %d of %s", errUnsupportedVersion, schema.version, schema.eventType)
+	}
+
+	event, err := decode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Events produced before event IDs existed get a stable ID derived from
+	// their position in the topic so that redelivery stays idempotent
+	if event.EventID == uuid.Nil {
+		event.EventID = legacyEventID(msg)
+	}
+
+	return event, nil
+}
+
+// commitOffsets returns the positions to commit after processing msgs: one past
+// the highest offset read from each partition
+func commitOffsets(msgs []*eventbus.Message) []eventbus.Position {
+	type partition struct {
+		topic string
+		id    int32
+	}
+
+	next := make(map[partition]int64)
+	for _, msg := range msgs {
+		key := partition{topic: msg.Topic, id: msg.Partition}
+		if cur, ok := next[key]; !ok || msg.Offset+1 > cur {
+			next[key] = msg.Offset + 1
+		}
+	}
+
+	positions := make([]eventbus.Position, 0, len(next))
+	for p, offset := range next {
+		positions = append(positions, eventbus.Position{Topic: p.topic, Partition: p.id, Offset: offset})
+	}
+	return positions
+}
+
+// batchOffsets returns the consumer offsets to store after processing msgs
+func (c *Consumer) batchOffsets(msgs []*eventbus.Message) *repository.ConsumerOffsets {
+	offsets := &repository.ConsumerOffsets{GroupID: c.groupID}
+	for _, pos := range commitOffsets(msgs) {
+		offsets.Offsets = append(offsets.Offsets, repository.PartitionOffset{
+			Topic:     pos.Topic,
+			Partition: pos.Partition,
+			Offset:    pos.Offset,
+		})
+	}
+	return offsets
+}
+
+// messageOffsets returns the offsets of msgs themselves, from which they would
+// be consumed again
+func messageOffsets(msgs []*eventbus.Message) []repository.PartitionOffset {
+	offsets := make([]repository.PartitionOffset, len(msgs))
+	for i, msg := range msgs {
+		offsets[i] = repository.PartitionOffset{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset}
+	}
+	return offsets
+}
+
+// failedOffsets returns the offsets of the failed messages
+func failedOffsets(failures []Failure) []repository.PartitionOffset {
+	msgs := make([]*eventbus.Message, len(failures))
+	for i, f := range failures {
+		msgs[i] = f.Message
+	}
+	return messageOffsets(msgs)
+}
+
+// setMetric sets a gauge in consumerMetrics
+func setMetric(key string, value float64) {
+	v, ok := consumerMetrics.Get(key).(*expvar.Float)
+	if !ok {
+		v = new(expvar.Float)
+		consumerMetrics.Set(key, v)
+	}
+	v.Set(value)
+}
+
+// viewerKey identifies the viewer of an event for deduplication. Views are keyed
+// by user when known and by session otherwise; anonymous views without a session
+// have no key and are always unique.
+func viewerKey(event *ViewEvent) string {
+	switch {
+	case event.UserID != "":
+		return "user:" + event.UserID
+	case event.SessionID != "":
+		return "session:" + event.SessionID
+	default:
+		return ""
+	}
+}
+
+// messagePosition formats a message's position for logs, e.g. "product-views[3]@42"
+func messagePosition(msg *eventbus.Message) string {
+	return fmt.Sprintf("%s[%d]@%d", msg.Topic, msg.Partition, msg.Offset)
+}
+
+// legacyEventID derives a deterministic event ID from a message's topic, partition and offset
+func legacyEventID(msg *eventbus.Message) uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)))
+}
+
+// toRepositoryEvent maps a Kafka view event to its database representation
+func toRepositoryEvent(e *ViewEvent) *repository.ViewEvent {
+	v := &repository.ViewEvent{
+		EventID:    e.EventID,
+		ProductID:  e.ProductID,
+		UserID:     e.UserID,
+		SessionID:  e.SessionID,
+		Source:     e.Source,
+		DeviceType: e.DeviceType,
+		Referrer:   e.Referrer,
+		OccurredAt: e.OccurredAt(),
+		ViewerKey:  viewerKey(e),
+	}
+	if e.UTM != nil {
+		v.UTMSource = e.UTM.Source
+		v.UTMMedium = e.UTM.Medium
+		v.UTMCampaign = e.UTM.Campaign
+		v.UTMTerm = e.UTM.Term
+		v.UTMContent = e.UTM.Content
+	}
+	return v
+}
@@ -0,0 +1,754 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/tushar-kalsi/product-views/internal/eventbus"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// fakeRepository records batches in memory. Each call costs roundTrip to
+// simulate the latency of a database transaction.
+type fakeRepository struct {
+	repository.ProductRepository
+	mu        sync.Mutex
+	roundTrip time.Duration
+	batches   [][]*repository.ViewEvent
+	counts    map[uuid.UUID]int64
+	err       error
+	// missing products are reported as not found
+	missing map[uuid.UUID]bool
+	// archived products are reported as archived when the options skip them
+	archived map[uuid.UUID]bool
+	// poison products make the whole batch fail as invalid data
+	poison map[uuid.UUID]bool
+	// offsets are stored atomically with the counts, like the real repository
+	offsets map[int32]int64
+	// recorded event IDs are not counted again, like the real repository
+	recorded map[uuid.UUID]bool
+}
+
+func (f *fakeRepository) RecordViews(ctx context.Context, events []*repository.ViewEvent, opts repository.RecordOptions) (repository.BatchResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	time.Sleep(f.roundTrip)
+	if f.err != nil {
+		return repository.BatchResult{}, f.err
+	}
+
+	for _, e := range events {
+		if f.poison[e.ProductID] {
+			return repository.BatchResult{}, &pq.Error{Code: "22008", Message: "date/time field value out of range"}
+		}
+	}
+
+	f.batches = append(f.batches, events)
+	result := repository.BatchResult{Counts: make(map[uuid.UUID]repository.ProductCounts)}
+	for _, e := range events {
+		if f.missing[e.ProductID] {
+			result.NotFound = append(result.NotFound, e.EventID)
+			continue
+		}
+		if opts.SkipArchived && f.archived[e.ProductID] {
+			result.Archived = append(result.Archived, e.EventID)
+			continue
+		}
+		if f.recorded[e.EventID] {
+			result.Duplicates++
+			continue
+		}
+		f.recorded[e.EventID] = true
+		result.Recorded++
+		f.counts[e.ProductID]++
+		result.Counts[e.ProductID] = repository.ProductCounts{ViewCount: f.counts[e.ProductID]}
+	}
+	if opts.Offsets != nil {
+		var skipped []repository.PartitionOffset
+		for _, id := range append(result.NotFound, result.Archived...) {
+			skipped = append(skipped, opts.Offsets.Positions[id]...)
+		}
+		f.saveOffsets(*opts.Offsets.StopAt(skipped))
+	}
+	return result, nil
+}
+
+// count returns the number of views recorded for a product
+func (f *fakeRepository) count(productID uuid.UUID) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[productID]
+}
+
+func (f *fakeRepository) LoadConsumerOffsets(ctx context.Context, groupID, topic string) (map[int32]int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	offsets := make(map[int32]int64, len(f.offsets))
+	for p, o := range f.offsets {
+		offsets[p] = o
+	}
+	return offsets, nil
+}
+
+func (f *fakeRepository) SaveConsumerOffsets(ctx context.Context, offsets repository.ConsumerOffsets) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.saveOffsets(offsets)
+	return nil
+}
+
+func (f *fakeRepository) saveOffsets(offsets repository.ConsumerOffsets) {
+	for _, o := range offsets.Offsets {
+		f.offsets[o.Partition] = max(f.offsets[o.Partition], o.Offset)
+	}
+}
+
+func newFakeRepository(roundTrip time.Duration) *fakeRepository {
+	return &fakeRepository{
+		roundTrip: roundTrip,
+		counts:    make(map[uuid.UUID]int64),
+		offsets:   make(map[int32]int64),
+		recorded:  make(map[uuid.UUID]bool),
+	}
+}
+
+// viewMessages builds n view messages spread over the given products and partitions
+func viewMessages(n int, products []uuid.UUID, partitions int32) []*eventbus.Message {
+	topic := "product-views"
+	msgs := make([]*eventbus.Message, n)
+	for i := range msgs {
+		event := NewViewEvent(products[i%len(products)])
+		event.EventID = uuid.New()
+		event.SessionID = fmt.Sprintf("session-%d", i)
+		value, _ := json.Marshal(event)
+
+		msgs[i] = &eventbus.Message{
+			Topic:     topic,
+			Partition: int32(i) % partitions,
+			Offset:    int64(i),
+			Value:     value,
+		}
+	}
+	return msgs
+}
+
+func TestProcessBatch(t *testing.T) {
+	t.Run("Records decodable messages in one call", func(t *testing.T) {
+		repo := newFakeRepository(0)
+		c := &Consumer{repo: repo, dedupWindow: time.Minute}
+
+		product := uuid.New()
+		msgs := viewMessages(3, []uuid.UUID{product}, 1)
+		garbage := &eventbus.Message{Topic: msgs[0].Topic, Offset: 3, Value: []byte("not json")}
+		msgs = append(msgs, garbage)
+
+		failures, err := c.processBatch(msgs, nil)
+		assert.NoError(t, err)
+		assert.Len(t, repo.batches, 1)
+		assert.Len(t, repo.batches[0], 3)
+		assert.Equal(t, "session:session-0", repo.batches[0][0].ViewerKey)
+		assert.Equal(t, int64(3), repo.counts[product])
+
+		assert.Len(t, failures, 1)
+		assert.Equal(t, garbage, failures[0].Message)
+		assert.Equal(t, ReasonDecodeError, failures[0].Reason)
+	})
+
+	t.Run("Reports views of unknown products as failures", func(t *testing.T) {
+		repo := newFakeRepository(0)
+		known, unknown := uuid.New(), uuid.New()
+		repo.missing = map[uuid.UUID]bool{unknown: true}
+		c := &Consumer{repo: repo}
+
+		msgs := viewMessages(4, []uuid.UUID{known, unknown}, 1)
+		failures, err := c.processBatch(msgs, nil)
+		assert.NoError(t, err)
+		assert.Len(t, failures, 2)
+		for _, f := range failures {
+			assert.Equal(t, ReasonProductNotFound, f.Reason)
+		}
+		assert.Equal(t, msgs[1], failures[0].Message)
+		assert.Equal(t, msgs[3], failures[1].Message)
+	})
+
+	t.Run("Applies the archived view policy", func(t *testing.T) {
+		active, archived := uuid.New(), uuid.New()
+		msgs := viewMessages(4, []uuid.UUID{active, archived}, 1)
+
+		for _, tc := range []struct {
+			policy   ArchivedViewPolicy
+			counted  int64
+			failures int
+		}{
+			{ArchivedViewsCount, 2, 0},
+			{ArchivedViewsDrop, 0, 0},
+			{ArchivedViewsDeadLetter, 0, 2},
+		} {
+			repo := newFakeRepository(0)
+			repo.archived = map[uuid.UUID]bool{archived: true}
+			c := &Consumer{repo: repo, archivedPolicy: tc.policy}
+
+			failures, err := c.processBatch(msgs, nil)
+			assert.NoError(t, err, tc.policy)
+			assert.Equal(t, int64(2), repo.counts[active], tc.policy)
+			assert.Equal(t, tc.counted, repo.counts[archived], tc.policy)
+			assert.Len(t, failures, tc.failures, tc.policy)
+			for _, f := range failures {
+				assert.Equal(t, ReasonProductArchived, f.Reason)
+			}
+		}
+	})
+
+	t.Run("Dispatches on event type and schema version", func(t *testing.T) {
+		repo := newFakeRepository(0)
+		c := &Consumer{repo: repo}
+
+		product := uuid.New()
+		msgs := viewMessages(4, []uuid.UUID{product}, 1)
+		// msgs[0] has no headers, as produced before they existed
+		msgs[1].Headers = eventHeaders(ContentTypeJSON, "api-1", traceParent(context.Background()))
+		msgs[2].Headers = []eventbus.Header{{Key: HeaderEventType, Value: []byte("product.created")}}
+		msgs[3].Headers = []eventbus.Header{
+			{Key: HeaderEventType, Value: []byte(EventTypeProductViewed)},
+			{Key: HeaderSchemaVersion, Value: []byte("2")},
+		}
+
+		failures, err := c.processBatch(msgs, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), repo.counts[product])
+
+		assert.Len(t, failures, 1)
+		assert.Equal(t, msgs[3], failures[0].Message)
+		assert.Equal(t, ReasonUnsupportedVersion, failures[0].Reason)
+	})
+
+	t.Run("Returns repository errors so the batch is retried", func(t *testing.T) {
+		repo := newFakeRepository(0)
+		repo.err = fmt.Errorf("connection refused")
+		c := &Consumer{repo: repo}
+
+		_, err := c.processBatch(viewMessages(2, []uuid.UUID{uuid.New()}, 1), nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestRecordWithRetryIsolatesPoisonMessages(t *testing.T) {
+	repo := newFakeRepository(0)
+	good, bad := uuid.New(), uuid.New()
+	repo.poison = map[uuid.UUID]bool{bad: true}
+	c := &Consumer{repo: repo}
+
+	products := []uuid.UUID{good, good, good, bad, good, good, good, good}
+	msgs := viewMessages(len(products), products, 1)
+
+	failures, ok := c.recordWithRetry(msgs, nil)
+	assert.True(t, ok)
+	assert.Len(t, failures, 1)
+	assert.Equal(t, int64(3), failures[0].Message.Offset)
+	assert.Equal(t, ReasonInvalidData, failures[0].Reason)
+	assert.Equal(t, int64(7), repo.counts[good])
+}
+
+// fakeDeadLetters collects dead letters in memory
+type fakeDeadLetters struct {
+	sent []Failure
+}
+
+func (f *fakeDeadLetters) Send(ctx context.Context, failures []Failure) error {
+	f.sent = append(f.sent, failures...)
+	return nil
+}
+
+func TestSendDeadLetters(t *testing.T) {
+	dlq := &fakeDeadLetters{}
+	c := &Consumer{deadLetters: dlq}
+
+	msg := viewMessages(1, []uuid.UUID{uuid.New()}, 1)[0]
+	failure := Failure{Message: msg, Reason: ReasonProductNotFound, Err: fmt.Errorf("product not found")}
+	assert.NoError(t, c.sendDeadLetters([]Failure{failure}))
+	assert.Equal(t, []Failure{failure}, dlq.sent)
+}
+
+func TestDeadLetterRoundTrip(t *testing.T) {
+	msg := viewMessages(1, []uuid.UUID{uuid.New()}, 1)[0]
+	msg.Partition = 2
+	msg.Offset = 42
+	msg.Key = []byte("key")
+	msg.Headers = []eventbus.Header{{Key: "trace", Value: []byte("abc")}}
+	failedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	wrapped := deadLetterMessage("product-views-dlq", Failure{
+		Message: msg,
+		Reason:  ReasonDecodeError,
+		Err:     fmt.Errorf("failed to unmarshal message"),
+	}, failedAt)
+	assert.Equal(t, "product-views-dlq", wrapped.Topic)
+
+	dl := ParseDeadLetter(wrapped)
+	assert.Equal(t, msg.Value, dl.Payload)
+	assert.Equal(t, msg.Key, dl.Key)
+	assert.Equal(t, msg.Headers, dl.Headers)
+	assert.Equal(t, ReasonDecodeError, dl.Reason)
+	assert.Equal(t, "failed to unmarshal message", dl.Error)
+	assert.Equal(t, "product-views", dl.SourceTopic)
+	assert.Equal(t, int32(2), dl.SourcePartition)
+	assert.Equal(t, int64(42), dl.SourceOffset)
+	assert.Equal(t, failedAt, dl.FailedAt)
+}
+
+// redeliver returns the messages a restarted consumer reads when resuming from tp
+func redeliver(msgs []*eventbus.Message, pos eventbus.Position) []*eventbus.Message {
+	if pos.Offset == eventbus.OffsetCommitted {
+		// No stored offset: nothing was committed to Kafka either, so start over
+		return msgs
+	}
+	var out []*eventbus.Message
+	for _, msg := range msgs {
+		if msg.Offset >= pos.Offset {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+func TestExactlyOnceRecovery(t *testing.T) {
+	topic := "product-views"
+	product := uuid.New()
+	assigned := []eventbus.Position{{Topic: topic, Partition: 0, Offset: eventbus.OffsetCommitted}}
+
+	// restart simulates a new consumer process taking over the partition
+	restart := func(repo *fakeRepository) (*Consumer, eventbus.Position) {
+		c := &Consumer{groupID: "group", topic: topic, repo: repo, offsetStore: repo}
+		resumed, err := c.resumeOffsets(assigned)
+		assert.NoError(t, err)
+		return c, resumed[0]
+	}
+
+	t.Run("Crash before the database commit", func(t *testing.T) {
+		repo := newFakeRepository(0)
+		msgs := viewMessages(10, []uuid.UUID{product}, 1)
+
+		c, _ := restart(repo)
+		repo.err = fmt.Errorf("connection reset")
+		_, err := c.processBatch(msgs, nil)
+		assert.Error(t, err)
+
+		repo.err = nil
+		c, tp := restart(repo)
+		assert.Equal(t, eventbus.OffsetCommitted, tp.Offset)
+		_, err = c.processBatch(redeliver(msgs, tp), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(10), repo.counts[product])
+	})
+
+	t.Run("Crash between the database and Kafka commits", func(t *testing.T) {
+		repo := newFakeRepository(0)
+		msgs := viewMessages(10, []uuid.UUID{product}, 1)
+
+		// The first batch is recorded but its offsets never reach Kafka
+		c, _ := restart(repo)
+		_, err := c.processBatch(msgs[:6], nil)
+		assert.NoError(t, err)
+
+		c, tp := restart(repo)
+		assert.Equal(t, int64(6), tp.Offset)
+		_, err = c.processBatch(redeliver(msgs, tp), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(10), repo.counts[product])
+	})
+
+	t.Run("Crash while isolating a poison message", func(t *testing.T) {
+		repo := newFakeRepository(0)
+		bad := uuid.New()
+		repo.poison = map[uuid.UUID]bool{bad: true}
+		products := []uuid.UUID{product, product, bad, product}
+		msgs := viewMessages(len(products), products, 1)
+
+		// Only the first half is recorded before the crash
+		c, _ := restart(repo)
+		_, err := c.processBatch(msgs[:2], nil)
+		assert.NoError(t, err)
+
+		c, tp := restart(repo)
+		failures, ok := c.recordWithRetry(redeliver(msgs, tp), nil)
+		assert.True(t, ok)
+		assert.Len(t, failures, 1)
+		assert.Equal(t, int64(3), repo.counts[product])
+	})
+
+	t.Run("Crash between recording and dead-lettering", func(t *testing.T) {
+		repo := newFakeRepository(0)
+		unknown := uuid.New()
+		repo.missing = map[uuid.UUID]bool{unknown: true}
+		products := []uuid.UUID{product, unknown, product, product}
+		msgs := viewMessages(len(products), products, 1)
+
+		// The batch is recorded but the consumer stops before the dead letter is sent
+		c, _ := restart(repo)
+		failures, err := c.processBatch(msgs, nil)
+		assert.NoError(t, err)
+		assert.Len(t, failures, 1)
+
+		c, tp := restart(repo)
+		assert.Equal(t, int64(1), tp.Offset)
+		failures, err = c.processBatch(redeliver(msgs, tp), nil)
+		assert.NoError(t, err)
+		if assert.Len(t, failures, 1) {
+			assert.Equal(t, ReasonProductNotFound, failures[0].Reason)
+			assert.Equal(t, int64(1), failures[0].Message.Offset)
+		}
+		assert.Equal(t, int64(3), repo.counts[product])
+	})
+
+	t.Run("Crash before dead-lettering an isolated poison message", func(t *testing.T) {
+		repo := newFakeRepository(0)
+		bad := uuid.New()
+		repo.poison = map[uuid.UUID]bool{bad: true}
+		products := []uuid.UUID{product, bad, product, product}
+		msgs := viewMessages(len(products), products, 1)
+
+		// The second half is recorded after the poison message in the first
+		c, _ := restart(repo)
+		failures, ok := c.recordWithRetry(msgs, nil)
+		assert.True(t, ok)
+		assert.Len(t, failures, 1)
+
+		_, tp := restart(repo)
+		assert.Equal(t, int64(1), tp.Offset)
+	})
+}
+
+func TestPipelineOnMemoryBus(t *testing.T) {
+	bus := eventbus.NewMemoryBus(2)
+	repo := newFakeRepository(0)
+	dlq := &fakeDeadLetters{}
+	product, unknown := uuid.New(), uuid.New()
+	repo.missing = map[uuid.UUID]bool{unknown: true}
+
+	publisher, _ := bus.NewPublisher()
+	producer := NewProducer(publisher, "product-views")
+	defer producer.Close()
+
+	subscriber, _ := bus.NewSubscriber("group")
+	consumer := NewConsumer(subscriber, "group", "product-views", repo,
+		WithBatching(10, 20*time.Millisecond),
+		WithExactlyOnce(repo),
+		WithDeadLetters(dlq),
+	)
+	assert.NoError(t, consumer.Start())
+
+	ctx := context.Background()
+	for i := 0; i < 25; i++ {
+		assert.NoError(t, producer.SendViewEvent(ctx, NewViewEvent(product)))
+	}
+	delivery, err := producer.SendViewEventSync(ctx, NewViewEvent(unknown))
+	assert.NoError(t, err)
+	assert.Equal(t, "product-views", delivery.Topic)
+
+	assert.Eventually(t, func() bool { return repo.count(product) == 25 }, 2*time.Second, 10*time.Millisecond)
+	consumer.Stop()
+
+	assert.Len(t, dlq.sent, 1)
+	assert.Equal(t, ReasonProductNotFound, dlq.sent[0].Reason)
+	assert.Equal(t, delivery.Partition, dlq.sent[0].Message.Partition)
+	assert.Equal(t, delivery.Offset, dlq.sent[0].Message.Offset)
+
+	// A restarted consumer resumes after everything processed
+	assert.NoError(t, producer.SendViewEvent(ctx, NewViewEvent(product)))
+	subscriber, _ = bus.NewSubscriber("group")
+	consumer = NewConsumer(subscriber, "group", "product-views", repo, WithExactlyOnce(repo))
+	assert.NoError(t, consumer.Start())
+	assert.Eventually(t, func() bool { return repo.count(product) == 26 }, 2*time.Second, 10*time.Millisecond)
+	consumer.Stop()
+	assert.Equal(t, int64(26), repo.count(product))
+}
+
+// fakeReplay is the shadow state of a replay in fakeReplayStore
+type fakeReplay struct {
+	state  repository.ReplayState
+	counts map[uuid.UUID]int64
+	seen   map[uuid.UUID]bool
+}
+
+func (r *fakeReplay) clone() *fakeReplay {
+	c := &fakeReplay{state: r.state, counts: make(map[uuid.UUID]int64), seen: make(map[uuid.UUID]bool)}
+	c.state.Positions = make(map[int32]int64)
+	for p, o := range r.state.Positions {
+		c.state.Positions[p] = o
+	}
+	for id, n := range r.counts {
+		c.counts[id] = n
+	}
+	for id := range r.seen {
+		c.seen[id] = true
+	}
+	return c
+}
+
+func (r *fakeReplay) record(events []*repository.ViewEvent, positions map[int32]int64) {
+	for _, e := range events {
+		if !r.seen[e.EventID] {
+			r.seen[e.EventID] = true
+			r.counts[e.ProductID]++
+		}
+	}
+	for p, o := range positions {
+		r.state.Positions[p] = max(r.state.Positions[p], o)
+	}
+}
+
+// fakeReplayStore replays into memory next to a fakeRepository. A swap holds
+// the repository's lock, blocking the live consumer like the real one.
+type fakeReplayStore struct {
+	*fakeRepository
+	replay *fakeReplay
+}
+
+func (f *fakeReplayStore) StartReplay(ctx context.Context, groupID, topic string, since time.Time, starts map[int32]int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r := &fakeReplay{state: repository.ReplayState{GroupID: groupID, Topic: topic, Since: since, Starts: starts}}
+	r.state.Positions = starts
+	f.replay = r.clone()
+	return nil
+}
+
+func (f *fakeReplayStore) LoadReplay(ctx context.Context) (*repository.ReplayState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.replay == nil {
+		return nil, repository.ErrNoReplay
+	}
+	state := f.replay.clone().state
+	return &state, nil
+}
+
+func (f *fakeReplayStore) RecordReplayViews(ctx context.Context, events []*repository.ViewEvent, positions map[int32]int64, dedupWindow time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.replay.record(events, positions)
+	return nil
+}
+
+func (f *fakeReplayStore) ReplayReport(ctx context.Context, limit int) (repository.ReplayReport, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.report(f.replay), nil
+}
+
+func (f *fakeReplayStore) report(r *fakeReplay) repository.ReplayReport {
+	report := repository.ReplayReport{Since: r.state.Since}
+	for _, n := range f.counts {
+		report.LiveViews += n
+	}
+	for _, n := range r.counts {
+		report.ReplayViews += n
+	}
+	return report
+}
+
+func (f *fakeReplayStore) BeginReplaySwap(ctx context.Context) (repository.ReplaySwap, error) {
+	f.mu.Lock()
+
+	live := make(map[int32]int64, len(f.offsets))
+	for p, o := range f.offsets {
+		live[p] = o
+	}
+	return &fakeSwap{store: f, replay: f.replay.clone(), live: live}, nil
+}
+
+type fakeSwap struct {
+	store  *fakeReplayStore
+	replay *fakeReplay
+	live   map[int32]int64
+	done   bool
+}
+
+func (s *fakeSwap) Live() map[int32]int64 {
+	return s.live
+}
+
+func (s *fakeSwap) RecordViews(ctx context.Context, events []*repository.ViewEvent, positions map[int32]int64, dedupWindow time.Duration) error {
+	s.replay.record(events, positions)
+	return nil
+}
+
+func (s *fakeSwap) Report(ctx context.Context, limit int) (repository.ReplayReport, error) {
+	return s.store.report(s.replay), nil
+}
+
+func (s *fakeSwap) Commit(ctx context.Context) error {
+	for id, n := range s.replay.counts {
+		s.store.counts[id] = n
+	}
+	s.store.replay = nil
+	return s.Rollback()
+}
+
+func (s *fakeSwap) Rollback() error {
+	if !s.done {
+		s.done = true
+		s.store.mu.Unlock()
+	}
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	bus := eventbus.NewMemoryBus(2)
+	store := &fakeReplayStore{fakeRepository: newFakeRepository(0)}
+	product := uuid.New()
+	ctx := context.Background()
+
+	publisher, _ := bus.NewPublisher()
+	producer := NewProducer(publisher, "product-views")
+	defer producer.Close()
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			assert.NoError(t, producer.SendViewEvent(ctx, NewViewEvent(product)))
+		}
+	}
+
+	subscriber, _ := bus.NewSubscriber(ConsumerGroup)
+	consumer := NewConsumer(subscriber, ConsumerGroup, "product-views", store,
+		WithBatching(5, 10*time.Millisecond),
+		WithExactlyOnce(store),
+	)
+	assert.NoError(t, consumer.Start())
+	defer consumer.Stop()
+
+	publish(30)
+	assert.Eventually(t, func() bool { return store.count(product) == 30 }, 2*time.Second, 10*time.Millisecond)
+
+	// Lose views, then replay them while the live consumer goes on
+	store.mu.Lock()
+	store.counts[product] = 5
+	store.mu.Unlock()
+
+	replaySubscriber, _ := bus.NewSubscriber(ReplayGroup(ConsumerGroup))
+	starts, err := ReplayStartOffsets(replaySubscriber, "product-views", time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[int32]int64{0: 0, 1: 0}, starts)
+	assert.NoError(t, store.StartReplay(ctx, ConsumerGroup, "product-views", time.Time{}, starts))
+
+	publish(10)
+	assert.Eventually(t, func() bool { return store.count(product) == 15 }, 2*time.Second, 10*time.Millisecond)
+	replayer := NewReplayer(replaySubscriber, store, 0)
+	assert.NoError(t, replayer.Run(ctx, 0))
+
+	// The live count is far off, so a bounded swap is refused and changes nothing
+	_, err = replayer.Swap(ctx, 0.5)
+	assert.ErrorIs(t, err, ErrReplayDiverged)
+	assert.Equal(t, int64(15), store.count(product))
+	_, err = replayer.Swap(ctx, 0)
+	assert.Error(t, err, "a replayer is single use after a swap")
+
+	// A new replayer resumes from the stored positions
+	publish(10)
+	assert.Eventually(t, func() bool { return store.count(product) == 25 }, 2*time.Second, 10*time.Millisecond)
+	replaySubscriber, _ = bus.NewSubscriber(ReplayGroup(ConsumerGroup))
+	replayer = NewReplayer(replaySubscriber, store, 0)
+	assert.NoError(t, replayer.Run(ctx, 5))
+	report, err := replayer.Swap(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50), report.ReplayViews)
+	assert.Equal(t, int64(50), store.count(product))
+
+	// The live consumer carries on from the swapped counts
+	publish(5)
+	assert.Eventually(t, func() bool { return store.count(product) == 55 }, 2*time.Second, 10*time.Millisecond)
+	_, err = store.LoadReplay(ctx)
+	assert.ErrorIs(t, err, repository.ErrNoReplay)
+}
+
+func TestProducerMessage(t *testing.T) {
+	bus := eventbus.NewMemoryBus(4)
+	publisher, _ := bus.NewPublisher()
+	producer := NewProducer(publisher, "product-views", WithProducerID("api-1"))
+
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := ContextWithTraceParent(context.Background(), tp)
+	product := uuid.New()
+
+	first, err := producer.SendViewEventSync(ctx, NewViewEvent(product))
+	assert.NoError(t, err)
+	second, err := producer.SendViewEventSync(ctx, NewViewEvent(product))
+	assert.NoError(t, err)
+	// Views of one product share a partition, in order
+	assert.Equal(t, first.Partition, second.Partition)
+	assert.Equal(t, first.Offset+1, second.Offset)
+
+	sub, _ := bus.NewSubscriber("group")
+	assert.NoError(t, sub.Subscribe("product-views", eventbus.Rebalance{}))
+	msg, err := sub.Poll(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, product.String(), string(msg.Key))
+
+	headers := make(map[string]string)
+	for _, h := range msg.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	assert.Equal(t, map[string]string{
+		HeaderContentType:   ContentTypeJSON,
+		HeaderEventType:     EventTypeProductViewed,
+		HeaderSchemaVersion: "1",
+		HeaderProducer:      "api-1",
+		HeaderTraceParent:   tp,
+	}, headers)
+
+	// Without a valid trace context every event starts a new trace
+	ctx = ContextWithTraceParent(context.Background(), "garbage")
+	assert.True(t, validTraceParent(traceParent(ctx)))
+	assert.NotEqual(t, traceParent(ctx), traceParent(ctx))
+}
+
+func TestCommitOffsets(t *testing.T) {
+	msgs := viewMessages(10, []uuid.UUID{uuid.New()}, 3)
+	// Offsets within a partition may arrive in any order within a batch
+	msgs[0], msgs[9] = msgs[9], msgs[0]
+
+	offsets := commitOffsets(msgs)
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].Partition < offsets[j].Partition })
+
+	assert.Len(t, offsets, 3)
+	assert.Equal(t, int64(10), offsets[0].Offset) // partition 0 read up to offset 9
+	assert.Equal(t, int64(8), offsets[1].Offset)
+	assert.Equal(t, int64(9), offsets[2].Offset)
+}
+
+// BenchmarkProcessBatch compares recording views one message at a time with
+// micro-batches, with every flush costing a simulated 1ms database round trip
+func BenchmarkProcessBatch(b *testing.B) {
+	products := make([]uuid.UUID, 50)
+	for i := range products {
+		products[i] = uuid.New()
+	}
+
+	for _, size := range []int{1, 50, 500} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			c := &Consumer{repo: newFakeRepository(time.Millisecond)}
+			msgs := viewMessages(size, products, 4)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i += size {
+				if _, err := c.processBatch(msgs, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/tushar-kalsi/product-views/internal/eventbus"
+)
+
+// Reasons a message is dead-lettered
+const (
+	ReasonDecodeError     = "decode_error"
+	ReasonProductNotFound = "product_not_found"
+	ReasonInvalidData     = "invalid_data"
+	// ReasonProductArchived marks views of archived products under the
+	// ArchivedViewsDeadLetter policy
+	ReasonProductArchived = "product_archived"
+	// ReasonUnsupportedVersion marks view events of a schema version newer
+	// than the consumer understands; re-drive them after upgrading it
+	ReasonUnsupportedVersion = "unsupported_version"
+)
+
+// Headers added to dead-lettered messages. The original key, value and headers
+// are kept so that a message can be re-driven unchanged.
+const (
+	HeaderDLQReason          = "dlq.reason"
+	HeaderDLQError           = "dlq.error"
+	HeaderDLQSourceTopic     = "dlq.source.topic"
+	HeaderDLQSourcePartition = "dlq.source.partition"
+	HeaderDLQSourceOffset    = "dlq.source.offset"
+	HeaderDLQFailedAt        = "dlq.failed_at"
+)
+
+// Failure is a message that failed permanently and will never succeed on retry
+type Failure struct {
+	Message *eventbus.Message
+	Reason  string
+	Err     error
+}
+
+// DeadLetter is a message read back from the dead-letter topic
+type DeadLetter struct {
+	// Partition and Offset locate the message in the dead-letter topic
+	Partition int32
+	Offset    int64
+
+	Key     []byte
+	Payload []byte
+	Headers []eventbus.Header
+
+	Reason          string
+	Error           string
+	SourceTopic     string
+	SourcePartition int32
+	SourceOffset    int64
+	FailedAt        time.Time
+}
+
+// DeadLetterProducer publishes permanently failed messages to a dead-letter topic
+type DeadLetterProducer struct {
+	publisher eventbus.Publisher
+	topic     string
+}
+
+// NewDeadLetterProducer creates a producer for the given dead-letter topic
+func NewDeadLetterProducer(publisher eventbus.Publisher, topic string) *DeadLetterProducer {
+	return &DeadLetterProducer{publisher: publisher, topic: topic}
+}
+
+// Send publishes the failures and waits until all of them are acknowledged, so
+// that the source offsets can be committed safely afterwards
+func (d *DeadLetterProducer) Send(ctx context.Context, failures []Failure) error {
+	now := time.Now()
+	msgs := make([]*eventbus.Message, len(failures))
+	for i, f := range failures {
+		msgs[i] = deadLetterMessage(d.topic, f, now)
+	}
+	return d.publisher.PublishSync(ctx, msgs...)
+}
+
+// Close closes the underlying publisher
+func (d *DeadLetterProducer) Close() {
+	if err := d.publisher.Close(); err != nil {
+		log.Printf("Error closing dead-letter publisher: %v\n", err)
+	}
+}
+
+// deadLetterMessage wraps a failed message for the dead-letter topic
+func deadLetterMessage(topic string, f Failure, failedAt time.Time) *eventbus.Message {
+	src := f.Message
+
+	headers := append([]eventbus.Header(nil), src.Headers...)
+	headers = append(headers,
+		eventbus.Header{Key: HeaderDLQReason, Value: []byte(f.Reason)},
+		eventbus.Header{Key: HeaderDLQError, Value: []byte(f.Err.Error())},
+		eventbus.Header{Key: HeaderDLQSourceTopic, Value: []byte(src.Topic)},
+		eventbus.Header{Key: HeaderDLQSourcePartition, Value: []byte(strconv.Itoa(int(src.Partition)))},
+		eventbus.Header{Key: HeaderDLQSourceOffset, Value: []byte(strconv.FormatInt(src.Offset, 10))},
+		eventbus.Header{Key: HeaderDLQFailedAt, Value: []byte(failedAt.UTC().Format(time.RFC3339Nano))},
+	)
+
+	return &eventbus.Message{
+		Topic:   topic,
+		Key:     src.Key,
+		Value:   src.Value,
+		Headers: headers,
+	}
+}
+
+// ParseDeadLetter reads the failure details back from a dead-lettered message
+func ParseDeadLetter(msg *eventbus.Message) DeadLetter {
+	dl := DeadLetter{
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Payload:   msg.Value,
+	}
+
+	for _, h := range msg.Headers {
+		value := string(h.Value)
+		switch h.Key {
+		case HeaderDLQReason:
+			dl.Reason = value
+		case HeaderDLQError:
+			dl.Error = value
+		case HeaderDLQSourceTopic:
+			dl.SourceTopic = value
+		case HeaderDLQSourcePartition:
+			p, _ := strconv.ParseInt(value, 10, 32)
+			dl.SourcePartition = int32(p)
+		case HeaderDLQSourceOffset:
+			dl.SourceOffset, _ = strconv.ParseInt(value, 10, 64)
+		case HeaderDLQFailedAt:
+			dl.FailedAt, _ = time.Parse(time.RFC3339Nano, value)
+		default:
+			dl.Headers = append(dl.Headers, h)
+		}
+	}
+
+	return dl
+}
+
+// DeadLetterAdmin inspects and re-drives the messages of a dead-letter topic.
+// Re-driven messages are committed under its consumer group, so inspection
+// lists only the messages still awaiting a re-drive.
+type DeadLetterAdmin struct {
+	bus     eventbus.Bus
+	topic   string
+	groupID string
+	// idleTimeout ends a read once no message has arrived for this long
+	idleTimeout time.Duration
+}
+
+// NewDeadLetterAdmin creates an admin client for the given dead-letter topic
+func NewDeadLetterAdmin(bus eventbus.Bus, topic string) *DeadLetterAdmin {
+	return &DeadLetterAdmin{
+		bus:         bus,
+		topic:       topic,
+		groupID:     topic + "-admin",
+		idleTimeout: 5 * time.Second,
+	}
+}
+
+// Inspect calls fn for up to limit pending dead letters, without consuming them.
+// A limit of zero reads until the topic is exhausted.
+func (a *DeadLetterAdmin) Inspect(ctx context.Context, limit int, fn func(DeadLetter) error) error {
+	sub, err := a.subscribe()
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	return a.read(ctx, sub, limit, func(msg *eventbus.Message) error {
+		return fn(ParseDeadLetter(msg))
+	})
+}
+
+// Redrive publishes up to limit pending dead letters back to the target topic
+// with their original key, payload and headers, committing each one after the
+// target acknowledges it. It returns the number of messages re-driven.
+func (a *DeadLetterAdmin) Redrive(ctx context.Context, target string, limit int) (int, error) {
+	sub, err := a.subscribe()
+	if err != nil {
+		return 0, err
+	}
+	defer sub.Close()
+
+	pub, err := a.bus.NewPublisher()
+	if err != nil {
+		return 0, err
+	}
+	defer pub.Close()
+
+	redriven := 0
+	err = a.read(ctx, sub, limit, func(msg *eventbus.Message) error {
+		dl := ParseDeadLetter(msg)
+		err := pub.PublishSync(ctx, &eventbus.Message{
+			Topic:   target,
+			Key:     dl.Key,
+			Value:   dl.Payload,
+			Headers: dl.Headers,
+		})
+		if err != nil {
+			return err
+		}
+		next := eventbus.Position{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset + 1}
+		if err := sub.Commit([]eventbus.Position{next}); err != nil {
+			return fmt.Errorf("failed to commit dead letter at offset %d: %w", dl.Offset, err)
+		}
+		redriven++
+		return nil
+	})
+
+	return redriven, err
+}
+
+func (a *DeadLetterAdmin) subscribe() (eventbus.Subscriber, error) {
+	sub, err := a.bus.NewSubscriber(a.groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sub.Subscribe(a.topic, eventbus.Rebalance{}); err != nil {
+		sub.Close()
+		return nil, fmt.Errorf("failed to subscribe to topic: %w", err)
+	}
+
+	return sub, nil
+}
+
+// read calls fn for each message until limit is reached, the topic stays idle
+// for idleTimeout or the context is done
+func (a *DeadLetterAdmin) read(ctx context.Context, sub eventbus.Subscriber, limit int, fn func(*eventbus.Message) error) error {
+	lastMessage := time.Now()
+	for n := 0; limit <= 0 || n < limit; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		msg, err := sub.Poll(100 * time.Millisecond)
+		if err != nil {
+			return fmt.Errorf("failed to read dead letter: %w", err)
+		}
+		if msg == nil {
+			if time.Since(lastMessage) >= a.idleTimeout {
+				return nil
+			}
+			continue
+		}
+		lastMessage = time.Now()
+
+		if err := fn(msg); err != nil {
+			return err
+		}
+		n++
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package kafka
+
+import (
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tushar-kalsi/product-views/internal/eventbus"
+	"github.com/tushar-kalsi/product-views/internal/schemaregistry"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// HeaderContentType names the encoding of a message payload
+const HeaderContentType = "content-type"
+
+// Encodings of view event payloads
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// Encoding names accepted by NewEncoder
+const (
+	EncodingJSON     = "json"
+	EncodingProtobuf = "protobuf"
+)
+
+// wireMagic starts payloads framed with a schema registry ID. A JSON payload
+// never starts with it, so it also tells the encodings apart when a message
+// carries no content type header.
+const wireMagic byte = 0
+
+// viewEventProto is the protobuf schema of view events
+//
+//go:embed schemas/view_event.proto
+var viewEventProto string
+
+// Encoder serializes view events for the bus
+type Encoder interface {
+	// ContentType is recorded in the content-type header of each message
+	ContentType() string
+	Encode(event *ViewEvent) ([]byte, error)
+}
+
+// NewEncoder returns the encoder with the given name. The protobuf encoder
+// registers the view event schema for topic in registry.
+func NewEncoder(ctx context.Context, name string, registry schemaregistry.Client, topic string) (Encoder, error) {
+	switch name {
+	case EncodingJSON:
+		return JSONEncoder{}, nil
+	case EncodingProtobuf:
+		if registry == nil {
+			return nil, errors.New("the protobuf encoding requires a schema registry")
+		}
+		return NewProtobufEncoder(ctx, registry, topic)
+	default:
+		return nil, fmt.Errorf("unknown view event encoding %q", name)
+	}
+}
+
+// JSONEncoder encodes view events as JSON, the original encoding
+type JSONEncoder struct{}
+
+func (JSONEncoder) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (JSONEncoder) Encode(event *ViewEvent) ([]byte, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	return payload, nil
+}
+
+// ProtobufEncoder encodes view events as protobuf in the schema registry wire
+// format: a zero magic byte, the big-endian schema ID, the message index and
+// the protobuf message
+type ProtobufEncoder struct {
+	schemaID int
+}
+
+// NewProtobufEncoder registers the view event schema under topic's value
+// subject, so that the registry rejects incompatible changes, and returns an
+// encoder stamping payloads with its ID
+func NewProtobufEncoder(ctx context.Context, registry schemaregistry.Client, topic string) (*ProtobufEncoder, error) {
+	id, err := registry.Register(ctx, schemaregistry.SubjectForTopic(topic), schemaregistry.Schema{
+		Schema:     viewEventProto,
+		SchemaType: schemaregistry.TypeProtobuf,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ProtobufEncoder{schemaID: id}, nil
+}
+
+func (e *ProtobufEncoder) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (e *ProtobufEncoder) Encode(event *ViewEvent) ([]byte, error) {
+	b := make([]byte, 0, 128)
+	b = append(b, wireMagic)
+	b = binary.BigEndian.AppendUint32(b, uint32(e.schemaID))
+	// Message indexes [0], i.e. the first message of the schema, shortened to a single zero
+	b = append(b, 0)
+	return appendViewEventProto(b, event), nil
+}
+
+// decodeViewEventV1 decodes a version 1 view event, choosing the encoding by
+// the content type header or, without one, by the magic byte
+func decodeViewEventV1(msg *eventbus.Message) (*ViewEvent, error) {
+	contentType := ""
+	for _, h := range msg.Headers {
+		if h.Key == HeaderContentType {
+			contentType = string(h.Value)
+		}
+	}
+	if contentType == "" && len(msg.Value) > 0 && msg.Value[0] == wireMagic {
+		contentType = ContentTypeProtobuf
+	}
+
+	switch contentType {
+	case "", ContentTypeJSON:
+		var event ViewEvent
+		if err := json.Unmarshal(msg.Value, &event); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		return &event, nil
+	case ContentTypeProtobuf:
+		return decodeViewEventProtobuf(msg.Value)
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", contentType)
+	}
+}
+
+// decodeViewEventProtobuf strips the wire format framing and decodes the
+// protobuf message. Fields unknown to this version are skipped.
+func decodeViewEventProtobuf(payload []byte) (*ViewEvent, error) {
+	if len(payload) < 5 || payload[0] != wireMagic {
+		return nil, errors.New("protobuf payload without schema registry framing")
+	}
+	b := payload[5:]
+
+	// Message indexes: a zigzag varint count followed by the indexes, where an
+	// empty list stands for [0]. View events are always the first message.
+	count, n := binary.Varint(b)
+	if n <= 0 || count < 0 {
+		return nil, errors.New("invalid message indexes")
+	}
+	b = b[n:]
+	for i := int64(0); i < count; i++ {
+		index, n := binary.Varint(b)
+		if n <= 0 || index != 0 {
+			return nil, errors.New("payload is not a view event message")
+		}
+		b = b[n:]
+	}
+
+	event, err := consumeViewEventProto(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal protobuf message: %w", err)
+	}
+	return event, nil
+}
+
+// appendViewEventProto appends the protobuf encoding of a view event. Zero
+// values are omitted, as in proto3.
+func appendViewEventProto(b []byte, e *ViewEvent) []byte {
+	if e.EventID != uuid.Nil {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, e.EventID[:])
+	}
+	if e.ProductID != uuid.Nil {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, e.ProductID[:])
+	}
+	if ms := e.OccurredAt().UnixMilli(); ms != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ms))
+	}
+	b = appendStringField(b, 4, e.UserID)
+	b = appendStringField(b, 5, e.SessionID)
+	b = appendStringField(b, 6, e.Source)
+	b = appendStringField(b, 7, e.DeviceType)
+	b = appendStringField(b, 8, e.Referrer)
+	if e.UTM != nil {
+		var utm []byte
+		utm = appendStringField(utm, 1, e.UTM.Source)
+		utm = appendStringField(utm, 2, e.UTM.Medium)
+		utm = appendStringField(utm, 3, e.UTM.Campaign)
+		utm = appendStringField(utm, 4, e.UTM.Term)
+		utm = appendStringField(utm, 5, e.UTM.Content)
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, utm)
+	}
+	return b
+}
+
+func appendStringField(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// consumeViewEventProto decodes a protobuf view event
+func consumeViewEventProto(b []byte) (*ViewEvent, error) {
+	var event ViewEvent
+	strs := map[protowire.Number]*string{
+		4: &event.UserID,
+		5: &event.SessionID,
+		6: &event.Source,
+		7: &event.DeviceType,
+		8: &event.Referrer,
+	}
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			return consumeUUID(b, &event.EventID)
+		case num == 2 && typ == protowire.BytesType:
+			return consumeUUID(b, &event.ProductID)
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n > 0 {
+				event.SetTime(time.UnixMilli(int64(v)))
+			}
+			return n, nil
+		case strs[num] != nil && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			*strs[num] = v
+			return n, nil
+		case num == 9 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			utm, err := consumeUTMProto(v)
+			event.UTM = utm
+			return n, err
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func consumeUTMProto(b []byte) (*UTMParams, error) {
+	var utm UTMParams
+	strs := map[protowire.Number]*string{
+		1: &utm.Source,
+		2: &utm.Medium,
+		3: &utm.Campaign,
+		4: &utm.Term,
+		5: &utm.Content,
+	}
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if strs[num] != nil && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			*strs[num] = v
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return &utm, err
+}
+
+// consumeFields calls fn with the value of each field in b. fn returns the
+// length of the value it consumed, negative for malformed input.
+func consumeFields(b []byte, fn func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, err := fn(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeUUID(b []byte, id *uuid.UUID) (int, error) {
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+	parsed, err := uuid.FromBytes(v)
+	if err != nil {
+		return n, err
+	}
+	*id = parsed
+	return n, nil
+}
@@ -0,0 +1,111 @@
+package kafka
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/tushar-kalsi/product-views/internal/eventbus"
+	"github.com/tushar-kalsi/product-views/internal/schemaregistry"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func newProtobufEncoder(t *testing.T) *ProtobufEncoder {
+	t.Helper()
+	registry, err := schemaregistry.OpenFileRegistry(filepath.Join(t.TempDir(), "schemas.json"))
+	assert.NoError(t, err)
+	enc, err := NewProtobufEncoder(context.Background(), registry, "product-views")
+	assert.NoError(t, err)
+	return enc
+}
+
+func TestViewEventEncodings(t *testing.T) {
+	event := NewViewEvent(uuid.New())
+	event.SetTime(time.UnixMilli(1700000000123))
+	event.ViewContext = ViewContext{
+		UserID:     "user-42",
+		SessionID:  "session-1",
+		Source:     SourceSearch,
+		DeviceType: DeviceMobile,
+		Referrer:   "https://www.google.com/",
+		UTM:        &UTMParams{Source: "newsletter", Campaign: "diwali"},
+	}
+
+	protoEnc := newProtobufEncoder(t)
+	protoPayload, err := protoEnc.Encode(&event)
+	assert.NoError(t, err)
+	jsonPayload, err := JSONEncoder{}.Encode(&event)
+	assert.NoError(t, err)
+	assert.Less(t, len(protoPayload), len(jsonPayload)/2)
+
+	t.Run("Round trips both encodings", func(t *testing.T) {
+		for _, msg := range []*eventbus.Message{
+			{Value: protoPayload, Headers: eventHeaders(ContentTypeProtobuf, "api-1", "")},
+			{Value: jsonPayload, Headers: eventHeaders(ContentTypeJSON, "api-1", "")},
+		} {
+			decoded, err := decodeMessage(msg)
+			assert.NoError(t, err)
+			assert.Equal(t, event, *decoded)
+		}
+	})
+
+	t.Run("Detects the encoding by magic byte without headers", func(t *testing.T) {
+		for _, payload := range [][]byte{protoPayload, jsonPayload} {
+			decoded, err := decodeMessage(&eventbus.Message{Value: payload})
+			assert.NoError(t, err)
+			assert.Equal(t, event.EventID, decoded.EventID)
+		}
+	})
+
+	t.Run("Skips fields added by newer producers", func(t *testing.T) {
+		payload := protowire.AppendTag(append([]byte(nil), protoPayload...), 42, protowire.BytesType)
+		payload = protowire.AppendString(payload, "from the future")
+
+		decoded, err := decodeMessage(&eventbus.Message{Value: payload})
+		assert.NoError(t, err)
+		assert.Equal(t, event, *decoded)
+	})
+
+	t.Run("Rejects malformed payloads", func(t *testing.T) {
+		for _, payload := range [][]byte{
+			protoPayload[:3],
+			protoPayload[:len(protoPayload)-2],
+			append(append([]byte(nil), protoPayload[:5]...), 2, 2), // message index [1]
+		} {
+			_, err := decodeMessage(&eventbus.Message{Value: payload})
+			assert.Error(t, err)
+		}
+
+		_, err := decodeMessage(&eventbus.Message{
+			Value:   jsonPayload,
+			Headers: []eventbus.Header{{Key: HeaderContentType, Value: []byte("application/avro")}},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestNewEncoder(t *testing.T) {
+	ctx := context.Background()
+
+	enc, err := NewEncoder(ctx, EncodingJSON, nil, "product-views")
+	assert.NoError(t, err)
+	assert.Equal(t, ContentTypeJSON, enc.ContentType())
+
+	_, err = NewEncoder(ctx, EncodingProtobuf, nil, "product-views")
+	assert.Error(t, err)
+
+	registry, _ := schemaregistry.OpenFileRegistry(filepath.Join(t.TempDir(), "schemas.json"))
+	enc, err = NewEncoder(ctx, EncodingProtobuf, registry, "product-views")
+	assert.NoError(t, err)
+	assert.Equal(t, ContentTypeProtobuf, enc.ContentType())
+
+	schema, err := registry.SchemaByID(ctx, enc.(*ProtobufEncoder).schemaID)
+	assert.NoError(t, err)
+	assert.Equal(t, schemaregistry.TypeProtobuf, schema.SchemaType)
+
+	_, err = NewEncoder(ctx, "xml", nil, "product-views")
+	assert.Error(t, err)
+}
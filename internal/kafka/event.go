@@ -0,0 +1,76 @@
+package kafka
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// View sources identify the surface a product was viewed from
+const (
+	SourceSearch         = "search"
+	SourceHome           = "home"
+	SourcePDP            = "pdp"
+	SourceRecommendation = "recommendation"
+)
+
+// Device types identify the kind of client that produced a view
+const (
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceDesktop = "desktop"
+	DeviceOther   = "other"
+)
+
+// UTMParams holds the campaign parameters attached to a view
+type UTMParams struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+// ViewContext holds the optional dimensions describing who viewed a product and how
+type ViewContext struct {
+	UserID     string     `json:"user_id,omitempty"`
+	SessionID  string     `json:"session_id,omitempty"`
+	Source     string     `json:"source,omitempty"`
+	DeviceType string     `json:"device_type,omitempty"`
+	Referrer   string     `json:"referrer,omitempty"`
+	UTM        *UTMParams `json:"utm,omitempty"`
+}
+
+// ViewEvent represents a product view event
+type ViewEvent struct {
+	EventID     uuid.UUID `json:"event_id"`
+	ProductID   uuid.UUID `json:"product_id"`
+	Timestamp   int64     `json:"timestamp"`    // Unix seconds, kept for older consumers
+	TimestampMs int64     `json:"timestamp_ms"` // Unix milliseconds
+	ViewContext
+}
+
+// NewViewEvent creates a view event for a product stamped with a new event ID and the current time
+func NewViewEvent(productID uuid.UUID) ViewEvent {
+	event := ViewEvent{
+		EventID:   uuid.New(),
+		ProductID: productID,
+	}
+	event.SetTime(time.Now())
+	return event
+}
+
+// SetTime sets both the legacy second and the millisecond timestamps
+func (e *ViewEvent) SetTime(t time.Time) {
+	e.Timestamp = t.Unix()
+	e.TimestampMs = t.UnixMilli()
+}
+
+// OccurredAt returns when the view happened, falling back to the
+// second-precision timestamp for events produced before TimestampMs existed
+func (e *ViewEvent) OccurredAt() time.Time {
+	if e.TimestampMs > 0 {
+		return time.UnixMilli(e.TimestampMs)
+	}
+	return time.Unix(e.Timestamp, 0)
+}
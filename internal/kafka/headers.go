@@ -0,0 +1,108 @@
+package kafka
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/tushar-kalsi/product-views/internal/eventbus"
+)
+
+// Headers describing the event carried by a message. Consumers dispatch on the
+// event type and schema version instead of guessing from the payload.
+const (
+	HeaderEventType     = "event.type"
+	HeaderSchemaVersion = "event.schema_version"
+	HeaderProducer      = "event.producer"
+	// HeaderTraceParent carries the W3C trace context of the request that
+	// produced the event
+	HeaderTraceParent = "traceparent"
+)
+
+// EventTypeProductViewed is the event type of view events
+const EventTypeProductViewed = "product.viewed"
+
+// ViewEventSchemaVersion is the schema version of the view events produced.
+// Bump it for changes older consumers cannot read; additive fields do not need it.
+const ViewEventSchemaVersion = 1
+
+var (
+	// errUnknownEventType marks messages of event types this consumer does not handle
+	errUnknownEventType = errors.New("unknown event type")
+	// errUnsupportedVersion marks view events of a schema version this consumer cannot read
+	errUnsupportedVersion = errors.New("unsupported schema version")
+)
+
+// eventSchema identifies the layout of a message payload
+type eventSchema struct {
+	eventType string
+	version   int
+}
+
+// messageSchema reads the event type and schema version of a message. Messages
+// produced before the headers existed are version 1 view events.
+func messageSchema(msg *eventbus.Message) (eventSchema, error) {
+	schema := eventSchema{eventType: EventTypeProductViewed, version: 1}
+	for _, h := range msg.Headers {
+		switch h.Key {
+		case HeaderEventType:
+			schema.eventType = string(h.Value)
+		case HeaderSchemaVersion:
+			v, err := strconv.Atoi(string(h.Value))
+			if err != nil {
+				return schema, fmt.Errorf("invalid schema version %q", h.Value)
+			}
+			schema.version = v
+		}
+	}
+	return schema, nil
+}
+
+// eventHeaders returns the headers of a view event message
+func eventHeaders(contentType, producerID, traceParent string) []eventbus.Header {
+	return []eventbus.Header{
+		{Key: HeaderContentType, Value: []byte(contentType)},
+		{Key: HeaderEventType, Value: []byte(EventTypeProductViewed)},
+		{Key: HeaderSchemaVersion, Value: []byte(strconv.Itoa(ViewEventSchemaVersion))},
+		{Key: HeaderProducer, Value: []byte(producerID)},
+		{Key: HeaderTraceParent, Value: []byte(traceParent)},
+	}
+}
+
+type traceParentKey struct{}
+
+// ContextWithTraceParent attaches a W3C traceparent to ctx, so that events
+// produced with it join the caller's trace. Invalid values are ignored.
+func ContextWithTraceParent(ctx context.Context, traceParent string) context.Context {
+	if !validTraceParent(traceParent) {
+		return ctx
+	}
+	return context.WithValue(ctx, traceParentKey{}, traceParent)
+}
+
+// traceParent returns the traceparent attached to ctx, or starts a new trace
+func traceParent(ctx context.Context) string {
+	if tp, ok := ctx.Value(traceParentKey{}).(string); ok {
+		return tp
+	}
+
+	var ids [24]byte
+	_, _ = rand.Read(ids[:])
+	return "00-" + hex.EncodeToString(ids[:16]) + "-" + hex.EncodeToString(ids[16:]) + "-01"
+}
+
+// validTraceParent checks the version 00 layout: 00-<32 hex trace ID>-<16 hex parent ID>-<2 hex flags>
+func validTraceParent(tp string) bool {
+	if len(tp) != 55 || tp[:3] != "00-" || tp[35] != '-' || tp[52] != '-' {
+		return false
+	}
+	for _, field := range []string{tp[3:35], tp[36:52], tp[53:]} {
+		if _, err := hex.DecodeString(field); err != nil {
+			return false
+		}
+	}
+	return true
+}
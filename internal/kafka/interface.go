@@ -2,11 +2,22 @@ package kafka
 
 import (
 	"context"
-	"github.com/google/uuid"
 )
 
 // ProducerInterface defines the interface for Kafka producer
 type ProducerInterface interface {
-	SendViewEvent(ctx context.Context, productID uuid.UUID) error
+	SendViewEvent(ctx context.Context, event ViewEvent) error
+	// SendViewEventSync waits for the bus to acknowledge the event and
+	// returns where it was stored
+	SendViewEventSync(ctx context.Context, event ViewEvent) (Delivery, error)
+	// SendViewEvents sends a batch of view events and returns one error per
+	// event, in the same order, with nil marking a successful send
+	SendViewEvents(ctx context.Context, events []ViewEvent) []error
 	Close()
 }
+
+// DeadLetterSender defines the interface for publishing permanently failed messages
+type DeadLetterSender interface {
+	// Send returns only once every failure has been durably written
+	Send(ctx context.Context, failures []Failure) error
+}
@@ -2,90 +2,149 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/google/uuid"
+	"github.com/tushar-kalsi/product-views/internal/eventbus"
 )
 
-// ViewEvent represents a product view event
-type ViewEvent struct {
-	ProductID uuid.UUID `json:"product_id"`
-	Timestamp int64     `json:"timestamp"`
+// Producer publishes product view events to the event bus. Events are keyed by
+// product ID, so all views of a product land on one partition in order.
+type Producer struct {
+	publisher  eventbus.Publisher
+	topic      string
+	producerID string
+	encoder    Encoder
 }
 
-// Producer handles producing messages to Kafka
-type Producer struct {
-	producer *kafka.Producer
-	topic    string
+// ProducerOption configures optional Producer behaviour
+type ProducerOption func(*Producer)
+
+// WithProducerID sets the producer instance recorded in each event's headers.
+// It defaults to the host name.
+func WithProducerID(id string) ProducerOption {
+	return func(p *Producer) {
+		p.producerID = id
+	}
 }
 
-// NewProducer creates a new Kafka producer
-func NewProducer(brokers, topic string) (*Producer, error) {
-	config := &kafka.ConfigMap{
-		"bootstrap.servers": brokers,
-		"message.max.bytes": 1000000, // 1MB
-		"retries":           3,
-		"acks":              "all",
+// WithEncoder sets the encoding of view event payloads. It defaults to JSON.
+func WithEncoder(encoder Encoder) ProducerOption {
+	return func(p *Producer) {
+		p.encoder = encoder
 	}
+}
 
-	p, err := kafka.NewProducer(config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create producer: %w", err)
+// NewProducer creates a producer that publishes view events to topic
+func NewProducer(publisher eventbus.Publisher, topic string, opts ...ProducerOption) *Producer {
+	producer := &Producer{
+		publisher: publisher,
+		topic:     topic,
+		encoder:   JSONEncoder{},
+	}
+	for _, opt := range opts {
+		opt(producer)
+	}
+	if producer.producerID == "" {
+		producer.producerID, _ = os.Hostname()
 	}
 
-	// Start a goroutine to handle delivery reports
-	go func() {
-		for e := range p.Events() {
-			switch ev := e.(type) {
-			case *kafka.Message:
-				if ev.TopicPartition.Error != nil {
-					log.Printf("Delivery failed: %v\n", ev.TopicPartition.Error)
-				}
-			}
-		}
-	}()
-
-	return &Producer{
-		producer: p,
-		topic:    topic,
-	}, nil
+	return producer
 }
 
-// SendViewEvent sends a product view event to Kafka
-func (p *Producer) SendViewEvent(ctx context.Context, productID uuid.UUID) error {
-	event := ViewEvent{
-		ProductID: productID,
-		Timestamp: time.Now().Unix(),
-	}
+// SendViewEvent sends a product view event to Kafka.
+// A missing event ID or timestamp is filled in before sending.
+func (p *Producer) SendViewEvent(ctx context.Context, event ViewEvent) error {
+	return p.produce(ctx, prepareEvent(event, time.Now()))
+}
+
+// Delivery locates a view event acknowledged by the bus
+type Delivery struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
 
-	payload, err := json.Marshal(event)
+// SendViewEventSync sends a product view event and waits until the bus
+// acknowledges it, or ctx is done. A context error leaves the outcome unknown:
+// the event may still be delivered.
+func (p *Producer) SendViewEventSync(ctx context.Context, event ViewEvent) (Delivery, error) {
+	msg, err := p.message(ctx, prepareEvent(event, time.Now()))
 	if err != nil {
-		return fmt.Errorf("failed to marshal event: %w", err)
+		return Delivery{}, err
 	}
 
-	err = p.producer.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{
-			Topic:     &p.topic,
-			Partition: kafka.PartitionAny,
-		},
-		Value: payload,
-	}, nil)
+	if err := p.publisher.PublishSync(ctx, msg); err != nil {
+		return Delivery{}, fmt.Errorf("failed to deliver message: %w", err)
+	}
+
+	return Delivery{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset}, nil
+}
+
+// SendViewEvents sends a batch of product view events to Kafka.
+// Events without a timestamp are stamped with the current time.
+func (p *Producer) SendViewEvents(ctx context.Context, events []ViewEvent) []error {
+	errs := make([]error, len(events))
+	now := time.Now()
 
+	for i, event := range events {
+		errs[i] = p.produce(ctx, prepareEvent(event, now))
+	}
+
+	return errs
+}
+
+// prepareEvent fills in the server-generated fields of an event
+func prepareEvent(event ViewEvent, now time.Time) ViewEvent {
+	if event.EventID == uuid.Nil {
+		event.EventID = uuid.New()
+	}
+	switch {
+	case event.TimestampMs == 0 && event.Timestamp == 0:
+		event.SetTime(now)
+	case event.TimestampMs == 0:
+		event.TimestampMs = event.Timestamp * 1000
+	case event.Timestamp == 0:
+		event.Timestamp = event.TimestampMs / 1000
+	}
+	return event
+}
+
+// produce serializes a view event and hands it to the bus for delivery
+func (p *Producer) produce(ctx context.Context, event ViewEvent) error {
+	msg, err := p.message(ctx, event)
 	if err != nil {
+		return err
+	}
+
+	if err := p.publisher.Publish(ctx, msg); err != nil {
 		return fmt.Errorf("failed to produce message: %w", err)
 	}
 
 	return nil
 }
 
-// Close closes the Kafka producer
+// message encodes a view event into a bus message keyed by product ID
+func (p *Producer) message(ctx context.Context, event ViewEvent) (*eventbus.Message, error) {
+	payload, err := p.encoder.Encode(&event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &eventbus.Message{
+		Topic:   p.topic,
+		Key:     []byte(event.ProductID.String()),
+		Value:   payload,
+		Headers: eventHeaders(p.encoder.ContentType(), p.producerID, traceParent(ctx)),
+	}, nil
+}
+
+// Close flushes and closes the underlying publisher
 func (p *Producer) Close() {
-	if p.producer != nil {
-		p.producer.Flush(15 * 1000) // Wait up to 15 seconds for any queued messages
-		p.producer.Close()
+	if err := p.publisher.Close(); err != nil {
+		log.Printf("Error closing publisher: %v\n", err)
 	}
 }
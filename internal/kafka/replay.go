@@ -0,0 +1,350 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tushar-kalsi/product-views/internal/eventbus"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// ConsumerGroup is the consumer group of the live view consumer
+const ConsumerGroup = "product-views-consumer"
+
+const (
+	// replayBatchSize is the number of messages recorded per transaction
+	replayBatchSize = 500
+	// replayPollTimeout bounds each wait for a message
+	replayPollTimeout = 100 * time.Millisecond
+	// replayRefreshInterval is how often Run reloads the live consumer's positions
+	replayRefreshInterval = 5 * time.Second
+	// maxReplayHeld bounds the messages read past the live consumer's positions
+	maxReplayHeld = 10000
+	// swapMaxLag is how far behind the live consumer a swap catches up
+	// before blocking it
+	swapMaxLag = replayBatchSize
+	// swapCatchUpTimeout bounds catching up with the blocked live consumer
+	swapCatchUpTimeout = 10 * time.Second
+	// replayReportLimit is the number of products listed in a swap's report
+	replayReportLimit = 10
+)
+
+var (
+	// ErrReplayDiverged is returned by Swap when the replay would change the
+	// views since the cut-off by more than allowed
+	ErrReplayDiverged = errors.New("replayed views diverge from the live counts")
+
+	errNoLiveOffsets = errors.New("live consumer has stored no offsets; replays require CONSUMER_EXACTLY_ONCE")
+	errReplayAhead   = errors.New("replay is too far ahead of the live consumer; is it running?")
+	errReplayStale   = errors.New("replayer failed or already swapped; run a new one to resume")
+)
+
+// ReplayGroup returns the consumer group a replay of group's views reads with.
+// Replays never commit; the group only keeps them out of the live assignment.
+func ReplayGroup(group string) string {
+	return group + "-replay"
+}
+
+// ReplayStartOffsets returns the offsets of the first messages published at
+// or after t, from which a replay sees every view published since then
+func ReplayStartOffsets(subscriber eventbus.Subscriber, topic string, t time.Time) (map[int32]int64, error) {
+	lookup, ok := subscriber.(eventbus.OffsetLookup)
+	if !ok {
+		return nil, errors.New("event bus cannot look up offsets by time")
+	}
+
+	positions, err := lookup.OffsetsForTime(topic, t)
+	if err != nil {
+		return nil, err
+	}
+
+	starts := make(map[int32]int64, len(positions))
+	for _, pos := range positions {
+		starts[pos.Partition] = pos.Offset
+	}
+	return starts, nil
+}
+
+// recordFunc records a batch of replayed views
+type recordFunc func(ctx context.Context, events []*repository.ViewEvent, positions map[int32]int64, dedupWindow time.Duration) error
+
+// Replayer recomputes the views since a replay's cut-off from the topic into
+// the replay's shadow tables, and swaps them with the live counts. It never
+// replays a partition past the live consumer's position, so that once both
+// stand at the same positions the shadow tables hold exactly what the live
+// ones should. The live consumer keeps running until Swap briefly blocks it.
+type Replayer struct {
+	subscriber  eventbus.Subscriber
+	store       repository.ReplayStore
+	dedupWindow time.Duration
+	state       *repository.ReplayState
+	// read holds the next offset to read and next the next offset to record,
+	// by partition
+	read map[int32]int64
+	next map[int32]int64
+	// held holds messages read past the live consumer's positions
+	held     map[int32][]*eventbus.Message
+	heldSize int
+	// stale is set once the recorded positions may no longer match next
+	stale bool
+}
+
+// NewReplayer creates a replayer for the replay started in store. The dedup
+// window must match the live consumer's.
+func NewReplayer(subscriber eventbus.Subscriber, store repository.ReplayStore, dedupWindow time.Duration) *Replayer {
+	return &Replayer{
+		subscriber:  subscriber,
+		store:       store,
+		dedupWindow: dedupWindow,
+		held:        make(map[int32][]*eventbus.Message),
+	}
+}
+
+// subscribe loads the replay and starts reading from its stored positions
+func (r *Replayer) subscribe(ctx context.Context) error {
+	if r.stale {
+		return errReplayStale
+	}
+	if r.state != nil {
+		return nil
+	}
+
+	state, err := r.store.LoadReplay(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.read = make(map[int32]int64, len(state.Positions))
+	r.next = make(map[int32]int64, len(state.Positions))
+	for p, offset := range state.Positions {
+		r.read[p] = offset
+		r.next[p] = offset
+	}
+	if err := r.subscriber.Subscribe(state.Topic, eventbus.Rebalance{Assigned: r.assigned}); err != nil {
+		return fmt.Errorf("failed to subscribe to topic: %w", err)
+	}
+
+	r.state = state
+	return nil
+}
+
+// assigned starts assigned partitions after the last message read
+func (r *Replayer) assigned(partitions []eventbus.Position) ([]eventbus.Position, error) {
+	for i, p := range partitions {
+		if offset, ok := r.read[p.Partition]; ok {
+			partitions[i].Offset = offset
+		}
+	}
+	return partitions, nil
+}
+
+// targets returns the offset to replay each partition up to given the live
+// consumer's positions
+func (r *Replayer) targets(live map[int32]int64) map[int32]int64 {
+	targets := make(map[int32]int64, len(r.state.Starts))
+	for p, start := range r.state.Starts {
+		targets[p] = max(live[p], start)
+	}
+	return targets
+}
+
+// lag returns the number of offsets left to replay up to targets
+func (r *Replayer) lag(targets map[int32]int64) int64 {
+	var lag int64
+	for p, target := range targets {
+		lag += max(target-r.next[p], 0)
+	}
+	return lag
+}
+
+// Run replays the topic until it is at most maxLag offsets behind the live
+// consumer, leaving the rest for Swap. The replay resumes from its stored
+// positions after an error, with a new Replayer.
+func (r *Replayer) Run(ctx context.Context, maxLag int64) error {
+	if err := r.subscribe(ctx); err != nil {
+		return err
+	}
+
+	for {
+		live, err := r.store.LoadConsumerOffsets(ctx, r.state.GroupID, r.state.Topic)
+		if err != nil {
+			return fmt.Errorf("failed to load live offsets: %w", err)
+		}
+		if len(live) == 0 {
+			return errNoLiveOffsets
+		}
+
+		targets := r.targets(live)
+		lag := r.lag(targets)
+		if lag <= maxLag {
+			return nil
+		}
+		log.Printf("Replaying views, %d offsets behind the live consumer\n", lag)
+
+		if _, err := r.advance(ctx, time.Now().Add(replayRefreshInterval), targets, r.store.RecordReplayViews); err != nil {
+			return err
+		}
+	}
+}
+
+// Swap catches up with the live consumer, then blocks it, replays the rest of
+// the topic up to its positions and replaces the live counts, raw events and
+// trending scores since the cut-off with the replayed ones. It catches up
+// first so that the consumer is only blocked for the last swapMaxLag offsets
+// or so; product writes wait only for the rows the swap adjusts. A maxChange
+// above zero refuses swaps that change the total views since the cut-off by
+// more than that fraction. The report is returned either way.
+func (r *Replayer) Swap(ctx context.Context, maxChange float64) (repository.ReplayReport, error) {
+	if err := r.Run(ctx, swapMaxLag); err != nil {
+		return repository.ReplayReport{}, err
+	}
+
+	swap, err := r.store.BeginReplaySwap(ctx)
+	if err != nil {
+		return repository.ReplayReport{}, fmt.Errorf("failed to block the live consumer: %w", err)
+	}
+	defer swap.Rollback()
+
+	// What the swap records is lost unless it commits, which ends the replay
+	r.stale = true
+
+	live := swap.Live()
+	if len(live) == 0 {
+		return repository.ReplayReport{}, errNoLiveOffsets
+	}
+
+	reached, err := r.advance(ctx, time.Now().Add(swapCatchUpTimeout), r.targets(live), swap.RecordViews)
+	if err != nil {
+		return repository.ReplayReport{}, err
+	}
+	if !reached {
+		return repository.ReplayReport{}, fmt.Errorf("replay did not catch up with the live consumer within %s", swapCatchUpTimeout)
+	}
+
+	report, err := swap.Report(ctx, replayReportLimit)
+	if err != nil {
+		return report, fmt.Errorf("failed to compare replayed views: %w", err)
+	}
+	if maxChange > 0 && report.Change() > maxChange {
+		return report, fmt.Errorf("%w: views since %s change by %.1f%%",
+			ErrReplayDiverged, report.Since.Format(time.RFC3339), report.Change()*100)
+	}
+
+	if err := swap.Commit(ctx); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// advance replays messages below targets, recording them in batches, until
+// every partition reached its target or the deadline passed. Messages at or
+// past a target are held until a later target covers them.
+func (r *Replayer) advance(ctx context.Context, deadline time.Time, targets map[int32]int64, record recordFunc) (bool, error) {
+	var batch []*eventbus.Message
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := r.record(ctx, batch, record)
+		batch = nil
+		if err != nil {
+			r.stale = true
+			return fmt.Errorf("failed to record replayed views: %w", err)
+		}
+		return nil
+	}
+	add := func(msg *eventbus.Message) {
+		batch = append(batch, msg)
+		r.next[msg.Partition] = msg.Offset + 1
+	}
+
+	// Messages held back by earlier targets come first
+	for p, msgs := range r.held {
+		n := 0
+		for n < len(msgs) && msgs[n].Offset < targets[p] {
+			add(msgs[n])
+			n++
+		}
+		r.held[p] = msgs[n:]
+		r.heldSize -= n
+	}
+
+	for !r.reached(targets) {
+		if len(batch) >= replayBatchSize {
+			if err := flush(); err != nil {
+				return false, err
+			}
+		}
+		if r.heldSize >= maxReplayHeld {
+			if err := flush(); err != nil {
+				return false, err
+			}
+			return false, errReplayAhead
+		}
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			return false, flush()
+		}
+
+		msg, err := r.subscriber.Poll(replayPollTimeout)
+		if err != nil {
+			if ferr := flush(); ferr != nil {
+				return false, ferr
+			}
+			return false, fmt.Errorf("failed to read message: %w", err)
+		}
+		if msg == nil {
+			if err := flush(); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		target, ok := targets[msg.Partition]
+		if !ok || msg.Offset < r.read[msg.Partition] {
+			continue
+		}
+		r.read[msg.Partition] = msg.Offset + 1
+
+		if msg.Offset >= target {
+			r.held[msg.Partition] = append(r.held[msg.Partition], msg)
+			r.heldSize++
+			continue
+		}
+		add(msg)
+	}
+
+	return true, flush()
+}
+
+// reached reports whether every partition was replayed up to its target
+func (r *Replayer) reached(targets map[int32]int64) bool {
+	for p, target := range targets {
+		if r.next[p] < target {
+			return false
+		}
+	}
+	return true
+}
+
+// record decodes a batch of messages as the live consumer does and records
+// their views. Messages the live consumer skips or dead-letters are skipped.
+func (r *Replayer) record(ctx context.Context, msgs []*eventbus.Message, record recordFunc) error {
+	events := make([]*repository.ViewEvent, 0, len(msgs))
+	for _, msg := range msgs {
+		event, err := decodeMessage(msg)
+		if err != nil {
+			continue
+		}
+		events = append(events, toRepositoryEvent(event))
+	}
+
+	positions := make(map[int32]int64)
+	for _, pos := range commitOffsets(msgs) {
+		positions[pos.Partition] = pos.Offset
+	}
+
+	return record(ctx, events, positions, r.dedupWindow)
+}
@@ -0,0 +1,193 @@
+package leaderboard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tushar-kalsi/product-views/internal/queue"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// Capacity is the number of products the leaderboard keeps ranked
+const Capacity = 100
+
+// Source loads rankings and product details for the leaderboard
+type Source interface {
+	GetTopViewedProducts(ctx context.Context, limit int) ([]repository.Product, error)
+	GetProduct(ctx context.Context, id uuid.UUID) (*repository.Product, error)
+}
+
+// ErrIncomplete is returned by Top when products removed since the last
+// warm-up leave fewer ranked products than requested
+var ErrIncomplete = errors.New("leaderboard: too few ranked products")
+
+// Leaderboard keeps the most viewed products in memory. It is warmed from the
+// database, fed live counts by the Kafka consumer and periodically reconciled,
+// because each API instance only consumes a share of the topic's partitions.
+// Every ranked product has its details loaded, so serving the ranking never
+// reads the database.
+type Leaderboard struct {
+	source   Source
+	pq       *queue.PriorityQueue
+	mu       sync.RWMutex
+	products map[uuid.UUID]repository.Product // product details by ID
+	removed  bool                             // whether products left the ranking since the last warm-up
+	asOf     time.Time
+	warm     bool
+	wg       sync.WaitGroup
+	done     chan struct{}
+}
+
+// New creates a cold leaderboard backed by the given source
+func New(source Source) *Leaderboard {
+	return &Leaderboard{
+		source:   source,
+		pq:       queue.NewPriorityQueue(Capacity),
+		products: make(map[uuid.UUID]repository.Product),
+		done:     make(chan struct{}),
+	}
+}
+
+// Warm replaces the leaderboard's contents with the current top products from the source
+func (l *Leaderboard) Warm(ctx context.Context) error {
+	products, err := l.source.GetTopViewedProducts(ctx, Capacity)
+	if err != nil {
+		return fmt.Errorf("failed to load top products: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pq.Clear()
+	l.products = make(map[uuid.UUID]repository.Product, len(products))
+	for _, p := range products {
+		l.pq.Update(p.ID, p.ViewCount)
+		l.products[p.ID] = p
+	}
+	l.removed = false
+	l.asOf = time.Now()
+	l.warm = true
+
+	return nil
+}
+
+// Update records a product's latest lifetime view count. The details of a
+// product climbing into the ranking are loaded first; archived products and
+// products whose details cannot be loaded are left out until the next warm-up.
+func (l *Leaderboard) Update(ctx context.Context, productID uuid.UUID, viewCount int64) {
+	if !l.pq.Admits(productID, viewCount) {
+		return
+	}
+
+	l.mu.RLock()
+	p, ok := l.products[productID]
+	l.mu.RUnlock()
+
+	if !ok {
+		loaded, err := l.source.GetProduct(ctx, productID)
+		if err != nil {
+			log.Printf("Error loading product %s for the leaderboard: %v\n", productID, err)
+			return
+		}
+		p = *loaded
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Archived details are kept so that later views do not load them again
+	l.products[productID] = p
+	if p.ArchivedAt != nil {
+		return
+	}
+	l.pq.Update(productID, viewCount)
+	l.asOf = time.Now()
+}
+
+// IsWarm reports whether the leaderboard has been loaded and can serve requests
+func (l *Leaderboard) IsWarm() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.warm
+}
+
+// Top returns the top N products by view count and the time the ranking was
+// last updated, or ErrIncomplete when fewer than N products remain ranked
+// after products were archived since the last warm-up
+func (l *Leaderboard) Top(limit int) ([]repository.Product, time.Time, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	top := l.pq.GetTop()
+	if len(top) < limit && l.removed {
+		return nil, time.Time{}, ErrIncomplete
+	}
+
+	products := make([]repository.Product, 0, min(limit, len(top)))
+	for _, item := range top[:min(limit, len(top))] {
+		p := l.products[item.ProductID]
+		p.ID = item.ProductID
+		p.ViewCount = item.ViewCount
+		products = append(products, p)
+	}
+
+	return products, l.asOf, nil
+}
+
+// Refresh replaces the details of a ranked product after it was edited
+func (l *Leaderboard) Refresh(p repository.Product) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.products[p.ID]; ok {
+		l.products[p.ID] = p
+	}
+}
+
+// Remove takes an archived product out of the ranking
+func (l *Leaderboard) Remove(productID uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pq.Remove(productID)
+	delete(l.products, productID)
+	l.removed = true
+}
+
+// Start periodically reconciles the leaderboard with the database
+func (l *Leaderboard) Start(interval time.Duration) {
+	l.wg.Add(1)
+	go l.reconcile(interval)
+}
+
+// Stop stops the periodic reconciliation
+func (l *Leaderboard) Stop() {
+	close(l.done)
+	l.wg.Wait()
+}
+
+func (l *Leaderboard) reconcile(interval time.Duration) {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := l.Warm(ctx); err != nil {
+				log.Printf("Error reconciling leaderboard: %v\n", err)
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package leaderboard
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/tushar-kalsi/product-views/internal/repository"
+)
+
+// fakeSource is an in-memory Source
+type fakeSource struct {
+	products map[uuid.UUID]repository.Product
+	top      []repository.Product
+	err      error
+	loads    int
+}
+
+func (f *fakeSource) GetTopViewedProducts(ctx context.Context, limit int) ([]repository.Product, error) {
+	return f.top, f.err
+}
+
+func (f *fakeSource) GetProduct(ctx context.Context, id uuid.UUID) (*repository.Product, error) {
+	f.loads++
+	p, ok := f.products[id]
+	if !ok {
+		return nil, errors.New("product not found")
+	}
+	return &p, nil
+}
+
+func TestLeaderboard(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Cold until warmed", func(t *testing.T) {
+		lb := New(&fakeSource{err: errors.New("db down")})
+		assert.False(t, lb.IsWarm())
+
+		err := lb.Warm(ctx)
+		assert.Error(t, err)
+		assert.False(t, lb.IsWarm())
+	})
+
+	t.Run("Warm and serve", func(t *testing.T) {
+		a := repository.Product{ID: uuid.New(), Name: "A", ViewCount: 300}
+		b := repository.Product{ID: uuid.New(), Name: "B", ViewCount: 200}
+		c := repository.Product{ID: uuid.New(), Name: "C", ViewCount: 100}
+		lb := New(&fakeSource{top: []repository.Product{a, b, c}})
+
+		assert.NoError(t, lb.Warm(ctx))
+		assert.True(t, lb.IsWarm())
+
+		top, asOf, err := lb.Top(2)
+		assert.NoError(t, err)
+		assert.False(t, asOf.IsZero())
+		assert.Len(t, top, 2)
+		assert.Equal(t, "A", top[0].Name)
+		assert.Equal(t, "B", top[1].Name)
+	})
+
+	t.Run("Live updates reorder and load new entries", func(t *testing.T) {
+		a := repository.Product{ID: uuid.New(), Name: "A", ViewCount: 300}
+		b := repository.Product{ID: uuid.New(), Name: "B", ViewCount: 200}
+		newcomer := repository.Product{ID: uuid.New(), Name: "Newcomer", ViewCount: 1}
+		source := &fakeSource{
+			top:      []repository.Product{a, b},
+			products: map[uuid.UUID]repository.Product{newcomer.ID: newcomer},
+		}
+		lb := New(source)
+		assert.NoError(t, lb.Warm(ctx))
+
+		_, warmedAt, err := lb.Top(10)
+		assert.NoError(t, err)
+
+		lb.Update(ctx, b.ID, 301)
+		lb.Update(ctx, newcomer.ID, 250)
+		assert.Equal(t, 1, source.loads)
+
+		top, asOf, err := lb.Top(10)
+		assert.NoError(t, err)
+		assert.False(t, asOf.Before(warmedAt))
+		assert.Len(t, top, 3)
+		assert.Equal(t, "B", top[0].Name)
+		assert.Equal(t, int64(301), top[0].ViewCount)
+		assert.Equal(t, "A", top[1].Name)
+		assert.Equal(t, "Newcomer", top[2].Name)
+		assert.Equal(t, int64(250), top[2].ViewCount)
+
+		// Serving never loads details
+		_, _, err = lb.Top(10)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, source.loads)
+	})
+
+	t.Run("Reconcile replaces live counts", func(t *testing.T) {
+		a := repository.Product{ID: uuid.New(), Name: "A", ViewCount: 10}
+		source := &fakeSource{top: []repository.Product{a}}
+		lb := New(source)
+		assert.NoError(t, lb.Warm(ctx))
+
+		lb.Update(ctx, uuid.New(), 50)
+
+		source.top = []repository.Product{{ID: a.ID, Name: "A", ViewCount: 60}}
+		assert.NoError(t, lb.Warm(ctx))
+
+		top, _, err := lb.Top(10)
+		assert.NoError(t, err)
+		assert.Len(t, top, 1)
+		assert.Equal(t, int64(60), top[0].ViewCount)
+	})
+
+	t.Run("Archived products leave the ranking", func(t *testing.T) {
+		a := repository.Product{ID: uuid.New(), Name: "A", ViewCount: 300}
+		b := repository.Product{ID: uuid.New(), Name: "B", ViewCount: 200}
+		c := repository.Product{ID: uuid.New(), Name: "C", ViewCount: 100}
+		lb := New(&fakeSource{top: []repository.Product{a, b, c}})
+		assert.NoError(t, lb.Warm(ctx))
+
+		lb.Remove(a.ID)
+
+		top, _, err := lb.Top(2)
+		assert.NoError(t, err)
+		assert.Len(t, top, 2)
+		assert.Equal(t, "B", top[0].Name)
+		assert.Equal(t, "C", top[1].Name)
+
+		// A page the remaining products cannot fill is left to the database
+		_, _, err = lb.Top(3)
+		assert.ErrorIs(t, err, ErrIncomplete)
+	})
+
+	t.Run("Archived products do not climb back in", func(t *testing.T) {
+		a := repository.Product{ID: uuid.New(), Name: "A", ViewCount: 300}
+		archivedAt := time.Now()
+		archived := repository.Product{ID: uuid.New(), Name: "Archived", ViewCount: 1, ArchivedAt: &archivedAt}
+		source := &fakeSource{
+			top:      []repository.Product{a},
+			products: map[uuid.UUID]repository.Product{archived.ID: archived},
+		}
+		lb := New(source)
+		assert.NoError(t, lb.Warm(ctx))
+
+		lb.Update(ctx, archived.ID, 400)
+		lb.Update(ctx, archived.ID, 500)
+		assert.Equal(t, 1, source.loads)
+
+		top, _, err := lb.Top(10)
+		assert.NoError(t, err)
+		assert.Len(t, top, 1)
+		assert.Equal(t, "A", top[0].Name)
+	})
+
+	t.Run("Edits refresh ranked details", func(t *testing.T) {
+		a := repository.Product{ID: uuid.New(), Name: "A", ViewCount: 300}
+		lb := New(&fakeSource{top: []repository.Product{a}})
+		assert.NoError(t, lb.Warm(ctx))
+
+		edited := a
+		edited.Name = "Renamed"
+		edited.ViewCount = 0
+		lb.Refresh(edited)
+		lb.Refresh(repository.Product{ID: uuid.New(), Name: "Unranked"})
+
+		top, _, err := lb.Top(10)
+		assert.NoError(t, err)
+		assert.Len(t, top, 1)
+		assert.Equal(t, "Renamed", top[0].Name)
+		assert.Equal(t, int64(300), top[0].ViewCount)
+	})
+}
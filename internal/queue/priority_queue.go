@@ -108,6 +108,27 @@ func (pq *PriorityQueue) Update(productID uuid.UUID, viewCount int64) {
 	}
 }
 
+// Admits reports whether Update would keep the product with the given count
+func (pq *PriorityQueue) Admits(productID uuid.UUID, viewCount int64) bool {
+	pq.mu.RLock()
+	defer pq.mu.RUnlock()
+
+	if _, exists := pq.itemMap[productID]; exists {
+		return true
+	}
+	return len(pq.items) < pq.capacity || viewCount > pq.items[0].ViewCount
+}
+
+// Remove removes a product from the queue, if it is queued
+func (pq *PriorityQueue) Remove(productID uuid.UUID) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	if item, exists := pq.itemMap[productID]; exists {
+		heap.Remove(pq, item.index)
+	}
+}
+
 // GetTop returns the top N products sorted by view count (descending)
 func (pq *PriorityQueue) GetTop() []*ProductView {
 	pq.mu.RLock()
@@ -69,6 +69,27 @@ func TestPriorityQueue(t *testing.T) {
 		assert.Equal(t, id1, top[0].ProductID)
 	})
 
+	t.Run("Admits and Remove", func(t *testing.T) {
+		pq := NewPriorityQueue(2)
+		id1, id2 := uuid.New(), uuid.New()
+
+		assert.True(t, pq.Admits(id1, 1))
+		pq.Update(id1, 100)
+		pq.Update(id2, 200)
+
+		// Full: only counts above the lowest, or queued products, are kept
+		assert.False(t, pq.Admits(uuid.New(), 100))
+		assert.True(t, pq.Admits(uuid.New(), 101))
+		assert.True(t, pq.Admits(id1, 1))
+
+		pq.Remove(id2)
+		pq.Remove(uuid.New())
+		top := pq.GetTop()
+		assert.Len(t, top, 1)
+		assert.Equal(t, id1, top[0].ProductID)
+		assert.True(t, pq.Admits(uuid.New(), 1))
+	})
+
 	t.Run("Clear", func(t *testing.T) {
 		pq := NewPriorityQueue(5)
 
@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// PartitionOffset is the next offset to consume from a topic partition
+type PartitionOffset struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// ConsumerOffsets are the positions of a consumer group after a batch of messages
+type ConsumerOffsets struct {
+	GroupID string
+	Offsets []PartitionOffset
+	// Positions holds the offsets of the messages carrying each event, by
+	// event ID. RecordViews stops the stored offsets at the first message whose
+	// event it skips, so that the message is read again if the consumer stops
+	// before dead-lettering it.
+	Positions map[uuid.UUID][]PartitionOffset
+}
+
+// StopAt returns a copy of the offsets in which every partition holding one of
+// the given messages resumes from the earliest of them
+func (o *ConsumerOffsets) StopAt(msgs []PartitionOffset) *ConsumerOffsets {
+	stopped := *o
+	stopped.Offsets = make([]PartitionOffset, len(o.Offsets))
+	for i, p := range o.Offsets {
+		for _, m := range msgs {
+			if m.Topic == p.Topic && m.Partition == p.Partition && m.Offset < p.Offset {
+				p.Offset = m.Offset
+			}
+		}
+		stopped.Offsets[i] = p
+	}
+	return &stopped
+}
+
+// OffsetStore keeps consumer offsets in the database so that they can be
+// written atomically with the data derived from the messages
+type OffsetStore interface {
+	// LoadConsumerOffsets returns the next offset of every partition of the
+	// topic the group has stored an offset for
+	LoadConsumerOffsets(ctx context.Context, groupID, topic string) (map[int32]int64, error)
+	SaveConsumerOffsets(ctx context.Context, offsets ConsumerOffsets) error
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// LoadConsumerOffsets returns the stored offsets of a consumer group for a topic
+func (r *productRepository) LoadConsumerOffsets(ctx context.Context, groupID, topic string) (map[int32]int64, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT partition, next_offset FROM consumer_offsets
+		WHERE group_id = $1 AND topic = $2`, groupID, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	offsets := make(map[int32]int64)
+	for rows.Next() {
+		var partition int32
+		var offset int64
+		if err := rows.Scan(&partition, &offset); err != nil {
+			return nil, err
+		}
+		offsets[partition] = offset
+	}
+
+	return offsets, rows.Err()
+}
+
+// SaveConsumerOffsets stores a consumer group's offsets outside of a batch,
+// e.g. for messages that were dead-lettered rather than recorded
+func (r *productRepository) SaveConsumerOffsets(ctx context.Context, offsets ConsumerOffsets) error {
+	return saveConsumerOffsets(ctx, r.db, &offsets)
+}
+
+// saveConsumerOffsets upserts offsets, never moving a partition backwards
+func saveConsumerOffsets(ctx context.Context, db execer, offsets *ConsumerOffsets) error {
+	if offsets == nil || len(offsets.Offsets) == 0 {
+		return nil
+	}
+
+	topics := make([]string, len(offsets.Offsets))
+	partitions := make([]int64, len(offsets.Offsets))
+	next := make([]int64, len(offsets.Offsets))
+	for i, o := range offsets.Offsets {
+		topics[i] = o.Topic
+		partitions[i] = int64(o.Partition)
+		next[i] = o.Offset
+	}
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO consumer_offsets (group_id, topic, partition, next_offset, updated_at)
+		SELECT $1, o.topic, o.partition, o.next_offset, CURRENT_TIMESTAMP
+		FROM unnest($2::text[], $3::int[], $4::bigint[]) AS o(topic, partition, next_offset)
+		ON CONFLICT (group_id, topic, partition) DO UPDATE
+		SET next_offset = GREATEST(consumer_offsets.next_offset, EXCLUDED.next_offset),
+		    updated_at = CURRENT_TIMESTAMP`,
+		offsets.GroupID, pq.Array(topics), pq.Array(partitions), pq.Array(next))
+	return err
+}
@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+)
+
+// JobStore coordinates the periodic jobs that every instance schedules, so
+// that each job runs once per interval whichever instances are up
+type JobStore interface {
+	// ClaimJobRun claims the run of a job for the interval starting at slot
+	// and takes the job's advisory lock. It returns nil if the run was already
+	// claimed or the job is still running elsewhere. Otherwise finish must be
+	// called with the outcome of the run to record it and release the lock.
+	ClaimJobRun(ctx context.Context, name string, slot time.Time) (finish func(runErr error), err error)
+}
+
+// jobLockPrefix namespaces the advisory locks of jobs from the locks the jobs
+// take themselves
+const jobLockPrefix = "job:"
+
+// ClaimJobRun holds the job's lock in a session of its own for the length of
+// the run, rather than a transaction, as runs take their own transactions
+func (r *productRepository) ClaimJobRun(ctx context.Context, name string, slot time.Time) (func(runErr error), error) {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, jobLockPrefix+name).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !locked {
+		conn.Close()
+		return nil, nil
+	}
+
+	// release unlocks the job before the connection goes back to the pool. If
+	// that fails the connection is discarded instead, which ends its session
+	// and with it the lock.
+	release := func() {
+		_, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(hashtext($1))`, jobLockPrefix+name)
+		if err != nil {
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}
+
+	result, err := conn.ExecContext(ctx, `
+		INSERT INTO job_runs AS j (name, slot, started_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP)
+		ON CONFLICT (name) DO UPDATE
+		SET slot = EXCLUDED.slot, started_at = EXCLUDED.started_at, finished_at = NULL, error = NULL
+		WHERE j.slot < EXCLUDED.slot`,
+		name, slot)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if claimed, err := result.RowsAffected(); err != nil || claimed == 0 {
+		release()
+		return nil, err
+	}
+
+	return func(runErr error) {
+		var message *string
+		if runErr != nil {
+			s := runErr.Error()
+			message = &s
+		}
+		_, _ = conn.ExecContext(context.Background(), `
+			UPDATE job_runs SET finished_at = CURRENT_TIMESTAMP, error = $2 WHERE name = $1`,
+			name, message)
+		release()
+	}, nil
+}
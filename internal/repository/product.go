@@ -5,25 +5,62 @@ import (
     "database/sql"
     "errors"
     "github.com/google/uuid"
+    "strings"
     "time"
 )
 
+var (
+    // ErrProductNotFound is returned for products that do not exist
+    ErrProductNotFound = errors.New("product not found")
+    // ErrVersionMismatch is returned when a product was changed since the
+    // version an update was based on
+    ErrVersionMismatch = errors.New("product version mismatch")
+    // ErrProductArchived is returned when changing an archived product
+    ErrProductArchived = errors.New("product is archived")
+)
+
+// AnyVersion makes UpdateProduct and ArchiveProduct skip the version check
+const AnyVersion int64 = 0
+
 // Product represents a product in the database
 type Product struct {
-    ID          uuid.UUID `db:"id"`
-    Name        string    `db:"name"`
-    Description string    `db:"description"`
-    ViewCount   int64     `db:"view_count"`
-    CreatedAt   time.Time `db:"created_at"`
-    UpdatedAt   time.Time `db:"updated_at"`
+    ID              uuid.UUID `db:"id"`
+    Name            string    `db:"name"`
+    Description     string    `db:"description"`
+    ViewCount       int64     `db:"view_count"`
+    UniqueViewCount int64     `db:"unique_view_count"`
+    // Version is incremented by every change to the catalog fields
+    Version    int64      `db:"version"`
+    ArchivedAt *time.Time `db:"archived_at"`
+    CreatedAt  time.Time  `db:"created_at"`
+    UpdatedAt  time.Time  `db:"updated_at"`
+}
+
+// ProductUpdate holds the catalog fields to change; nil fields are kept
+type ProductUpdate struct {
+    Name        *string
+    Description *string
 }
 
 // ProductRepository defines the interface for product data operations
 type ProductRepository interface {
     IncrementViewCount(ctx context.Context, productID uuid.UUID) error
+    RecordView(ctx context.Context, v *ViewEvent, opts RecordOptions) (RecordResult, error)
+    RecordViews(ctx context.Context, events []*ViewEvent, opts RecordOptions) (BatchResult, error)
+    PurgeViewDedup(ctx context.Context, before time.Time) (int64, error)
     GetTopViewedProducts(ctx context.Context, limit int) ([]Product, error)
+    GetTopUniqueViewedProducts(ctx context.Context, limit int) ([]Product, error)
+    GetTopProductsIncludingArchived(ctx context.Context, limit int, unique bool) ([]Product, error)
+    GetTopProductsInSlice(ctx context.Context, slice ProductSlice, limit int, unique, includeArchived bool) ([]Product, error)
+    GetTopViewedProductsInRange(ctx context.Context, from, to time.Time, limit int, unique bool) ([]ProductPeriodViews, error)
+    GetTrendingProducts(ctx context.Context, limit int, halfLife time.Duration) ([]TrendingProduct, error)
+    GetProductViewSeries(ctx context.Context, productID uuid.UUID, from, to time.Time, interval SeriesInterval, loc *time.Location) ([]ViewSeriesPoint, error)
     GetProduct(ctx context.Context, id uuid.UUID) (*Product, error)
+    ListProducts(ctx context.Context, q ProductListQuery) (ProductPage, error)
+    SearchProducts(ctx context.Context, q ProductSearchQuery) (ProductSearchPage, error)
     CreateProduct(ctx context.Context, p *Product) error
+    UpdateProduct(ctx context.Context, id uuid.UUID, update ProductUpdate, version int64) (*Product, error)
+    ArchiveProduct(ctx context.Context, id uuid.UUID, version int64) (*Product, error)
 }
 
 type productRepository struct {
@@ -53,25 +90,67 @@ func (r *productRepository) IncrementViewCount(ctx context.Context, productID uu
     }
 
     if rowsAffected == 0 {
-        return errors.New("product not found")
+        return ErrProductNotFound
     }
 
     return nil
 }
 
-// GetTopViewedProducts returns the top N most viewed products
+// GetTopViewedProducts returns the top N most viewed products that are not archived
 func (r *productRepository) GetTopViewedProducts(ctx context.Context, limit int) ([]Product, error) {
+    return r.getTopProducts(ctx, "view_count", limit, false, productSlice{})
+}
+
+// GetTopUniqueViewedProducts returns the top N products by deduplicated view count
+// that are not archived
+func (r *productRepository) GetTopUniqueViewedProducts(ctx context.Context, limit int) ([]Product, error) {
+    return r.getTopProducts(ctx, "unique_view_count", limit, false, productSlice{})
+}
+
+// GetTopProductsIncludingArchived returns the top N products by raw or, when
+// unique is set, deduplicated view count, archived or not
+func (r *productRepository) GetTopProductsIncludingArchived(ctx context.Context, limit int, unique bool) ([]Product, error) {
+    if unique {
+        return r.getTopProducts(ctx, "unique_view_count", limit, true, productSlice{})
+    }
+    return r.getTopProducts(ctx, "view_count", limit, true, productSlice{})
+}
+
+// getTopProducts returns the top N products ordered by the given count column,
+// restricted to the products of slice
+func (r *productRepository) getTopProducts(ctx context.Context, column string, limit int, includeArchived bool, slice productSlice) ([]Product, error) {
     if limit > 100 {
         limit = 100 // Enforce max limit
     }
 
-    query := `
-        SELECT id, name, description, view_count, created_at, updated_at
-        FROM products
-        ORDER BY view_count DESC
+    args := []any{limit}
+    with := slice.with(&args)
+    outer := []string{"archived_at IS NULL"}
+    inner := []string{"archived_at IS NULL"}
+    if includeArchived {
+        outer, inner = []string{"TRUE"}, []string{"TRUE"}
+    }
+    outer = append(outer, slice.conditions("p.id", &args)...)
+    candidates := slice.candidates(column, inner, &args)
+
+    // Counts still in the counter shards only ever add to a product's count,
+    // so the top N are among the top N by their products row and the products
+    // with shards. column is never user input, only one of the fixed count columns.
+    query := with + `
+        SELECT p.id, p.name, p.description,
+               p.view_count + s.views AS view_count,
+               p.unique_view_count + s.unique_views AS unique_view_count,
+               p.version, p.archived_at, p.created_at, p.updated_at
+        FROM products p` + shardSums("s", "p.id") + `
+        WHERE ` + strings.Join(outer, " AND ") + ` AND p.id IN (
+            (` + candidates + `)
+            UNION
+            SELECT product_id FROM product_view_count_shards
+        )
+        ORDER BY ` + column + ` DESC
         LIMIT $1`
 
-    rows, err := r.db.QueryContext(ctx, query, limit)
+    rows, err := r.db.QueryContext(ctx, query, args...)
     if err != nil {
         return nil, err
     }
@@ -85,6 +164,9 @@ func (r *productRepository) GetTopViewedProducts(ctx context.Context, limit int)
             &p.Name,
             &p.Description,
             &p.ViewCount,
+            &p.UniqueViewCount,
+            &p.Version,
+            &p.ArchivedAt,
             &p.CreatedAt,
             &p.UpdatedAt,
         )
@@ -101,39 +183,34 @@ func (r *productRepository) GetTopViewedProducts(ctx context.Context, limit int)
     return products, nil
 }
 
-// GetProduct retrieves a product by ID
+// GetProduct retrieves a product by ID, archived or not
 func (r *productRepository) GetProduct(ctx context.Context, id uuid.UUID) (*Product, error) {
     query := `
-        SELECT id, name, description, view_count, created_at, updated_at
-        FROM products
-        WHERE id = $1`
+        SELECT p.id, p.name, p.description, p.view_count + s.views, p.unique_view_count + s.unique_views,
+               p.version, p.archived_at, p.created_at, p.updated_at
+        FROM products p` + shardSums("s", "p.id") + `
+        WHERE p.id = $1`
 
-    var p Product
-    err := r.db.QueryRowContext(ctx, query, id).Scan(
-        &p.ID,
-        &p.Name,
-        &p.Description,
-        &p.ViewCount,
-        &p.CreatedAt,
-        &p.UpdatedAt,
-    )
-
-    if err != nil {
-        if errors.Is(err, sql.ErrNoRows) {
-            return nil, errors.New("product not found")
-        }
-        return nil, err
+    p, err := scanProduct(r.db.QueryRowContext(ctx, query, id))
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrProductNotFound
     }
-
-    return &p, nil
+    return p, err
 }
 
-// CreateProduct creates a new product
+// CreateProduct creates a new product. An initial view count has no views
+// behind it, so it is recorded as the product's baseline for reconciliation.
 func (r *productRepository) CreateProduct(ctx context.Context, p *Product) error {
     query := `
-        INSERT INTO products (name, description, view_count)
-        VALUES ($1, $2, $3)
-        RETURNING id, created_at, updated_at`
+        WITH created AS (
+            INSERT INTO products (name, description, view_count)
+            VALUES ($1, $2, $3)
+            RETURNING id, view_count, version, created_at, updated_at
+        ), baseline AS (
+            INSERT INTO product_view_baselines (product_id, views)
+            SELECT id, view_count FROM created WHERE view_count <> 0
+        )
+        SELECT id, version, created_at, updated_at FROM created`
 
     return r.db.QueryRowContext(
         ctx,
@@ -141,5 +218,95 @@ func (r *productRepository) CreateProduct(ctx context.Context, p *Product) error
         p.Name,
         p.Description,
         p.ViewCount,
-    ).Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt)
+    ).Scan(&p.ID, &p.Version, &p.CreatedAt, &p.UpdatedAt)
+}
+
+// UpdateProduct changes the catalog fields of a product that is not archived,
+// provided it is still at the given version, and returns the updated product.
+// An update that changes nothing keeps the version, so that it does not fail
+// the If-Match of other clients, and returns the product as it is.
+func (r *productRepository) UpdateProduct(ctx context.Context, id uuid.UUID, update ProductUpdate, version int64) (*Product, error) {
+    query := `
+        WITH updated AS (
+            UPDATE products
+            SET name = COALESCE($2, name),
+                description = COALESCE($3, description),
+                version = version + 1
+            WHERE id = $1 AND archived_at IS NULL AND ($4::bigint = 0 OR version = $4)
+              AND (name IS DISTINCT FROM COALESCE($2, name) OR description IS DISTINCT FROM COALESCE($3, description))
+            RETURNING *
+        ), current AS (
+            SELECT * FROM updated
+            UNION ALL
+            SELECT * FROM products
+            WHERE id = $1 AND archived_at IS NULL AND ($4::bigint = 0 OR version = $4)
+              AND NOT EXISTS (SELECT 1 FROM updated)
+        )
+        SELECT p.id, p.name, p.description, p.view_count + s.views, p.unique_view_count + s.unique_views,
+               p.version, p.archived_at, p.created_at, p.updated_at
+        FROM current p` + shardSums("s", "p.id")
+
+    p, err := scanProduct(r.db.QueryRowContext(ctx, query, id, update.Name, update.Description, version))
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, r.unchangedReason(ctx, id)
+    }
+    return p, err
+}
+
+// ArchiveProduct archives a product, provided it is still at the given
+// version, and returns the archived product. Its views are kept.
+func (r *productRepository) ArchiveProduct(ctx context.Context, id uuid.UUID, version int64) (*Product, error) {
+    query := `
+        WITH archived AS (
+            UPDATE products
+            SET archived_at = CURRENT_TIMESTAMP,
+                version = version + 1
+            WHERE id = $1 AND archived_at IS NULL AND ($2::bigint = 0 OR version = $2)
+            RETURNING *
+        )
+        SELECT p.id, p.name, p.description, p.view_count + s.views, p.unique_view_count + s.unique_views,
+               p.version, p.archived_at, p.created_at, p.updated_at
+        FROM archived p` + shardSums("s", "p.id")
+
+    p, err := scanProduct(r.db.QueryRowContext(ctx, query, id, version))
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, r.unchangedReason(ctx, id)
+    }
+    return p, err
+}
+
+// unchangedReason explains why a conditional update of a product matched no row
+func (r *productRepository) unchangedReason(ctx context.Context, id uuid.UUID) error {
+    var archived bool
+    err := r.db.QueryRowContext(ctx, `SELECT archived_at IS NOT NULL FROM products WHERE id = $1`, id).Scan(&archived)
+    switch {
+    case errors.Is(err, sql.ErrNoRows):
+        return ErrProductNotFound
+    case err != nil:
+        return err
+    case archived:
+        return ErrProductArchived
+    default:
+        return ErrVersionMismatch
+    }
+}
+
+// scanProduct scans a product selected with its counts, version and timestamps
+func scanProduct(row *sql.Row) (*Product, error) {
+    var p Product
+    err := row.Scan(
+        &p.ID,
+        &p.Name,
+        &p.Description,
+        &p.ViewCount,
+        &p.UniqueViewCount,
+        &p.Version,
+        &p.ArchivedAt,
+        &p.CreatedAt,
+        &p.UpdatedAt,
+    )
+    if err != nil {
+        return nil, err
+    }
+    return &p, nil
 }
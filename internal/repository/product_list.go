@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProductSort is a column the product listing can be ordered by
+type ProductSort string
+
+const (
+	SortByName      ProductSort = "name"
+	SortByCreatedAt ProductSort = "created_at"
+	// SortByViewCount orders by the view count of the products row, which
+	// lags the lifetime count by the views still in the counter shards
+	SortByViewCount ProductSort = "view_count"
+)
+
+// ErrInvalidCursor is returned for cursors of a different sort order than the
+// listing, or whose key is not a value of the sort column
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// sortColumns maps each sort to its column and the type its cursor key is cast to
+var sortColumns = map[ProductSort]struct{ column, cast string }{
+	SortByName:      {"p.name", "text"},
+	SortByCreatedAt: {"p.created_at", "timestamptz"},
+	SortByViewCount: {"p.view_count", "bigint"},
+}
+
+// ProductCursor is the position after the last product of a page. Listings
+// continue strictly after (Key, ID) in the sort order, so products inserted or
+// changed meanwhile never shift the following pages.
+type ProductCursor struct {
+	Sort       ProductSort `json:"sort"`
+	Descending bool        `json:"desc,omitempty"`
+	// Key is the sort column of the last product, as text
+	Key string    `json:"key"`
+	ID  uuid.UUID `json:"id"`
+}
+
+// ProductListQuery selects a page of the product catalog
+type ProductListQuery struct {
+	Sort       ProductSort
+	Descending bool
+	// CreatedFrom and CreatedTo bound the creation time to [from, to); zero
+	// times leave the range open
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// MinViews and MaxViews bound the view count of the products row,
+	// inclusive, which lags the lifetime count like SortByViewCount
+	MinViews *int64
+	MaxViews *int64
+	// IncludeArchived lists archived products too
+	IncludeArchived bool
+	// After continues a previous listing
+	After *ProductCursor
+	Limit int
+}
+
+// ProductPage is a page of the product catalog
+type ProductPage struct {
+	Products []Product
+	// ApproximateViews is set when the listing was sorted or filtered by view
+	// count. Its products then carry the counts of their products rows, which
+	// the order and filters follow, without the views in the counter shards.
+	ApproximateViews bool
+	// Next continues the listing, nil on the last page
+	Next *ProductCursor
+}
+
+// ListProducts returns a page of products in the query's sort order, ties
+// broken by ID. Pages are read with a keyset condition on the sort column and
+// ID rather than an offset, so every page costs the same index range scan.
+// View count sorts and filters use the indexed count of the products row, as
+// adding the counter shards to every row would scan the whole catalog.
+func (r *productRepository) ListProducts(ctx context.Context, q ProductListQuery) (ProductPage, error) {
+	sort, ok := sortColumns[q.Sort]
+	if !ok {
+		return ProductPage{}, fmt.Errorf("unknown product sort %q", q.Sort)
+	}
+	if q.After != nil && !q.After.valid(q.Sort, q.Descending) {
+		return ProductPage{}, ErrInvalidCursor
+	}
+	if q.Limit <= 0 {
+		return ProductPage{}, nil
+	}
+	if q.Limit > 100 {
+		q.Limit = 100 // Enforce max limit
+	}
+
+	var conds []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if !q.IncludeArchived {
+		conds = append(conds, "p.archived_at IS NULL")
+	}
+	if !q.CreatedFrom.IsZero() {
+		conds = append(conds, "p.created_at >= "+arg(q.CreatedFrom))
+	}
+	if !q.CreatedTo.IsZero() {
+		conds = append(conds, "p.created_at < "+arg(q.CreatedTo))
+	}
+	if q.MinViews != nil {
+		conds = append(conds, "p.view_count >= "+arg(*q.MinViews))
+	}
+	if q.MaxViews != nil {
+		conds = append(conds, "p.view_count <= "+arg(*q.MaxViews))
+	}
+
+	direction, after := "ASC", ">"
+	if q.Descending {
+		direction, after = "DESC", "<"
+	}
+	if q.After != nil {
+		conds = append(conds, fmt.Sprintf("(%s, p.id) %s (%s::%s, %s::uuid)",
+			sort.column, after, arg(q.After.Key), sort.cast, arg(q.After.ID)))
+	}
+
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+
+	// Approximate pages return the counts they were ordered and filtered by,
+	// so that they read in order
+	approximate := q.Sort == SortByViewCount || q.MinViews != nil || q.MaxViews != nil
+	counts := `p.view_count + s.views, p.unique_view_count + s.unique_views`
+	from := `products p` + shardSums("s", "p.id")
+	if approximate {
+		counts = `p.view_count, p.unique_view_count`
+		from = `products p`
+	}
+
+	// One extra row tells whether there is a next page
+	query := `
+		SELECT p.id, p.name, p.description, ` + counts + `,
+		       p.version, p.archived_at, p.created_at, p.updated_at
+		FROM ` + from + `
+		` + where + `
+		ORDER BY ` + sort.column + ` ` + direction + `, p.id ` + direction + `
+		LIMIT ` + arg(q.Limit+1)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return ProductPage{}, err
+	}
+	defer rows.Close()
+
+	page := ProductPage{ApproximateViews: approximate}
+	for rows.Next() {
+		if len(page.Products) == q.Limit {
+			last := page.Products[len(page.Products)-1]
+			page.Next = &ProductCursor{Sort: q.Sort, Descending: q.Descending, Key: sortKey(q.Sort, &last), ID: last.ID}
+			break
+		}
+
+		var p Product
+		err := rows.Scan(
+			&p.ID,
+			&p.Name,
+			&p.Description,
+			&p.ViewCount,
+			&p.UniqueViewCount,
+			&p.Version,
+			&p.ArchivedAt,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+		)
+		if err != nil {
+			return ProductPage{}, err
+		}
+		page.Products = append(page.Products, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return ProductPage{}, err
+	}
+
+	return page, nil
+}
+
+// valid reports whether the cursor continues a listing in the given order
+func (c *ProductCursor) valid(sort ProductSort, descending bool) bool {
+	if c.Sort != sort || c.Descending != descending {
+		return false
+	}
+	var err error
+	switch sort {
+	case SortByCreatedAt:
+		_, err = time.Parse(time.RFC3339Nano, c.Key)
+	case SortByViewCount:
+		_, err = strconv.ParseInt(c.Key, 10, 64)
+	}
+	return err == nil
+}
+
+// sortKey returns the cursor key of a product: its sort column as text. Pages
+// sorted by view count carry the count of the products row.
+func sortKey(sort ProductSort, p *Product) string {
+	switch sort {
+	case SortByName:
+		return p.Name
+	case SortByCreatedAt:
+		return p.CreatedAt.Format(time.RFC3339Nano)
+	default:
+		return strconv.FormatInt(p.ViewCount, 10)
+	}
+}
@@ -0,0 +1,505 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// productRankLock keeps instances from taking rank snapshots at the same time
+const productRankLock = "product_ranks"
+
+var (
+	// ErrNoRankSnapshot is returned when the products were never ranked
+	ErrNoRankSnapshot = errors.New("no rank snapshot")
+	// ErrProductNotRanked is returned for archived products
+	ErrProductNotRanked = errors.New("product not ranked")
+	// ErrRankSnapshotExpired is returned for cursors of a snapshot that has
+	// since been removed
+	ErrRankSnapshotExpired = errors.New("rank snapshot expired")
+)
+
+// RankStore ranks products and snapshots the top of the rankings
+type RankStore interface {
+	// SnapshotRanks keeps the top depth products of both rankings and removes
+	// the snapshots taken more than retention before it, keeping the latest
+	SnapshotRanks(ctx context.Context, depth int, retention time.Duration) (*RankSnapshot, error)
+	// GetProductRank returns a product's rank in the latest snapshot with up
+	// to neighbors products on each side of it, estimated for products beyond
+	// the snapshot's depth
+	GetProductRank(ctx context.Context, productID uuid.UUID, unique bool, neighbors int) (*ProductRank, error)
+	// GetRankedProducts returns a page of the top of a ranking
+	GetRankedProducts(ctx context.Context, q RankPageQuery) (RankPage, error)
+}
+
+// RankSnapshot holds the top of the rankings as they were when it was taken
+type RankSnapshot struct {
+	ID       int64
+	RankedAt time.Time
+	// Products is the number of products that were not archived
+	Products int64
+	// Depth is the number of top products kept per ranking
+	Depth int64
+}
+
+// RankedProduct is a product and its rank. Its view counts are those it was
+// ranked by: as of the snapshot within its depth, current beyond it.
+type RankedProduct struct {
+	Product
+	Rank int64
+}
+
+// ProductRank is a product's position in a ranking
+type ProductRank struct {
+	RankedProduct
+	// Approximate is set for products beyond the snapshot's depth, whose rank
+	// is estimated from its count histogram
+	Approximate bool
+	// Products is the number of products ranked, as of the latest snapshot
+	Products int64
+	// Percentile is the percentage of ranked products ranked at or below the
+	// product: 100 for the first
+	Percentile float64
+	// Above and Below are the products ranked just before and after it, both
+	// in rank order
+	Above []RankedProduct
+	Below []RankedProduct
+}
+
+// RankCursor is the position after the last product of a ranking page. It
+// pins the snapshot, so the following pages neither skip nor repeat products
+// while the counts move.
+type RankCursor struct {
+	SnapshotID int64 `json:"snapshot"`
+	Unique     bool  `json:"unique,omitempty"`
+	Rank       int64 `json:"rank"`
+}
+
+// RankPageQuery selects a page of the ranking by view count, or by unique
+// view count when Unique is set
+type RankPageQuery struct {
+	Unique bool
+	// Offset skips that many products of the latest snapshot; After continues
+	// a previous page instead
+	Offset int64
+	After  *RankCursor
+	Limit  int
+}
+
+// RankPage is a page of a ranking
+type RankPage struct {
+	Snapshot RankSnapshot
+	Products []RankedProduct
+	// Next continues the ranking, nil on the last page of the snapshot
+	Next *RankCursor
+}
+
+// rankCounts names the count a ranking orders by: its products column and
+// its shardSums column
+type rankCounts struct{ column, shards string }
+
+func rankCountsOf(unique bool) rankCounts {
+	if unique {
+		return rankCounts{"unique_view_count", "unique_views"}
+	}
+	return rankCounts{"view_count", "views"}
+}
+
+// SnapshotRanks keeps the top depth products of both rankings. Counts still
+// in the counter shards only ever add to a product's count, so the top
+// products are among the top by their products row and the products with
+// shards, as for the top N. It also keeps a histogram of the counts of all the
+// products, which takes a scan of the catalog once per snapshot rather than
+// once per rank lookup. When another instance is already taking a snapshot it
+// returns nil rather than waiting to take another one.
+func (r *productRepository) SnapshotRanks(ctx context.Context, depth int, retention time.Duration) (*RankSnapshot, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock(hashtext($1))`, productRankLock).Scan(&locked); err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, nil
+	}
+
+	var s RankSnapshot
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO product_rank_snapshots DEFAULT VALUES
+		RETURNING id, ranked_at`).Scan(&s.ID, &s.RankedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, unique := range []bool{false, true} {
+		counts := rankCountsOf(unique)
+		// Counts below 64 get a bucket each, larger ones one per sixteenth of a
+		// power of two, so an estimate is off by at most the share of its
+		// bucket that is above the product
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO product_rank_histograms (snapshot_id, by_unique, min_count, max_count, products)
+			SELECT $1, $2, MIN(c), MAX(c), COUNT(*)
+			FROM (
+				SELECT p.`+counts.column+` + COALESCE(s.count, 0) AS c
+				FROM products p
+				LEFT JOIN (
+					SELECT product_id, SUM(`+counts.column+`) AS count
+					FROM product_view_count_shards
+					GROUP BY product_id
+				) s ON s.product_id = p.id
+				WHERE p.archived_at IS NULL
+			) counts
+			GROUP BY CASE WHEN c < 64 THEN c ELSE 64 + floor(ln(c) / ln(2) * 16)::BIGINT END`, s.ID, unique)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO product_ranks (snapshot_id, by_unique, rank, product_id, view_count, unique_view_count)
+			SELECT $1, $2, ROW_NUMBER() OVER (ORDER BY ranked_count DESC, id DESC), id, views, unique_views
+			FROM (
+				SELECT p.id, p.view_count + s.views AS views, p.unique_view_count + s.unique_views AS unique_views,
+				       p.`+counts.column+` + s.`+counts.shards+` AS ranked_count
+				FROM products p`+shardSums("s", "p.id")+`
+				WHERE p.archived_at IS NULL AND p.id IN (
+					(SELECT id FROM products WHERE archived_at IS NULL ORDER BY `+counts.column+` DESC, id DESC LIMIT $3)
+					UNION
+					SELECT product_id FROM product_view_count_shards
+				)
+				ORDER BY ranked_count DESC, id DESC
+				LIMIT $3
+			) top`, s.ID, unique, depth)
+		if err != nil {
+			return nil, err
+		}
+		if s.Depth, err = result.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE product_rank_snapshots
+		SET depth = $2,
+		    products = (SELECT COALESCE(SUM(products), 0) FROM product_rank_histograms
+		                WHERE snapshot_id = $1 AND NOT by_unique)
+		WHERE id = $1
+		RETURNING products`, s.ID, s.Depth).Scan(&s.Products)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ranks of removed snapshots go with them
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM product_rank_snapshots WHERE id <> $1 AND ranked_at < $2`, s.ID, s.RankedAt.Add(-retention))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// latestRankSnapshot returns the most recent snapshot
+func (r *productRepository) latestRankSnapshot(ctx context.Context) (RankSnapshot, error) {
+	var s RankSnapshot
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, ranked_at, products, depth FROM product_rank_snapshots
+		ORDER BY id DESC
+		LIMIT 1`).Scan(&s.ID, &s.RankedAt, &s.Products, &s.Depth)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RankSnapshot{}, ErrNoRankSnapshot
+	}
+	return s, err
+}
+
+// GetProductRank serves the rank of a product within the depth of the latest
+// snapshot, and its neighbours, from the snapshot's ranks. Beyond the depth its
+// rank is estimated from the snapshot's count histogram, as one plus the
+// number of products counted above its current count, and its neighbours are
+// read from the (count, id) index around it. Neighbours below the depth's last
+// products continue from the index too. Percentiles are relative to the number
+// of products in the latest snapshot.
+func (r *productRepository) GetProductRank(ctx context.Context, productID uuid.UUID, unique bool, neighbors int) (*ProductRank, error) {
+	snapshot, err := r.latestRankSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := r.GetProduct(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if p.ArchivedAt != nil {
+		return nil, ErrProductNotRanked
+	}
+
+	var rank int64
+	err = r.db.QueryRowContext(ctx, `
+		SELECT rank FROM product_ranks
+		WHERE snapshot_id = $1 AND by_unique = $2 AND product_id = $3`, snapshot.ID, unique, productID).Scan(&rank)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r.estimateProductRank(ctx, snapshot, p, unique, neighbors)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ranked, err := r.snapshotRanks(ctx, snapshot.ID, unique, rank-int64(neighbors)-1, rank+int64(neighbors))
+	if err != nil {
+		return nil, err
+	}
+	pr := &ProductRank{}
+	for _, rp := range ranked {
+		switch {
+		case rp.Rank < rank:
+			pr.Above = append(pr.Above, rp)
+		case rp.Rank > rank:
+			pr.Below = append(pr.Below, rp)
+		default:
+			pr.RankedProduct = rp
+		}
+	}
+	if pr.ID == uuid.Nil {
+		// Deleted between the two reads
+		return nil, ErrProductNotFound
+	}
+
+	if missing := neighbors - len(pr.Below); missing > 0 && rank+int64(neighbors) > snapshot.Depth {
+		last := pr.RankedProduct
+		if len(pr.Below) > 0 {
+			last = pr.Below[len(pr.Below)-1]
+		}
+		count := last.ViewCount
+		if unique {
+			count = last.UniqueViewCount
+		}
+		below, err := r.rankNeighbors(ctx, rankCountsOf(unique), count, last.ID, false, missing)
+		if err != nil {
+			return nil, err
+		}
+		for i := range below {
+			below[i].Rank = last.Rank + int64(i) + 1
+		}
+		pr.Below = append(pr.Below, below...)
+	}
+
+	pr.setPercentile(snapshot)
+	return pr, nil
+}
+
+// estimateProductRank ranks a product beyond the snapshot's depth by its
+// current count. Products of the histogram bucket of its count are taken as
+// spread evenly over the bucket, so the estimate never reads more than the
+// histogram's rows; it is never within the depth.
+func (r *productRepository) estimateProductRank(ctx context.Context, snapshot RankSnapshot, p *Product, unique bool, neighbors int) (*ProductRank, error) {
+	count := p.ViewCount
+	if unique {
+		count = p.UniqueViewCount
+	}
+
+	var above float64
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(CASE
+			WHEN min_count > $3 THEN products
+			WHEN max_count > $3 THEN products * (max_count - $3)::FLOAT8 / (max_count - min_count + 1)
+			ELSE 0
+		END), 0)
+		FROM product_rank_histograms
+		WHERE snapshot_id = $1 AND by_unique = $2`, snapshot.ID, unique, count).Scan(&above)
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &ProductRank{
+		RankedProduct: RankedProduct{Product: *p, Rank: max(snapshot.Depth+1, 1+int64(math.Round(above)))},
+		Approximate:   true,
+	}
+
+	if neighbors > 0 {
+		counts := rankCountsOf(unique)
+		above, err := r.rankNeighbors(ctx, counts, count, p.ID, true, neighbors)
+		if err != nil {
+			return nil, err
+		}
+		// Nearest first, so the first is ranked just above
+		for i := len(above) - 1; i >= 0; i-- {
+			above[i].Rank = pr.Rank - int64(i) - 1
+			pr.Above = append(pr.Above, above[i])
+		}
+
+		if pr.Below, err = r.rankNeighbors(ctx, counts, count, p.ID, false, neighbors); err != nil {
+			return nil, err
+		}
+		for i := range pr.Below {
+			pr.Below[i].Rank = pr.Rank + int64(i) + 1
+		}
+	}
+
+	pr.setPercentile(snapshot)
+	return pr, nil
+}
+
+// setPercentile sets the number of products ranked, which covers at least the
+// product and its neighbours below, and the product's percentile among them
+func (pr *ProductRank) setPercentile(snapshot RankSnapshot) {
+	pr.Products = max(snapshot.Products, pr.Rank+int64(len(pr.Below)))
+	pr.Percentile = 100 * float64(pr.Products-pr.Rank+1) / float64(pr.Products)
+}
+
+// rankNeighbors returns up to limit products ranked just above or below the
+// given count and ID, nearest first, without their ranks. Products without
+// counter shards are walked in (count, id) index order, skipping those with
+// shards; those are ranked by their current counts separately.
+func (r *productRepository) rankNeighbors(ctx context.Context, counts rankCounts, count int64, id uuid.UUID, above bool, limit int) ([]RankedProduct, error) {
+	cmp, order := "<", "DESC"
+	if above {
+		cmp, order = ">", "ASC"
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT p.id, p.name, p.description, p.view_count + s.views, p.unique_view_count + s.unique_views,
+		       p.version, p.archived_at, p.created_at, p.updated_at
+		FROM products p`+shardSums("s", "p.id")+`
+		WHERE p.archived_at IS NULL
+		  AND (p.`+counts.column+` + s.`+counts.shards+`, p.id) `+cmp+` ($1, $2)
+		  AND p.id IN (
+			(SELECT q.id FROM products q
+			 WHERE q.archived_at IS NULL AND (q.`+counts.column+`, q.id) `+cmp+` ($1, $2)
+			   AND NOT EXISTS (SELECT 1 FROM product_view_count_shards WHERE product_id = q.id)
+			 ORDER BY q.`+counts.column+` `+order+`, q.id `+order+`
+			 LIMIT $3)
+			UNION
+			SELECT product_id FROM product_view_count_shards
+		  )
+		ORDER BY p.`+counts.column+` + s.`+counts.shards+` `+order+`, p.id `+order+`
+		LIMIT $3`, count, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var products []RankedProduct
+	for rows.Next() {
+		var p RankedProduct
+		err := rows.Scan(
+			&p.ID,
+			&p.Name,
+			&p.Description,
+			&p.ViewCount,
+			&p.UniqueViewCount,
+			&p.Version,
+			&p.ArchivedAt,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
+
+// GetRankedProducts reads a page of a snapshot through its primary key, so
+// deep pages cost as much as the first one. Pages end at the snapshot's depth.
+func (r *productRepository) GetRankedProducts(ctx context.Context, q RankPageQuery) (RankPage, error) {
+	if q.After != nil && q.After.Unique != q.Unique {
+		return RankPage{}, ErrInvalidCursor
+	}
+
+	var snapshot RankSnapshot
+	var err error
+	after := q.Offset
+	if q.After != nil {
+		err = r.db.QueryRowContext(ctx, `
+			SELECT id, ranked_at, products, depth FROM product_rank_snapshots
+			WHERE id = $1`, q.After.SnapshotID).Scan(&snapshot.ID, &snapshot.RankedAt, &snapshot.Products, &snapshot.Depth)
+		if errors.Is(err, sql.ErrNoRows) {
+			return RankPage{}, ErrRankSnapshotExpired
+		}
+		after = q.After.Rank
+	} else {
+		snapshot, err = r.latestRankSnapshot(ctx)
+	}
+	if err != nil {
+		return RankPage{}, err
+	}
+
+	if q.Limit <= 0 {
+		return RankPage{Snapshot: snapshot}, nil
+	}
+	if q.Limit > 100 {
+		q.Limit = 100 // Enforce max limit
+	}
+
+	page := RankPage{Snapshot: snapshot}
+	if page.Products, err = r.snapshotRanks(ctx, snapshot.ID, q.Unique, after, after+int64(q.Limit)); err != nil {
+		return RankPage{}, err
+	}
+
+	// Pages span limit ranks even when products were deleted since the snapshot
+	if last := after + int64(q.Limit); last < snapshot.Depth {
+		page.Next = &RankCursor{SnapshotID: snapshot.ID, Unique: q.Unique, Rank: last}
+	}
+
+	return page, nil
+}
+
+// snapshotRanks reads the ranks after from up to to of a snapshot, in rank
+// order, with the view counts they were ranked by
+func (r *productRepository) snapshotRanks(ctx context.Context, snapshotID int64, unique bool, from, to int64) ([]RankedProduct, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT r.rank, p.id, p.name, p.description, r.view_count, r.unique_view_count,
+		       p.version, p.archived_at, p.created_at, p.updated_at
+		FROM product_ranks r
+		JOIN products p ON p.id = r.product_id
+		WHERE r.snapshot_id = $1 AND r.by_unique = $2 AND r.rank > $3 AND r.rank <= $4
+		ORDER BY r.rank`, snapshotID, unique, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var products []RankedProduct
+	for rows.Next() {
+		var p RankedProduct
+		err := rows.Scan(
+			&p.Rank,
+			&p.ID,
+			&p.Name,
+			&p.Description,
+			&p.ViewCount,
+			&p.UniqueViewCount,
+			&p.Version,
+			&p.ArchivedAt,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"html"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ProductSearchCursor is the position after the last result of a search page
+type ProductSearchCursor struct {
+	// Query is the search text the cursor belongs to
+	Query string    `json:"q"`
+	Score float64   `json:"score"`
+	ID    uuid.UUID `json:"id"`
+}
+
+// ProductSearchQuery searches the product catalog
+type ProductSearchQuery struct {
+	// Text is a web search style query: words, "quoted phrases", or and -word
+	Text string
+	// PopularityWeight is added to a result's score per natural log of its
+	// lifetime views; zero ranks by text relevance alone
+	PopularityWeight float64
+	// IncludeArchived returns archived products too
+	IncludeArchived bool
+	// After continues a previous search
+	After *ProductSearchCursor
+	Limit int
+}
+
+// ProductSearchResult is a product matching a search
+type ProductSearchResult struct {
+	Product
+	// Relevance is how well the product matches the text alone
+	Relevance float64
+	// Score is the relevance plus the popularity weight, results are ordered by it
+	Score float64
+	// NameHighlight and Snippet are the name and the best matching fragments
+	// of the description, HTML escaped, with the matched words wrapped in
+	// <mark> tags
+	NameHighlight string
+	Snippet       string
+}
+
+// ts_headline marks matches with these private use characters, which are kept
+// by HTML escaping, and markHighlights turns them into <mark> tags
+const (
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+)
+
+var highlightMarks = strings.NewReplacer(
+	highlightStart, "<mark>",
+	highlightStop, "</mark>",
+)
+
+// markHighlights HTML escapes a ts_headline result and marks its matches, so
+// that product text cannot inject markup of its own
+func markHighlights(headline string) string {
+	return highlightMarks.Replace(html.EscapeString(headline))
+}
+
+// ProductSearchPage is a page of search results
+type ProductSearchPage struct {
+	Results []ProductSearchResult
+	// Next continues the search, nil on the last page
+	Next *ProductSearchCursor
+}
+
+// SearchProducts returns the products matching the text, best first. Products
+// match when their name or description contains the query words (stemmed,
+// through the search_vector index), or when the name contains a word
+// similar to the query (through the trigram index), which tolerates typos.
+// Relevance is the full-text rank plus the trigram word similarity of the name.
+func (r *productRepository) SearchProducts(ctx context.Context, q ProductSearchQuery) (ProductSearchPage, error) {
+	text := strings.TrimSpace(q.Text)
+	if text == "" {
+		return ProductSearchPage{}, errors.New("empty search query")
+	}
+	if q.After != nil && q.After.Query != text {
+		return ProductSearchPage{}, ErrInvalidCursor
+	}
+	if q.Limit <= 0 {
+		return ProductSearchPage{}, nil
+	}
+	if q.Limit > 100 {
+		q.Limit = 100 // Enforce max limit
+	}
+
+	archived := ""
+	if !q.IncludeArchived {
+		archived = "AND p.archived_at IS NULL"
+	}
+	args := []any{text, q.PopularityWeight, q.Limit + 1}
+	after := ""
+	if q.After != nil {
+		after = "WHERE (score, id) < ($4::float8, $5::uuid)"
+		args = append(args, q.After.Score, q.After.ID)
+	}
+
+	// Highlights are only computed for the page, one extra row tells whether
+	// there is a next page
+	query := `
+		WITH matches AS (
+			SELECT p.id, p.name, p.description, p.view_count + s.views AS views,
+			       p.unique_view_count + s.unique_views AS unique_views,
+			       p.version, p.archived_at, p.created_at, p.updated_at,
+			       (ts_rank(p.search_vector, tsq) + word_similarity($1::text, p.name))::float8 AS relevance
+			FROM products p
+			CROSS JOIN websearch_to_tsquery('english', $1::text) AS tsq` + shardSums("s", "p.id") + `
+			WHERE (p.search_vector @@ tsq OR $1::text <% p.name) ` + archived + `
+		),
+		ranked AS (
+			SELECT *, relevance + $2::float8 * ln(1 + GREATEST(views, 0)::float8) AS score
+			FROM matches
+		),
+		page AS (
+			SELECT * FROM ranked
+			` + after + `
+			ORDER BY score DESC, id DESC
+			LIMIT $3
+		)
+		SELECT id, name, description, views, unique_views, version, archived_at, created_at, updated_at,
+		       relevance, score,
+		       ts_headline('english', name, websearch_to_tsquery('english', $1::text),
+		                   'StartSel=` + highlightStart + `, StopSel=` + highlightStop + `, HighlightAll=true'),
+		       ts_headline('english', COALESCE(description, ''), websearch_to_tsquery('english', $1::text),
+		                   'StartSel=` + highlightStart + `, StopSel=` + highlightStop + `, MaxFragments=2, MinWords=5, MaxWords=20')
+		FROM page
+		ORDER BY score DESC, id DESC`
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return ProductSearchPage{}, err
+	}
+	defer rows.Close()
+
+	var page ProductSearchPage
+	for rows.Next() {
+		if len(page.Results) == q.Limit {
+			last := page.Results[len(page.Results)-1]
+			page.Next = &ProductSearchCursor{Query: text, Score: last.Score, ID: last.ID}
+			break
+		}
+
+		var res ProductSearchResult
+		err := rows.Scan(
+			&res.ID,
+			&res.Name,
+			&res.Description,
+			&res.ViewCount,
+			&res.UniqueViewCount,
+			&res.Version,
+			&res.ArchivedAt,
+			&res.CreatedAt,
+			&res.UpdatedAt,
+			&res.Relevance,
+			&res.Score,
+			&res.NameHighlight,
+			&res.Snippet,
+		)
+		if err != nil {
+			return ProductSearchPage{}, err
+		}
+		res.NameHighlight = markHighlights(res.NameHighlight)
+		res.Snippet = markHighlights(res.Snippet)
+		page.Results = append(page.Results, res)
+	}
+
+	if err = rows.Err(); err != nil {
+		return ProductSearchPage{}, err
+	}
+
+	return page, nil
+}
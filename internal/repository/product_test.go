@@ -1,9 +1,12 @@
 package repository_test
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"testing"
 	"time"
@@ -75,13 +78,335 @@ func TestMain(m *testing.M) {
             name VARCHAR(255) NOT NULL,
             description TEXT,
             view_count BIGINT NOT NULL DEFAULT 0,
+            unique_view_count BIGINT NOT NULL DEFAULT 0,
+            version BIGINT NOT NULL DEFAULT 1,
+            archived_at TIMESTAMP WITH TIME ZONE,
             created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-            updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+            updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+            search_vector tsvector GENERATED ALWAYS AS (
+                setweight(to_tsvector('english', COALESCE(name, '')), 'A') ||
+                setweight(to_tsvector('english', COALESCE(description, '')), 'B')
+            ) STORED
         )`)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to create test table: %v", err))
 	}
 
+	_, err = dbPool.Exec(context.Background(), `CREATE EXTENSION IF NOT EXISTS pg_trgm`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create pg_trgm extension: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS view_events (
+            event_id UUID NOT NULL,
+            product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+            user_id VARCHAR(255),
+            session_id VARCHAR(255),
+            source VARCHAR(32),
+            device_type VARCHAR(32),
+            referrer TEXT,
+            utm_source VARCHAR(255),
+            utm_medium VARCHAR(255),
+            utm_campaign VARCHAR(255),
+            utm_term VARCHAR(255),
+            utm_content VARCHAR(255),
+            occurred_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            received_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (event_id, occurred_at)
+        ) PARTITION BY RANGE (occurred_at)`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create view_events table: %v", err))
+	}
+
+	// Tests record views on arbitrary days, which the default partition catches
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS view_events_default PARTITION OF view_events DEFAULT`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create view_events partition: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS view_dedup (
+            product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+            viewer_key VARCHAR(300) NOT NULL,
+            counted_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            PRIMARY KEY (product_id, viewer_key)
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create view_dedup table: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS product_view_buckets (
+            product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+            bucket_start TIMESTAMP WITH TIME ZONE NOT NULL,
+            views BIGINT NOT NULL DEFAULT 0,
+            unique_views BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (product_id, bucket_start)
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create product_view_buckets table: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS product_views_hourly (
+            product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+            hour_start TIMESTAMP WITH TIME ZONE NOT NULL,
+            views BIGINT NOT NULL DEFAULT 0,
+            unique_views BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (product_id, hour_start)
+        );
+        CREATE TABLE IF NOT EXISTS product_views_daily (
+            product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+            day_start TIMESTAMP WITH TIME ZONE NOT NULL,
+            views BIGINT NOT NULL DEFAULT 0,
+            unique_views BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (product_id, day_start)
+        );
+        CREATE TABLE IF NOT EXISTS rollup_watermarks (
+            name VARCHAR(64) PRIMARY KEY,
+            materialized_until TIMESTAMP WITH TIME ZONE NOT NULL,
+            updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create rollup tables: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS product_trend_scores (
+            product_id UUID PRIMARY KEY REFERENCES products(id) ON DELETE CASCADE,
+            log_score DOUBLE PRECISION NOT NULL,
+            updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create product_trend_scores table: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS trend_score_settings (
+            id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+            half_life_seconds DOUBLE PRECISION NOT NULL CHECK (half_life_seconds > 0),
+            pending_half_life_seconds DOUBLE PRECISION CHECK (pending_half_life_seconds > 0),
+            updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE TABLE IF NOT EXISTS product_trend_scores_next (
+            product_id UUID PRIMARY KEY REFERENCES products(id) ON DELETE CASCADE,
+            log_score DOUBLE PRECISION NOT NULL,
+            updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create trend_score_settings table: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS consumer_offsets (
+            group_id VARCHAR(255) NOT NULL,
+            topic VARCHAR(255) NOT NULL,
+            partition INTEGER NOT NULL,
+            next_offset BIGINT NOT NULL,
+            updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (group_id, topic, partition)
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create consumer_offsets table: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS view_replay (
+            id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+            group_id VARCHAR(255) NOT NULL,
+            topic VARCHAR(255) NOT NULL,
+            since TIMESTAMP WITH TIME ZONE NOT NULL,
+            started_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE TABLE IF NOT EXISTS view_replay_positions (
+            partition INTEGER PRIMARY KEY,
+            start_offset BIGINT NOT NULL,
+            next_offset BIGINT NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS view_replay_events (
+            event_id UUID NOT NULL,
+            occurred_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            product_id UUID,
+            user_id VARCHAR(255),
+            session_id VARCHAR(255),
+            source VARCHAR(32),
+            device_type VARCHAR(32),
+            referrer TEXT,
+            utm_source VARCHAR(255),
+            utm_medium VARCHAR(255),
+            utm_campaign VARCHAR(255),
+            utm_term VARCHAR(255),
+            utm_content VARCHAR(255),
+            PRIMARY KEY (event_id, occurred_at)
+        );
+        CREATE TABLE IF NOT EXISTS view_replay_dedup (
+            product_id UUID NOT NULL,
+            viewer_key VARCHAR(300) NOT NULL,
+            counted_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            PRIMARY KEY (product_id, viewer_key)
+        );
+        CREATE TABLE IF NOT EXISTS view_replay_buckets (
+            product_id UUID NOT NULL,
+            bucket_start TIMESTAMP WITH TIME ZONE NOT NULL,
+            views BIGINT NOT NULL DEFAULT 0,
+            unique_views BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (product_id, bucket_start)
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create view replay tables: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS count_reconciliations (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            source VARCHAR(16) NOT NULL,
+            dry_run BOOLEAN NOT NULL,
+            applied_run_id UUID REFERENCES count_reconciliations(id),
+            triggered_by VARCHAR(255) NOT NULL,
+            products_checked BIGINT NOT NULL DEFAULT 0,
+            discrepancies BIGINT NOT NULL DEFAULT 0,
+            view_drift BIGINT NOT NULL DEFAULT 0,
+            unique_view_drift BIGINT NOT NULL DEFAULT 0,
+            repaired BIGINT NOT NULL DEFAULT 0,
+            started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            finished_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE TABLE IF NOT EXISTS count_discrepancies (
+            run_id UUID NOT NULL REFERENCES count_reconciliations(id) ON DELETE CASCADE,
+            product_id UUID NOT NULL,
+            view_count BIGINT NOT NULL,
+            expected_view_count BIGINT NOT NULL,
+            unique_view_count BIGINT NOT NULL,
+            expected_unique_view_count BIGINT NOT NULL,
+            PRIMARY KEY (run_id, product_id)
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create reconciliation tables: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS product_view_count_shards (
+            product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+            shard INT NOT NULL,
+            view_count BIGINT NOT NULL DEFAULT 0,
+            unique_view_count BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (product_id, shard)
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create product_view_count_shards table: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS product_view_baselines (
+            product_id UUID PRIMARY KEY REFERENCES products(id) ON DELETE CASCADE,
+            views BIGINT NOT NULL DEFAULT 0,
+            unique_views BIGINT NOT NULL DEFAULT 0,
+            expired_event_views BIGINT NOT NULL DEFAULT 0
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create product_view_baselines table: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS categories (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            slug VARCHAR(100) NOT NULL UNIQUE,
+            name VARCHAR(255) NOT NULL,
+            parent_id UUID REFERENCES categories(id),
+            created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE TABLE IF NOT EXISTS tags (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            name VARCHAR(100) NOT NULL UNIQUE,
+            created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+        );
+        CREATE TABLE IF NOT EXISTS product_categories (
+            product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+            category_id UUID NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+            PRIMARY KEY (product_id, category_id)
+        );
+        CREATE TABLE IF NOT EXISTS product_tags (
+            product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+            tag_id UUID NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+            PRIMARY KEY (product_id, tag_id)
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create taxonomy tables: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        ALTER TABLE product_categories
+            ADD COLUMN IF NOT EXISTS view_count BIGINT NOT NULL DEFAULT 0,
+            ADD COLUMN IF NOT EXISTS unique_view_count BIGINT NOT NULL DEFAULT 0;
+        ALTER TABLE product_tags
+            ADD COLUMN IF NOT EXISTS view_count BIGINT NOT NULL DEFAULT 0,
+            ADD COLUMN IF NOT EXISTS unique_view_count BIGINT NOT NULL DEFAULT 0;
+        CREATE INDEX IF NOT EXISTS idx_product_categories_rank ON product_categories(category_id, view_count DESC);
+        CREATE INDEX IF NOT EXISTS idx_product_categories_unique_rank ON product_categories(category_id, unique_view_count DESC);
+        CREATE INDEX IF NOT EXISTS idx_product_tags_rank ON product_tags(tag_id, view_count DESC);
+        CREATE INDEX IF NOT EXISTS idx_product_tags_unique_rank ON product_tags(tag_id, unique_view_count DESC);
+        CREATE OR REPLACE FUNCTION copy_product_counts()
+        RETURNS TRIGGER AS $$
+        BEGIN
+            SELECT view_count, unique_view_count INTO NEW.view_count, NEW.unique_view_count
+            FROM products WHERE id = NEW.product_id;
+            RETURN NEW;
+        END;
+        $$ LANGUAGE plpgsql;
+        CREATE TRIGGER copy_product_categories_counts BEFORE INSERT ON product_categories
+            FOR EACH ROW EXECUTE FUNCTION copy_product_counts();
+        CREATE TRIGGER copy_product_tags_counts BEFORE INSERT ON product_tags
+            FOR EACH ROW EXECUTE FUNCTION copy_product_counts()`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create taxonomy rankings: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE INDEX IF NOT EXISTS idx_products_view_count_id ON products(view_count, id);
+        CREATE INDEX IF NOT EXISTS idx_products_unique_view_count_id ON products(unique_view_count, id);
+        CREATE TABLE IF NOT EXISTS product_rank_snapshots (
+            id BIGSERIAL PRIMARY KEY,
+            ranked_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            products BIGINT NOT NULL DEFAULT 0,
+            depth BIGINT NOT NULL DEFAULT 0
+        );
+        CREATE TABLE IF NOT EXISTS product_ranks (
+            snapshot_id BIGINT NOT NULL REFERENCES product_rank_snapshots(id) ON DELETE CASCADE,
+            by_unique BOOLEAN NOT NULL,
+            rank BIGINT NOT NULL,
+            product_id UUID NOT NULL,
+            view_count BIGINT NOT NULL,
+            unique_view_count BIGINT NOT NULL,
+            PRIMARY KEY (snapshot_id, by_unique, rank)
+        );
+        CREATE INDEX IF NOT EXISTS idx_product_ranks_product ON product_ranks(snapshot_id, by_unique, product_id);
+        CREATE TABLE IF NOT EXISTS product_rank_histograms (
+            snapshot_id BIGINT NOT NULL REFERENCES product_rank_snapshots(id) ON DELETE CASCADE,
+            by_unique BOOLEAN NOT NULL,
+            min_count BIGINT NOT NULL,
+            max_count BIGINT NOT NULL,
+            products BIGINT NOT NULL,
+            PRIMARY KEY (snapshot_id, by_unique, min_count)
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create rank tables: %v", err))
+	}
+
+	_, err = dbPool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS job_runs (
+            name VARCHAR(64) PRIMARY KEY,
+            slot TIMESTAMP WITH TIME ZONE NOT NULL,
+            started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+            finished_at TIMESTAMP WITH TIME ZONE,
+            error TEXT
+        )`)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create job_runs table: %v", err))
+	}
+
 	// Run the tests
 	code := m.Run()
 
@@ -130,6 +455,156 @@ func TestProductRepository(t *testing.T) {
 		assert.Equal(t, int64(1), updated.ViewCount)
 	})
 
+	t.Run("RecordView", func(t *testing.T) {
+		before, err := repo.GetProduct(ctx, product.ID)
+		assert.NoError(t, err)
+
+		event := &repository.ViewEvent{
+			EventID:    uuid.New(),
+			ProductID:  product.ID,
+			SessionID:  "session-1",
+			Source:     "search",
+			DeviceType: "mobile",
+			UTMSource:  "newsletter",
+			OccurredAt: time.Now(),
+		}
+		result, err := repo.RecordView(ctx, event, repository.RecordOptions{})
+		assert.NoError(t, err)
+		assert.False(t, result.Duplicate)
+		assert.Equal(t, before.ViewCount+1, result.ViewCount)
+
+		// Redelivering the same event must not count it twice
+		result, err = repo.RecordView(ctx, event, repository.RecordOptions{})
+		assert.NoError(t, err)
+		assert.True(t, result.Duplicate)
+
+		after, err := repo.GetProduct(ctx, product.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, before.ViewCount+1, after.ViewCount)
+
+		var source string
+		err = sqlDB.QueryRowContext(ctx, "SELECT source FROM view_events WHERE event_id = $1", event.EventID).Scan(&source)
+		assert.NoError(t, err)
+		assert.Equal(t, "search", source)
+
+		_, err = repo.RecordView(ctx, &repository.ViewEvent{EventID: uuid.New(), ProductID: uuid.New(), OccurredAt: time.Now()}, repository.RecordOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("RecordViewDeduplicated", func(t *testing.T) {
+		p := &repository.Product{Name: "Dedup Product"}
+		assert.NoError(t, repo.CreateProduct(ctx, p))
+
+		opts := repository.RecordOptions{DedupWindow: 30 * time.Minute}
+		start := time.Now().Add(-time.Hour)
+
+		// Two views ten minutes apart fall into one window, the third opens a new one
+		for _, offset := range []time.Duration{0, 10 * time.Minute, 45 * time.Minute} {
+			_, err := repo.RecordView(ctx, &repository.ViewEvent{
+				EventID:    uuid.New(),
+				ProductID:  p.ID,
+				SessionID:  "abc",
+				ViewerKey:  "session:abc",
+				OccurredAt: start.Add(offset),
+			}, opts)
+			assert.NoError(t, err)
+		}
+
+		updated, err := repo.GetProduct(ctx, p.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), updated.ViewCount)
+		assert.Equal(t, int64(2), updated.UniqueViewCount)
+
+		purged, err := repo.PurgeViewDedup(ctx, time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), purged)
+	})
+
+	t.Run("RecordViews", func(t *testing.T) {
+		hot := &repository.Product{Name: "Batch Hot Product"}
+		cold := &repository.Product{Name: "Batch Cold Product"}
+		assert.NoError(t, repo.CreateProduct(ctx, hot))
+		assert.NoError(t, repo.CreateProduct(ctx, cold))
+
+		start := time.Now().Add(-time.Hour)
+		opts := repository.RecordOptions{DedupWindow: 30 * time.Minute, TrendHalfLife: time.Hour}
+		redelivered := &repository.ViewEvent{EventID: uuid.New(), ProductID: cold.ID, OccurredAt: start}
+		missing := &repository.ViewEvent{EventID: uuid.New(), ProductID: uuid.New(), OccurredAt: start}
+
+		// Deliberately out of order: dedup must follow event time, not batch order
+		events := []*repository.ViewEvent{
+			{EventID: uuid.New(), ProductID: hot.ID, ViewerKey: "user:1", OccurredAt: start.Add(40 * time.Minute)},
+			{EventID: uuid.New(), ProductID: hot.ID, ViewerKey: "user:1", OccurredAt: start},
+			{EventID: uuid.New(), ProductID: hot.ID, ViewerKey: "user:1", OccurredAt: start.Add(5 * time.Minute)},
+			{EventID: uuid.New(), ProductID: hot.ID, OccurredAt: start},
+			redelivered,
+			redelivered,
+			missing,
+		}
+		result, err := repo.RecordViews(ctx, events, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, result.Recorded)
+		assert.Equal(t, 1, result.Duplicates)
+		assert.Equal(t, []uuid.UUID{missing.EventID}, result.NotFound)
+		assert.Equal(t, repository.ProductCounts{ViewCount: 4, UniqueViewCount: 3}, result.Counts[hot.ID])
+		assert.Equal(t, repository.ProductCounts{ViewCount: 1, UniqueViewCount: 1}, result.Counts[cold.ID])
+
+		// A later batch sees the earlier viewer state and event IDs
+		result, err = repo.RecordViews(ctx, []*repository.ViewEvent{
+			redelivered,
+			{EventID: uuid.New(), ProductID: hot.ID, ViewerKey: "user:1", OccurredAt: start.Add(50 * time.Minute)},
+		}, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.Recorded)
+		assert.Equal(t, 1, result.Duplicates)
+		assert.Equal(t, repository.ProductCounts{ViewCount: 5, UniqueViewCount: 3}, result.Counts[hot.ID])
+
+		var bucketViews int64
+		err = sqlDB.QueryRowContext(ctx, "SELECT SUM(views) FROM product_view_buckets WHERE product_id = $1", hot.ID).Scan(&bucketViews)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), bucketViews)
+	})
+
+	t.Run("RecordViewsWithOffsets", func(t *testing.T) {
+		store := repo.(repository.OffsetStore)
+		p := &repository.Product{Name: "Offsets Product"}
+		assert.NoError(t, repo.CreateProduct(ctx, p))
+
+		offsetsAt := func(offset int64) *repository.ConsumerOffsets {
+			return &repository.ConsumerOffsets{
+				GroupID: "exactly-once",
+				Offsets: []repository.PartitionOffset{{Topic: "product-views", Partition: 0, Offset: offset}},
+			}
+		}
+		view := func() *repository.ViewEvent {
+			return &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: time.Now()}
+		}
+
+		_, err := repo.RecordViews(ctx, []*repository.ViewEvent{view(), view()}, repository.RecordOptions{Offsets: offsetsAt(2)})
+		assert.NoError(t, err)
+
+		// A transaction that fails part way must leave neither counts nor offsets behind
+		failing := view()
+		failing.OccurredAt = time.Date(300000, 1, 1, 0, 0, 0, 0, time.UTC)
+		_, err = repo.RecordViews(ctx, []*repository.ViewEvent{view(), failing}, repository.RecordOptions{Offsets: offsetsAt(4)})
+		assert.Error(t, err)
+		assert.True(t, repository.IsInvalidData(err))
+
+		offsets, err := store.LoadConsumerOffsets(ctx, "exactly-once", "product-views")
+		assert.NoError(t, err)
+		assert.Equal(t, map[int32]int64{0: 2}, offsets)
+
+		updated, err := repo.GetProduct(ctx, p.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), updated.ViewCount)
+
+		// Offsets never move backwards
+		assert.NoError(t, store.SaveConsumerOffsets(ctx, *offsetsAt(1)))
+		offsets, err = store.LoadConsumerOffsets(ctx, "exactly-once", "product-views")
+		assert.NoError(t, err)
+		assert.Equal(t, map[int32]int64{0: 2}, offsets)
+	})
+
 	t.Run("GetTopViewedProducts", func(t *testing.T) {
 		// Create a few more test products
 		products := []*repository.Product{
@@ -163,6 +638,810 @@ func TestProductRepository(t *testing.T) {
 		assert.True(t, len(allProducts) >= 4) // At least 4 products now
 	})
 
+	t.Run("GetTopViewedProductsInRange", func(t *testing.T) {
+		recent := &repository.Product{Name: "Trending Now"}
+		old := &repository.Product{Name: "Hot Last Year"}
+		assert.NoError(t, repo.CreateProduct(ctx, recent))
+		assert.NoError(t, repo.CreateProduct(ctx, old))
+
+		// Use fixed times far from the other subtests' views
+		now := time.Date(2030, 1, 1, 12, 30, 0, 0, time.UTC)
+		record := func(p *repository.Product, at time.Time, n int) {
+			for i := 0; i < n; i++ {
+				_, err := repo.RecordView(ctx, &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: at}, repository.RecordOptions{})
+				assert.NoError(t, err)
+			}
+		}
+		record(old, now.AddDate(-1, 0, 0), 5)
+		record(recent, now.Add(-30*time.Minute), 3)
+
+		top, err := repo.GetTopViewedProductsInRange(ctx, now.Add(-time.Hour), now.Add(time.Hour), 10, false)
+		assert.NoError(t, err)
+		assert.Len(t, top, 1)
+		assert.Equal(t, "Trending Now", top[0].Name)
+		assert.Equal(t, int64(3), top[0].Views)
+
+		top, err = repo.GetTopViewedProductsInRange(ctx, now.AddDate(-2, 0, 0), now.Add(time.Hour), 1, false)
+		assert.NoError(t, err)
+		assert.Len(t, top, 1)
+		assert.Equal(t, "Hot Last Year", top[0].Name)
+	})
+
+	t.Run("GetTrendingProducts", func(t *testing.T) {
+		accelerating := &repository.Product{Name: "Accelerating"}
+		fading := &repository.Product{Name: "Fading"}
+		assert.NoError(t, repo.CreateProduct(ctx, accelerating))
+		assert.NoError(t, repo.CreateProduct(ctx, fading))
+
+		halfLife := time.Hour
+		opts := repository.RecordOptions{TrendHalfLife: halfLife}
+		now := time.Now()
+
+		// Ten views a day ago are worth less than two views just now
+		for i := 0; i < 10; i++ {
+			_, err := repo.RecordView(ctx, &repository.ViewEvent{EventID: uuid.New(), ProductID: fading.ID, OccurredAt: now.Add(-24 * time.Hour)}, opts)
+			assert.NoError(t, err)
+		}
+		for i := 0; i < 2; i++ {
+			_, err := repo.RecordView(ctx, &repository.ViewEvent{EventID: uuid.New(), ProductID: accelerating.ID, OccurredAt: now}, opts)
+			assert.NoError(t, err)
+		}
+
+		trending, err := repo.GetTrendingProducts(ctx, 10, halfLife)
+		assert.NoError(t, err)
+		assert.Len(t, trending, 2)
+		assert.Equal(t, "Accelerating", trending[0].Name)
+		assert.InDelta(t, 2.0, trending[0].Score, 0.01)
+		assert.Equal(t, "Fading", trending[1].Name)
+		assert.Less(t, trending[1].Score, 0.001)
+	})
+
+	t.Run("RebuildTrendScores", func(t *testing.T) {
+		store := repo.(repository.TrendStore)
+		p := &repository.Product{Name: "Half-Life Product"}
+		assert.NoError(t, repo.CreateProduct(ctx, p))
+
+		recorded, err := store.RecordTrendHalfLife(ctx, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Hour, recorded)
+
+		// Another configured half-life does not replace the recorded one
+		recorded, err = store.RecordTrendHalfLife(ctx, 2*time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Hour, recorded)
+
+		// Two views an hour ago are worth 1 with a one hour half-life
+		now := time.Now()
+		for i := 0; i < 2; i++ {
+			_, err := repo.RecordView(ctx, &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: now.Add(-time.Hour)}, repository.RecordOptions{TrendHalfLife: time.Hour})
+			assert.NoError(t, err)
+		}
+
+		scoreOf := func(halfLife time.Duration) float64 {
+			trending, err := repo.GetTrendingProducts(ctx, 100, halfLife)
+			assert.NoError(t, err)
+			for _, tp := range trending {
+				if tp.ID == p.ID {
+					return tp.Score
+				}
+			}
+			return 0
+		}
+		assert.InDelta(t, 1.0, scoreOf(time.Hour), 0.01)
+
+		// With a two hour half-life they are worth 2^-0.5 each
+		assert.NoError(t, store.RebuildTrendScores(ctx, 2*time.Hour))
+		assert.InDelta(t, 2*math.Pow(2, -0.5), scoreOf(time.Hour), 0.01)
+
+		// Instances configured with another half-life add to the scores in the recorded one
+		_, err = repo.RecordView(ctx, &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: now.Add(-time.Hour)}, repository.RecordOptions{TrendHalfLife: time.Hour})
+		assert.NoError(t, err)
+		assert.InDelta(t, 3*math.Pow(2, -0.5), scoreOf(time.Hour), 0.01)
+
+		assert.NoError(t, store.RebuildTrendScores(ctx, time.Hour))
+		assert.InDelta(t, 1.5, scoreOf(time.Hour), 0.01)
+		recorded, err = store.RecordTrendHalfLife(ctx, 2*time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Hour, recorded)
+	})
+
+	t.Run("GetProductViewSeries", func(t *testing.T) {
+		p := &repository.Product{Name: "Series Product"}
+		assert.NoError(t, repo.CreateProduct(ctx, p))
+
+		ist, err := time.LoadLocation("Asia/Kolkata")
+		assert.NoError(t, err)
+
+		// 23:50 IST on June 1st is 18:20 UTC, so it must land on June 1st in IST
+		// even though June 2nd starts five and a half hours later in UTC
+		views := []time.Time{
+			time.Date(2024, 6, 1, 23, 50, 0, 0, ist),
+			time.Date(2024, 6, 2, 0, 10, 0, 0, ist),
+			time.Date(2024, 6, 2, 9, 0, 0, 0, ist),
+		}
+		for _, at := range views {
+			_, err := repo.RecordView(ctx, &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: at}, repository.RecordOptions{})
+			assert.NoError(t, err)
+		}
+
+		from := time.Date(2024, 6, 1, 0, 0, 0, 0, ist)
+		points, err := repo.GetProductViewSeries(ctx, p.ID, from, from.AddDate(0, 0, 3), repository.IntervalDay, ist)
+		assert.NoError(t, err)
+		assert.Len(t, points, 2)
+		assert.True(t, from.Equal(points[0].Start))
+		assert.Equal(t, int64(1), points[0].Views)
+		assert.True(t, from.AddDate(0, 0, 1).Equal(points[1].Start))
+		assert.Equal(t, int64(2), points[1].Views)
+
+		// The hour a DST fall-back repeats is two points, 01:00 EDT and 01:00 EST
+		newYork, err := time.LoadLocation("America/New_York")
+		assert.NoError(t, err)
+		repeated := time.Date(2024, 11, 3, 5, 0, 0, 0, time.UTC)
+		for _, at := range []time.Time{repeated.Add(10 * time.Minute), repeated.Add(70 * time.Minute), repeated.Add(80 * time.Minute)} {
+			_, err := repo.RecordView(ctx, &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: at}, repository.RecordOptions{})
+			assert.NoError(t, err)
+		}
+		points, err = repo.GetProductViewSeries(ctx, p.ID, repeated, repeated.Add(2*time.Hour), repository.IntervalHour, newYork)
+		assert.NoError(t, err)
+		assert.Len(t, points, 2)
+		assert.True(t, repeated.Equal(points[0].Start))
+		assert.Equal(t, int64(1), points[0].Views)
+		assert.True(t, repeated.Add(time.Hour).Equal(points[1].Start))
+		assert.Equal(t, int64(2), points[1].Views)
+	})
+
+	t.Run("ViewRollups", func(t *testing.T) {
+		store := repo.(repository.RollupStore)
+		p := &repository.Product{Name: "Rollup Product"}
+		assert.NoError(t, repo.CreateProduct(ctx, p))
+
+		// Views over three UTC days far ahead of every other test
+		start := time.Date(2040, 3, 1, 22, 10, 0, 0, time.UTC)
+		for i := 0; i < 12; i++ {
+			_, err := repo.RecordView(ctx, &repository.ViewEvent{
+				EventID:    uuid.New(),
+				ProductID:  p.ID,
+				OccurredAt: start.Add(time.Duration(i) * 4 * time.Hour),
+			}, repository.RecordOptions{})
+			assert.NoError(t, err)
+		}
+		from, to := start.Add(-10*time.Minute), start.Add(48*time.Hour)
+
+		series := func() []repository.ViewSeriesPoint {
+			points, err := repo.GetProductViewSeries(ctx, p.ID, from.Truncate(24*time.Hour), to, repository.IntervalDay, time.UTC)
+			assert.NoError(t, err)
+			return points
+		}
+		periodViews := func() int64 {
+			top, err := repo.GetTopViewedProductsInRange(ctx, from, to, 100, false)
+			assert.NoError(t, err)
+			for _, tp := range top {
+				if tp.ID == p.ID {
+					return tp.Views
+				}
+			}
+			return 0
+		}
+		before, beforeViews := series(), periodViews()
+		assert.Equal(t, int64(12), beforeViews)
+
+		// Materializing, even twice, does not change what readers see
+		watermark, err := store.MaterializeViewRollups(ctx, start.Add(72*time.Hour), time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Date(2040, 3, 4, 22, 0, 0, 0, time.UTC), watermark)
+		_, err = store.MaterializeViewRollups(ctx, start.Add(72*time.Hour), time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, before, series())
+		assert.Equal(t, beforeViews, periodViews())
+
+		var daily int64
+		err = sqlDB.QueryRowContext(ctx, "SELECT views FROM product_views_daily WHERE product_id = $1 AND day_start = $2",
+			p.ID, time.Date(2040, 3, 2, 0, 0, 0, 0, time.UTC)).Scan(&daily)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(6), daily)
+
+		// A corrupted hour is repaired from the raw events
+		_, err = sqlDB.ExecContext(ctx, "UPDATE product_views_hourly SET views = 100 WHERE product_id = $1", p.ID)
+		assert.NoError(t, err)
+		assert.NoError(t, store.RebuildViewRollups(ctx, from, to.Add(24*time.Hour)))
+		assert.Equal(t, before, series())
+		assert.Equal(t, beforeViews, periodViews())
+	})
+
+	t.Run("MaintainViewEventPartitions", func(t *testing.T) {
+		store := repo.(repository.ViewEventStore)
+		p := &repository.Product{Name: "Partitioned Product"}
+		assert.NoError(t, repo.CreateProduct(ctx, p))
+
+		now := time.Date(2100, 1, 1, 15, 0, 0, 0, time.UTC)
+		changes, err := store.MaintainViewEventPartitions(ctx, now, 2, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"view_events_p21000101", "view_events_p21000102", "view_events_p21000103"}, changes.Created)
+
+		// Existing partitions are kept
+		changes, err = store.MaintainViewEventPartitions(ctx, now, 2, 0)
+		assert.NoError(t, err)
+		assert.Empty(t, changes.Created)
+
+		event := &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: now}
+		_, err = repo.RecordView(ctx, event, repository.RecordOptions{})
+		assert.NoError(t, err)
+
+		var partition string
+		err = sqlDB.QueryRowContext(ctx, "SELECT tableoid::regclass::text FROM view_events WHERE event_id = $1", event.EventID).Scan(&partition)
+		assert.NoError(t, err)
+		assert.Equal(t, "view_events_p21000101", partition)
+
+		// With a two day retention, January 1st ends too long before January 4th noon
+		changes, err = store.MaintainViewEventPartitions(ctx, now.Add(69*time.Hour), 0, 48*time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"view_events_p21000104"}, changes.Created)
+		assert.Equal(t, []string{"view_events_p21000101"}, changes.Dropped)
+
+		var count int
+		err = sqlDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM view_events WHERE event_id = $1", event.EventID).Scan(&count)
+		assert.NoError(t, err)
+		assert.Zero(t, count)
+
+		// The dropped view still counts for reconciliation against raw events
+		var expired int64
+		err = sqlDB.QueryRowContext(ctx, "SELECT expired_event_views FROM product_view_baselines WHERE product_id = $1", p.ID).Scan(&expired)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), expired)
+	})
+
+	t.Run("ReplayViews", func(t *testing.T) {
+		store := repo.(repository.ReplayStore)
+		p := &repository.Product{Name: "Replayed Product"}
+		assert.NoError(t, repo.CreateProduct(ctx, p))
+
+		since := time.Date(2200, 1, 1, 10, 0, 0, 0, time.UTC)
+		views := make([]*repository.ViewEvent, 4)
+		for i := range views {
+			views[i] = &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: since.Add(time.Duration(i) * time.Minute)}
+		}
+		live := func(events []*repository.ViewEvent, offset int64) {
+			_, err := repo.RecordViews(ctx, events, repository.RecordOptions{Offsets: &repository.ConsumerOffsets{
+				GroupID: "replay-live",
+				Offsets: []repository.PartitionOffset{{Topic: "product-views", Partition: 0, Offset: offset}},
+			}})
+			assert.NoError(t, err)
+		}
+
+		// The live counts drift from the topic
+		live(views[:3], 3)
+		_, err := sqlDB.ExecContext(ctx, "UPDATE products SET view_count = view_count + 10 WHERE id = $1", p.ID)
+		assert.NoError(t, err)
+		_, err = sqlDB.ExecContext(ctx, "UPDATE product_view_buckets SET views = views + 10 WHERE product_id = $1 AND bucket_start = $2", p.ID, since)
+		assert.NoError(t, err)
+		phantom := uuid.New()
+		_, err = sqlDB.ExecContext(ctx, "INSERT INTO view_events (event_id, product_id, occurred_at) VALUES ($1, $2, $3)", phantom, p.ID, since)
+		assert.NoError(t, err)
+
+		assert.NoError(t, store.StartReplay(ctx, "replay-live", "product-views", since, map[int32]int64{0: 0}))
+		early := &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: since.Add(-time.Minute)}
+		err = store.RecordReplayViews(ctx, []*repository.ViewEvent{early, views[0], views[1], views[1], views[2]}, map[int32]int64{0: 3}, 0)
+		assert.NoError(t, err)
+
+		// The live consumer goes on while the replay runs
+		live(views[3:], 4)
+		state, err := store.LoadReplay(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, map[int32]int64{0: 3}, state.Positions)
+
+		swap, err := store.BeginReplaySwap(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, map[int32]int64{0: 4}, swap.Live())
+		assert.NoError(t, swap.RecordViews(ctx, views[3:], map[int32]int64{0: 4}, 0))
+
+		report, err := swap.Report(ctx, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(14), report.LiveViews)
+		assert.Equal(t, int64(4), report.ReplayViews)
+		assert.Equal(t, 1, report.ChangedProducts)
+		assert.Equal(t, p.ID, report.Largest[0].ProductID)
+		assert.NoError(t, swap.Commit(ctx))
+
+		updated, err := repo.GetProduct(ctx, p.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), updated.ViewCount)
+
+		var bucketViews int64
+		err = sqlDB.QueryRowContext(ctx, "SELECT SUM(views) FROM product_view_buckets WHERE product_id = $1", p.ID).Scan(&bucketViews)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), bucketViews)
+
+		// The raw events and the trending score follow the replayed views
+		var events int
+		err = sqlDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM view_events WHERE product_id = $1", p.ID).Scan(&events)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, events)
+
+		var logScore, halfLife float64
+		err = sqlDB.QueryRowContext(ctx, `
+			SELECT t.log_score, s.half_life_seconds FROM product_trend_scores t, trend_score_settings s
+			WHERE t.product_id = $1`, p.ID).Scan(&logScore, &halfLife)
+		assert.NoError(t, err)
+		latest := views[3].OccurredAt.Sub(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)).Seconds() / halfLife
+		var sum float64
+		for _, v := range views {
+			sum += math.Exp2(-views[3].OccurredAt.Sub(v.OccurredAt).Seconds() / halfLife)
+		}
+		assert.InDelta(t, latest+math.Log2(sum), logScore, 1e-6)
+
+		_, err = store.LoadReplay(ctx)
+		assert.ErrorIs(t, err, repository.ErrNoReplay)
+	})
+
+	t.Run("ReconcileViewCounts", func(t *testing.T) {
+		store := repo.(repository.ReconcileStore)
+		p := &repository.Product{Name: "Drifting Product"}
+		assert.NoError(t, repo.CreateProduct(ctx, p))
+		for i := 0; i < 3; i++ {
+			_, err := repo.RecordView(ctx, &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: time.Now()}, repository.RecordOptions{})
+			assert.NoError(t, err)
+		}
+		_, err := sqlDB.ExecContext(ctx, "UPDATE products SET view_count = view_count + 5 WHERE id = $1", p.ID)
+		assert.NoError(t, err)
+
+		// Views counted before any bucket are the product's baseline, not drift
+		legacy := &repository.Product{Name: "Legacy Product", ViewCount: 500}
+		assert.NoError(t, repo.CreateProduct(ctx, legacy))
+		_, err = repo.RecordView(ctx, &repository.ViewEvent{EventID: uuid.New(), ProductID: legacy.ID, OccurredAt: time.Now()}, repository.RecordOptions{})
+		assert.NoError(t, err)
+
+		discrepancyOf := func(run *repository.Reconciliation, id uuid.UUID) *repository.CountDiscrepancy {
+			run, err := store.GetReconciliation(ctx, run.ID, 1000)
+			assert.NoError(t, err)
+			for i := range run.Products {
+				if run.Products[i].ProductID == id {
+					return &run.Products[i]
+				}
+			}
+			return nil
+		}
+		discrepancy := func(run *repository.Reconciliation) *repository.CountDiscrepancy {
+			return discrepancyOf(run, p.ID)
+		}
+
+		dryRun, err := store.ReconcileViewCounts(ctx, repository.ReconcileBuckets, "test")
+		assert.NoError(t, err)
+		assert.True(t, dryRun.DryRun)
+		assert.GreaterOrEqual(t, dryRun.Discrepancies, int64(1))
+		assert.Equal(t, &repository.CountDiscrepancy{
+			ProductID: p.ID, ViewCount: 8, ExpectedViewCount: 3, UniqueViewCount: 3, ExpectedUniqueViewCount: 3,
+		}, discrepancy(dryRun))
+		assert.Nil(t, discrepancyOf(dryRun, legacy.ID))
+
+		// A view recorded after the dry run is kept by the repair
+		_, err = repo.RecordView(ctx, &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: time.Now()}, repository.RecordOptions{})
+		assert.NoError(t, err)
+
+		applied, err := store.ApplyReconciliation(ctx, dryRun.ID, "test")
+		assert.NoError(t, err)
+		assert.Equal(t, &dryRun.ID, applied.AppliedRunID)
+		assert.NotNil(t, discrepancy(applied))
+
+		updated, err := repo.GetProduct(ctx, p.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), updated.ViewCount)
+
+		// Repaired products no longer drift, and applies cannot be applied
+		check, err := store.ReconcileViewCounts(ctx, repository.ReconcileEvents, "test")
+		assert.NoError(t, err)
+		assert.Nil(t, discrepancy(check))
+		_, err = store.ApplyReconciliation(ctx, applied.ID, "test")
+		assert.ErrorIs(t, err, repository.ErrNotDryRun)
+
+		runs, err := store.ListReconciliations(ctx, 3)
+		assert.NoError(t, err)
+		assert.Len(t, runs, 3)
+		assert.Equal(t, check.ID, runs[0].ID)
+	})
+
+	t.Run("ShardedCounters", func(t *testing.T) {
+		store := repo.(repository.CounterStore)
+		p := &repository.Product{Name: "Viral Product", ViewCount: 1000}
+		assert.NoError(t, repo.CreateProduct(ctx, p))
+
+		opts := repository.RecordOptions{CounterShards: 4}
+		for i := 0; i < 3; i++ {
+			result, err := repo.RecordViews(ctx, []*repository.ViewEvent{
+				{EventID: uuid.New(), ProductID: p.ID, OccurredAt: time.Now()},
+			}, opts)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1001+i), result.Counts[p.ID].ViewCount)
+		}
+
+		// The increments stay in the shards, which reads add to the products row
+		var stored int64
+		err := sqlDB.QueryRowContext(ctx, "SELECT view_count FROM products WHERE id = $1", p.ID).Scan(&stored)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1000), stored)
+
+		retrieved, err := repo.GetProduct(ctx, p.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1003), retrieved.ViewCount)
+		assert.Equal(t, int64(3), retrieved.UniqueViewCount)
+
+		top, err := repo.GetTopViewedProducts(ctx, 1)
+		assert.NoError(t, err)
+		assert.Len(t, top, 1)
+		assert.Equal(t, p.ID, top[0].ID)
+		assert.Equal(t, int64(1003), top[0].ViewCount)
+
+		// Compaction moves the shards into the products row without changing the counts
+		compacted, err := store.CompactViewCounts(ctx)
+		assert.NoError(t, err)
+		assert.True(t, compacted >= 1)
+
+		var shards int
+		err = sqlDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM product_view_count_shards").Scan(&shards)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, shards)
+
+		retrieved, err = repo.GetProduct(ctx, p.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1003), retrieved.ViewCount)
+		assert.Equal(t, int64(3), retrieved.UniqueViewCount)
+	})
+
+	t.Run("UpdateAndArchiveProduct", func(t *testing.T) {
+		p := &repository.Product{Name: "Catalog Product", Description: "Before", ViewCount: 5000}
+		assert.NoError(t, repo.CreateProduct(ctx, p))
+		assert.Equal(t, int64(1), p.Version)
+
+		name := "Renamed Product"
+		updated, err := repo.UpdateProduct(ctx, p.ID, repository.ProductUpdate{Name: &name}, p.Version)
+		assert.NoError(t, err)
+		assert.Equal(t, "Renamed Product", updated.Name)
+		assert.Equal(t, "Before", updated.Description)
+		assert.Equal(t, int64(2), updated.Version)
+		assert.Equal(t, int64(5000), updated.ViewCount)
+
+		// Updates that change nothing keep the version
+		unchanged, err := repo.UpdateProduct(ctx, p.ID, repository.ProductUpdate{}, updated.Version)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), unchanged.Version)
+		unchanged, err = repo.UpdateProduct(ctx, p.ID, repository.ProductUpdate{Name: &name}, repository.AnyVersion)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), unchanged.Version)
+		assert.Equal(t, "Renamed Product", unchanged.Name)
+		assert.Equal(t, int64(5000), unchanged.ViewCount)
+
+		// Updates based on an older version are refused
+		_, err = repo.UpdateProduct(ctx, p.ID, repository.ProductUpdate{Name: &name}, p.Version)
+		assert.ErrorIs(t, err, repository.ErrVersionMismatch)
+		_, err = repo.UpdateProduct(ctx, uuid.New(), repository.ProductUpdate{Name: &name}, repository.AnyVersion)
+		assert.ErrorIs(t, err, repository.ErrProductNotFound)
+
+		archived, err := repo.ArchiveProduct(ctx, p.ID, updated.Version)
+		assert.NoError(t, err)
+		assert.NotNil(t, archived.ArchivedAt)
+		assert.Equal(t, int64(3), archived.Version)
+
+		_, err = repo.UpdateProduct(ctx, p.ID, repository.ProductUpdate{Name: &name}, repository.AnyVersion)
+		assert.ErrorIs(t, err, repository.ErrProductArchived)
+
+		// Archived products keep their details but leave the rankings
+		retrieved, err := repo.GetProduct(ctx, p.ID)
+		assert.NoError(t, err)
+		assert.NotNil(t, retrieved.ArchivedAt)
+
+		top, err := repo.GetTopViewedProducts(ctx, 1)
+		assert.NoError(t, err)
+		assert.NotEqual(t, p.ID, top[0].ID)
+		top, err = repo.GetTopProductsIncludingArchived(ctx, 1, false)
+		assert.NoError(t, err)
+		assert.Equal(t, p.ID, top[0].ID)
+
+		// Their views are skipped when asked to
+		event := &repository.ViewEvent{EventID: uuid.New(), ProductID: p.ID, OccurredAt: time.Now()}
+		result, err := repo.RecordViews(ctx, []*repository.ViewEvent{event}, repository.RecordOptions{SkipArchived: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []uuid.UUID{event.EventID}, result.Archived)
+		assert.Equal(t, 0, result.Recorded)
+	})
+
+	t.Run("ListProducts", func(t *testing.T) {
+		// Only list the products created here
+		start := time.Now().Add(-time.Second)
+		for i, name := range []string{"List C", "List A", "List D", "List B"} {
+			assert.NoError(t, repo.CreateProduct(ctx, &repository.Product{Name: name, ViewCount: int64(i * 10)}))
+		}
+
+		query := repository.ProductListQuery{Sort: repository.SortByName, CreatedFrom: start, Limit: 3}
+		page, err := repo.ListProducts(ctx, query)
+		assert.NoError(t, err)
+		assert.Len(t, page.Products, 3)
+		assert.Equal(t, "List A", page.Products[0].Name)
+		assert.Equal(t, "List C", page.Products[2].Name)
+		assert.NotNil(t, page.Next)
+		assert.False(t, page.ApproximateViews)
+
+		query.After = page.Next
+		page, err = repo.ListProducts(ctx, query)
+		assert.NoError(t, err)
+		assert.Len(t, page.Products, 1)
+		assert.Equal(t, "List D", page.Products[0].Name)
+		assert.Nil(t, page.Next)
+
+		// Filtered by views, most viewed first
+		minViews := int64(10)
+		page, err = repo.ListProducts(ctx, repository.ProductListQuery{
+			Sort: repository.SortByViewCount, Descending: true, CreatedFrom: start, MinViews: &minViews, Limit: 10,
+		})
+		assert.NoError(t, err)
+		assert.Len(t, page.Products, 3)
+		assert.Equal(t, "List B", page.Products[0].Name)
+		assert.True(t, page.ApproximateViews)
+
+		// The filter and order follow the compacted counts, which are returned
+		listed := page.Products[0]
+		_, err = sqlDB.ExecContext(ctx, "INSERT INTO product_view_count_shards (product_id, shard, view_count) VALUES ($1, 0, 100)", listed.ID)
+		assert.NoError(t, err)
+		page, err = repo.ListProducts(ctx, repository.ProductListQuery{
+			Sort: repository.SortByViewCount, Descending: true, CreatedFrom: start, MinViews: &minViews, Limit: 10,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, listed.ID, page.Products[0].ID)
+		assert.Equal(t, listed.ViewCount, page.Products[0].ViewCount)
+		_, err = sqlDB.ExecContext(ctx, "DELETE FROM product_view_count_shards WHERE product_id = $1", listed.ID)
+		assert.NoError(t, err)
+
+		// Cursors only continue the listing they came from
+		_, err = repo.ListProducts(ctx, repository.ProductListQuery{Sort: repository.SortByCreatedAt, After: query.After, Limit: 3})
+		assert.ErrorIs(t, err, repository.ErrInvalidCursor)
+	})
+
+	t.Run("SearchProducts", func(t *testing.T) {
+		quiet := &repository.Product{Name: "Walnut Standing Desk", Description: "A solid walnut desk with an electric height adjustment"}
+		popular := &repository.Product{Name: "Oak Standing Desk", Description: "Oak top on a steel frame", ViewCount: 100000}
+		other := &repository.Product{Name: "Ceramic Mug", Description: "Holds a standing amount of coffee"}
+		hostile := &repository.Product{Name: `<img src=x onerror="alert(1)"> Lamp`, Description: "A <b>desk</b> lamp"}
+		for _, p := range []*repository.Product{quiet, popular, other, hostile} {
+			assert.NoError(t, repo.CreateProduct(ctx, p))
+		}
+
+		// Without popularity, the name match on both words ranks above the description
+		page, err := repo.SearchProducts(ctx, repository.ProductSearchQuery{Text: "walnut desk", Limit: 10})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, page.Results)
+		assert.Equal(t, quiet.ID, page.Results[0].ID)
+		assert.Contains(t, page.Results[0].NameHighlight, "<mark>Walnut</mark>")
+		assert.Contains(t, page.Results[0].Snippet, "<mark>walnut</mark>")
+
+		// Product text is escaped, only the highlights are markup
+		page, err = repo.SearchProducts(ctx, repository.ProductSearchQuery{Text: "lamp", Limit: 1})
+		assert.NoError(t, err)
+		assert.Len(t, page.Results, 1)
+		assert.Equal(t, hostile.ID, page.Results[0].ID)
+		assert.NotContains(t, page.Results[0].NameHighlight, "<img")
+		assert.Contains(t, page.Results[0].NameHighlight, "&lt;img")
+		assert.Contains(t, page.Results[0].NameHighlight, "<mark>Lamp</mark>")
+		assert.Contains(t, page.Results[0].Snippet, "&lt;b&gt;")
+
+		// Popularity lifts the most viewed desk
+		page, err = repo.SearchProducts(ctx, repository.ProductSearchQuery{Text: "standing desk", PopularityWeight: 1, Limit: 1})
+		assert.NoError(t, err)
+		assert.Len(t, page.Results, 1)
+		assert.Equal(t, popular.ID, page.Results[0].ID)
+		assert.NotNil(t, page.Next)
+
+		next, err := repo.SearchProducts(ctx, repository.ProductSearchQuery{Text: "standing desk", PopularityWeight: 1, After: page.Next, Limit: 10})
+		assert.NoError(t, err)
+		for _, res := range next.Results {
+			assert.NotEqual(t, popular.ID, res.ID)
+			assert.LessOrEqual(t, res.Score, page.Results[0].Score)
+		}
+
+		// Typos still match names
+		page, err = repo.SearchProducts(ctx, repository.ProductSearchQuery{Text: "ceramik", Limit: 10})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, page.Results)
+		assert.Equal(t, other.ID, page.Results[0].ID)
+
+		// Cursors only continue the search they came from
+		_, err = repo.SearchProducts(ctx, repository.ProductSearchQuery{Text: "mug", After: &repository.ProductSearchCursor{Query: "desk"}, Limit: 10})
+		assert.ErrorIs(t, err, repository.ErrInvalidCursor)
+	})
+
+	t.Run("Taxonomy", func(t *testing.T) {
+		store := repo.(repository.TaxonomyStore)
+
+		electronics := &repository.Category{Slug: "electronics", Name: "Electronics"}
+		assert.NoError(t, store.CreateCategory(ctx, electronics))
+		audio := &repository.Category{Slug: "audio", Name: "Audio", ParentID: &electronics.ID}
+		assert.NoError(t, store.CreateCategory(ctx, audio))
+		headphones := &repository.Category{Slug: "headphones", Name: "Headphones", ParentID: &audio.ID}
+		assert.NoError(t, store.CreateCategory(ctx, headphones))
+		assert.ErrorIs(t, store.CreateCategory(ctx, &repository.Category{Slug: "audio", Name: "Audio"}), repository.ErrCategoryExists)
+
+		earbuds := &repository.Product{Name: "Earbuds", ViewCount: 300000}
+		speaker := &repository.Product{Name: "Speaker", ViewCount: 200000}
+		novel := &repository.Product{Name: "Novel", ViewCount: 900000}
+		for _, p := range []*repository.Product{earbuds, speaker, novel} {
+			assert.NoError(t, repo.CreateProduct(ctx, p))
+		}
+
+		categories, err := store.SetProductCategories(ctx, earbuds.ID, []uuid.UUID{headphones.ID})
+		assert.NoError(t, err)
+		assert.Len(t, categories, 1)
+		_, err = store.SetProductCategories(ctx, speaker.ID, []uuid.UUID{audio.ID})
+		assert.NoError(t, err)
+		_, err = store.SetProductCategories(ctx, novel.ID, []uuid.UUID{uuid.New()})
+		assert.ErrorIs(t, err, repository.ErrCategoryNotFound)
+
+		tags, err := store.SetProductTags(ctx, earbuds.ID, []string{"Wireless", " wireless ", "Noise  Cancelling"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"noise cancelling", "wireless"}, []string{tags[0].Name, tags[1].Name})
+
+		// Categories roll up their subcategories
+		top, err := repo.GetTopProductsInSlice(ctx, repository.ProductSlice{Category: "electronics"}, 10, false, false)
+		assert.NoError(t, err)
+		assert.Len(t, top, 2)
+		assert.Equal(t, earbuds.ID, top[0].ID)
+		assert.Equal(t, speaker.ID, top[1].ID)
+
+		top, err = repo.GetTopProductsInSlice(ctx, repository.ProductSlice{Category: "audio", Tag: "WIRELESS"}, 10, false, false)
+		assert.NoError(t, err)
+		assert.Len(t, top, 1)
+		assert.Equal(t, earbuds.ID, top[0].ID)
+
+		_, err = repo.GetTopProductsInSlice(ctx, repository.ProductSlice{Tag: "vintage"}, 10, false, false)
+		assert.ErrorIs(t, err, repository.ErrTagNotFound)
+
+		// Category rankings follow the products' counts once the counters are
+		// compacted
+		_, err = sqlDB.ExecContext(ctx, "UPDATE products SET view_count = 400000 WHERE id = $1", speaker.ID)
+		assert.NoError(t, err)
+		_, err = repo.(repository.CounterStore).CompactViewCounts(ctx)
+		assert.NoError(t, err)
+		top, err = repo.GetTopProductsInSlice(ctx, repository.ProductSlice{Category: "electronics"}, 1, false, false)
+		assert.NoError(t, err)
+		assert.Len(t, top, 1)
+		assert.Equal(t, speaker.ID, top[0].ID)
+
+		top, err = repo.GetTopProductsInSlice(ctx, repository.ProductSlice{Tag: "wireless"}, 10, false, false)
+		assert.NoError(t, err)
+		assert.Len(t, top, 1)
+		assert.Equal(t, earbuds.ID, top[0].ID)
+
+		// The tree cannot get cycles, nor lose branches
+		electronics.ParentID = &headphones.ID
+		assert.ErrorIs(t, store.UpdateCategory(ctx, electronics), repository.ErrCategoryCycle)
+		assert.ErrorIs(t, store.DeleteCategory(ctx, audio.ID), repository.ErrCategoryHasChildren)
+
+		// Deleting a leaf unassigns its products
+		assert.NoError(t, store.DeleteCategory(ctx, headphones.ID))
+		categories, err = store.GetProductCategories(ctx, earbuds.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, categories)
+	})
+
+	t.Run("ClaimJobRun", func(t *testing.T) {
+		store := repo.(repository.JobStore)
+		slot := time.Now().Truncate(time.Hour)
+
+		finish, err := store.ClaimJobRun(ctx, "test", slot)
+		assert.NoError(t, err)
+		assert.NotNil(t, finish)
+
+		// The next interval cannot start while the job is still running
+		running, err := store.ClaimJobRun(ctx, "test", slot.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Nil(t, running)
+		finish(errors.New("boom"))
+
+		var message string
+		assert.NoError(t, sqlDB.QueryRowContext(ctx, "SELECT error FROM job_runs WHERE name = 'test'").Scan(&message))
+		assert.Equal(t, "boom", message)
+
+		// Each interval is claimed once
+		claimed, err := store.ClaimJobRun(ctx, "test", slot)
+		assert.NoError(t, err)
+		assert.Nil(t, claimed)
+		next, err := store.ClaimJobRun(ctx, "test", slot.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.NotNil(t, next)
+		next(nil)
+	})
+
+	t.Run("ProductRanks", func(t *testing.T) {
+		store := repo.(repository.RankStore)
+
+		// Counts far above the other tests' products, two of them tied and
+		// one lifted above them by its counter shards
+		first := &repository.Product{Name: "Rank First", ViewCount: 3000000000}
+		lifted := &repository.Product{Name: "Rank Lifted", ViewCount: 1500000000}
+		tiedHigh := &repository.Product{Name: "Rank Tied", ViewCount: 2000000000}
+		tiedLow := &repository.Product{Name: "Rank Tied", ViewCount: 2000000000}
+		archived := &repository.Product{Name: "Rank Archived", ViewCount: 4000000000}
+		for _, p := range []*repository.Product{first, lifted, tiedHigh, tiedLow, archived} {
+			assert.NoError(t, repo.CreateProduct(ctx, p))
+		}
+		_, err := repo.ArchiveProduct(ctx, archived.ID, repository.AnyVersion)
+		assert.NoError(t, err)
+		_, err = sqlDB.ExecContext(ctx, `
+			INSERT INTO product_view_count_shards (product_id, shard, view_count) VALUES ($1, 0, 1000000000)`, lifted.ID)
+		assert.NoError(t, err)
+		if bytes.Compare(tiedHigh.ID[:], tiedLow.ID[:]) < 0 {
+			tiedHigh, tiedLow = tiedLow, tiedHigh
+		}
+
+		old, err := store.SnapshotRanks(ctx, 3, time.Hour)
+		assert.NoError(t, err)
+		snapshot, err := store.SnapshotRanks(ctx, 3, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), snapshot.Depth)
+		assert.Greater(t, snapshot.Products, int64(4))
+
+		// Ranks within the depth are the snapshot's, ties are broken by ID,
+		// archived products are left out
+		rank, err := store.GetProductRank(ctx, tiedHigh.ID, false, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), rank.Rank)
+		assert.False(t, rank.Approximate)
+		assert.Len(t, rank.Above, 1)
+		assert.Equal(t, lifted.ID, rank.Above[0].ID)
+		assert.Equal(t, int64(2), rank.Above[0].Rank)
+		assert.Equal(t, int64(2500000000), rank.Above[0].ViewCount)
+		assert.Len(t, rank.Below, 1)
+		assert.Equal(t, tiedLow.ID, rank.Below[0].ID)
+		assert.Equal(t, int64(4), rank.Below[0].Rank)
+		assert.InDelta(t, 100*float64(snapshot.Products-2)/float64(snapshot.Products), rank.Percentile, 1e-9)
+
+		rank, err = store.GetProductRank(ctx, lifted.ID, false, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), rank.Rank)
+		assert.Len(t, rank.Above, 1)
+		assert.Equal(t, first.ID, rank.Above[0].ID)
+		assert.Len(t, rank.Below, 2)
+		assert.Equal(t, []uuid.UUID{tiedHigh.ID, tiedLow.ID}, []uuid.UUID{rank.Below[0].ID, rank.Below[1].ID})
+
+		// Beyond the depth, ranks are estimated from the histogram; the tie
+		// shares its bucket, which is not counted above the product
+		rank, err = store.GetProductRank(ctx, tiedLow.ID, false, 1)
+		assert.NoError(t, err)
+		assert.True(t, rank.Approximate)
+		assert.Equal(t, int64(4), rank.Rank)
+		assert.Len(t, rank.Above, 1)
+		assert.Equal(t, tiedHigh.ID, rank.Above[0].ID)
+		assert.Equal(t, int64(3), rank.Above[0].Rank)
+
+		// Counts that moved since the snapshot do not move snapshot ranks
+		_, err = sqlDB.ExecContext(ctx, `UPDATE products SET view_count = 5000000000 WHERE id = $1`, tiedHigh.ID)
+		assert.NoError(t, err)
+		rank, err = store.GetProductRank(ctx, tiedHigh.ID, false, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), rank.Rank)
+		assert.Equal(t, int64(2000000000), rank.ViewCount)
+
+		_, err = store.GetProductRank(ctx, archived.ID, false, 1)
+		assert.ErrorIs(t, err, repository.ErrProductNotRanked)
+		_, err = store.GetProductRank(ctx, uuid.New(), false, 1)
+		assert.ErrorIs(t, err, repository.ErrProductNotFound)
+
+		// Offsets and cursors page through the top of the snapshot
+		page, err := store.GetRankedProducts(ctx, repository.RankPageQuery{Offset: 1, Limit: 1})
+		assert.NoError(t, err)
+		assert.Len(t, page.Products, 1)
+		assert.Equal(t, lifted.ID, page.Products[0].ID)
+		assert.NotNil(t, page.Next)
+
+		page, err = store.GetRankedProducts(ctx, repository.RankPageQuery{After: page.Next, Limit: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), page.Products[0].Rank)
+		assert.Equal(t, tiedHigh.ID, page.Products[0].ID)
+		assert.Nil(t, page.Next)
+
+		// Snapshots are kept for the retention, cursors of removed ones expire
+		_, err = store.GetRankedProducts(ctx, repository.RankPageQuery{After: &repository.RankCursor{SnapshotID: old.ID, Rank: 1}, Limit: 1})
+		assert.ErrorIs(t, err, repository.ErrRankSnapshotExpired)
+		_, err = store.GetRankedProducts(ctx, repository.RankPageQuery{Unique: true, After: &repository.RankCursor{SnapshotID: snapshot.ID, Rank: 1}, Limit: 1})
+		assert.ErrorIs(t, err, repository.ErrInvalidCursor)
+	})
+
 	t.Run("NonExistentProduct", func(t *testing.T) {
 		nonExistentID := uuid.New()
 
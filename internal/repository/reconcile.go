@@ -0,0 +1,354 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Sources of the counts products are reconciled against
+const (
+	// ReconcileBuckets sums the view buckets the rollups are built from, which
+	// cover every view since they were introduced
+	ReconcileBuckets = "buckets"
+	// ReconcileEvents counts raw view events, and the views of the events
+	// dropped after their retention from the baselines; unique views still
+	// come from the buckets, as raw events do not determine them.
+	ReconcileEvents = "events"
+)
+
+var (
+	// ErrReconciliationNotFound is returned for unknown reconciliation runs
+	ErrReconciliationNotFound = errors.New("reconciliation not found")
+	// ErrNotDryRun is returned when applying a run that was not a dry run
+	ErrNotDryRun = errors.New("only dry runs can be applied")
+	// ErrUnknownSource is returned for unsupported reconciliation sources
+	ErrUnknownSource = errors.New("unknown reconciliation source")
+)
+
+// CountDiscrepancy is a product whose stored counts differ from its expected ones
+type CountDiscrepancy struct {
+	ProductID               uuid.UUID
+	ViewCount               int64
+	ExpectedViewCount       int64
+	UniqueViewCount         int64
+	ExpectedUniqueViewCount int64
+}
+
+// Reconciliation is the audit record of a reconciliation run
+type Reconciliation struct {
+	ID     uuid.UUID
+	Source string
+	DryRun bool
+	// AppliedRunID is the dry run whose discrepancies an apply repaired
+	AppliedRunID    *uuid.UUID
+	TriggeredBy     string
+	ProductsChecked int64
+	Discrepancies   int64
+	// ViewDrift and UniqueViewDrift sum the stored minus the expected counts
+	ViewDrift       int64
+	UniqueViewDrift int64
+	Repaired        int64
+	StartedAt       time.Time
+	FinishedAt      time.Time
+	// Products holds the largest discrepancies when loaded with a limit
+	Products []CountDiscrepancy
+}
+
+// String summarizes the run for the audit log
+func (r *Reconciliation) String() string {
+	if r.DryRun {
+		return fmt.Sprintf("Reconciliation %s against %s by %s: %d of %d products drift by %d views and %d unique views",
+			r.ID, r.Source, r.TriggeredBy, r.Discrepancies, r.ProductsChecked, r.ViewDrift, r.UniqueViewDrift)
+	}
+	return fmt.Sprintf("Reconciliation %s by %s applied dry run %s: repaired %d of %d products, removing %d views and %d unique views of drift",
+		r.ID, r.TriggeredBy, r.AppliedRunID, r.Repaired, r.ProductsChecked, r.ViewDrift, r.UniqueViewDrift)
+}
+
+// ReconcileStore compares the stored view counts of products with the counts
+// derived from their views and repairs them
+type ReconcileStore interface {
+	// ReconcileViewCounts records a dry run comparing every product with source
+	ReconcileViewCounts(ctx context.Context, source, triggeredBy string) (*Reconciliation, error)
+	// ApplyReconciliation repairs the discrepancies of a dry run that have not
+	// changed since, and records the repair
+	ApplyReconciliation(ctx context.Context, runID uuid.UUID, triggeredBy string) (*Reconciliation, error)
+	// GetReconciliation returns a run with up to limit of its largest discrepancies
+	GetReconciliation(ctx context.Context, id uuid.UUID, limit int) (*Reconciliation, error)
+	// ListReconciliations returns the most recent runs first
+	ListReconciliations(ctx context.Context, limit int) ([]Reconciliation, error)
+}
+
+// expectedCounts returns a query of (product_id, views, unique_views) for
+// source. Both sources start from the product's baseline, the views it was
+// counted before view buckets were introduced; the events source adds the views
+// whose events expired. filter, if set, restricts the product IDs.
+func expectedCounts(source, filter string) (string, error) {
+	where := ""
+	if filter != "" {
+		where = "WHERE product_id IN (" + filter + ")"
+	}
+	baseline := `SELECT product_id, views, unique_views FROM product_view_baselines ` + where
+
+	switch source {
+	case ReconcileBuckets:
+		return `
+			SELECT product_id, SUM(views) AS views, SUM(unique_views) AS unique_views
+			FROM (
+				` + baseline + `
+				UNION ALL
+				SELECT product_id, views, unique_views FROM product_view_buckets ` + where + `
+			) AS counts
+			GROUP BY product_id`, nil
+	case ReconcileEvents:
+		return `
+			SELECT product_id, SUM(views) AS views, SUM(unique_views) AS unique_views
+			FROM (
+				` + baseline + `
+				UNION ALL
+				SELECT product_id, expired_event_views, 0 FROM product_view_baselines ` + where + `
+				UNION ALL
+				SELECT product_id, COUNT(*) AS views, 0 AS unique_views FROM view_events ` + where + ` GROUP BY product_id
+				UNION ALL
+				SELECT product_id, 0, SUM(unique_views) FROM product_view_buckets ` + where + ` GROUP BY product_id
+			) AS counts
+			GROUP BY product_id`, nil
+	default:
+		return "", fmt.Errorf("%w %q", ErrUnknownSource, source)
+	}
+}
+
+// ReconcileViewCounts compares the counts of every product in one snapshot,
+// so that views recorded meanwhile, which update both sides in one
+// transaction, never read as drift
+func (r *productRepository) ReconcileViewCounts(ctx context.Context, source, triggeredBy string) (*Reconciliation, error) {
+	expected, err := expectedCounts(source, "")
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	run := &Reconciliation{ID: uuid.New(), Source: source, DryRun: true, TriggeredBy: triggeredBy, StartedAt: time.Now()}
+	if err := insertReconciliation(ctx, tx, run); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		WITH expected AS (`+expected+`)
+		INSERT INTO count_discrepancies
+			(run_id, product_id, view_count, expected_view_count, unique_view_count, expected_unique_view_count)
+		SELECT $1, p.id, p.view_count + s.views, COALESCE(e.views, 0),
+		       p.unique_view_count + s.unique_views, COALESCE(e.unique_views, 0)
+		FROM products p`+shardSums("s", "p.id")+`
+		LEFT JOIN expected e ON e.product_id = p.id
+		WHERE p.view_count + s.views <> COALESCE(e.views, 0)
+		   OR p.unique_view_count + s.unique_views <> COALESCE(e.unique_views, 0)`,
+		run.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare view counts: %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM products`).Scan(&run.ProductsChecked)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := finishReconciliation(ctx, tx, run); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// ApplyReconciliation moves each product of a dry run by the drift recorded
+// for it, provided its drift is still the same. Counts are adjusted rather
+// than overwritten, so views recorded concurrently are kept; products whose
+// drift changed are left for a new dry run. The adjustment goes to the
+// products row, so the counter shards only ever hold views.
+func (r *productRepository) ApplyReconciliation(ctx context.Context, runID uuid.UUID, triggeredBy string) (*Reconciliation, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	dryRun, err := getReconciliation(ctx, tx, runID)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun.DryRun {
+		return nil, ErrNotDryRun
+	}
+
+	expected, err := expectedCounts(dryRun.Source, "SELECT product_id FROM count_discrepancies WHERE run_id = $1")
+	if err != nil {
+		return nil, err
+	}
+
+	run := &Reconciliation{
+		ID:              uuid.New(),
+		Source:          dryRun.Source,
+		AppliedRunID:    &dryRun.ID,
+		TriggeredBy:     triggeredBy,
+		ProductsChecked: dryRun.Discrepancies,
+		StartedAt:       time.Now(),
+	}
+	if err := insertReconciliation(ctx, tx, run); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		WITH expected AS (`+expected+`),
+		repaired AS (
+			UPDATE products p
+			SET view_count = p.view_count - (d.view_count - d.expected_view_count),
+			    unique_view_count = p.unique_view_count - (d.unique_view_count - d.expected_unique_view_count)
+			FROM count_discrepancies d`+shardSums("s", "d.product_id")+`
+			LEFT JOIN expected e ON e.product_id = d.product_id
+			WHERE d.run_id = $1 AND p.id = d.product_id
+			  AND p.view_count + s.views - COALESCE(e.views, 0) = d.view_count - d.expected_view_count
+			  AND p.unique_view_count + s.unique_views - COALESCE(e.unique_views, 0) = d.unique_view_count - d.expected_unique_view_count
+			RETURNING p.id
+		)
+		INSERT INTO count_discrepancies
+			(run_id, product_id, view_count, expected_view_count, unique_view_count, expected_unique_view_count)
+		SELECT $2, d.product_id, d.view_count, d.expected_view_count, d.unique_view_count, d.expected_unique_view_count
+		FROM count_discrepancies d
+		JOIN repaired ON repaired.id = d.product_id
+		WHERE d.run_id = $1`,
+		dryRun.ID, run.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to repair view counts: %w", err)
+	}
+
+	if err := finishReconciliation(ctx, tx, run); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+func insertReconciliation(ctx context.Context, tx *sql.Tx, run *Reconciliation) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO count_reconciliations (id, source, dry_run, applied_run_id, triggered_by, started_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		run.ID, run.Source, run.DryRun, run.AppliedRunID, run.TriggeredBy, run.StartedAt)
+	return err
+}
+
+// finishReconciliation totals a run's discrepancies into its record. The
+// discrepancies of an apply are the products it repaired.
+func finishReconciliation(ctx context.Context, tx *sql.Tx, run *Reconciliation) error {
+	return tx.QueryRowContext(ctx, `
+		WITH totals AS (
+			SELECT COUNT(*) AS discrepancies,
+			       COALESCE(SUM(view_count - expected_view_count), 0) AS view_drift,
+			       COALESCE(SUM(unique_view_count - expected_unique_view_count), 0) AS unique_view_drift
+			FROM count_discrepancies
+			WHERE run_id = $1
+		)
+		UPDATE count_reconciliations c
+		SET products_checked = $2,
+		    discrepancies = t.discrepancies,
+		    view_drift = t.view_drift,
+		    unique_view_drift = t.unique_view_drift,
+		    repaired = CASE WHEN c.dry_run THEN 0 ELSE t.discrepancies END,
+		    finished_at = CURRENT_TIMESTAMP
+		FROM totals t
+		WHERE c.id = $1
+		RETURNING c.discrepancies, c.view_drift, c.unique_view_drift, c.repaired, c.finished_at`,
+		run.ID, run.ProductsChecked).Scan(
+		&run.Discrepancies, &run.ViewDrift, &run.UniqueViewDrift, &run.Repaired, &run.FinishedAt)
+}
+
+// GetReconciliation returns a reconciliation run and its largest discrepancies
+func (r *productRepository) GetReconciliation(ctx context.Context, id uuid.UUID, limit int) (*Reconciliation, error) {
+	run, err := getReconciliation(ctx, r.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT product_id, view_count, expected_view_count, unique_view_count, expected_unique_view_count
+		FROM count_discrepancies
+		WHERE run_id = $1
+		ORDER BY ABS(view_count - expected_view_count) DESC, ABS(unique_view_count - expected_unique_view_count) DESC, product_id
+		LIMIT $2`, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d CountDiscrepancy
+		if err := rows.Scan(&d.ProductID, &d.ViewCount, &d.ExpectedViewCount, &d.UniqueViewCount, &d.ExpectedUniqueViewCount); err != nil {
+			return nil, err
+		}
+		run.Products = append(run.Products, d)
+	}
+
+	return run, rows.Err()
+}
+
+// reconciliationColumns are scanned by scanReconciliation
+const reconciliationColumns = `id, source, dry_run, applied_run_id, triggered_by, products_checked,
+	discrepancies, view_drift, unique_view_drift, repaired, started_at, finished_at`
+
+func scanReconciliation(row interface{ Scan(...any) error }) (*Reconciliation, error) {
+	var run Reconciliation
+	var applied uuid.NullUUID
+	err := row.Scan(&run.ID, &run.Source, &run.DryRun, &applied, &run.TriggeredBy, &run.ProductsChecked,
+		&run.Discrepancies, &run.ViewDrift, &run.UniqueViewDrift, &run.Repaired, &run.StartedAt, &run.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	if applied.Valid {
+		run.AppliedRunID = &applied.UUID
+	}
+	return &run, nil
+}
+
+func getReconciliation(ctx context.Context, q queryer, id uuid.UUID) (*Reconciliation, error) {
+	run, err := scanReconciliation(q.QueryRowContext(ctx, `
+		SELECT `+reconciliationColumns+` FROM count_reconciliations WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrReconciliationNotFound
+	}
+	return run, err
+}
+
+// ListReconciliations returns the latest reconciliation runs
+func (r *productRepository) ListReconciliations(ctx context.Context, limit int) ([]Reconciliation, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+reconciliationColumns+` FROM count_reconciliations
+		ORDER BY started_at DESC
+		LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []Reconciliation
+	for rows.Next() {
+		run, err := scanReconciliation(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, *run)
+	}
+
+	return runs, rows.Err()
+}
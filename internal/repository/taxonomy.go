@@ -0,0 +1,573 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrCategoryNotFound is returned for unknown categories
+	ErrCategoryNotFound = errors.New("category not found")
+	// ErrParentCategoryNotFound is returned when placing a category under an unknown parent
+	ErrParentCategoryNotFound = errors.New("parent category not found")
+	// ErrCategoryExists is returned when a category slug is already taken
+	ErrCategoryExists = errors.New("category slug already exists")
+	// ErrCategoryCycle is returned when moving a category under itself or one of its subcategories
+	ErrCategoryCycle = errors.New("category cannot be moved under itself or its subcategories")
+	// ErrCategoryHasChildren is returned when deleting a category that still has subcategories
+	ErrCategoryHasChildren = errors.New("category has subcategories")
+	// ErrTagNotFound is returned for unknown tags
+	ErrTagNotFound = errors.New("tag not found")
+	// ErrTagExists is returned when a tag name is already taken
+	ErrTagExists = errors.New("tag already exists")
+)
+
+// PostgreSQL error codes of the constraint violations mapped to the errors above
+const (
+	foreignKeyViolation pq.ErrorCode = "23503"
+	uniqueViolation     pq.ErrorCode = "23505"
+)
+
+// Category groups products. Categories form a tree: rankings of a category
+// include the products of all its subcategories.
+type Category struct {
+	ID   uuid.UUID
+	Slug string
+	Name string
+	// ParentID is nil for top-level categories
+	ParentID  *uuid.UUID
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Tag is a free-form product label
+type Tag struct {
+	ID        uuid.UUID
+	Name      string
+	CreatedAt time.Time
+}
+
+// ProductSlice restricts a ranking to the products of a category, including
+// its subcategories, and to the products carrying a tag. Empty fields do not
+// restrict it.
+type ProductSlice struct {
+	// Category is a category slug
+	Category string
+	// Tag is a tag name
+	Tag string
+}
+
+// TaxonomyStore manages categories, tags and the products they are assigned to
+type TaxonomyStore interface {
+	CreateCategory(ctx context.Context, c *Category) error
+	GetCategory(ctx context.Context, id uuid.UUID) (*Category, error)
+	ListCategories(ctx context.Context) ([]Category, error)
+	// UpdateCategory changes the slug, name and parent of a category
+	UpdateCategory(ctx context.Context, c *Category) error
+	// DeleteCategory removes a category without subcategories, unassigning its products
+	DeleteCategory(ctx context.Context, id uuid.UUID) error
+
+	CreateTag(ctx context.Context, t *Tag) error
+	ListTags(ctx context.Context) ([]Tag, error)
+	UpdateTag(ctx context.Context, t *Tag) error
+	// DeleteTag removes a tag from the catalog and all its products
+	DeleteTag(ctx context.Context, id uuid.UUID) error
+
+	// SetProductCategories replaces the categories of a product
+	SetProductCategories(ctx context.Context, productID uuid.UUID, categoryIDs []uuid.UUID) ([]Category, error)
+	GetProductCategories(ctx context.Context, productID uuid.UUID) ([]Category, error)
+	// SetProductTags replaces the tags of a product, creating the tags that do not exist yet
+	SetProductTags(ctx context.Context, productID uuid.UUID, names []string) ([]Tag, error)
+	GetProductTags(ctx context.Context, productID uuid.UUID) ([]Tag, error)
+}
+
+// NormalizeTag returns the stored form of a tag name: lower case, with runs of
+// white space collapsed into single spaces
+func NormalizeTag(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// isViolation reports whether err is the database rejecting a write for the given constraint violation
+func isViolation(err error, code pq.ErrorCode) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == code
+}
+
+// GetTopProductsInSlice returns the top N products of a slice by raw or, when
+// unique is set, deduplicated view count
+func (r *productRepository) GetTopProductsInSlice(ctx context.Context, slice ProductSlice, limit int, unique, includeArchived bool) ([]Product, error) {
+	var s productSlice
+	if slice.Category != "" {
+		var id uuid.UUID
+		err := r.db.QueryRowContext(ctx, `SELECT id FROM categories WHERE slug = $1`, slice.Category).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrCategoryNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.categoryID = &id
+	}
+	if slice.Tag != "" {
+		var id uuid.UUID
+		err := r.db.QueryRowContext(ctx, `SELECT id FROM tags WHERE name = $1`, NormalizeTag(slice.Tag)).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTagNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.tagID = &id
+	}
+
+	if unique {
+		return r.getTopProducts(ctx, "unique_view_count", limit, includeArchived, s)
+	}
+	return r.getTopProducts(ctx, "view_count", limit, includeArchived, s)
+}
+
+// productSlice is a ProductSlice resolved to IDs; nil IDs do not restrict it
+type productSlice struct {
+	categoryID *uuid.UUID
+	tagID      *uuid.UUID
+}
+
+// conditions returns the conditions restricting the product ID productID to
+// the slice, adding their parameters to args. The category condition expects
+// the slice_categories CTE of with.
+func (s productSlice) conditions(productID string, args *[]any) []string {
+	var conds []string
+	if s.categoryID != nil {
+		conds = append(conds, `EXISTS (
+			SELECT 1 FROM product_categories pc
+			WHERE pc.product_id = `+productID+` AND pc.category_id IN (SELECT id FROM slice_categories)
+		)`)
+	}
+	if s.tagID != nil {
+		*args = append(*args, *s.tagID)
+		conds = append(conds, `EXISTS (
+			SELECT 1 FROM product_tags pt
+			WHERE pt.product_id = `+productID+` AND pt.tag_id = $`+strconv.Itoa(len(*args))+`
+		)`)
+	}
+	return conds
+}
+
+// candidates returns a query of product IDs that includes the top $1
+// products of the slice by the stored count column, among the products
+// matching filter, adding its parameters to args. Slices are read from the
+// rankings of their memberships, which carry the stored counts as of the last
+// counter compaction: each category of the subtree contributes its own top
+// $1, as any product in the top of the slice is in the top of each of its
+// categories. A slice of both a category and a tag walks the category
+// rankings and tests the tag per product.
+func (s productSlice) candidates(column string, filter []string, args *[]any) string {
+	switch {
+	case s.categoryID != nil:
+		conds := append(append([]string{}, filter...), productSlice{tagID: s.tagID}.conditions("pc.product_id", args)...)
+		return `
+			SELECT ranked.product_id
+			FROM slice_categories sc
+			CROSS JOIN LATERAL (
+				SELECT pc.product_id
+				FROM product_categories pc
+				JOIN products ON products.id = pc.product_id
+				WHERE pc.category_id = sc.id AND ` + strings.Join(conds, " AND ") + `
+				ORDER BY pc.` + column + ` DESC
+				LIMIT $1
+			) ranked`
+	case s.tagID != nil:
+		*args = append(*args, *s.tagID)
+		return `
+			SELECT pt.product_id
+			FROM product_tags pt
+			JOIN products ON products.id = pt.product_id
+			WHERE pt.tag_id = $` + strconv.Itoa(len(*args)) + ` AND ` + strings.Join(filter, " AND ") + `
+			ORDER BY pt.` + column + ` DESC
+			LIMIT $1`
+	default:
+		return `SELECT id FROM products WHERE ` + strings.Join(filter, " AND ") + ` ORDER BY ` + column + ` DESC LIMIT $1`
+	}
+}
+
+// with returns the WITH clause the conditions need, adding its parameters to args
+func (s productSlice) with(args *[]any) string {
+	if s.categoryID == nil {
+		return ""
+	}
+	*args = append(*args, *s.categoryID)
+	return `
+		WITH RECURSIVE slice_categories AS (
+			SELECT id FROM categories WHERE id = $` + strconv.Itoa(len(*args)) + `
+			UNION
+			SELECT c.id FROM categories c JOIN slice_categories sc ON c.parent_id = sc.id
+		)`
+}
+
+// CreateCategory creates a category, under its parent if it has one
+func (r *productRepository) CreateCategory(ctx context.Context, c *Category) error {
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO categories (slug, name, parent_id)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at`,
+		c.Slug, c.Name, c.ParentID,
+	).Scan(&c.ID, &c.CreatedAt, &c.UpdatedAt)
+	return categoryWriteError(err)
+}
+
+// categoryWriteError maps the constraint violations of category writes to errors
+func categoryWriteError(err error) error {
+	switch {
+	case isViolation(err, uniqueViolation):
+		return ErrCategoryExists
+	case isViolation(err, foreignKeyViolation):
+		return ErrParentCategoryNotFound
+	}
+	return err
+}
+
+// GetCategory retrieves a category by ID
+func (r *productRepository) GetCategory(ctx context.Context, id uuid.UUID) (*Category, error) {
+	var c Category
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, slug, name, parent_id, created_at, updated_at
+		FROM categories
+		WHERE id = $1`, id,
+	).Scan(&c.ID, &c.Slug, &c.Name, &c.ParentID, &c.CreatedAt, &c.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCategoryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ListCategories returns every category ordered by slug; clients build the
+// tree from the parent IDs
+func (r *productRepository) ListCategories(ctx context.Context) ([]Category, error) {
+	return queryCategories(ctx, r.db, `
+		SELECT id, slug, name, parent_id, created_at, updated_at
+		FROM categories
+		ORDER BY slug`)
+}
+
+// queryCategories runs a query selecting categories
+func queryCategories(ctx context.Context, q queryer, query string, args ...any) ([]Category, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []Category{}
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Slug, &c.Name, &c.ParentID, &c.CreatedAt, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+
+	return categories, rows.Err()
+}
+
+// UpdateCategory changes the slug, name and parent of a category. Category
+// writes are serialized while a category moves, so that two concurrent moves
+// cannot form a cycle the check of each missed.
+func (r *productRepository) UpdateCategory(ctx context.Context, c *Category) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if c.ParentID != nil {
+		if _, err := tx.ExecContext(ctx, `LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+
+		var cycle bool
+		err := tx.QueryRowContext(ctx, `
+			WITH RECURSIVE ancestors AS (
+				SELECT id, parent_id FROM categories WHERE id = $1
+				UNION
+				SELECT c.id, c.parent_id FROM categories c JOIN ancestors a ON c.id = a.parent_id
+			)
+			SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $2)`,
+			*c.ParentID, c.ID,
+		).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrCategoryCycle
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE categories
+		SET slug = $2, name = $3, parent_id = $4
+		WHERE id = $1
+		RETURNING created_at, updated_at`,
+		c.ID, c.Slug, c.Name, c.ParentID,
+	).Scan(&c.CreatedAt, &c.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrCategoryNotFound
+	}
+	if err != nil {
+		return categoryWriteError(err)
+	}
+
+	return tx.Commit()
+}
+
+// DeleteCategory removes a category without subcategories; its products are
+// unassigned from it
+func (r *productRepository) DeleteCategory(ctx context.Context, id uuid.UUID) error {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM categories WHERE id = $1`, id)
+	if isViolation(err, foreignKeyViolation) {
+		return ErrCategoryHasChildren
+	}
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrCategoryNotFound
+	}
+	return nil
+}
+
+// CreateTag creates a tag with the normalized name
+func (r *productRepository) CreateTag(ctx context.Context, t *Tag) error {
+	t.Name = NormalizeTag(t.Name)
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO tags (name)
+		VALUES ($1)
+		RETURNING id, created_at`,
+		t.Name,
+	).Scan(&t.ID, &t.CreatedAt)
+	if isViolation(err, uniqueViolation) {
+		return ErrTagExists
+	}
+	return err
+}
+
+// ListTags returns every tag ordered by name
+func (r *productRepository) ListTags(ctx context.Context) ([]Tag, error) {
+	return queryTags(ctx, r.db, `SELECT id, name, created_at FROM tags ORDER BY name`)
+}
+
+// queryTags runs a query selecting tags
+func queryTags(ctx context.Context, q queryer, query string, args ...any) ([]Tag, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.ID, &t.Name, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+
+	return tags, rows.Err()
+}
+
+// UpdateTag renames a tag
+func (r *productRepository) UpdateTag(ctx context.Context, t *Tag) error {
+	t.Name = NormalizeTag(t.Name)
+	err := r.db.QueryRowContext(ctx, `
+		UPDATE tags SET name = $2
+		WHERE id = $1
+		RETURNING created_at`,
+		t.ID, t.Name,
+	).Scan(&t.CreatedAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrTagNotFound
+	case isViolation(err, uniqueViolation):
+		return ErrTagExists
+	}
+	return err
+}
+
+// DeleteTag removes a tag from the catalog and all its products
+func (r *productRepository) DeleteTag(ctx context.Context, id uuid.UUID) error {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM tags WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrTagNotFound
+	}
+	return nil
+}
+
+// lockProductAssignments locks a product against concurrent replacements of
+// its categories or tags
+func lockProductAssignments(ctx context.Context, tx *sql.Tx, productID uuid.UUID) error {
+	var id uuid.UUID
+	err := tx.QueryRowContext(ctx, `SELECT id FROM products WHERE id = $1 FOR NO KEY UPDATE`, productID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrProductNotFound
+	}
+	return err
+}
+
+// productCategoriesQuery selects the categories of the product $1
+const productCategoriesQuery = `
+	SELECT c.id, c.slug, c.name, c.parent_id, c.created_at, c.updated_at
+	FROM categories c
+	JOIN product_categories pc ON pc.category_id = c.id
+	WHERE pc.product_id = $1
+	ORDER BY c.slug`
+
+// SetProductCategories replaces the categories of a product and returns them
+func (r *productRepository) SetProductCategories(ctx context.Context, productID uuid.UUID, categoryIDs []uuid.UUID) ([]Category, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockProductAssignments(ctx, tx, productID); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM product_categories WHERE product_id = $1`, productID); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(categoryIDs))
+	for _, id := range categoryIDs {
+		ids = append(ids, id.String())
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO product_categories (product_id, category_id)
+		SELECT $1, unnest($2::uuid[])
+		ON CONFLICT DO NOTHING`,
+		productID, pq.Array(ids))
+	if isViolation(err, foreignKeyViolation) {
+		return nil, ErrCategoryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	categories, err := queryCategories(ctx, tx, productCategoriesQuery, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	return categories, tx.Commit()
+}
+
+// GetProductCategories returns the categories a product is assigned to, not
+// including their ancestors
+func (r *productRepository) GetProductCategories(ctx context.Context, productID uuid.UUID) ([]Category, error) {
+	categories, err := queryCategories(ctx, r.db, productCategoriesQuery, productID)
+	if err == nil && len(categories) == 0 {
+		err = r.productExists(ctx, productID)
+	}
+	return categories, err
+}
+
+// productExists returns ErrProductNotFound for unknown products
+func (r *productRepository) productExists(ctx context.Context, productID uuid.UUID) error {
+	var exists bool
+	err := r.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)`, productID).Scan(&exists)
+	if err == nil && !exists {
+		return ErrProductNotFound
+	}
+	return err
+}
+
+// productTagsQuery selects the tags of the product $1
+const productTagsQuery = `
+	SELECT t.id, t.name, t.created_at
+	FROM tags t
+	JOIN product_tags pt ON pt.tag_id = t.id
+	WHERE pt.product_id = $1
+	ORDER BY t.name`
+
+// SetProductTags replaces the tags of a product and returns them. Names are
+// normalized, and the tags that do not exist yet are created.
+func (r *productRepository) SetProductTags(ctx context.Context, productID uuid.UUID, names []string) ([]Tag, error) {
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		if name = NormalizeTag(name); name != "" {
+			normalized = append(normalized, name)
+		}
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockProductAssignments(ctx, tx, productID); err != nil {
+		return nil, err
+	}
+
+	// Create missing tags in name order so that concurrent calls cannot deadlock
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO tags (name)
+		SELECT DISTINCT name FROM unnest($1::text[]) AS name
+		ORDER BY name
+		ON CONFLICT (name) DO NOTHING`,
+		pq.Array(normalized))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM product_tags WHERE product_id = $1`, productID); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO product_tags (product_id, tag_id)
+		SELECT $1, id FROM tags WHERE name = ANY($2::text[])`,
+		productID, pq.Array(normalized))
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := queryTags(ctx, tx, productTagsQuery, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	return tags, tx.Commit()
+}
+
+// GetProductTags returns the tags of a product
+func (r *productRepository) GetProductTags(ctx context.Context, productID uuid.UUID) ([]Tag, error) {
+	tags, err := queryTags(ctx, r.db, productTagsQuery, productID)
+	if err == nil && len(tags) == 0 {
+		err = r.productExists(ctx, productID)
+	}
+	return tags, err
+}
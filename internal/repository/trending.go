@@ -0,0 +1,395 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// trendEpoch is the reference time trend scores are expressed against
+var trendEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ErrTrendRebuildRunning is returned when another rebuild of the trending
+// scores is in progress
+var ErrTrendRebuildRunning = errors.New("a trending score rebuild is already running")
+
+// TrendStore keeps the trending scores in the recorded half-life
+type TrendStore interface {
+	// RecordTrendHalfLife records halfLife as the half-life the trending
+	// scores are kept with unless one is recorded already, and returns the
+	// recorded one
+	RecordTrendHalfLife(ctx context.Context, halfLife time.Duration) (time.Duration, error)
+	// RebuildTrendScores rebuilds the trending scores from the raw view
+	// events with a new half-life and records it
+	RebuildTrendScores(ctx context.Context, halfLife time.Duration) error
+}
+
+// TrendingProduct is a product together with its time-decayed view score
+type TrendingProduct struct {
+	Product
+	Score float64
+}
+
+// trendExponent returns the number of half-lives between the epoch and t
+func trendExponent(t time.Time, halfLife time.Duration) float64 {
+	return t.Sub(trendEpoch).Seconds() / halfLife.Seconds()
+}
+
+// addToTrendScores adds the events to their products' decayed scores, kept in
+// the recorded half-life, or in halfLife until one is recorded. While a rebuild
+// is pending they are added to the rebuilt scores in its half-life as well; the
+// share lock orders the batch against the start and the swap of a rebuild.
+func addToTrendScores(ctx context.Context, tx *sql.Tx, events []*ViewEvent, halfLife time.Duration) error {
+	recorded := halfLife.Seconds()
+	var pending sql.NullFloat64
+	err := tx.QueryRowContext(ctx, `
+		SELECT half_life_seconds, pending_half_life_seconds FROM trend_score_settings FOR SHARE`,
+	).Scan(&recorded, &pending)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if err := upsertTrendScores(ctx, tx, "product_trend_scores", events, recorded); err != nil {
+		return err
+	}
+	if pending.Valid {
+		return upsertTrendScores(ctx, tx, "product_trend_scores_next", events, pending.Float64)
+	}
+	return nil
+}
+
+// upsertTrendScores adds the events to the scores in table. Scores are combined
+// in log space: log2(2^a + 2^b) = max(a, b) + log2(1 + 2^-|a-b|), which is order
+// independent so late events are handled like any other. The events of each
+// product are combined in Go first so that every product is upserted once.
+func upsertTrendScores(ctx context.Context, tx *sql.Tx, table string, events []*ViewEvent, halfLifeSeconds float64) error {
+	halfLife := time.Duration(halfLifeSeconds * float64(time.Second))
+	scores := make(map[uuid.UUID]float64)
+	for _, e := range events {
+		x := trendExponent(e.OccurredAt, halfLife)
+		if s, ok := scores[e.ProductID]; ok {
+			scores[e.ProductID] = logSumExp2(s, x)
+		} else {
+			scores[e.ProductID] = x
+		}
+	}
+
+	ids := make([]string, 0, len(scores))
+	logScores := make([]float64, 0, len(scores))
+	for id, s := range scores {
+		ids = append(ids, id.String())
+		logScores = append(logScores, s)
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO `+table+` AS t (product_id, log_score, updated_at)
+		SELECT s.product_id, s.log_score, CURRENT_TIMESTAMP
+		FROM unnest($1::uuid[], $2::float8[]) AS s(product_id, log_score)
+		ORDER BY s.product_id`+trendScoreConflict,
+		pq.Array(ids), pq.Array(logScores))
+	return err
+}
+
+// trendScoreConflict adds the log score of a row inserted into a trend score
+// table, aliased t, to the one already there
+const trendScoreConflict = `
+		ON CONFLICT (product_id) DO UPDATE
+		SET log_score = GREATEST(t.log_score, EXCLUDED.log_score) +
+		        CASE
+		            -- The smaller term is negligible, and power() would underflow
+		            WHEN abs(t.log_score - EXCLUDED.log_score) > 60 THEN 0
+		            ELSE ln(1 + power(2::float8, -abs(t.log_score - EXCLUDED.log_score))) / ln(2)
+		        END,
+		    updated_at = CURRENT_TIMESTAMP`
+
+// logSumExp2 returns log2(2^a + 2^b) without overflowing
+func logSumExp2(a, b float64) float64 {
+	hi, lo := math.Max(a, b), math.Min(a, b)
+	return hi + math.Log2(1+math.Exp2(lo-hi))
+}
+
+// RecordTrendHalfLife records the half-life of the trending scores on first
+// start. Scores already kept are taken to be in it.
+func (r *productRepository) RecordTrendHalfLife(ctx context.Context, halfLife time.Duration) (time.Duration, error) {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO trend_score_settings (half_life_seconds) VALUES ($1)
+		ON CONFLICT (id) DO NOTHING`,
+		halfLife.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	var recorded float64
+	if err := r.db.QueryRowContext(ctx, `SELECT half_life_seconds FROM trend_score_settings`).Scan(&recorded); err != nil {
+		return 0, err
+	}
+	return time.Duration(recorded * float64(time.Second)), nil
+}
+
+// RebuildTrendScores rebuilds the trending scores into product_trend_scores_next
+// and swaps the tables, without holding up the consumers: the settings row is
+// only locked to start the rebuild and to swap. From the start, batches add
+// their views to both tables; the views recorded before it are summed from
+// view_events in a snapshot taken while no batch is in flight. Views older than
+// VIEW_EVENT_RETENTION are lost, which matters little once they are a few
+// half-lives old.
+func (r *productRepository) RebuildTrendScores(ctx context.Context, halfLife time.Duration) error {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The session lock outlives the transactions below
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, "trend_rebuild").Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return ErrTrendRebuildRunning
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(hashtext($1))`, "trend_rebuild")
+
+	if err := rebuildTrendScores(ctx, r.db, conn, halfLife); err != nil {
+		// Stop the batches adding to scores that will not be swapped in
+		cleanup := context.Background()
+		conn.ExecContext(cleanup, `DROP TABLE IF EXISTS trend_scores_backfill`)
+		r.db.ExecContext(cleanup, `UPDATE trend_score_settings SET pending_half_life_seconds = NULL`)
+		return err
+	}
+	return nil
+}
+
+// rebuildTrendScores runs a rebuild of the trending scores on conn, see
+// RebuildTrendScores
+func rebuildTrendScores(ctx context.Context, db *sql.DB, conn *sql.Conn, halfLife time.Duration) error {
+	if err := startTrendRebuild(ctx, db, conn, halfLife); err != nil {
+		return err
+	}
+
+	// Merge the snapshot into the scores the batches have added since the start
+	_, err := conn.ExecContext(ctx, `
+		INSERT INTO product_trend_scores_next AS t (product_id, log_score, updated_at)
+		SELECT product_id, log_score, CURRENT_TIMESTAMP
+		FROM trend_scores_backfill
+		ORDER BY product_id`+trendScoreConflict)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, `DROP TABLE trend_scores_backfill`); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM trend_score_settings FOR UPDATE`); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		ALTER TABLE product_trend_scores RENAME TO product_trend_scores_swap;
+		ALTER TABLE product_trend_scores_next RENAME TO product_trend_scores;
+		ALTER TABLE product_trend_scores_swap RENAME TO product_trend_scores_next;
+		TRUNCATE product_trend_scores_next`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE trend_score_settings
+		SET half_life_seconds = pending_half_life_seconds, pending_half_life_seconds = NULL,
+		    updated_at = CURRENT_TIMESTAMP`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// startTrendRebuild sets the pending half-life and sums the views recorded
+// before it into trend_scores_backfill, a temporary table of conn. The snapshot
+// is taken while the settings row is locked, after the batches in flight
+// committed and before any later batch does, so each view ends up either in
+// the snapshot or added by its batch.
+func startTrendRebuild(ctx context.Context, db *sql.DB, conn *sql.Conn, halfLife time.Duration) error {
+	start, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer start.Rollback()
+
+	if _, err := start.ExecContext(ctx, `SELECT 1 FROM trend_score_settings FOR UPDATE`); err != nil {
+		return err
+	}
+	// Scores left behind by an interrupted rebuild are discarded
+	if _, err := start.ExecContext(ctx, `TRUNCATE product_trend_scores_next`); err != nil {
+		return err
+	}
+	res, err := start.ExecContext(ctx, `
+		UPDATE trend_score_settings SET pending_half_life_seconds = $1, updated_at = CURRENT_TIMESTAMP`,
+		halfLife.Seconds())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("no trending half-life is recorded yet")
+	}
+
+	snapshot, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return err
+	}
+	defer snapshot.Rollback()
+
+	// The first statement takes the snapshot
+	_, err = snapshot.ExecContext(ctx, `
+		CREATE TEMP TABLE trend_scores_backfill (
+			product_id UUID PRIMARY KEY,
+			log_score DOUBLE PRECISION NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+	if err := start.Commit(); err != nil {
+		return err
+	}
+
+	_, err = snapshot.ExecContext(ctx, `
+		INSERT INTO trend_scores_backfill (product_id, log_score)
+		SELECT product_id, log_score FROM (`+trendScoreSums("")+`) sums`,
+		trendEpoch, halfLife.Seconds())
+	if err != nil {
+		return err
+	}
+	return snapshot.Commit()
+}
+
+// trendScoreSums returns a query of the log score of every product with view
+// events matching filter, a WHERE clause. $1 is the epoch and $2 the half-life
+// in seconds. 2^x is summed relative to each product's largest exponent, as in
+// upsertTrendScores.
+func trendScoreSums(filter string) string {
+	return `
+		SELECT product_id, max(peak) + ln(sum(
+		           CASE WHEN peak - x > 60 THEN 0 ELSE power(2::float8, x - peak) END
+		       )) / ln(2) AS log_score
+		FROM (
+			SELECT product_id, x, max(x) OVER (PARTITION BY product_id) AS peak
+			FROM (
+				SELECT product_id, extract(epoch FROM occurred_at - $1::timestamptz)::float8 / $2 AS x
+				FROM view_events
+				` + filter + `
+			) exponents
+		) scaled
+		GROUP BY product_id`
+}
+
+// rebuildProductTrendScores recomputes the trending scores of products from
+// their view events, in the recorded half-life and in the pending one of a
+// rebuild. As with a rebuild, views older than VIEW_EVENT_RETENTION are lost.
+func rebuildProductTrendScores(ctx context.Context, tx *sql.Tx, productIDs []string) error {
+	var recorded float64
+	var pending sql.NullFloat64
+	err := tx.QueryRowContext(ctx, `
+		SELECT half_life_seconds, pending_half_life_seconds FROM trend_score_settings FOR SHARE`,
+	).Scan(&recorded, &pending)
+	if errors.Is(err, sql.ErrNoRows) {
+		// No instance keeps trending scores
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	halfLives := map[string]float64{"product_trend_scores": recorded}
+	if pending.Valid {
+		halfLives["product_trend_scores_next"] = pending.Float64
+	}
+	for table, halfLife := range halfLives {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE product_id = ANY($1::uuid[])`, pq.Array(productIDs)); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO `+table+` (product_id, log_score, updated_at)
+			SELECT product_id, log_score, CURRENT_TIMESTAMP
+			FROM (`+trendScoreSums("WHERE product_id = ANY($3::uuid[])")+`) sums`,
+			trendEpoch, halfLife, pq.Array(productIDs))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTrendingProducts returns the top N products by time-decayed view score
+// that are not archived. Each view is worth 1 when it happens and half as much
+// every half-life after. Scores are decayed with the recorded half-life, and
+// with halfLife until one is recorded.
+func (r *productRepository) GetTrendingProducts(ctx context.Context, limit int, halfLife time.Duration) ([]TrendingProduct, error) {
+	if limit > 100 {
+		limit = 100 // Enforce max limit
+	}
+
+	// Rank first so that only the top N products are summed with their counter shards
+	query := `
+		WITH trending AS (
+			SELECT t.product_id, t.log_score
+			FROM product_trend_scores t
+			JOIN products a ON a.id = t.product_id AND a.archived_at IS NULL
+			ORDER BY t.log_score DESC, t.product_id
+			LIMIT $1
+		)
+		SELECT p.id, p.name, p.description, p.view_count + c.views, p.unique_view_count + c.unique_views,
+		       p.version, p.archived_at, p.created_at, p.updated_at, t.log_score,
+		       COALESCE((SELECT half_life_seconds FROM trend_score_settings), $2)
+		FROM trending t
+		JOIN products p ON p.id = t.product_id` + shardSums("c", "p.id") + `
+		ORDER BY t.log_score DESC, p.id`
+
+	rows, err := r.db.QueryContext(ctx, query, limit, halfLife.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+
+	var products []TrendingProduct
+	for rows.Next() {
+		var p TrendingProduct
+		var logScore, halfLifeSeconds float64
+		err := rows.Scan(
+			&p.ID,
+			&p.Name,
+			&p.Description,
+			&p.ViewCount,
+			&p.UniqueViewCount,
+			&p.Version,
+			&p.ArchivedAt,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+			&logScore,
+			&halfLifeSeconds,
+		)
+		if err != nil {
+			return nil, err
+		}
+		// Decay the score from the epoch to now
+		p.Score = math.Exp2(logScore - trendExponent(now, time.Duration(halfLifeSeconds*float64(time.Second))))
+		products = append(products, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
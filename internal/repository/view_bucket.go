@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// BucketSize is the granularity of the product_view_buckets table
+const BucketSize = 15 * time.Minute
+
+// ProductPeriodViews is a product together with its views over a time range
+type ProductPeriodViews struct {
+	Product
+	Views       int64
+	UniqueViews int64
+}
+
+// bucketStart returns the start of the bucket a view falls into
+func bucketStart(t time.Time) time.Time {
+	return t.UTC().Truncate(BucketSize)
+}
+
+// addToBuckets adds the events to their products' time buckets in table
+func addToBuckets(ctx context.Context, tx *sql.Tx, table string, events []*ViewEvent, unique map[uuid.UUID]bool) error {
+	type bucketKey struct {
+		productID uuid.UUID
+		start     time.Time
+	}
+
+	buckets := make(map[bucketKey]*ProductCounts)
+	for _, e := range events {
+		k := bucketKey{productID: e.ProductID, start: bucketStart(e.OccurredAt)}
+		b, ok := buckets[k]
+		if !ok {
+			b = &ProductCounts{}
+			buckets[k] = b
+		}
+		b.ViewCount++
+		if unique[e.EventID] {
+			b.UniqueViewCount++
+		}
+	}
+
+	ids := make([]string, 0, len(buckets))
+	starts := make([]string, 0, len(buckets))
+	views := make([]int64, 0, len(buckets))
+	uniqueViews := make([]int64, 0, len(buckets))
+	for k, b := range buckets {
+		ids = append(ids, k.productID.String())
+		starts = append(starts, k.start.Format(time.RFC3339))
+		views = append(views, b.ViewCount)
+		uniqueViews = append(uniqueViews, b.UniqueViewCount)
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO `+table+` AS b (product_id, bucket_start, views, unique_views)
+		SELECT * FROM unnest($1::uuid[], $2::timestamptz[], $3::bigint[], $4::bigint[])
+		ORDER BY 1, 2
+		ON CONFLICT (product_id, bucket_start) DO UPDATE
+		SET views = b.views + EXCLUDED.views,
+		    unique_views = b.unique_views + EXCLUDED.unique_views`,
+		pq.Array(ids), pq.Array(starts), pq.Array(views), pq.Array(uniqueViews))
+	return err
+}
+
+// GetTopViewedProductsInRange returns the top N products that are not archived by views that occurred in [from, to).
+// Bounds are aligned down to BucketSize. When unique is set products are ranked by
+// deduplicated views instead of raw views. Whole days and hours of the range are
+// read from the daily and hourly rollups where they have been materialized.
+func (r *productRepository) GetTopViewedProductsInRange(ctx context.Context, from, to time.Time, limit int, unique bool) ([]ProductPeriodViews, error) {
+	if limit > 100 {
+		limit = 100 // Enforce max limit
+	}
+
+	orderBy := "views"
+	if unique {
+		orderBy = "unique_views"
+	}
+
+	watermark, err := r.rollupWatermark(ctx)
+	if err != nil {
+		return nil, err
+	}
+	segments := planRollups(bucketStart(from), bucketStart(to), watermark, levelDaily)
+	if len(segments) == 0 {
+		return nil, nil
+	}
+	periods, args := rollupQuery(segments, []any{limit}, "")
+
+	// Aggregate the periods first so that only the top N rows are joined with products
+	query := `
+		WITH ranked AS (
+			SELECT product_id, SUM(views) AS views, SUM(unique_views) AS unique_views
+			FROM (
+			` + periods + `
+			) AS periods
+			WHERE NOT EXISTS (
+				SELECT 1 FROM products a WHERE a.id = periods.product_id AND a.archived_at IS NOT NULL
+			)
+			GROUP BY product_id
+			ORDER BY ` + orderBy + ` DESC, product_id
+			LIMIT $1
+		)
+		SELECT p.id, p.name, p.description, p.view_count + s.views, p.unique_view_count + s.unique_views,
+		       p.version, p.archived_at, p.created_at, p.updated_at, ranked.views, ranked.unique_views
+		FROM ranked
+		JOIN products p ON p.id = ranked.product_id` + shardSums("s", "p.id") + `
+		ORDER BY ranked.` + orderBy + ` DESC, p.id`
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var products []ProductPeriodViews
+	for rows.Next() {
+		var p ProductPeriodViews
+		err := rows.Scan(
+			&p.ID,
+			&p.Name,
+			&p.Description,
+			&p.ViewCount,
+			&p.UniqueViewCount,
+			&p.Version,
+			&p.ArchivedAt,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+			&p.Views,
+			&p.UniqueViews,
+		)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return products, nil
+}
@@ -0,0 +1,152 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// CounterStore maintains the sharded view counters
+type CounterStore interface {
+	// CompactViewCounts moves the counts accumulated in the counter shards into
+	// the products table, brings the category and tag memberships up to the
+	// products' counts, and returns the number of shards compacted
+	CompactViewCounts(ctx context.Context) (int64, error)
+}
+
+// shardSums returns a FROM item, named alias, holding the views and
+// unique_views of the product productID that are still in its counter shards.
+// A product's lifetime counts are the counts of its products row plus these.
+func shardSums(alias, productID string) string {
+	return `
+		CROSS JOIN LATERAL (
+			SELECT COALESCE(SUM(view_count), 0) AS views, COALESCE(SUM(unique_view_count), 0) AS unique_views
+			FROM product_view_count_shards
+			WHERE product_id = ` + productID + `
+		) AS ` + alias
+}
+
+// addToCounterShards adds the count deltas of each product to one of its
+// shards, picked at random, and stores the resulting lifetime counts. The
+// products rows are not written, so batches of the same product do not wait
+// for each other unless they pick the same shard.
+func addToCounterShards(ctx context.Context, tx *sql.Tx, deltas map[uuid.UUID]*ProductCounts, shards int, counts map[uuid.UUID]ProductCounts) error {
+	products := make([]uuid.UUID, 0, len(deltas))
+	for id := range deltas {
+		products = append(products, id)
+	}
+	// Upsert in the order of the primary key so that concurrent batches and
+	// compactions cannot deadlock
+	sort.Slice(products, func(i, j int) bool { return bytes.Compare(products[i][:], products[j][:]) < 0 })
+
+	ids := make([]string, 0, len(products))
+	shardIDs := make([]int, 0, len(products))
+	views := make([]int64, 0, len(products))
+	uniqueViews := make([]int64, 0, len(products))
+	for _, id := range products {
+		d := deltas[id]
+		ids = append(ids, id.String())
+		shardIDs = append(shardIDs, rand.IntN(shards))
+		views = append(views, d.ViewCount)
+		uniqueViews = append(uniqueViews, d.UniqueViewCount)
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO product_view_count_shards AS s (product_id, shard, view_count, unique_view_count)
+		SELECT * FROM unnest($1::uuid[], $2::int[], $3::bigint[], $4::bigint[])
+		ON CONFLICT (product_id, shard) DO UPDATE
+		SET view_count = s.view_count + EXCLUDED.view_count,
+		    unique_view_count = s.unique_view_count + EXCLUDED.unique_view_count`,
+		pq.Array(ids), pq.Array(shardIDs), pq.Array(views), pq.Array(uniqueViews))
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT p.id, p.view_count + s.views, p.unique_view_count + s.unique_views
+		FROM products p`+shardSums("s", "p.id")+`
+		WHERE p.id = ANY($1::uuid[])`,
+		pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uuid.UUID
+		var c ProductCounts
+		if err := rows.Scan(&id, &c.ViewCount, &c.UniqueViewCount); err != nil {
+			return err
+		}
+		counts[id] = c
+	}
+
+	return rows.Err()
+}
+
+// CompactViewCounts moves every counter shard into its products row in a
+// single statement, so readers see each product's counts either before or
+// after the move. Shards are locked in the order of the primary key, like
+// views lock them, and views recorded meanwhile wait for the shard they write
+// to and recreate it once the compaction commits.
+//
+// It then copies the stored counts to the memberships that are behind them,
+// whichever way the counts changed, in one statement for both tables, once the
+// shard locks are released. Category and tag rankings lag the stored counts
+// by up to an interval, as the stored counts lag the shards.
+func (r *productRepository) CompactViewCounts(ctx context.Context) (int64, error) {
+	var compacted int64
+	err := r.db.QueryRowContext(ctx, `
+		WITH moved AS (
+			DELETE FROM product_view_count_shards s
+			USING (
+				SELECT product_id, shard FROM product_view_count_shards
+				ORDER BY product_id, shard
+				FOR UPDATE
+			) AS locked
+			WHERE s.product_id = locked.product_id AND s.shard = locked.shard
+			RETURNING s.product_id, s.view_count, s.unique_view_count
+		),
+		totals AS (
+			SELECT product_id, COUNT(*) AS shards,
+			       SUM(view_count) AS views, SUM(unique_view_count) AS unique_views
+			FROM moved
+			GROUP BY product_id
+		),
+		compacted AS (
+			UPDATE products p
+			SET view_count = p.view_count + t.views,
+			    unique_view_count = p.unique_view_count + t.unique_views
+			FROM totals t
+			WHERE p.id = t.product_id
+		)
+		SELECT COALESCE(SUM(shards), 0) FROM totals`).Scan(&compacted)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = r.db.ExecContext(ctx, `
+		WITH categories AS (
+			UPDATE product_categories pc
+			SET view_count = p.view_count, unique_view_count = p.unique_view_count
+			FROM products p
+			WHERE p.id = pc.product_id
+			  AND (pc.view_count <> p.view_count OR pc.unique_view_count <> p.unique_view_count)
+		)
+		UPDATE product_tags pt
+		SET view_count = p.view_count, unique_view_count = p.unique_view_count
+		FROM products p
+		WHERE p.id = pt.product_id
+		  AND (pt.view_count <> p.view_count OR pt.unique_view_count <> p.unique_view_count)`)
+	if err != nil {
+		return compacted, fmt.Errorf("failed to refresh membership counts: %w", err)
+	}
+
+	return compacted, nil
+}
@@ -0,0 +1,543 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ViewEvent represents a single persisted product view
+type ViewEvent struct {
+	EventID     uuid.UUID `db:"event_id"`
+	ProductID   uuid.UUID `db:"product_id"`
+	UserID      string    `db:"user_id"`
+	SessionID   string    `db:"session_id"`
+	Source      string    `db:"source"`
+	DeviceType  string    `db:"device_type"`
+	Referrer    string    `db:"referrer"`
+	UTMSource   string    `db:"utm_source"`
+	UTMMedium   string    `db:"utm_medium"`
+	UTMCampaign string    `db:"utm_campaign"`
+	UTMTerm     string    `db:"utm_term"`
+	UTMContent  string    `db:"utm_content"`
+	OccurredAt  time.Time `db:"occurred_at"`
+
+	// ViewerKey identifies the viewer for deduplication, e.g. "user:42".
+	// Views without a key are always counted as unique.
+	ViewerKey string `db:"-"`
+}
+
+// RecordOptions controls the optional aggregates RecordView and RecordViews maintain
+type RecordOptions struct {
+	// DedupWindow limits the unique view count to one view per viewer, product
+	// and window; zero counts every view as unique
+	DedupWindow time.Duration
+	// TrendHalfLife is the half-life of the trending score; zero skips it
+	TrendHalfLife time.Duration
+	// Offsets are stored in the same transaction as the views when set
+	Offsets *ConsumerOffsets
+	// CounterShards spreads the view count increments of each product over
+	// this many rows of product_view_count_shards instead of updating its
+	// products row; zero updates the products row
+	CounterShards int
+	// SkipArchived reports the events of archived products in
+	// BatchResult.Archived instead of recording them
+	SkipArchived bool
+}
+
+// RecordResult describes the effect of RecordView
+type RecordResult struct {
+	// Duplicate is set when the event had already been recorded and nothing changed
+	Duplicate bool
+	// ViewCount and UniqueViewCount are the product's lifetime counts after the view
+	ViewCount       int64
+	UniqueViewCount int64
+}
+
+// ProductCounts holds a product's lifetime view counts
+type ProductCounts struct {
+	ViewCount       int64
+	UniqueViewCount int64
+}
+
+// BatchResult describes the effect of RecordViews
+type BatchResult struct {
+	// Recorded is the number of events counted by this call
+	Recorded int
+	// Duplicates is the number of events that had already been recorded
+	Duplicates int
+	// NotFound holds the IDs of events skipped because their product does not exist
+	NotFound []uuid.UUID
+	// Archived holds the IDs of events skipped because their product is
+	// archived, when RecordOptions.SkipArchived is set
+	Archived []uuid.UUID
+	// Counts holds the lifetime counts after the batch of every updated product
+	Counts map[uuid.UUID]ProductCounts
+}
+
+// RecordView stores a single view event, see RecordViews
+func (r *productRepository) RecordView(ctx context.Context, v *ViewEvent, opts RecordOptions) (RecordResult, error) {
+	batch, err := r.RecordViews(ctx, []*ViewEvent{v}, opts)
+	if err != nil {
+		return RecordResult{}, err
+	}
+	if len(batch.NotFound) > 0 {
+		return RecordResult{}, ErrProductNotFound
+	}
+	if len(batch.Archived) > 0 {
+		return RecordResult{}, ErrProductArchived
+	}
+
+	counts := batch.Counts[v.ProductID]
+	return RecordResult{
+		Duplicate:       batch.Duplicates > 0,
+		ViewCount:       counts.ViewCount,
+		UniqueViewCount: counts.UniqueViewCount,
+	}, nil
+}
+
+// RecordViews stores view events and updates the products' view counts, time
+// buckets and trending scores in one transaction, issuing a fixed number of
+// statements regardless of the batch size. Redelivered events are recognised by
+// their event ID and not counted twice. Consumer offsets in opts are committed
+// atomically with the views.
+func (r *productRepository) RecordViews(ctx context.Context, events []*ViewEvent, opts RecordOptions) (BatchResult, error) {
+	res := BatchResult{Counts: make(map[uuid.UUID]ProductCounts)}
+	if len(events) == 0 && opts.Offsets == nil {
+		return res, nil
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	// Take the lock the offsets are stored under before any product row, so
+	// that a replay swap, which locks consumer_offsets and then the products it
+	// adjusts, blocks the batch before it holds anything the swap waits for
+	if opts.Offsets != nil {
+		if _, err := tx.ExecContext(ctx, `LOCK TABLE consumer_offsets IN ROW EXCLUSIVE MODE`); err != nil {
+			return res, err
+		}
+	}
+
+	// Lock the products in a stable order so that concurrent batches cannot
+	// deadlock and updates to the same product are serialised. Sharded counts
+	// leave the products rows alone, and only need them to keep existing.
+	existing, archived, err := lockProducts(ctx, tx, events, opts.CounterShards > 0)
+	if err != nil {
+		return res, err
+	}
+
+	seen := make(map[uuid.UUID]bool, len(events))
+	candidates := make([]*ViewEvent, 0, len(events))
+	for _, e := range events {
+		switch {
+		case !existing[e.ProductID]:
+			res.NotFound = append(res.NotFound, e.EventID)
+		case opts.SkipArchived && archived[e.ProductID]:
+			res.Archived = append(res.Archived, e.EventID)
+		case seen[e.EventID]:
+			res.Duplicates++
+		default:
+			seen[e.EventID] = true
+			candidates = append(candidates, e)
+		}
+	}
+
+	inserted, err := insertViewEvents(ctx, tx, candidates)
+	if err != nil {
+		return res, err
+	}
+
+	fresh := make([]*ViewEvent, 0, len(inserted))
+	for _, e := range candidates {
+		if inserted[e.EventID] {
+			fresh = append(fresh, e)
+		}
+	}
+	res.Duplicates += len(candidates) - len(fresh)
+	res.Recorded = len(fresh)
+
+	if len(fresh) > 0 {
+		if err := recordAggregates(ctx, tx, fresh, opts, res.Counts); err != nil {
+			return res, err
+		}
+	}
+
+	// Skipped events are dead-lettered after the commit; until then their
+	// messages must stay ahead of the stored offsets
+	offsets := opts.Offsets
+	if offsets != nil {
+		var skipped []PartitionOffset
+		for _, id := range append(res.NotFound, res.Archived...) {
+			skipped = append(skipped, offsets.Positions[id]...)
+		}
+		offsets = offsets.StopAt(skipped)
+	}
+	if err := saveConsumerOffsets(ctx, tx, offsets); err != nil {
+		return res, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return BatchResult{}, err
+	}
+
+	return res, nil
+}
+
+// recordAggregates updates the counts, buckets and trending scores of newly recorded events
+func recordAggregates(ctx context.Context, tx *sql.Tx, events []*ViewEvent, opts RecordOptions, counts map[uuid.UUID]ProductCounts) error {
+	unique, err := markViewersCounted(ctx, tx, "view_dedup", events, opts.DedupWindow)
+	if err != nil {
+		return err
+	}
+
+	if err := incrementCounts(ctx, tx, events, unique, opts.CounterShards, counts); err != nil {
+		return err
+	}
+
+	if err := addToBuckets(ctx, tx, "product_view_buckets", events, unique); err != nil {
+		return err
+	}
+
+	if opts.TrendHalfLife > 0 {
+		if err := addToTrendScores(ctx, tx, events, opts.TrendHalfLife); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lockProducts locks the rows of the events' products and returns the IDs that
+// exist and those that are archived. A shared lock only keeps the products from
+// being deleted and lets other batches take it too.
+func lockProducts(ctx context.Context, tx *sql.Tx, events []*ViewEvent, shared bool) (existing, archived map[uuid.UUID]bool, err error) {
+	ids := make([]string, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.ProductID.String())
+	}
+
+	mode := "FOR NO KEY UPDATE"
+	if shared {
+		mode = "FOR KEY SHARE"
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, archived_at IS NOT NULL FROM products
+		WHERE id = ANY($1::uuid[])
+		ORDER BY id
+		`+mode, pq.Array(ids))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	existing = make(map[uuid.UUID]bool)
+	archived = make(map[uuid.UUID]bool)
+	for rows.Next() {
+		var id uuid.UUID
+		var isArchived bool
+		if err := rows.Scan(&id, &isArchived); err != nil {
+			return nil, nil, err
+		}
+		existing[id] = true
+		archived[id] = isArchived
+	}
+
+	return existing, archived, rows.Err()
+}
+
+// viewEventColumns are the columns of view_events written by the consumer
+var viewEventColumns = []string{
+	"event_id", "product_id", "user_id", "session_id", "source", "device_type", "referrer",
+	"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content", "occurred_at",
+}
+
+// insertViewEvents inserts the events and returns the IDs of those that were
+// not stored yet. The events are streamed with COPY into a transaction-scoped
+// staging table, since COPY itself cannot skip rows that already exist, and
+// moved into view_events from there.
+func insertViewEvents(ctx context.Context, tx *sql.Tx, events []*ViewEvent) (map[uuid.UUID]bool, error) {
+	inserted := make(map[uuid.UUID]bool, len(events))
+	if len(events) == 0 {
+		return inserted, nil
+	}
+
+	if err := stageViewEvents(ctx, tx, events); err != nil {
+		return nil, err
+	}
+
+	// An event outside every partition fails with a check violation, which
+	// IsInvalidData reports like any other rejected row
+	rows, err := tx.QueryContext(ctx, `
+		INSERT INTO view_events (
+			event_id, product_id, user_id, session_id, source, device_type, referrer,
+			utm_source, utm_medium, utm_campaign, utm_term, utm_content, occurred_at
+		)
+		SELECT event_id, product_id, user_id, session_id, source, device_type, referrer,
+		       utm_source, utm_medium, utm_campaign, utm_term, utm_content, occurred_at
+		FROM view_events_staging
+		ON CONFLICT (event_id, occurred_at) DO NOTHING
+		RETURNING event_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		inserted[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Empty the staging table for the next batch of this transaction
+	if _, err := tx.ExecContext(ctx, `TRUNCATE view_events_staging`); err != nil {
+		return nil, err
+	}
+
+	return inserted, nil
+}
+
+// stageViewEvents streams the events with COPY into view_events_staging, a
+// transaction-scoped staging table. Callers empty it once they moved the rows.
+func stageViewEvents(ctx context.Context, tx *sql.Tx, events []*ViewEvent) error {
+	// The staging table lives as long as the session, its rows only until commit
+	_, err := tx.ExecContext(ctx, `
+		CREATE TEMP TABLE IF NOT EXISTS view_events_staging (
+			event_id UUID NOT NULL,
+			product_id UUID NOT NULL,
+			user_id VARCHAR(255),
+			session_id VARCHAR(255),
+			source VARCHAR(32),
+			device_type VARCHAR(32),
+			referrer TEXT,
+			utm_source VARCHAR(255),
+			utm_medium VARCHAR(255),
+			utm_campaign VARCHAR(255),
+			utm_term VARCHAR(255),
+			utm_content VARCHAR(255),
+			occurred_at TIMESTAMP WITH TIME ZONE NOT NULL
+		) ON COMMIT DELETE ROWS`)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("view_events_staging", viewEventColumns...))
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		// Empty strings stand for missing optional dimensions
+		_, err := stmt.ExecContext(ctx,
+			e.EventID.String(), e.ProductID.String(), nullString(e.UserID), nullString(e.SessionID),
+			nullString(e.Source), nullString(e.DeviceType), nullString(e.Referrer),
+			nullString(e.UTMSource), nullString(e.UTMMedium), nullString(e.UTMCampaign),
+			nullString(e.UTMTerm), nullString(e.UTMContent), e.OccurredAt,
+		)
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
+// nullString maps an empty string to NULL
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// viewerKey identifies a viewer of a product for deduplication
+type viewerKey struct {
+	productID uuid.UUID
+	viewer    string
+}
+
+// markViewersCounted decides which events count towards the unique view count and
+// records in table when each viewer was last counted. A view is unique when the
+// viewer was not counted for the product within the window before it.
+func markViewersCounted(ctx context.Context, tx *sql.Tx, table string, events []*ViewEvent, window time.Duration) (map[uuid.UUID]bool, error) {
+	unique := make(map[uuid.UUID]bool, len(events))
+
+	groups := make(map[viewerKey][]*ViewEvent)
+	for _, e := range events {
+		if window <= 0 || e.ViewerKey == "" {
+			unique[e.EventID] = true
+			continue
+		}
+		k := viewerKey{productID: e.ProductID, viewer: e.ViewerKey}
+		groups[k] = append(groups[k], e)
+	}
+	if len(groups) == 0 {
+		return unique, nil
+	}
+
+	productIDs := make([]string, 0, len(groups))
+	viewers := make([]string, 0, len(groups))
+	for k := range groups {
+		productIDs = append(productIDs, k.productID.String())
+		viewers = append(viewers, k.viewer)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT d.product_id, d.viewer_key, d.counted_at
+		FROM `+table+` d
+		JOIN unnest($1::uuid[], $2::text[]) AS k(product_id, viewer_key)
+		  ON d.product_id = k.product_id AND d.viewer_key = k.viewer_key`,
+		pq.Array(productIDs), pq.Array(viewers))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lastCounted := make(map[viewerKey]time.Time, len(groups))
+	for rows.Next() {
+		var k viewerKey
+		var countedAt time.Time
+		if err := rows.Scan(&k.productID, &k.viewer, &countedAt); err != nil {
+			return nil, err
+		}
+		lastCounted[k] = countedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	productIDs, viewers = productIDs[:0], viewers[:0]
+	var countedAt []string
+	for k, group := range groups {
+		sort.Slice(group, func(i, j int) bool { return group[i].OccurredAt.Before(group[j].OccurredAt) })
+
+		last, ok := lastCounted[k]
+		changed := false
+		for _, e := range group {
+			if ok && e.OccurredAt.Before(last.Add(window)) {
+				continue
+			}
+			unique[e.EventID] = true
+			last, ok, changed = e.OccurredAt, true, true
+		}
+
+		if changed {
+			productIDs = append(productIDs, k.productID.String())
+			viewers = append(viewers, k.viewer)
+			countedAt = append(countedAt, last.Format(time.RFC3339Nano))
+		}
+	}
+	if len(countedAt) == 0 {
+		return unique, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO `+table+` AS d (product_id, viewer_key, counted_at)
+		SELECT * FROM unnest($1::uuid[], $2::text[], $3::timestamptz[])
+		ORDER BY 1, 2
+		ON CONFLICT (product_id, viewer_key) DO UPDATE
+		SET counted_at = GREATEST(d.counted_at, EXCLUDED.counted_at)`,
+		pq.Array(productIDs), pq.Array(viewers), pq.Array(countedAt))
+	if err != nil {
+		return nil, err
+	}
+
+	return unique, nil
+}
+
+// incrementCounts adds the events to their products' lifetime counts with a single
+// multi-row update, of the products or of their counter shards when shards is
+// positive, and stores the resulting counts
+func incrementCounts(ctx context.Context, tx *sql.Tx, events []*ViewEvent, unique map[uuid.UUID]bool, shards int, counts map[uuid.UUID]ProductCounts) error {
+	deltas := make(map[uuid.UUID]*ProductCounts)
+	for _, e := range events {
+		d, ok := deltas[e.ProductID]
+		if !ok {
+			d = &ProductCounts{}
+			deltas[e.ProductID] = d
+		}
+		d.ViewCount++
+		if unique[e.EventID] {
+			d.UniqueViewCount++
+		}
+	}
+	if shards > 0 {
+		return addToCounterShards(ctx, tx, deltas, shards, counts)
+	}
+
+	ids := make([]string, 0, len(deltas))
+	views := make([]int64, 0, len(deltas))
+	uniqueViews := make([]int64, 0, len(deltas))
+	for id, d := range deltas {
+		ids = append(ids, id.String())
+		views = append(views, d.ViewCount)
+		uniqueViews = append(uniqueViews, d.UniqueViewCount)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE products p
+		SET view_count = p.view_count + d.views,
+		    unique_view_count = p.unique_view_count + d.unique_views
+		FROM unnest($1::uuid[], $2::bigint[], $3::bigint[]) AS d(id, views, unique_views)
+		WHERE p.id = d.id
+		RETURNING p.id, p.view_count, p.unique_view_count`,
+		pq.Array(ids), pq.Array(views), pq.Array(uniqueViews))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uuid.UUID
+		var c ProductCounts
+		if err := rows.Scan(&id, &c.ViewCount, &c.UniqueViewCount); err != nil {
+			return err
+		}
+		counts[id] = c
+	}
+
+	return rows.Err()
+}
+
+// IsInvalidData reports whether err is the database rejecting the data written,
+// such as an out-of-range value, which no retry of the same data can fix
+func IsInvalidData(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	// Class 22 is data exceptions, class 23 integrity constraint violations
+	class := pqErr.Code.Class()
+	return class == "22" || class == "23"
+}
+
+// DedupStore expires the entries that deduplicate views within the dedup window
+type DedupStore interface {
+	// PurgeViewDedup removes dedup entries counted before the given time
+	PurgeViewDedup(ctx context.Context, before time.Time) (int64, error)
+}
+
+// PurgeViewDedup removes dedup entries counted before the given time
+func (r *productRepository) PurgeViewDedup(ctx context.Context, before time.Time) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM view_dedup WHERE counted_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
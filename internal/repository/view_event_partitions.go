@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// viewEventPartitionPrefix starts the name of each daily view_events
+// partition, followed by its UTC day, e.g. view_events_p20240131
+const viewEventPartitionPrefix = "view_events_p"
+
+// viewEventPartitionLock serialises partition maintenance across consumers
+const viewEventPartitionLock = "view_events_partitions"
+
+// PartitionChanges lists the view_events partitions created and dropped by
+// MaintainViewEventPartitions
+type PartitionChanges struct {
+	Created []string
+	Dropped []string
+}
+
+// ViewEventStore manages the daily partitions of the raw view event table
+type ViewEventStore interface {
+	// MaintainViewEventPartitions creates the partitions of the days from now
+	// to ahead days later and drops the partitions that end retention or more
+	// before now, adding their views to the products' expired event views. A
+	// zero retention keeps every partition.
+	MaintainViewEventPartitions(ctx context.Context, now time.Time, ahead int, retention time.Duration) (PartitionChanges, error)
+}
+
+// MaintainViewEventPartitions creates missing future partitions and drops
+// expired ones in a single transaction
+func (r *productRepository) MaintainViewEventPartitions(ctx context.Context, now time.Time, ahead int, retention time.Duration) (PartitionChanges, error) {
+	var changes PartitionChanges
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return changes, err
+	}
+	defer tx.Rollback()
+
+	// Concurrent consumers would otherwise race to create the same partition
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, viewEventPartitionLock); err != nil {
+		return changes, err
+	}
+
+	existing, err := viewEventPartitions(ctx, tx)
+	if err != nil {
+		return changes, err
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	for i := 0; i <= ahead; i++ {
+		day := today.AddDate(0, 0, i)
+		name := viewEventPartitionName(day)
+		if _, ok := existing[name]; ok {
+			continue
+		}
+		// DDL takes no parameters; the bounds are formatted timestamps
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(
+			`CREATE TABLE %s PARTITION OF view_events FOR VALUES FROM ('%s') TO ('%s')`,
+			pq.QuoteIdentifier(name), day.Format(time.RFC3339), day.AddDate(0, 0, 1).Format(time.RFC3339)))
+		if err != nil {
+			return changes, fmt.Errorf("failed to create partition %s: %w", name, err)
+		}
+		changes.Created = append(changes.Created, name)
+	}
+
+	if retention > 0 {
+		cutoff := now.Add(-retention)
+		names := make([]string, 0, len(existing))
+		for name := range existing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if existing[name].AddDate(0, 0, 1).After(cutoff) {
+				continue
+			}
+			// Keep the dropped views for reconciliation against raw events
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO product_view_baselines (product_id, expired_event_views)
+				SELECT product_id, COUNT(*) FROM `+pq.QuoteIdentifier(name)+` GROUP BY product_id
+				ON CONFLICT (product_id) DO UPDATE
+				SET expired_event_views = product_view_baselines.expired_event_views + EXCLUDED.expired_event_views`)
+			if err != nil {
+				return changes, fmt.Errorf("failed to count the views of partition %s: %w", name, err)
+			}
+			if _, err := tx.ExecContext(ctx, `DROP TABLE `+pq.QuoteIdentifier(name)); err != nil {
+				return changes, fmt.Errorf("failed to drop partition %s: %w", name, err)
+			}
+			changes.Dropped = append(changes.Dropped, name)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return PartitionChanges{}, err
+	}
+
+	return changes, nil
+}
+
+// viewEventPartitions returns the daily partitions of view_events by name,
+// with the day each one holds. Partitions not named by day are left out.
+func viewEventPartitions(ctx context.Context, tx *sql.Tx) (map[string]time.Time, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT c.relname
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'view_events'::regclass`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := make(map[string]time.Time)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		day, err := time.Parse("20060102", strings.TrimPrefix(name, viewEventPartitionPrefix))
+		if err != nil || !strings.HasPrefix(name, viewEventPartitionPrefix) {
+			continue
+		}
+		partitions[name] = day
+	}
+
+	return partitions, rows.Err()
+}
+
+// viewEventPartitionName names the partition holding the given UTC day
+func viewEventPartitionName(day time.Time) string {
+	return viewEventPartitionPrefix + day.Format("20060102")
+}
@@ -0,0 +1,537 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrNoReplay is returned when no view replay has been started
+var ErrNoReplay = errors.New("no view replay in progress")
+
+// ReplayState describes the view replay in progress
+type ReplayState struct {
+	// GroupID and Topic identify the live consumer the replay catches up with
+	GroupID string
+	Topic   string
+	// Since is the cut-off: views that occurred before it keep their live counts
+	Since     time.Time
+	StartedAt time.Time
+	// Starts and Positions hold the first and the next offset to replay by partition
+	Starts    map[int32]int64
+	Positions map[int32]int64
+}
+
+// ReplayDiff compares a product's views since the cut-off, as counted live
+// and as replayed
+type ReplayDiff struct {
+	ProductID         uuid.UUID
+	LiveViews         int64
+	ReplayViews       int64
+	LiveUniqueViews   int64
+	ReplayUniqueViews int64
+}
+
+// ReplayReport compares the replayed views since the cut-off with the live ones
+type ReplayReport struct {
+	Since             time.Time
+	LiveViews         int64
+	ReplayViews       int64
+	LiveUniqueViews   int64
+	ReplayUniqueViews int64
+	// ChangedProducts is the number of products whose counts a swap changes
+	ChangedProducts int
+	// Largest lists the products with the largest changes in views
+	Largest []ReplayDiff
+}
+
+// Change returns the relative change in total views a swap makes
+func (r ReplayReport) Change() float64 {
+	diff := r.ReplayViews - r.LiveViews
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) / float64(max(r.LiveViews, 1))
+}
+
+// ReplayStore keeps the shadow state of a view replay. A replay recomputes the
+// views that occurred since a cut-off time from the topic into shadow tables
+// while the live consumer keeps running, and swaps them in once it has caught
+// up with the live consumer's stored offsets.
+type ReplayStore interface {
+	OffsetStore
+	// StartReplay discards any previous replay and starts a new one reading
+	// each partition from the given offset. since is aligned down to BucketSize.
+	StartReplay(ctx context.Context, groupID, topic string, since time.Time, starts map[int32]int64) error
+	// LoadReplay returns the replay in progress, or ErrNoReplay
+	LoadReplay(ctx context.Context) (*ReplayState, error)
+	// RecordReplayViews adds events to the shadow tables and advances the
+	// replay's positions, in one transaction
+	RecordReplayViews(ctx context.Context, events []*ViewEvent, positions map[int32]int64, dedupWindow time.Duration) error
+	// ReplayReport compares the shadow tables with the live ones, listing up
+	// to limit products with the largest changes
+	ReplayReport(ctx context.Context, limit int) (ReplayReport, error)
+	// BeginReplaySwap blocks the live consumer and returns the swap holding
+	// it. It fails with ErrTrendRebuildRunning during a rebuild of the
+	// trending scores.
+	BeginReplaySwap(ctx context.Context) (ReplaySwap, error)
+}
+
+// ReplaySwap is an open transaction that blocks the live consumer, so that
+// the replay can catch up with its final positions and replace the live
+// counts atomically. It locks consumer_offsets, which the consumer's batches
+// take first, and the rows it adjusts; API reads and product writes go on.
+type ReplaySwap interface {
+	// Live returns the live consumer's next offsets, which cannot move while
+	// the swap is open
+	Live() map[int32]int64
+	RecordViews(ctx context.Context, events []*ViewEvent, positions map[int32]int64, dedupWindow time.Duration) error
+	Report(ctx context.Context, limit int) (ReplayReport, error)
+	// Commit replaces the live buckets, dedup entries, raw view events and
+	// counts since the cut-off with the replayed ones, rebuilds the trending
+	// scores of the products whose views changed and ends the replay
+	Commit(ctx context.Context) error
+	Rollback() error
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// StartReplay resets the shadow tables and records the replay's starting point
+func (r *productRepository) StartReplay(ctx context.Context, groupID, topic string, since time.Time, starts map[int32]int64) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		TRUNCATE view_replay, view_replay_positions, view_replay_events, view_replay_dedup, view_replay_buckets`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO view_replay (group_id, topic, since) VALUES ($1, $2, $3)`,
+		groupID, topic, bucketStart(since))
+	if err != nil {
+		return err
+	}
+
+	partitions, offsets := make([]int32, 0, len(starts)), make([]int64, 0, len(starts))
+	for p, offset := range starts {
+		partitions = append(partitions, p)
+		offsets = append(offsets, offset)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO view_replay_positions (partition, start_offset, next_offset)
+		SELECT p, o, o FROM unnest($1::integer[], $2::bigint[]) AS s(p, o)`,
+		pq.Array(partitions), pq.Array(offsets))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LoadReplay returns the state of the replay in progress
+func (r *productRepository) LoadReplay(ctx context.Context) (*ReplayState, error) {
+	return loadReplay(ctx, r.db)
+}
+
+func loadReplay(ctx context.Context, q queryer) (*ReplayState, error) {
+	state := &ReplayState{Starts: make(map[int32]int64), Positions: make(map[int32]int64)}
+	err := q.QueryRowContext(ctx, `
+		SELECT group_id, topic, since, started_at FROM view_replay`).Scan(
+		&state.GroupID, &state.Topic, &state.Since, &state.StartedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoReplay
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.QueryContext(ctx, `
+		SELECT partition, start_offset, next_offset FROM view_replay_positions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var partition int32
+		var start, next int64
+		if err := rows.Scan(&partition, &start, &next); err != nil {
+			return nil, err
+		}
+		state.Starts[partition] = start
+		state.Positions[partition] = next
+	}
+
+	return state, rows.Err()
+}
+
+// RecordReplayViews records a batch of replayed events
+func (r *productRepository) RecordReplayViews(ctx context.Context, events []*ViewEvent, positions map[int32]int64, dedupWindow time.Duration) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordReplayViews(ctx, tx, events, positions, dedupWindow); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// recordReplayViews counts the events that occurred since the cut-off into the
+// shadow tables, as RecordViews counts them into the live ones. Views of
+// unknown products and events already replayed are skipped.
+func recordReplayViews(ctx context.Context, tx *sql.Tx, events []*ViewEvent, positions map[int32]int64, dedupWindow time.Duration) error {
+	var since time.Time
+	if err := tx.QueryRowContext(ctx, `SELECT since FROM view_replay`).Scan(&since); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoReplay
+		}
+		return err
+	}
+
+	seen := make(map[uuid.UUID]bool, len(events))
+	candidates := make([]*ViewEvent, 0, len(events))
+	for _, e := range events {
+		if e.OccurredAt.Before(since) || seen[e.EventID] {
+			continue
+		}
+		seen[e.EventID] = true
+		candidates = append(candidates, e)
+	}
+
+	if len(candidates) > 0 {
+		if err := stageViewEvents(ctx, tx, candidates); err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, `
+			INSERT INTO view_replay_events (
+				event_id, product_id, user_id, session_id, source, device_type, referrer,
+				utm_source, utm_medium, utm_campaign, utm_term, utm_content, occurred_at
+			)
+			SELECT event_id, product_id, user_id, session_id, source, device_type, referrer,
+			       utm_source, utm_medium, utm_campaign, utm_term, utm_content, occurred_at
+			FROM view_events_staging s
+			WHERE EXISTS (SELECT 1 FROM products p WHERE p.id = s.product_id)
+			ON CONFLICT (event_id, occurred_at) DO NOTHING
+			RETURNING event_id`)
+		if err != nil {
+			return err
+		}
+		inserted := make(map[uuid.UUID]bool, len(candidates))
+		for rows.Next() {
+			var id uuid.UUID
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			inserted[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `TRUNCATE view_events_staging`); err != nil {
+			return err
+		}
+
+		fresh := make([]*ViewEvent, 0, len(inserted))
+		for _, e := range candidates {
+			if inserted[e.EventID] {
+				fresh = append(fresh, e)
+			}
+		}
+		if len(fresh) > 0 {
+			unique, err := markViewersCounted(ctx, tx, "view_replay_dedup", fresh, dedupWindow)
+			if err != nil {
+				return err
+			}
+			if err := addToBuckets(ctx, tx, "view_replay_buckets", fresh, unique); err != nil {
+				return err
+			}
+		}
+	}
+
+	partitions, offsets := make([]int32, 0, len(positions)), make([]int64, 0, len(positions))
+	for p, offset := range positions {
+		partitions = append(partitions, p)
+		offsets = append(offsets, offset)
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE view_replay_positions rp
+		SET next_offset = GREATEST(rp.next_offset, p.next_offset)
+		FROM unnest($1::integer[], $2::bigint[]) AS p(partition, next_offset)
+		WHERE rp.partition = p.partition`,
+		pq.Array(partitions), pq.Array(offsets))
+	return err
+}
+
+// ReplayReport compares the replay with the live counts as they are now
+func (r *productRepository) ReplayReport(ctx context.Context, limit int) (ReplayReport, error) {
+	state, err := r.LoadReplay(ctx)
+	if err != nil {
+		return ReplayReport{}, err
+	}
+	return replayReport(ctx, r.db, state.Since, limit)
+}
+
+func replayReport(ctx context.Context, q queryer, since time.Time, limit int) (ReplayReport, error) {
+	report := ReplayReport{Since: since}
+
+	err := q.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COALESCE(SUM(views), 0) FROM product_view_buckets WHERE bucket_start >= $1),
+			(SELECT COALESCE(SUM(views), 0) FROM view_replay_buckets),
+			(SELECT COALESCE(SUM(unique_views), 0) FROM product_view_buckets WHERE bucket_start >= $1),
+			(SELECT COALESCE(SUM(unique_views), 0) FROM view_replay_buckets)`, since).Scan(
+		&report.LiveViews, &report.ReplayViews, &report.LiveUniqueViews, &report.ReplayUniqueViews)
+	if err != nil {
+		return report, err
+	}
+
+	rows, err := q.QueryContext(ctx, `
+		WITH live AS (
+			SELECT product_id, SUM(views) AS views, SUM(unique_views) AS unique_views
+			FROM product_view_buckets
+			WHERE bucket_start >= $1
+			GROUP BY product_id
+		), replay AS (
+			SELECT product_id, SUM(views) AS views, SUM(unique_views) AS unique_views
+			FROM view_replay_buckets
+			GROUP BY product_id
+		)
+		SELECT product_id,
+		       COALESCE(live.views, 0), COALESCE(replay.views, 0),
+		       COALESCE(live.unique_views, 0), COALESCE(replay.unique_views, 0),
+		       COUNT(*) OVER ()
+		FROM live FULL JOIN replay USING (product_id)
+		WHERE COALESCE(live.views, 0) <> COALESCE(replay.views, 0)
+		   OR COALESCE(live.unique_views, 0) <> COALESCE(replay.unique_views, 0)
+		ORDER BY ABS(COALESCE(replay.views, 0) - COALESCE(live.views, 0)) DESC, product_id
+		LIMIT $2`, since, limit)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d ReplayDiff
+		if err := rows.Scan(&d.ProductID, &d.LiveViews, &d.ReplayViews, &d.LiveUniqueViews, &d.ReplayUniqueViews, &report.ChangedProducts); err != nil {
+			return report, err
+		}
+		report.Largest = append(report.Largest, d)
+	}
+
+	return report, rows.Err()
+}
+
+// replaySwap holds the transaction of a swap
+type replaySwap struct {
+	tx    *sql.Tx
+	since time.Time
+	live  map[int32]int64
+}
+
+// BeginReplaySwap locks out the live consumer and loads its final positions.
+// Its batches lock consumer_offsets before anything else, which the EXCLUSIVE
+// lock blocks, so the swap never waits on product rows they hold.
+func (r *productRepository) BeginReplaySwap(ctx context.Context) (ReplaySwap, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := beginReplaySwap(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return s, nil
+}
+
+func beginReplaySwap(ctx context.Context, tx *sql.Tx) (*replaySwap, error) {
+	// A trending score rebuild would merge views from before the swap into
+	// the scores it rebuilds
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock(hashtext($1))`, "trend_rebuild").Scan(&locked); err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrTrendRebuildRunning
+	}
+
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE consumer_offsets IN EXCLUSIVE MODE`); err != nil {
+		return nil, err
+	}
+
+	state, err := loadReplay(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT partition, next_offset FROM consumer_offsets
+		WHERE group_id = $1 AND topic = $2`, state.GroupID, state.Topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	live := make(map[int32]int64)
+	for rows.Next() {
+		var partition int32
+		var offset int64
+		if err := rows.Scan(&partition, &offset); err != nil {
+			return nil, err
+		}
+		live[partition] = offset
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &replaySwap{tx: tx, since: state.Since, live: live}, nil
+}
+
+func (s *replaySwap) Live() map[int32]int64 {
+	return s.live
+}
+
+func (s *replaySwap) RecordViews(ctx context.Context, events []*ViewEvent, positions map[int32]int64, dedupWindow time.Duration) error {
+	return recordReplayViews(ctx, s.tx, events, positions, dedupWindow)
+}
+
+func (s *replaySwap) Report(ctx context.Context, limit int) (ReplayReport, error) {
+	return replayReport(ctx, s.tx, s.since, limit)
+}
+
+func (s *replaySwap) Commit(ctx context.Context) error {
+	// Replace each product's live views since the cut-off with the replayed ones
+	_, err := s.tx.ExecContext(ctx, `
+		UPDATE products p
+		SET view_count = p.view_count + d.views,
+		    unique_view_count = p.unique_view_count + d.unique_views
+		FROM (
+			SELECT product_id, SUM(views) AS views, SUM(unique_views) AS unique_views
+			FROM (
+				SELECT product_id, views, unique_views FROM view_replay_buckets
+				UNION ALL
+				SELECT product_id, -views, -unique_views FROM product_view_buckets WHERE bucket_start >= $1
+			) AS changes
+			GROUP BY product_id
+		) AS d
+		WHERE p.id = d.product_id AND (d.views <> 0 OR d.unique_views <> 0)`, s.since)
+	if err != nil {
+		return fmt.Errorf("failed to update view counts: %w", err)
+	}
+
+	if err := s.replaceViewEvents(ctx); err != nil {
+		return fmt.Errorf("failed to swap replayed view events: %w", err)
+	}
+
+	steps := []struct {
+		query string
+		args  []any
+	}{
+		// Keep the rollup job from raising its watermark past the cut-off meanwhile
+		{`SELECT pg_advisory_xact_lock(hashtext($1))`, []any{viewRollupLock}},
+		{`DELETE FROM product_view_buckets WHERE bucket_start >= $1`, []any{s.since}},
+		{`INSERT INTO product_view_buckets (product_id, bucket_start, views, unique_views)
+		  SELECT b.product_id, b.bucket_start, b.views, b.unique_views
+		  FROM view_replay_buckets b JOIN products p ON p.id = b.product_id`, nil},
+		{`DELETE FROM view_dedup WHERE counted_at >= $1`, []any{s.since}},
+		{`INSERT INTO view_dedup (product_id, viewer_key, counted_at)
+		  SELECT d.product_id, d.viewer_key, d.counted_at
+		  FROM view_replay_dedup d
+		  WHERE EXISTS (SELECT 1 FROM products p WHERE p.id = d.product_id)
+		  ON CONFLICT (product_id, viewer_key) DO UPDATE SET counted_at = EXCLUDED.counted_at`, nil},
+		// Have the rollup job aggregate the replaced hours again
+		{`UPDATE rollup_watermarks
+		  SET materialized_until = LEAST(materialized_until, $1), updated_at = CURRENT_TIMESTAMP`,
+			[]any{s.since.Truncate(time.Hour)}},
+		{`TRUNCATE view_replay, view_replay_positions, view_replay_events, view_replay_dedup, view_replay_buckets`, nil},
+	}
+	for _, step := range steps {
+		if _, err := s.tx.ExecContext(ctx, step.query, step.args...); err != nil {
+			return fmt.Errorf("failed to swap replayed views: %w", err)
+		}
+	}
+
+	return s.tx.Commit()
+}
+
+// replaceViewEvents replaces the raw view events since the cut-off with the
+// replayed ones and rebuilds the trending scores of the products whose events
+// changed
+func (s *replaySwap) replaceViewEvents(ctx context.Context) error {
+	rows, err := s.tx.QueryContext(ctx, `
+		WITH removed AS (
+			DELETE FROM view_events v
+			WHERE v.occurred_at >= $1
+			  AND NOT EXISTS (
+			      SELECT 1 FROM view_replay_events r
+			      WHERE r.event_id = v.event_id AND r.occurred_at = v.occurred_at
+			  )
+			RETURNING v.product_id
+		), added AS (
+			INSERT INTO view_events (
+				event_id, product_id, user_id, session_id, source, device_type, referrer,
+				utm_source, utm_medium, utm_campaign, utm_term, utm_content, occurred_at
+			)
+			SELECT r.event_id, r.product_id, r.user_id, r.session_id, r.source, r.device_type, r.referrer,
+			       r.utm_source, r.utm_medium, r.utm_campaign, r.utm_term, r.utm_content, r.occurred_at
+			FROM view_replay_events r
+			JOIN products p ON p.id = r.product_id
+			ON CONFLICT (event_id, occurred_at) DO NOTHING
+			RETURNING product_id
+		)
+		SELECT product_id FROM removed
+		UNION
+		SELECT product_id FROM added`, s.since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var changed []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		changed = append(changed, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if len(changed) == 0 {
+		return nil
+	}
+	return rebuildProductTrendScores(ctx, s.tx, changed)
+}
+
+func (s *replaySwap) Rollback() error {
+	err := s.tx.Rollback()
+	if errors.Is(err, sql.ErrTxDone) {
+		return nil
+	}
+	return err
+}
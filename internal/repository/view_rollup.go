@@ -0,0 +1,265 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// viewRollupWatermark names the watermark of the product view rollups
+const viewRollupWatermark = "product_views"
+
+// viewRollupLock serialises rollup materialization and rebuilds across instances
+const viewRollupLock = "product_views_rollups"
+
+// rollupLevel is a table of per product view counts at a fixed UTC granularity
+type rollupLevel struct {
+	table  string
+	column string
+	size   time.Duration
+}
+
+// rollupLevels from coarsest to finest. The consumer keeps the buckets current;
+// the hourly and daily rollups are only complete up to the watermark.
+var rollupLevels = []rollupLevel{
+	{table: "product_views_daily", column: "day_start", size: 24 * time.Hour},
+	{table: "product_views_hourly", column: "hour_start", size: time.Hour},
+	{table: "product_view_buckets", column: "bucket_start", size: BucketSize},
+}
+
+// Indexes into rollupLevels
+const (
+	levelDaily = iota
+	levelHourly
+	levelBuckets
+)
+
+// RollupStore maintains the hourly and daily view rollups
+type RollupStore interface {
+	// MaterializeViewRollups aggregates the buckets of every hour closed by now
+	// into the rollups and returns the new watermark
+	MaterializeViewRollups(ctx context.Context, now time.Time, lateness time.Duration) (time.Time, error)
+	// RebuildViewRollups recomputes the rollups of [from, to) from raw view events
+	RebuildViewRollups(ctx context.Context, from, to time.Time) error
+}
+
+// rollupSegment is a time range read from a single rollup level
+type rollupSegment struct {
+	level    rollupLevel
+	from, to time.Time
+}
+
+// planRollups covers [from, to) with as few rows as possible: the periods of
+// the coarsest level that lie within the range and before the watermark, and
+// finer levels for the edges. coarsest is the first level to consider.
+func planRollups(from, to, watermark time.Time, coarsest int) []rollupSegment {
+	if !from.Before(to) {
+		return nil
+	}
+	level := rollupLevels[coarsest]
+	if coarsest == levelBuckets {
+		return []rollupSegment{{level: level, from: from, to: to}}
+	}
+
+	end := to
+	if watermark.Before(end) {
+		end = watermark
+	}
+	start, end := ceilTime(from, level.size), end.Truncate(level.size)
+	if !start.Before(end) {
+		return planRollups(from, to, watermark, coarsest+1)
+	}
+
+	segments := planRollups(from, start, watermark, coarsest+1)
+	segments = append(segments, rollupSegment{level: level, from: start, to: end})
+	return append(segments, planRollups(end, to, watermark, coarsest+1)...)
+}
+
+// ceilTime rounds t up to a multiple of d since the zero time
+func ceilTime(t time.Time, d time.Duration) time.Time {
+	if floor := t.Truncate(d); floor.Before(t) {
+		return floor.Add(d)
+	}
+	return t
+}
+
+// rollupQuery returns a UNION ALL of the segments' rows as (product_id,
+// period_start, views, unique_views). The segment bounds are appended to args;
+// filter is an extra condition on every table.
+func rollupQuery(segments []rollupSegment, args []any, filter string) (string, []any) {
+	parts := make([]string, 0, len(segments))
+	for _, s := range segments {
+		args = append(args, s.from, s.to)
+		cond := fmt.Sprintf("%s >= $%d AND %s < $%d", s.level.column, len(args)-1, s.level.column, len(args))
+		if filter != "" {
+			cond += " AND " + filter
+		}
+		parts = append(parts, fmt.Sprintf(
+			"SELECT product_id, %s AS period_start, views, unique_views FROM %s WHERE %s",
+			s.level.column, s.level.table, cond))
+	}
+	return strings.Join(parts, "\n\t\t\tUNION ALL\n\t\t\t"), args
+}
+
+// rollupWatermark returns the time before which the rollups are complete,
+// or the zero time if they were never materialized
+func (r *productRepository) rollupWatermark(ctx context.Context) (time.Time, error) {
+	var until time.Time
+	err := r.db.QueryRowContext(ctx, `
+		SELECT materialized_until FROM rollup_watermarks WHERE name = $1`, viewRollupWatermark).Scan(&until)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return until, err
+}
+
+// MaterializeViewRollups aggregates the buckets of every hour closed by now
+// into the hourly rollups, and those into the daily rollups. Hours younger than
+// lateness are aggregated again on every run so that views consumed late are
+// included; views consumed later than that only reach the rollups through
+// RebuildViewRollups. Each run replaces the rows it covers, so reruns are
+// harmless.
+func (r *productRepository) MaterializeViewRollups(ctx context.Context, now time.Time, lateness time.Duration) (time.Time, error) {
+	until := now.Truncate(time.Hour)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, viewRollupLock); err != nil {
+		return time.Time{}, err
+	}
+
+	// Start at the watermark, or at the first bucket on the first run
+	var from sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+		SELECT materialized_until FROM rollup_watermarks WHERE name = $1`, viewRollupWatermark).Scan(&from)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if err := tx.QueryRowContext(ctx, `SELECT MIN(bucket_start) FROM product_view_buckets`).Scan(&from); err != nil {
+			return time.Time{}, err
+		}
+	case err != nil:
+		return time.Time{}, err
+	default:
+		from.Time = from.Time.Add(-lateness)
+	}
+	start := until
+	if from.Valid && from.Time.Before(until) {
+		start = from.Time.Truncate(time.Hour)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM product_views_hourly WHERE hour_start >= $1 AND hour_start < $2`, start, until)
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO product_views_hourly (product_id, hour_start, views, unique_views)
+		SELECT product_id, date_trunc('hour', bucket_start, 'UTC'), SUM(views), SUM(unique_views)
+		FROM product_view_buckets
+		WHERE bucket_start >= $1 AND bucket_start < $2
+		GROUP BY 1, 2`, start, until)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := rollUpDays(ctx, tx, start, until); err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO rollup_watermarks (name, materialized_until, updated_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP)
+		ON CONFLICT (name) DO UPDATE
+		SET materialized_until = GREATEST(rollup_watermarks.materialized_until, EXCLUDED.materialized_until),
+		    updated_at = CURRENT_TIMESTAMP`, viewRollupWatermark, until)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, err
+	}
+
+	return until, nil
+}
+
+// RebuildViewRollups recomputes the rollups of the hours overlapping [from, to)
+// from raw view events. Unique views are not derivable from raw events, as
+// they depend on the deduplication state when each view was consumed, so they
+// are taken from the buckets. Raw events are dropped after their retention, so
+// ranges older than that must not be rebuilt.
+func (r *productRepository) RebuildViewRollups(ctx context.Context, from, to time.Time) error {
+	from, to = from.Truncate(time.Hour), ceilTime(to, time.Hour)
+	if !from.Before(to) {
+		return nil
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, viewRollupLock); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM product_views_hourly WHERE hour_start >= $1 AND hour_start < $2`, from, to)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO product_views_hourly (product_id, hour_start, views, unique_views)
+		SELECT product_id, hour_start, COALESCE(e.views, 0), COALESCE(b.unique_views, 0)
+		FROM (
+			SELECT product_id, date_trunc('hour', occurred_at, 'UTC') AS hour_start, COUNT(*) AS views
+			FROM view_events
+			WHERE occurred_at >= $1 AND occurred_at < $2
+			GROUP BY 1, 2
+		) e
+		FULL JOIN (
+			SELECT product_id, date_trunc('hour', bucket_start, 'UTC') AS hour_start, SUM(unique_views) AS unique_views
+			FROM product_view_buckets
+			WHERE bucket_start >= $1 AND bucket_start < $2
+			GROUP BY 1, 2
+		) b USING (product_id, hour_start)`, from, to)
+	if err != nil {
+		return err
+	}
+
+	if err := rollUpDays(ctx, tx, from, to); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rollUpDays recomputes the daily rollups of the days overlapping [from, to)
+// from the hourly rollups
+func rollUpDays(ctx context.Context, tx *sql.Tx, from, to time.Time) error {
+	from, to = from.Truncate(24*time.Hour), ceilTime(to, 24*time.Hour)
+	if !from.Before(to) {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		DELETE FROM product_views_daily WHERE day_start >= $1 AND day_start < $2`, from, to)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO product_views_daily (product_id, day_start, views, unique_views)
+		SELECT product_id, date_trunc('day', hour_start, 'UTC'), SUM(views), SUM(unique_views)
+		FROM product_views_hourly
+		WHERE hour_start >= $1 AND hour_start < $2
+		GROUP BY 1, 2`, from, to)
+	return err
+}
@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SeriesInterval is the bucket width of a view time series
+type SeriesInterval string
+
+// Supported view time series intervals
+const (
+	IntervalHour SeriesInterval = "hour"
+	IntervalDay  SeriesInterval = "day"
+	IntervalWeek SeriesInterval = "week"
+)
+
+// ViewSeriesPoint holds the views of one series bucket. Start is the local
+// start of the bucket in the time zone the series was requested in.
+type ViewSeriesPoint struct {
+	Start       time.Time
+	Views       int64
+	UniqueViews int64
+}
+
+// TruncateToInterval returns the start of the interval t falls into in the
+// given location. Weeks start on Monday, matching Postgres date_trunc. Hours
+// are truncated from the instant rather than rebuilt from the wall clock, so
+// both of the hours a DST fall-back repeats keep their own start.
+func TruncateToInterval(t time.Time, interval SeriesInterval, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch interval {
+	case IntervalHour:
+		return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	case IntervalWeek:
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+}
+
+// NextInterval returns the start of the interval following the one starting at t.
+// It steps in wall-clock time so that days and weeks stay aligned across DST changes,
+// and hours by elapsed time so that a repeated hour is not skipped.
+func NextInterval(t time.Time, interval SeriesInterval, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch interval {
+	case IntervalHour:
+		return TruncateToInterval(t.Add(time.Hour), interval, loc)
+	case IntervalWeek:
+		return time.Date(t.Year(), t.Month(), t.Day()+7, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+	}
+}
+
+// seriesRollupLevel returns the coarsest rollup level whose UTC periods each
+// fall within a single local interval throughout [from, to): hourly rollups
+// need a whole-hour UTC offset, daily rollups a zero offset
+func seriesRollupLevel(interval SeriesInterval, loc *time.Location, from, to time.Time) int {
+	level := levelDaily
+	if interval == IntervalHour {
+		level = levelHourly
+	}
+
+	// Visit each zone period the range crosses, e.g. either side of a DST change
+	for t := from; t.Before(to); {
+		local := t.In(loc)
+		_, offset := local.Zone()
+		if offset != 0 {
+			level = max(level, levelHourly)
+		}
+		if offset%3600 != 0 {
+			return levelBuckets
+		}
+		_, end := local.ZoneBounds()
+		if end.IsZero() {
+			break
+		}
+		t = end
+	}
+
+	return level
+}
+
+// GetProductViewSeries returns the product's views in [from, to) grouped by interval
+// in the given location. Only buckets with views are returned, in ascending order;
+// from and to should be aligned to the interval. Rollups are used where their
+// periods line up with the local intervals.
+func (r *productRepository) GetProductViewSeries(ctx context.Context, productID uuid.UUID, from, to time.Time, interval SeriesInterval, loc *time.Location) ([]ViewSeriesPoint, error) {
+	watermark, err := r.rollupWatermark(ctx)
+	if err != nil {
+		return nil, err
+	}
+	segments := planRollups(from, to, watermark, seriesRollupLevel(interval, loc, from, to))
+	if len(segments) == 0 {
+		return nil, nil
+	}
+	periods, args := rollupQuery(segments, []any{productID, string(interval), loc.String()}, "product_id = $1")
+
+	// Periods are stored in UTC; converting to the local wall clock before truncating
+	// makes days and weeks follow the requested time zone. Hours are grouped by the
+	// UTC instant they start at instead, its wall clock minus its minutes, as the
+	// wall clock of the hour a DST fall-back repeats would merge both into one.
+	start := `date_trunc($2, period_start AT TIME ZONE $3)`
+	if interval == IntervalHour {
+		start = `period_start - (period_start AT TIME ZONE $3 - date_trunc($2, period_start AT TIME ZONE $3))`
+	}
+	query := `
+		SELECT ` + start + ` AS local_start,
+		       SUM(views), SUM(unique_views)
+		FROM (
+			` + periods + `
+		) AS periods
+		GROUP BY local_start
+		ORDER BY local_start`
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []ViewSeriesPoint
+	for rows.Next() {
+		var p ViewSeriesPoint
+		var start time.Time
+		if err := rows.Scan(&start, &p.Views, &p.UniqueViews); err != nil {
+			return nil, err
+		}
+		if interval == IntervalHour {
+			p.Start = start.In(loc)
+		} else {
+			// The driver returns the local wall clock without a zone, re-attach it
+			p.Start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+		}
+		points = append(points, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
@@ -0,0 +1,108 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileRegistry keeps schemas in a JSON file. It assigns IDs like a schema
+// registry but performs no compatibility checks, so it is only meant for local
+// development and tests.
+type FileRegistry struct {
+	path string
+
+	mu      sync.Mutex
+	schemas []fileSchema
+}
+
+// fileSchema is a registered schema as stored in the registry file
+type fileSchema struct {
+	ID      int    `json:"id"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+	Schema
+}
+
+// OpenFileRegistry opens the registry file at path, which is created on the
+// first registration if it does not exist
+func OpenFileRegistry(path string) (*FileRegistry, error) {
+	r := &FileRegistry{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema registry file: %w", err)
+	}
+	if err := json.Unmarshal(data, &r.schemas); err != nil {
+		return nil, fmt.Errorf("failed to parse schema registry file: %w", err)
+	}
+
+	return r, nil
+}
+
+// Register registers schema under subject, returning the existing ID if the
+// subject already has an identical schema
+func (r *FileRegistry) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if schema.SchemaType == "" {
+		schema.SchemaType = TypeAvro
+	}
+
+	nextID, version := 1, 1
+	for _, s := range r.schemas {
+		if s.Subject == subject {
+			if s.Schema == schema {
+				return s.ID, nil
+			}
+			version = max(version, s.Version+1)
+		}
+		nextID = max(nextID, s.ID+1)
+	}
+
+	schemas := append(r.schemas, fileSchema{ID: nextID, Subject: subject, Version: version, Schema: schema})
+	if err := r.save(schemas); err != nil {
+		return 0, err
+	}
+	r.schemas = schemas
+
+	return nextID, nil
+}
+
+// SchemaByID returns the schema with the given ID
+func (r *FileRegistry) SchemaByID(ctx context.Context, id int) (Schema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range r.schemas {
+		if s.ID == id {
+			return s.Schema, nil
+		}
+	}
+	return Schema{}, ErrNotFound
+}
+
+// save atomically replaces the registry file
+func (r *FileRegistry) save(schemas []fileSchema) error {
+	data, err := json.MarshalIndent(schemas, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create schema registry directory: %w", err)
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write schema registry file: %w", err)
+	}
+	return os.Rename(tmp, r.path)
+}
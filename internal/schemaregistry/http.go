@@ -0,0 +1,88 @@
+package schemaregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// contentType is the media type of registry API requests and responses
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+// HTTPClient talks to a Confluent-compatible schema registry
+type HTTPClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPClient creates a client for the registry at baseURL
+func NewHTTPClient(baseURL string, client *http.Client) *HTTPClient {
+	return &HTTPClient{baseURL: strings.TrimSuffix(baseURL, "/"), client: client}
+}
+
+// Register registers schema under subject with POST /subjects/{subject}/versions
+func (c *HTTPClient) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	var resp struct {
+		ID int `json:"id"`
+	}
+	path := "/subjects/" + url.PathEscape(subject) + "/versions"
+	if err := c.do(ctx, http.MethodPost, path, schema, &resp); err != nil {
+		return 0, fmt.Errorf("failed to register schema for %s: %w", subject, err)
+	}
+	return resp.ID, nil
+}
+
+// SchemaByID fetches a schema with GET /schemas/ids/{id}
+func (c *HTTPClient) SchemaByID(ctx context.Context, id int) (Schema, error) {
+	var schema Schema
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &schema); err != nil {
+		return Schema{}, fmt.Errorf("failed to fetch schema %d: %w", id, err)
+	}
+	return schema, nil
+}
+
+// do sends a request and decodes the JSON response into out
+func (c *HTTPClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			ErrorCode int    `json:"error_code"`
+			Message   string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("registry returned %s: %s", resp.Status, apiErr.Message)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
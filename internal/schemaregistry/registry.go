@@ -0,0 +1,67 @@
+// Package schemaregistry registers and looks up message schemas through the
+// Confluent Schema Registry REST API, or through a local file standing in for
+// it during development and tests.
+package schemaregistry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Schema types understood by the registry
+const (
+	TypeProtobuf = "PROTOBUF"
+	TypeAvro     = "AVRO"
+	TypeJSON     = "JSON"
+)
+
+// ErrNotFound is returned when a schema ID or subject is not registered
+var ErrNotFound = errors.New("schema not found")
+
+// Schema is a registered schema definition
+type Schema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+// Client registers schemas under subjects and resolves schema IDs
+type Client interface {
+	// Register registers schema under subject, returning its global ID.
+	// Registering an identical schema again returns the existing ID.
+	Register(ctx context.Context, subject string, schema Schema) (int, error)
+	// SchemaByID returns the schema with the given global ID
+	SchemaByID(ctx context.Context, id int) (Schema, error)
+}
+
+// Open returns a client for rawURL: http and https URLs point at a schema
+// registry, file URLs at a local registry file
+func Open(rawURL string) (Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema registry URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return NewHTTPClient(rawURL, &http.Client{Timeout: 10 * time.Second}), nil
+	case "file":
+		path := u.Path
+		if u.Host != "" {
+			// file://relative/path parses the first element as the host
+			path = u.Host + path
+		}
+		return OpenFileRegistry(path)
+	default:
+		return nil, fmt.Errorf("unsupported schema registry URL scheme %q", u.Scheme)
+	}
+}
+
+// SubjectForTopic names the subject of a topic's message values, following
+// the registry's default topic name strategy
+func SubjectForTopic(topic string) string {
+	return topic + "-value"
+}
@@ -0,0 +1,88 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileRegistry(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "registry", "schemas.json")
+
+	r, err := OpenFileRegistry(path)
+	assert.NoError(t, err)
+
+	v1 := Schema{Schema: "message A {}", SchemaType: TypeProtobuf}
+	id, err := r.Register(ctx, "views-value", v1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, id)
+
+	// Registering the same schema again returns its ID
+	again, err := r.Register(ctx, "views-value", v1)
+	assert.NoError(t, err)
+	assert.Equal(t, id, again)
+
+	v2 := Schema{Schema: "message A { string b = 1; }", SchemaType: TypeProtobuf}
+	id2, err := r.Register(ctx, "views-value", v2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, id2)
+
+	// Schemas survive reopening the file
+	r, err = OpenFileRegistry(path)
+	assert.NoError(t, err)
+	schema, err := r.SchemaByID(ctx, id2)
+	assert.NoError(t, err)
+	assert.Equal(t, v2, schema)
+	assert.Equal(t, 2, r.schemas[1].Version)
+
+	_, err = r.SchemaByID(ctx, 42)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/subjects/views-value/versions":
+			var schema Schema
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&schema))
+			assert.Equal(t, TypeProtobuf, schema.SchemaType)
+			json.NewEncoder(w).Encode(map[string]int{"id": 7})
+		case r.Method == http.MethodGet && r.URL.Path == "/schemas/ids/7":
+			json.NewEncoder(w).Encode(Schema{Schema: "message A {}", SchemaType: TypeProtobuf})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error_code": 40403, "message": "Schema not found"})
+		}
+	}))
+	defer srv.Close()
+
+	c, err := Open(srv.URL + "/")
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	id, err := c.Register(ctx, SubjectForTopic("views"), Schema{Schema: "message A {}", SchemaType: TypeProtobuf})
+	assert.NoError(t, err)
+	assert.Equal(t, 7, id)
+
+	schema, err := c.SchemaByID(ctx, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, "message A {}", schema.Schema)
+
+	_, err = c.SchemaByID(ctx, 8)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestOpen(t *testing.T) {
+	c, err := Open("file://" + filepath.Join(t.TempDir(), "schemas.json"))
+	assert.NoError(t, err)
+	assert.IsType(t, &FileRegistry{}, c)
+
+	_, err = Open("ftp://registry")
+	assert.Error(t, err)
+}
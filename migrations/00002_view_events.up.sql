@@ -0,0 +1,22 @@
+-- +goose Up
+-- Store every consumed view event together with its context dimensions
+CREATE TABLE IF NOT EXISTS view_events (
+    event_id UUID PRIMARY KEY,
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    user_id VARCHAR(255),
+    session_id VARCHAR(255),
+    source VARCHAR(32),
+    device_type VARCHAR(32),
+    referrer TEXT,
+    utm_source VARCHAR(255),
+    utm_medium VARCHAR(255),
+    utm_campaign VARCHAR(255),
+    utm_term VARCHAR(255),
+    utm_content VARCHAR(255),
+    occurred_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create indexes for slicing views per product and per dimension over time
+CREATE INDEX IF NOT EXISTS idx_view_events_product_occurred ON view_events(product_id, occurred_at);
+CREATE INDEX IF NOT EXISTS idx_view_events_source_occurred ON view_events(source, occurred_at);
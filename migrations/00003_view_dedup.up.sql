@@ -0,0 +1,20 @@
+-- +goose Up
+-- Track views counted once per viewer within the deduplication window
+ALTER TABLE products ADD COLUMN IF NOT EXISTS unique_view_count BIGINT NOT NULL DEFAULT 0;
+
+-- Existing views were never deduplicated, so start from the raw count
+UPDATE products SET unique_view_count = view_count;
+
+-- Create index for faster top N queries on deduplicated counts
+CREATE INDEX IF NOT EXISTS idx_products_unique_view_count ON products(unique_view_count DESC);
+
+-- Remember when each viewer was last counted for a product
+CREATE TABLE IF NOT EXISTS view_dedup (
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    viewer_key VARCHAR(300) NOT NULL,
+    counted_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (product_id, viewer_key)
+);
+
+-- Create index for purging expired windows
+CREATE INDEX IF NOT EXISTS idx_view_dedup_counted_at ON view_dedup(counted_at);
@@ -0,0 +1,15 @@
+-- +goose Up
+-- Aggregate views per product into 15 minute buckets. Every real-world UTC offset
+-- (e.g. IST +05:30, NPT +05:45) is a multiple of 15 minutes, so buckets can be
+-- regrouped into local hours and days exactly.
+CREATE TABLE IF NOT EXISTS product_view_buckets (
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    bucket_start TIMESTAMP WITH TIME ZONE NOT NULL,
+    views BIGINT NOT NULL DEFAULT 0,
+    unique_views BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (product_id, bucket_start)
+);
+
+-- Create index for index-only top N scans over a time range
+CREATE INDEX IF NOT EXISTS idx_product_view_buckets_start
+    ON product_view_buckets(bucket_start) INCLUDE (product_id, views, unique_views);
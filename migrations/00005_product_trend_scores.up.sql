@@ -0,0 +1,12 @@
+-- +goose Up
+-- Exponentially time-decayed view score per product. log_score is stored as
+-- log2(sum of 2^((view_time - epoch) / half_life)) so that ordering by it stays
+-- valid as time passes and the table never needs to be rewritten to decay.
+CREATE TABLE IF NOT EXISTS product_trend_scores (
+    product_id UUID PRIMARY KEY REFERENCES products(id) ON DELETE CASCADE,
+    log_score DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create index for faster trending queries
+CREATE INDEX IF NOT EXISTS idx_product_trend_scores_log_score ON product_trend_scores(log_score DESC);
@@ -0,0 +1,12 @@
+-- +goose Up
+-- Kafka offsets of consumers running in exactly-once mode. Each row is written in
+-- the same transaction as the view counts it covers, so that after a crash the
+-- consumer resumes exactly where the database left off.
+CREATE TABLE IF NOT EXISTS consumer_offsets (
+    group_id VARCHAR(255) NOT NULL,
+    topic VARCHAR(255) NOT NULL,
+    partition INTEGER NOT NULL,
+    next_offset BIGINT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_id, topic, partition)
+);
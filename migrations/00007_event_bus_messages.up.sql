@@ -0,0 +1,16 @@
+-- +goose Up
+-- Message queue for the PostgreSQL event bus backend. Subscribers lease rows
+-- with SELECT ... FOR UPDATE SKIP LOCKED and delete them once processed.
+CREATE TABLE IF NOT EXISTS event_bus_messages (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(255) NOT NULL,
+    msg_key BYTEA,
+    value BYTEA NOT NULL,
+    headers JSONB NOT NULL DEFAULT '[]',
+    published_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    leased_by VARCHAR(64),
+    leased_until TIMESTAMP WITH TIME ZONE
+);
+
+-- Create index for polling a topic in order
+CREATE INDEX IF NOT EXISTS idx_event_bus_messages_topic_id ON event_bus_messages(topic, id);
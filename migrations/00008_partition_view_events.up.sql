@@ -0,0 +1,62 @@
+-- +goose Up
+-- Range-partition view_events by UTC day of occurred_at so that expired days
+-- can be dropped whole instead of deleted row by row. The primary key has to
+-- include the partition key; a redelivered event carries the same occurred_at,
+-- so (event_id, occurred_at) still recognises it.
+ALTER TABLE view_events RENAME TO view_events_unpartitioned;
+DROP INDEX IF EXISTS idx_view_events_product_occurred;
+DROP INDEX IF EXISTS idx_view_events_source_occurred;
+
+CREATE TABLE view_events (
+    event_id UUID NOT NULL,
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    user_id VARCHAR(255),
+    session_id VARCHAR(255),
+    source VARCHAR(32),
+    device_type VARCHAR(32),
+    referrer TEXT,
+    utm_source VARCHAR(255),
+    utm_medium VARCHAR(255),
+    utm_campaign VARCHAR(255),
+    utm_term VARCHAR(255),
+    utm_content VARCHAR(255),
+    occurred_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    received_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (event_id, occurred_at)
+) PARTITION BY RANGE (occurred_at);
+
+-- Create indexes for slicing views per product and per dimension over time
+CREATE INDEX IF NOT EXISTS idx_view_events_product_occurred ON view_events(product_id, occurred_at);
+CREATE INDEX IF NOT EXISTS idx_view_events_source_occurred ON view_events(source, occurred_at);
+
+-- Create a partition per day from the oldest stored event to a week ahead; the
+-- consumer keeps creating partitions ahead from then on
+-- +goose StatementBegin
+DO $$
+DECLARE
+    day DATE;
+    last_day DATE;
+BEGIN
+    SELECT LEAST(MIN(occurred_at AT TIME ZONE 'UTC')::date, (now() AT TIME ZONE 'UTC')::date),
+           GREATEST(MAX(occurred_at AT TIME ZONE 'UTC')::date, (now() AT TIME ZONE 'UTC')::date + 7)
+    INTO day, last_day
+    FROM view_events_unpartitioned;
+
+    WHILE day <= last_day LOOP
+        EXECUTE format(
+            'CREATE TABLE IF NOT EXISTS %I PARTITION OF view_events FOR VALUES FROM (%L) TO (%L)',
+            'view_events_p' || to_char(day, 'YYYYMMDD'),
+            day::timestamp AT TIME ZONE 'UTC',
+            (day + 1)::timestamp AT TIME ZONE 'UTC');
+        day := day + 1;
+    END LOOP;
+END
+$$;
+-- +goose StatementEnd
+
+INSERT INTO view_events
+SELECT event_id, product_id, user_id, session_id, source, device_type, referrer,
+       utm_source, utm_medium, utm_campaign, utm_term, utm_content, occurred_at, received_at
+FROM view_events_unpartitioned;
+
+DROP TABLE view_events_unpartitioned;
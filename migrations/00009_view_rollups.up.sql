@@ -0,0 +1,32 @@
+-- +goose Up
+-- Hourly and daily rollups of product_view_buckets in UTC. They are
+-- materialized by a periodic job rather than by the consumer, and only read
+-- up to the job's watermark; later views are read from the buckets.
+CREATE TABLE IF NOT EXISTS product_views_hourly (
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    hour_start TIMESTAMP WITH TIME ZONE NOT NULL,
+    views BIGINT NOT NULL DEFAULT 0,
+    unique_views BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (product_id, hour_start)
+);
+
+CREATE TABLE IF NOT EXISTS product_views_daily (
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    day_start TIMESTAMP WITH TIME ZONE NOT NULL,
+    views BIGINT NOT NULL DEFAULT 0,
+    unique_views BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (product_id, day_start)
+);
+
+-- Create indexes for index-only top N scans over a time range
+CREATE INDEX IF NOT EXISTS idx_product_views_hourly_start
+    ON product_views_hourly(hour_start) INCLUDE (product_id, views, unique_views);
+CREATE INDEX IF NOT EXISTS idx_product_views_daily_start
+    ON product_views_daily(day_start) INCLUDE (product_id, views, unique_views);
+
+-- Rollups are complete for every period before materialized_until
+CREATE TABLE IF NOT EXISTS rollup_watermarks (
+    name VARCHAR(64) PRIMARY KEY,
+    materialized_until TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,41 @@
+-- +goose Up
+-- Shadow state of a view replay. A replay recomputes the buckets of views that
+-- occurred since a cut-off time from the topic, next to the live tables, and
+-- swaps them in once it has caught up with the live consumer. Only one replay
+-- runs at a time; starting one empties these tables.
+CREATE TABLE IF NOT EXISTS view_replay (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    group_id VARCHAR(255) NOT NULL,
+    topic VARCHAR(255) NOT NULL,
+    since TIMESTAMP WITH TIME ZONE NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Next offset of every partition the replay reads, stored with the shadow data
+CREATE TABLE IF NOT EXISTS view_replay_positions (
+    partition INTEGER PRIMARY KEY,
+    start_offset BIGINT NOT NULL,
+    next_offset BIGINT NOT NULL
+);
+
+-- Replayed event IDs, so that events published twice are counted once
+CREATE TABLE IF NOT EXISTS view_replay_events (
+    event_id UUID NOT NULL,
+    occurred_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (event_id, occurred_at)
+);
+
+CREATE TABLE IF NOT EXISTS view_replay_dedup (
+    product_id UUID NOT NULL,
+    viewer_key VARCHAR(300) NOT NULL,
+    counted_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (product_id, viewer_key)
+);
+
+CREATE TABLE IF NOT EXISTS view_replay_buckets (
+    product_id UUID NOT NULL,
+    bucket_start TIMESTAMP WITH TIME ZONE NOT NULL,
+    views BIGINT NOT NULL DEFAULT 0,
+    unique_views BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (product_id, bucket_start)
+);
@@ -0,0 +1,31 @@
+-- +goose Up
+-- Audit trail of view count reconciliations. A dry run records every product
+-- whose stored counts differ from the counts derived from its views; applying
+-- a dry run records the products it repaired.
+CREATE TABLE IF NOT EXISTS count_reconciliations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    source VARCHAR(16) NOT NULL,
+    dry_run BOOLEAN NOT NULL,
+    applied_run_id UUID REFERENCES count_reconciliations(id),
+    triggered_by VARCHAR(255) NOT NULL,
+    products_checked BIGINT NOT NULL DEFAULT 0,
+    discrepancies BIGINT NOT NULL DEFAULT 0,
+    view_drift BIGINT NOT NULL DEFAULT 0,
+    unique_view_drift BIGINT NOT NULL DEFAULT 0,
+    repaired BIGINT NOT NULL DEFAULT 0,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    finished_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_count_reconciliations_started_at ON count_reconciliations(started_at DESC);
+
+-- Products are not referenced so that the audit trail outlives them
+CREATE TABLE IF NOT EXISTS count_discrepancies (
+    run_id UUID NOT NULL REFERENCES count_reconciliations(id) ON DELETE CASCADE,
+    product_id UUID NOT NULL,
+    view_count BIGINT NOT NULL,
+    expected_view_count BIGINT NOT NULL,
+    unique_view_count BIGINT NOT NULL,
+    expected_unique_view_count BIGINT NOT NULL,
+    PRIMARY KEY (run_id, product_id)
+);
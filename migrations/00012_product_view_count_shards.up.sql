@@ -0,0 +1,12 @@
+-- +goose Up
+-- View count increments spread over several rows per product, so that views
+-- of a popular product do not all update its products row. A product's counts
+-- are the counts in products plus the sums of its shards; the shards are
+-- periodically compacted into products.
+CREATE TABLE IF NOT EXISTS product_view_count_shards (
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    shard INT NOT NULL,
+    view_count BIGINT NOT NULL DEFAULT 0,
+    unique_view_count BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (product_id, shard)
+);
@@ -0,0 +1,6 @@
+-- +goose Up
+-- version counts the edits of a product's catalog fields and is its ETag for
+-- optimistic concurrency; updated_at also moves with every view count update.
+-- Archived products are kept with their views but left out of the rankings.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP WITH TIME ZONE;
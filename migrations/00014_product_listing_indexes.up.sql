@@ -0,0 +1,6 @@
+-- +goose Up
+-- Keyset pagination of the product listing orders by one of these columns and
+-- breaks ties by id, so each sort needs an index on both
+CREATE INDEX IF NOT EXISTS idx_products_name_id ON products(name, id);
+CREATE INDEX IF NOT EXISTS idx_products_created_at_id ON products(created_at, id);
+CREATE INDEX IF NOT EXISTS idx_products_view_count_id ON products(view_count, id);
@@ -0,0 +1,27 @@
+-- +goose Up
+-- Products are ranked by view count, or by unique view count, ties broken by
+-- id, highest first. These indexes leave archived products out so that a
+-- product's rank is a count over the index range above it.
+CREATE INDEX IF NOT EXISTS idx_products_rank ON products(view_count, id) WHERE archived_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_products_unique_rank ON products(unique_view_count, id) WHERE archived_at IS NULL;
+
+-- Each snapshot keeps the top of both rankings, which the paginated
+-- leaderboard serves, so that its pages stay consistent while counts move
+CREATE TABLE IF NOT EXISTS product_rank_snapshots (
+    id BIGSERIAL PRIMARY KEY,
+    ranked_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    -- products is the number of products that were not archived, depth the
+    -- number of them kept per ranking
+    products BIGINT NOT NULL DEFAULT 0,
+    depth BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS product_ranks (
+    snapshot_id BIGINT NOT NULL REFERENCES product_rank_snapshots(id) ON DELETE CASCADE,
+    by_unique BOOLEAN NOT NULL,
+    rank BIGINT NOT NULL,
+    product_id UUID NOT NULL,
+    view_count BIGINT NOT NULL,
+    unique_view_count BIGINT NOT NULL,
+    PRIMARY KEY (snapshot_id, by_unique, rank)
+);
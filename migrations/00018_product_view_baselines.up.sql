@@ -0,0 +1,31 @@
+-- +goose Up
+-- Views a product was counted before view buckets were introduced, such as
+-- seeded or imported counts, have no buckets or events behind them. Each
+-- product's baseline records those views, so that reconciliation only compares
+-- the views counted since.
+CREATE TABLE IF NOT EXISTS product_view_baselines (
+    product_id UUID PRIMARY KEY REFERENCES products(id) ON DELETE CASCADE,
+    views BIGINT NOT NULL DEFAULT 0,
+    unique_views BIGINT NOT NULL DEFAULT 0
+);
+
+-- The baseline of existing products is whatever their counts, shards included,
+-- exceed their buckets by now
+INSERT INTO product_view_baselines (product_id, views, unique_views)
+SELECT p.id,
+       p.view_count + COALESCE(s.views, 0) - COALESCE(b.views, 0),
+       p.unique_view_count + COALESCE(s.unique_views, 0) - COALESCE(b.unique_views, 0)
+FROM products p
+LEFT JOIN (
+    SELECT product_id, SUM(view_count) AS views, SUM(unique_view_count) AS unique_views
+    FROM product_view_count_shards
+    GROUP BY product_id
+) s ON s.product_id = p.id
+LEFT JOIN (
+    SELECT product_id, SUM(views) AS views, SUM(unique_views) AS unique_views
+    FROM product_view_buckets
+    GROUP BY product_id
+) b ON b.product_id = p.id
+WHERE p.view_count + COALESCE(s.views, 0) <> COALESCE(b.views, 0)
+   OR p.unique_view_count + COALESCE(s.unique_views, 0) <> COALESCE(b.unique_views, 0)
+ON CONFLICT (product_id) DO NOTHING;
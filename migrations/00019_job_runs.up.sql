@@ -0,0 +1,11 @@
+-- +goose Up
+-- The latest run of each periodic job. Runs are aligned to multiples of the
+-- job's interval; an instance only runs a job after claiming its interval
+-- here, so every interval runs once however many instances schedule the job.
+CREATE TABLE IF NOT EXISTS job_runs (
+    name VARCHAR(64) PRIMARY KEY,
+    slot TIMESTAMP WITH TIME ZONE NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    finished_at TIMESTAMP WITH TIME ZONE,
+    error TEXT
+);
@@ -0,0 +1,70 @@
+-- +goose Up
+-- Category and tag memberships carry their product's stored counts, so that
+-- the top N of a category or tag are read from an index of its own members
+-- rather than by walking every product by view count until N members turn up
+ALTER TABLE product_categories
+    ADD COLUMN IF NOT EXISTS view_count BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS unique_view_count BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE product_tags
+    ADD COLUMN IF NOT EXISTS view_count BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS unique_view_count BIGINT NOT NULL DEFAULT 0;
+
+UPDATE product_categories pc
+SET view_count = p.view_count, unique_view_count = p.unique_view_count
+FROM products p
+WHERE p.id = pc.product_id;
+
+UPDATE product_tags pt
+SET view_count = p.view_count, unique_view_count = p.unique_view_count
+FROM products p
+WHERE p.id = pt.product_id;
+
+CREATE INDEX IF NOT EXISTS idx_product_categories_rank ON product_categories(category_id, view_count DESC);
+CREATE INDEX IF NOT EXISTS idx_product_categories_unique_rank ON product_categories(category_id, unique_view_count DESC);
+CREATE INDEX IF NOT EXISTS idx_product_tags_rank ON product_tags(tag_id, view_count DESC);
+CREATE INDEX IF NOT EXISTS idx_product_tags_unique_rank ON product_tags(tag_id, unique_view_count DESC);
+
+-- New memberships start from the product's counts
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION copy_product_counts()
+RETURNS TRIGGER AS $$
+BEGIN
+    SELECT view_count, unique_view_count INTO NEW.view_count, NEW.unique_view_count
+    FROM products WHERE id = NEW.product_id;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER copy_product_categories_counts
+BEFORE INSERT ON product_categories
+FOR EACH ROW
+EXECUTE FUNCTION copy_product_counts();
+
+CREATE TRIGGER copy_product_tags_counts
+BEFORE INSERT ON product_tags
+FOR EACH ROW
+EXECUTE FUNCTION copy_product_counts();
+
+-- Count changes of a product, which views only make when they update its row
+-- directly or when its counter shards are compacted, follow to its memberships
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION propagate_product_counts()
+RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE product_categories
+    SET view_count = NEW.view_count, unique_view_count = NEW.unique_view_count
+    WHERE product_id = NEW.id;
+    UPDATE product_tags
+    SET view_count = NEW.view_count, unique_view_count = NEW.unique_view_count
+    WHERE product_id = NEW.id;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER propagate_products_counts
+AFTER UPDATE OF view_count, unique_view_count ON products
+FOR EACH ROW
+WHEN (OLD.view_count IS DISTINCT FROM NEW.view_count OR OLD.unique_view_count IS DISTINCT FROM NEW.unique_view_count)
+EXECUTE FUNCTION propagate_product_counts();
@@ -0,0 +1,10 @@
+-- +goose Up
+-- The half-life product_trend_scores are kept with, as their log scores are
+-- expressed in half-lives. The first API instance to start records it, and a
+-- rebuild switches the scores to another one; until it is recorded, the scores
+-- are taken to be kept with the configured half-life.
+CREATE TABLE IF NOT EXISTS trend_score_settings (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    half_life_seconds DOUBLE PRECISION NOT NULL CHECK (half_life_seconds > 0),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
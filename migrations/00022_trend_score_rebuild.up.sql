@@ -0,0 +1,15 @@
+-- +goose Up
+-- Trending scores are rebuilt with a new half-life into product_trend_scores_next
+-- while the consumers keep running: from the start of a rebuild, batches add
+-- their views in pending_half_life_seconds to it as well, and the tables are
+-- swapped once the views recorded before the start are summed into it.
+ALTER TABLE trend_score_settings ADD COLUMN IF NOT EXISTS pending_half_life_seconds DOUBLE PRECISION
+    CHECK (pending_half_life_seconds > 0);
+
+CREATE TABLE IF NOT EXISTS product_trend_scores_next (
+    product_id UUID PRIMARY KEY REFERENCES products(id) ON DELETE CASCADE,
+    log_score DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_product_trend_scores_next_log_score ON product_trend_scores_next(log_score DESC);
@@ -0,0 +1,17 @@
+-- +goose Up
+-- Replayed events are kept whole, so that a swap can replace the raw view
+-- events since the cut-off as well and rebuild the trending scores of the
+-- products it changes. Events replayed before these columns existed have no
+-- product and are left out of view_events.
+ALTER TABLE view_replay_events
+    ADD COLUMN IF NOT EXISTS product_id UUID,
+    ADD COLUMN IF NOT EXISTS user_id VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS session_id VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS source VARCHAR(32),
+    ADD COLUMN IF NOT EXISTS device_type VARCHAR(32),
+    ADD COLUMN IF NOT EXISTS referrer TEXT,
+    ADD COLUMN IF NOT EXISTS utm_source VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS utm_medium VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS utm_campaign VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS utm_term VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS utm_content VARCHAR(255);
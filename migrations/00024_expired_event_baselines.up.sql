@@ -0,0 +1,5 @@
+-- +goose Up
+-- Views whose raw events were dropped with their view_events partition. The
+-- events source of reconciliation counts them on top of the baseline, so that
+-- products with views older than VIEW_EVENT_RETENTION do not look over-counted.
+ALTER TABLE product_view_baselines ADD COLUMN IF NOT EXISTS expired_event_views BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,17 @@
+-- +goose Up
+-- A product's rank within the depth of a snapshot is looked up by product
+CREATE INDEX IF NOT EXISTS idx_product_ranks_product ON product_ranks(snapshot_id, by_unique, product_id);
+
+-- Each snapshot keeps a histogram of the counts of all the products that are
+-- not archived, per ranking, from which the rank of a product beyond the
+-- snapshot's depth is estimated. Small counts get a bucket each, larger ones
+-- share logarithmic buckets; min_count and max_count bound the counts of the
+-- products in a bucket.
+CREATE TABLE IF NOT EXISTS product_rank_histograms (
+    snapshot_id BIGINT NOT NULL REFERENCES product_rank_snapshots(id) ON DELETE CASCADE,
+    by_unique BOOLEAN NOT NULL,
+    min_count BIGINT NOT NULL,
+    max_count BIGINT NOT NULL,
+    products BIGINT NOT NULL,
+    PRIMARY KEY (snapshot_id, by_unique, min_count)
+);
@@ -0,0 +1,6 @@
+-- +goose Up
+-- Updating the memberships of every product whose counts change, row by row,
+-- doubled the writes of each batch of views and of each compaction. The
+-- counter compaction refreshes the memberships that are behind in bulk instead.
+DROP TRIGGER IF EXISTS propagate_products_counts ON products;
+DROP FUNCTION IF EXISTS propagate_product_counts();
@@ -0,0 +1,11 @@
+-- +goose Up
+-- Each count has one (count, id) index, which serves the top N, keyset
+-- pagination of the listing and the rank snapshots and neighbours alike.
+-- Archived products are filtered out as the index is walked, since ranks are
+-- no longer counted over an index range.
+CREATE INDEX IF NOT EXISTS idx_products_unique_view_count_id ON products(unique_view_count, id);
+
+DROP INDEX IF EXISTS idx_products_view_count;
+DROP INDEX IF EXISTS idx_products_unique_view_count;
+DROP INDEX IF EXISTS idx_products_rank;
+DROP INDEX IF EXISTS idx_products_unique_rank;
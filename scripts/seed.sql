@@ -45,5 +45,18 @@ SELECT
     floor(random() * 10000)::bigint
 FROM generate_series(21, 1000);
 
+-- Seeded counts have no views behind them; record them as baselines so that
+-- reconciliation does not report them as drift. On a fresh database the
+-- migrations record them instead.
+DO $$
+BEGIN
+    IF to_regclass('product_view_baselines') IS NOT NULL THEN
+        INSERT INTO product_view_baselines (product_id, views, unique_views)
+        SELECT id, view_count, unique_view_count FROM products
+        ON CONFLICT (product_id) DO UPDATE
+        SET views = EXCLUDED.views, unique_views = EXCLUDED.unique_views;
+    END IF;
+END $$;
+
 -- Update statistics
 ANALYZE products;